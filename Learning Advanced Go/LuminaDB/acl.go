@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "auth", handler: authCommand, arity: -2, flags: flagFast | flagNoMulti, group: "connection"},
+		&command{name: "acl", handler: aclCommand, arity: -2, flags: flagAdmin | flagNoMulti, group: "server"},
+	)
+}
+
+// Every connection acts as a user, whose rules say which commands it may run
+// and which keys they may touch. A new connection is logged in as the
+// default user if that needs no password; otherwise it can only run the
+// commands below until AUTH succeeds.
+//
+// Users are kept in the ACL file, one per line in the format ACL LIST
+// shows, and the file is rewritten whenever ACL SETUSER or DELUSER change
+// them. Passwords are stored as SHA-256 hashes only.
+
+const defaultACLFile = "users.acl"
+
+var noAuthCommands = map[string]bool{
+	"auth":  true,
+	"hello": true,
+	"ping":  true,
+}
+
+var (
+	errNoAuth    = respError("NOAUTH Authentication required.")
+	errWrongPass = respError("WRONGPASS invalid username-password pair or user is disabled.")
+	errNoPermKey = respError("NOPERM No permissions to access a key")
+
+	// errUserDeleted ends the connections of a user ACL DELUSER removed.
+	errUserDeleted = errors.New("its user was deleted")
+)
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // hex SHA-256 hashes
+	keys      []string // glob patterns of the keys the user may touch
+
+	// commandRules are the +/- rules as given, for ACL LIST; commands is
+	// what they allow.
+	commandRules []string
+	commands     map[string]bool
+
+	deleted bool // connections logged in as a deleted user are closed
+}
+
+// acl guards the users; their rules are read under mu on every command, so
+// changes apply to connections already logged in.
+type acl struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+	file  string // "" keeps users in memory only
+}
+
+func newACL() *acl {
+	a := &acl{users: make(map[string]*aclUser), file: defaultACLFile}
+	a.users["default"] = newDefaultUser()
+	return a
+}
+
+// newDefaultUser may do anything without a password, as before ACLs.
+func newDefaultUser() *aclUser {
+	u := &aclUser{name: "default", commands: make(map[string]bool)}
+	for _, rule := range []string{"on", "nopass", "~*", "+@all"} {
+		u.apply(rule)
+	}
+	return u
+}
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+// clone copies u for a change that is committed only if every rule is
+// valid.
+func (u *aclUser) clone() *aclUser {
+	v := *u
+	v.passwords = append([]string(nil), u.passwords...)
+	v.keys = append([]string(nil), u.keys...)
+	v.commandRules = append([]string(nil), u.commandRules...)
+	v.commands = make(map[string]bool, len(u.commands))
+	for name, ok := range u.commands {
+		v.commands[name] = ok
+	}
+	return &v
+}
+
+// apply changes u by one ACL SETUSER rule.
+func (u *aclUser) apply(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass, u.passwords = true, nil
+	case lower == "resetpass":
+		u.nopass, u.passwords = false, nil
+	case lower == "allkeys":
+		u.keys = []string{"*"}
+	case lower == "resetkeys":
+		u.keys = nil
+	case lower == "allcommands":
+		return u.apply("+@all")
+	case lower == "nocommands":
+		return u.apply("-@all")
+	case lower == "reset":
+		for _, r := range []string{"off", "resetpass", "resetkeys", "-@all"} {
+			u.apply(r)
+		}
+	case strings.HasPrefix(rule, ">"):
+		u.addPassword(hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "<"):
+		return u.removePassword(hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if len(rule) != 65 || !isHexString(rule[1:]) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(lower[1:])
+	case strings.HasPrefix(rule, "!"):
+		return u.removePassword(lower[1:])
+	case strings.HasPrefix(rule, "~"):
+		if !slices.Contains(u.keys, "*") {
+			u.keys = append(u.keys, rule[1:])
+		}
+		if rule == "~*" {
+			u.keys = []string{"*"}
+		}
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		return u.applyCommandRule(lower)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	if !slices.Contains(u.passwords, hash) {
+		u.passwords = append(u.passwords, hash)
+	}
+}
+
+func (u *aclUser) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no such password")
+}
+
+// applyCommandRule applies +command, -command, +@category or -@category.
+// +@all and -@all replace every rule before them.
+func (u *aclUser) applyCommandRule(rule string) error {
+	allow, name := rule[0] == '+', rule[1:]
+	var names []string
+	if cat, ok := strings.CutPrefix(name, "@"); ok {
+		if cat == "all" {
+			u.commandRules = nil
+			clear(u.commands)
+		}
+		for cmdName, cmd := range commandTable {
+			if cat == "all" || slices.Contains(cmd.categories(), "@"+cat) {
+				names = append(names, cmdName)
+			}
+		}
+		if len(names) == 0 {
+			return errors.New("Unknown command or category name in ACL")
+		}
+	} else {
+		if _, ok := commandTable[name]; !ok {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		names = []string{name}
+	}
+	for _, n := range names {
+		u.commands[n] = allow
+	}
+	u.commandRules = append(u.commandRules, rule)
+	return nil
+}
+
+// checkPassword compares pass with the user's hashes in constant time.
+func (u *aclUser) checkPassword(pass string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(pass))
+	ok := false
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// canAccess reports whether u may touch key.
+func (u *aclUser) canAccess(key string) bool {
+	for _, pattern := range u.keys {
+		if pattern == "*" || globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes u as a line of ACL LIST and of the ACL file.
+func (u *aclUser) String() string {
+	parts := []string{"user", u.name, "off"}
+	if u.enabled {
+		parts[2] = "on"
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	for _, k := range u.keys {
+		parts = append(parts, "~"+k)
+	}
+	if len(u.keys) == 0 {
+		parts = append(parts, "resetkeys")
+	}
+	if len(u.commandRules) == 0 || !strings.HasSuffix(u.commandRules[0], "@all") {
+		parts = append(parts, "-@all")
+	}
+	return strings.Join(append(parts, u.commandRules...), " ")
+}
+
+// login returns the user a new connection starts as, nil if it has to
+// authenticate.
+func (a *acl) login() *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if u := a.users["default"]; u.enabled && u.nopass {
+		return u
+	}
+	return nil
+}
+
+// authenticate returns the user that name and pass log in as.
+func (a *acl) authenticate(name, pass string) (*aclUser, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[name]
+	if !ok || !u.checkPassword(pass) {
+		return nil, errWrongPass
+	}
+	return u, nil
+}
+
+// setUser creates or changes a user. The rules are all applied to a copy
+// first, so an invalid one leaves the user as it was.
+func (a *acl) setUser(name string, rules []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u, ok := a.users[name]
+	var v *aclUser
+	if ok {
+		v = u.clone()
+	} else {
+		v = &aclUser{name: name, commands: make(map[string]bool)}
+	}
+	for _, rule := range rules {
+		if err := v.apply(rule); err != nil {
+			return respError(fmt.Sprintf("ERR Error in ACL SETUSER modifier '%s': %v", rule, err))
+		}
+	}
+
+	users := a.copyUsers()
+	users[name] = v
+	if err := a.save(users); err != nil {
+		return err
+	}
+	if ok {
+		*u = *v
+	} else {
+		a.users[name] = v
+	}
+	return nil
+}
+
+// deleteUsers removes users and returns how many there were.
+func (a *acl) deleteUsers(names []string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	users := a.copyUsers()
+	n := 0
+	for _, name := range names {
+		if name == "default" {
+			return 0, respError("ERR The 'default' user cannot be removed")
+		}
+		if _, ok := users[name]; ok {
+			delete(users, name)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := a.save(users); err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if u, ok := a.users[name]; ok {
+			u.deleted = true
+			delete(a.users, name)
+		}
+	}
+	return n, nil
+}
+
+// setRequirePass gives the default user pass as its only password, or no
+// password at all if pass is empty. It overrides what the ACL file says
+// about the default user, and is saved with it on the next change.
+func (a *acl) setRequirePass(pass string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.users["default"]
+	if pass == "" {
+		u.apply("nopass")
+		return
+	}
+	u.apply("resetpass")
+	u.apply(">" + pass)
+}
+
+func (a *acl) copyUsers() map[string]*aclUser {
+	users := make(map[string]*aclUser, len(a.users))
+	for name, u := range a.users {
+		users[name] = u
+	}
+	return users
+}
+
+// check returns the error cmd gets if c's user may not run it on these
+// arguments, or errUserDeleted.
+func (a *acl) check(c *clientConn, cmd *command, args []string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u := c.user
+	if u.deleted {
+		return errUserDeleted
+	}
+	// What a connection may run before it authenticates, it may run as
+	// any user, so a user can always switch to another.
+	if !u.commands[cmd.name] && !noAuthCommands[cmd.name] {
+		return respError(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", u.name, cmd.name))
+	}
+	for _, key := range cmd.keys(args) {
+		if !u.canAccess(key) {
+			return errNoPermKey
+		}
+	}
+	return nil
+}
+
+// load reads the ACL file. A missing file leaves the default user alone.
+func (a *acl) load() error {
+	if a.file == "" {
+		return nil
+	}
+	f, err := os.Open(a.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]*aclUser{"default": newDefaultUser()}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return fmt.Errorf("%s:%d: expected \"user <name> <rules...>\"", a.file, n)
+		}
+		u := &aclUser{name: fields[1], commands: make(map[string]bool)}
+		for _, rule := range fields[2:] {
+			if err := u.apply(rule); err != nil {
+				return fmt.Errorf("%s:%d: %q: %v", a.file, n, rule, err)
+			}
+		}
+		users[u.name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// save writes users to the ACL file, replacing it atomically. Callers hold
+// a.mu.
+func (a *acl) save(users map[string]*aclUser) error {
+	if a.file == "" {
+		return nil
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.file), filepath.Base(a.file)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to save ACL file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	tmp.Chmod(0600)
+
+	w := bufio.NewWriter(tmp)
+	for _, name := range names {
+		fmt.Fprintln(w, users[name])
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to save ACL file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to save ACL file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save ACL file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.file); err != nil {
+		return fmt.Errorf("failed to save ACL file: %w", err)
+	}
+	syncDir(filepath.Dir(a.file))
+	return nil
+}
+
+// AUTH [username] password
+func authCommand(c *clientConn, args []string) error {
+	if len(args) > 3 {
+		return errSyntax
+	}
+	name, pass := "default", args[len(args)-1]
+	if len(args) == 3 {
+		name = args[1]
+	} else if c.db.acl.login() != nil {
+		return respError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	u, err := c.db.acl.authenticate(name, pass)
+	if err != nil {
+		return err
+	}
+	c.user = u
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// ACL SETUSER name [rule ...] | DELUSER name [name ...] | LIST | WHOAMI
+func aclCommand(c *clientConn, args []string) error {
+	a := c.db.acl
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "SETUSER" && len(args) >= 3:
+		if err := a.setUser(args[2], args[3:]); err != nil {
+			return err
+		}
+		c.w.WriteSimpleString("OK")
+	case sub == "DELUSER" && len(args) >= 3:
+		n, err := a.deleteUsers(args[2:])
+		if err != nil {
+			return err
+		}
+		c.w.WriteInteger(int64(n))
+	case sub == "LIST" && len(args) == 2:
+		a.mu.RLock()
+		names := make([]string, 0, len(a.users))
+		for name := range a.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make([]string, len(names))
+		for i, name := range names {
+			lines[i] = a.users[name].String()
+		}
+		a.mu.RUnlock()
+		c.w.WriteBulks(lines)
+	case sub == "WHOAMI" && len(args) == 2:
+		c.w.WriteBulk(c.user.name)
+	case sub == "SETUSER" || sub == "DELUSER" || sub == "LIST" || sub == "WHOAMI":
+		return errWrongArgs("acl|" + strings.ToLower(sub))
+	default:
+		return respError(fmt.Sprintf("ERR unknown subcommand '%s'. Try ACL HELP.", args[1]))
+	}
+	return nil
+}
+
+func isHexString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isHex(s[i]) || (s[i] >= 'A' && s[i] <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A user's key patterns only hold if every command that takes keys says
+// where they are. keyCalls has a call of every command, with the keys it
+// takes named k1, k2 and so on and no other argument starting with k; a
+// command added without one fails the test.
+var keyCalls = map[string][]string{
+	"append":        {"APPEND", "k1", "v"},
+	"blmove":        {"BLMOVE", "k1", "k2", "LEFT", "RIGHT", "0"},
+	"blpop":         {"BLPOP", "k1", "k2", "0"},
+	"brpop":         {"BRPOP", "k1", "k2", "0"},
+	"decr":          {"DECR", "k1"},
+	"decrby":        {"DECRBY", "k1", "2"},
+	"del":           {"DEL", "k1", "k2", "k3"},
+	"exists":        {"EXISTS", "k1", "k2"},
+	"expire":        {"EXPIRE", "k1", "10"},
+	"expireat":      {"EXPIREAT", "k1", "10"},
+	"get":           {"GET", "k1"},
+	"getdel":        {"GETDEL", "k1"},
+	"getrange":      {"GETRANGE", "k1", "0", "1"},
+	"getset":        {"GETSET", "k1", "v"},
+	"hdel":          {"HDEL", "k1", "f", "g"},
+	"hexists":       {"HEXISTS", "k1", "f"},
+	"hget":          {"HGET", "k1", "f"},
+	"hgetall":       {"HGETALL", "k1"},
+	"hincrby":       {"HINCRBY", "k1", "f", "1"},
+	"hincrbyfloat":  {"HINCRBYFLOAT", "k1", "f", "1.5"},
+	"hkeys":         {"HKEYS", "k1"},
+	"hlen":          {"HLEN", "k1"},
+	"hmget":         {"HMGET", "k1", "f", "g"},
+	"hscan":         {"HSCAN", "k1", "0", "MATCH", "*"},
+	"hset":          {"HSET", "k1", "f", "v", "g", "w"},
+	"hvals":         {"HVALS", "k1"},
+	"incr":          {"INCR", "k1"},
+	"incrby":        {"INCRBY", "k1", "2"},
+	"incrbyfloat":   {"INCRBYFLOAT", "k1", "1.5"},
+	"lindex":        {"LINDEX", "k1", "0"},
+	"llen":          {"LLEN", "k1"},
+	"lmove":         {"LMOVE", "k1", "k2", "LEFT", "RIGHT"},
+	"lpop":          {"LPOP", "k1", "2"},
+	"lpush":         {"LPUSH", "k1", "a", "b"},
+	"lrange":        {"LRANGE", "k1", "0", "-1"},
+	"lrem":          {"LREM", "k1", "0", "a"},
+	"ltrim":         {"LTRIM", "k1", "0", "1"},
+	"mget":          {"MGET", "k1", "k2", "k3"},
+	"mset":          {"MSET", "k1", "v", "k2", "w"},
+	"msetnx":        {"MSETNX", "k1", "v", "k2", "w"},
+	"persist":       {"PERSIST", "k1"},
+	"pexpire":       {"PEXPIRE", "k1", "10"},
+	"pttl":          {"PTTL", "k1"},
+	"rpop":          {"RPOP", "k1"},
+	"rpush":         {"RPUSH", "k1", "a", "b"},
+	"sadd":          {"SADD", "k1", "a", "b"},
+	"scard":         {"SCARD", "k1"},
+	"sdiff":         {"SDIFF", "k1", "k2", "k3"},
+	"set":           {"SET", "k1", "v", "EX", "10"},
+	"setnx":         {"SETNX", "k1", "v"},
+	"setrange":      {"SETRANGE", "k1", "0", "v"},
+	"sinter":        {"SINTER", "k1", "k2"},
+	"sismember":     {"SISMEMBER", "k1", "a"},
+	"smembers":      {"SMEMBERS", "k1"},
+	"spop":          {"SPOP", "k1", "2"},
+	"srandmember":   {"SRANDMEMBER", "k1", "2"},
+	"srem":          {"SREM", "k1", "a", "b"},
+	"sscan":         {"SSCAN", "k1", "0", "COUNT", "5"},
+	"strlen":        {"STRLEN", "k1"},
+	"sunion":        {"SUNION", "k1", "k2"},
+	"ttl":           {"TTL", "k1"},
+	"type":          {"TYPE", "k1"},
+	"watch":         {"WATCH", "k1", "k2"},
+	"zadd":          {"ZADD", "k1", "NX", "1", "a", "2", "b"},
+	"zcard":         {"ZCARD", "k1"},
+	"zcount":        {"ZCOUNT", "k1", "0", "10"},
+	"zincrby":       {"ZINCRBY", "k1", "1", "a"},
+	"zrange":        {"ZRANGE", "k1", "0", "-1", "WITHSCORES"},
+	"zrangebyscore": {"ZRANGEBYSCORE", "k1", "0", "10", "LIMIT", "0", "2"},
+	"zrank":         {"ZRANK", "k1", "a"},
+	"zrem":          {"ZREM", "k1", "a", "b"},
+	"zrevrange":     {"ZREVRANGE", "k1", "0", "-1"},
+	"zrevrank":      {"ZREVRANK", "k1", "a"},
+	"zscan":         {"ZSCAN", "k1", "0"},
+	"zscore":        {"ZSCORE", "k1", "a"},
+}
+
+// keylessCommands take no key arguments. KEYS and SCAN take a pattern,
+// and FLUSHALL and DBSIZE work on the whole keyspace; none of them is held
+// back by key patterns, as in Redis.
+var keylessCommands = []string{
+	"acl", "auth", "bgrewriteaof", "bgsave", "command", "config", "dbsize",
+	"discard", "exec", "flushall", "hello", "info", "keys", "lastsave",
+	"multi", "ping", "psubscribe", "psync", "publish", "pubsub",
+	"punsubscribe", "replconf", "replicaof", "save", "scan", "shutdown",
+	"slaveof", "subscribe", "unsubscribe", "unwatch",
+}
+
+func TestCommandKeys(t *testing.T) {
+	for name, cmd := range commandTable {
+		args, ok := keyCalls[name]
+		if !ok {
+			if !slices.Contains(keylessCommands, name) {
+				t.Errorf("%s is in neither keyCalls nor keylessCommands", name)
+			} else if cmd.firstKey != 0 {
+				t.Errorf("%s is keyless but declares keys from argument %d", name, cmd.firstKey)
+			}
+			continue
+		}
+		if !cmd.checkArity(args) {
+			t.Errorf("%q has the wrong number of arguments", args)
+			continue
+		}
+		var want []string
+		for _, arg := range args[1:] {
+			if strings.HasPrefix(arg, "k") {
+				want = append(want, arg)
+			}
+		}
+		if got := cmd.keys(args); !slices.Equal(got, want) {
+			t.Errorf("keys of %q = %q, want %q", args, got, want)
+		}
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	user := func(rules ...string) *aclUser {
+		u := &aclUser{name: "u", commands: make(map[string]bool)}
+		for _, rule := range rules {
+			if err := u.apply(rule); err != nil {
+				t.Fatalf("rule %q: %v", rule, err)
+			}
+		}
+		return u
+	}
+	deleted := user("on", "+@all", "~*")
+	deleted.deleted = true
+
+	const noPermCommand = "NOPERM User u has no permissions to run the '%s' command"
+	tests := []struct {
+		user *aclUser
+		args []string
+		want string // the error, "" if allowed; noPermCommand gets the name filled in
+	}{
+		{user("+get", "~app:*"), []string{"GET", "app:1"}, ""},
+		{user("+get", "~app:*"), []string{"GET", "other"}, string(errNoPermKey)},
+		{user("+get", "~app:*"), []string{"SET", "app:1", "v"}, noPermCommand},
+		{user("+get"), []string{"GET", "app:1"}, string(errNoPermKey)},
+		{user("+@read", "~*"), []string{"HGET", "h", "f"}, ""},
+		{user("+@read", "~*"), []string{"HSET", "h", "f", "v"}, noPermCommand},
+		{user("+@all", "-flushall", "~*"), []string{"FLUSHALL"}, noPermCommand},
+		{user("+@all", "-flushall", "~*"), []string{"DEL", "a", "b"}, ""},
+		{user("+@all", "-@write", "+set", "~*"), []string{"SET", "a", "1"}, ""},
+		{user("+@all", "-@write", "+set", "~*"), []string{"DEL", "a"}, noPermCommand},
+
+		// Every key of a multi-key command is checked, and only the keys.
+		{user("+mset", "~a*"), []string{"MSET", "a1", "bval", "a2", "bval"}, ""},
+		{user("+mset", "~a*"), []string{"MSET", "a1", "v", "b", "v"}, string(errNoPermKey)},
+		{user("+blpop", "~q*"), []string{"BLPOP", "q1", "q2", "0"}, ""},
+		{user("+blpop", "~q*"), []string{"BLPOP", "q1", "x", "0"}, string(errNoPermKey)},
+		{user("+lmove", "~src", "~dst"), []string{"LMOVE", "src", "dst", "LEFT", "RIGHT"}, ""},
+		{user("+lmove", "~src"), []string{"LMOVE", "src", "dst", "LEFT", "RIGHT"}, string(errNoPermKey)},
+		{user("+del", "~[ab]"), []string{"DEL", "a", "b", "c"}, string(errNoPermKey)},
+
+		// What runs before AUTH runs as any user.
+		{user("+get", "~*"), []string{"AUTH", "other", "pw"}, ""},
+		{user(), []string{"PING"}, ""},
+
+		{deleted, []string{"PING"}, errUserDeleted.Error()},
+	}
+	a := newACL()
+	for _, tt := range tests {
+		cmd := commandTable[strings.ToLower(tt.args[0])]
+		want := tt.want
+		if want == noPermCommand {
+			want = strings.Replace(want, "%s", cmd.name, 1)
+		}
+		got := ""
+		if err := a.check(&clientConn{user: tt.user}, cmd, tt.args); err != nil {
+			got = err.Error()
+		}
+		if got != want {
+			t.Errorf("%s running %q: got %q, want %q", tt.user, tt.args, got, want)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	_, addr := startServer(t)
+	admin := dial(t, addr)
+	admin.do("ACL", "SETUSER", "alice", "on", ">pw", "~a*", "+get", "+set", "+acl")
+	admin.do("ACL", "SETUSER", "bob", "off", ">pw", "~*", "+@all")
+	if got := admin.do("CONFIG", "SET", "requirepass", "secret"); got != "+OK\r\n" {
+		t.Fatalf("CONFIG SET requirepass = %q", got)
+	}
+
+	c := dial(t, addr)
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "a"}, "-NOAUTH Authentication required.\r\n"},
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"AUTH", "wrong"}, "-" + string(errWrongPass) + "\r\n"},
+		{[]string{"AUTH", "alice", "wrong"}, "-" + string(errWrongPass) + "\r\n"},
+		{[]string{"AUTH", "bob", "pw"}, "-" + string(errWrongPass) + "\r\n"},
+		{[]string{"AUTH", "nobody", "pw"}, "-" + string(errWrongPass) + "\r\n"},
+		{[]string{"AUTH", "alice", "pw"}, "+OK\r\n"},
+		{[]string{"ACL", "WHOAMI"}, "$5\r\nalice\r\n"},
+		{[]string{"SET", "a1", "v"}, "+OK\r\n"},
+		{[]string{"GET", "a1"}, "$1\r\nv\r\n"},
+		{[]string{"GET", "b1"}, "-" + string(errNoPermKey) + "\r\n"},
+		{[]string{"DEL", "a1"}, "-NOPERM User alice has no permissions to run the 'del' command\r\n"},
+		{[]string{"AUTH", "secret"}, "+OK\r\n"},
+		{[]string{"ACL", "WHOAMI"}, "$7\r\ndefault\r\n"},
+		{[]string{"DEL", "a1"}, ":1\r\n"},
+	}
+	for _, step := range steps {
+		if got := c.do(step.args...); got != step.want {
+			t.Errorf("%q = %q, want %q", step.args, got, step.want)
+		}
+	}
+
+	// Changes apply to connections already logged in.
+	c.do("AUTH", "alice", "pw")
+	admin.do("AUTH", "secret")
+	admin.do("ACL", "SETUSER", "alice", "-set")
+	if got := c.do("SET", "a1", "v"); !strings.HasPrefix(got, "-NOPERM ") {
+		t.Errorf("SET after ACL SETUSER alice -set = %q, want NOPERM", got)
+	}
+}
+
+// Connections logged in as a user that ACL DELUSER removes are closed.
+func TestDelUserClosesConnections(t *testing.T) {
+	_, addr := startServer(t)
+	admin := dial(t, addr)
+	admin.do("ACL", "SETUSER", "alice", "on", ">pw", "~*", "+@all")
+	c := dial(t, addr)
+	if got := c.do("AUTH", "alice", "pw"); got != "+OK\r\n" {
+		t.Fatalf("AUTH = %q", got)
+	}
+
+	if got := admin.do("ACL", "DELUSER", "alice", "nobody"); got != ":1\r\n" {
+		t.Errorf("ACL DELUSER = %q, want 1", got)
+	}
+	if got := admin.do("ACL", "DELUSER", "default"); !strings.HasPrefix(got, "-ERR ") {
+		t.Errorf("ACL DELUSER default = %q, want an error", got)
+	}
+	c.send("PING")
+	var b strings.Builder
+	if err := readRaw(c.r, &b); err != io.EOF {
+		t.Errorf("PING as a deleted user read %q, %v; want the connection closed", b.String(), err)
+	}
+	if got := dial(t, addr).do("AUTH", "alice", "pw"); got != "-"+string(errWrongPass)+"\r\n" {
+		t.Errorf("AUTH as a deleted user = %q", got)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.acl")
+	a := newACL()
+	a.file = file
+	for _, set := range [][]string{
+		{"alice", "on", ">secret", "~app:*", "~cache:*", "+@read", "-keys", "+set"},
+		{"bob", "off", "#" + hashPassword("other"), "allkeys", "+@all", "-flushall"},
+		{"carol", "on", "nopass", "+ping"},
+	} {
+		if err := a.setUser(set[0], set[1:]); err != nil {
+			t.Fatalf("setUser %q: %v", set, err)
+		}
+	}
+	if n, err := a.deleteUsers([]string{"carol"}); n != 1 || err != nil {
+		t.Fatalf("deleteUsers = %d, %v", n, err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "carol") {
+		t.Errorf("ACL file holds a password or a deleted user:\n%s", data)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("ACL file mode = %v, %v; want 0600", fi.Mode().Perm(), err)
+	}
+
+	b := newACL()
+	b.file = file
+	if err := b.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.users) != len(a.users) {
+		t.Errorf("loaded %d users, want %d", len(b.users), len(a.users))
+	}
+	for name, u := range a.users {
+		if got := b.users[name]; got == nil || got.String() != u.String() {
+			t.Errorf("loaded %v, want %v", got, u)
+		}
+	}
+	if u, err := b.authenticate("alice", "secret"); err != nil || !u.canAccess("app:1") || u.canAccess("other") {
+		t.Errorf("alice after loading: %v, %v", u, err)
+	}
+
+	// A bad line names the file and line.
+	os.WriteFile(file, []byte("user alice on\nuser bob +nosuchcommand\n"), 0600)
+	if err := b.load(); err == nil || !strings.Contains(err.Error(), "users.acl:2") {
+		t.Errorf("load of a bad file = %v, want an error at line 2", err)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	benchDuration = 3 * time.Second
+	benchClients  = 50
+	benchKeys     = 100_000
+)
+
+// runBenchmark runs the named benchmark and returns the exit code.
+func runBenchmark(name string) int {
+	switch name {
+	case "fsync":
+		return benchFsync()
+	case "shards":
+		return benchShards()
+	case "pipeline":
+		return benchPipeline()
+	}
+	fmt.Printf("Unknown benchmark %q (available: fsync, shards, pipeline)\n", name)
+	return 2
+}
+
+// benchFsync measures SET throughput against a scratch log under each
+// appendfsync policy, with benchClients writers running concurrently.
+func benchFsync() int {
+	dir, err := os.MkdirTemp("", "lumina-bench-*")
+	if err != nil {
+		fmt.Println("Error creating scratch directory:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("SET throughput, %d concurrent writers, %v per policy\n", benchClients, benchDuration)
+	for _, policy := range []fsyncPolicy{fsyncAlways, fsyncEverySec, fsyncNo} {
+		db, err := NewLuminaDB(filepath.Join(dir, policy.String()+".log"))
+		if err != nil {
+			fmt.Println("Error creating database:", err)
+			return 1
+		}
+		db.logger.SetFsyncPolicy(policy)
+		db.StartLogSync()
+
+		var ops atomic.Int64
+		var failed atomic.Bool
+		var wg sync.WaitGroup
+		deadline := time.Now().Add(benchDuration)
+		start := time.Now()
+		for c := 0; c < benchClients; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				value := fmt.Sprintf("value-%d", c)
+				for i := 0; time.Now().Before(deadline); i++ {
+					key := fmt.Sprintf("key:%d:%d", c, i%1000)
+					shards := shardsOf(key)
+					db.store.lock(shards)
+					err := db.Put(key, value)
+					db.store.unlock(shards)
+					if err == nil {
+						err = db.logger.WaitDurable()
+					}
+					if err != nil {
+						failed.Store(true)
+						return
+					}
+					ops.Add(1)
+				}
+			}(c)
+		}
+		wg.Wait()
+		elapsed := time.Since(start)
+
+		db.logger.mu.Lock()
+		fsyncs := db.logger.fsyncs
+		db.logger.mu.Unlock()
+		db.Close()
+		if failed.Load() {
+			fmt.Printf("%-9s writes failed\n", policy)
+			return 1
+		}
+
+		n := ops.Load()
+		fmt.Printf("%-9s %10.0f ops/sec  %8d fsyncs", policy, float64(n)/elapsed.Seconds(), fsyncs)
+		if fsyncs > 0 {
+			fmt.Printf("  (%.1f writes per fsync)", float64(n)/float64(fsyncs))
+		}
+		fmt.Println()
+	}
+	return 0
+}
+
+// benchShards measures a mix of GET and SET over benchKeys keys with
+// benchClients clients at each GOMAXPROCS from 1 up to the number of CPUs.
+// Each command locks the shards of its key, as the dispatcher does, and
+// for comparison one RWMutex, as the keyspace had before it was sharded. The
+// log is not fsynced, so the numbers show the keyspace rather than the
+// disk; writes still take turns on the logger's lock.
+func benchShards() int {
+	dir, err := os.MkdirTemp("", "lumina-bench-*")
+	if err != nil {
+		fmt.Println("Error creating scratch directory:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLuminaDB(filepath.Join(dir, "shards.log"))
+	if err != nil {
+		fmt.Println("Error creating database:", err)
+		return 1
+	}
+	defer db.Close()
+	db.logger.SetFsyncPolicy(fsyncNo)
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+		db.store.Set(keys[i], "value")
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	fmt.Printf("GET/SET throughput, %d keys, %d clients, %v per run, %d CPUs\n",
+		benchKeys, benchClients, benchDuration, runtime.NumCPU())
+	fmt.Printf("%-6s %6s %14s %14s %8s\n", "writes", "procs", "sharded", "one lock", "speedup")
+	for _, writePct := range []int{10, 50} {
+		var base float64
+		for _, procs := range benchProcs() {
+			runtime.GOMAXPROCS(procs)
+			sharded, err := benchMix(db, keys, writePct, false)
+			if err != nil {
+				fmt.Println("Error running benchmark:", err)
+				return 1
+			}
+			single, err := benchMix(db, keys, writePct, true)
+			if err != nil {
+				fmt.Println("Error running benchmark:", err)
+				return 1
+			}
+			if base == 0 {
+				base = sharded
+			}
+			fmt.Printf("%5d%% %6d %10.0f/sec %10.0f/sec %7.2fx\n", writePct, procs, sharded, single, sharded/base)
+		}
+	}
+	fmt.Println("speedup is sharded throughput relative to sharded at 1 proc")
+	return 0
+}
+
+// benchProcs returns the GOMAXPROCS values to try: powers of two below the
+// number of CPUs, then the number of CPUs.
+func benchProcs() []int {
+	var procs []int
+	for p := 1; p < runtime.NumCPU(); p *= 2 {
+		procs = append(procs, p)
+	}
+	return append(procs, runtime.NumCPU())
+}
+
+// benchMix runs GET and SET with writePct percent writes for benchDuration
+// and returns the commands per second.
+func benchMix(db *LuminaDB, keys []string, writePct int, oneLock bool) (float64, error) {
+	get, set := commandTable["get"], commandTable["set"]
+	var global sync.RWMutex
+	var ops atomic.Int64
+	var failure atomic.Pointer[error]
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(benchDuration)
+	start := time.Now()
+	for i := 0; i < benchClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &clientConn{db: db, w: NewRespWriter(io.Discard)}
+			n := int64(0)
+			for ; n%64 != 0 || time.Now().Before(deadline); n++ {
+				key := keys[rand.IntN(len(keys))]
+				cmd, args := get, []string{"GET", key}
+				if rand.IntN(100) < writePct {
+					cmd, args = set, []string{"SET", key, "value"}
+				}
+
+				var err error
+				switch {
+				case oneLock && cmd == set:
+					global.Lock()
+					err = cmd.handler(c, args)
+					global.Unlock()
+				case oneLock:
+					global.RLock()
+					err = cmd.handler(c, args)
+					global.RUnlock()
+				case cmd == set:
+					shards := cmd.shards(args)
+					db.store.lock(shards)
+					err = cmd.handler(c, args)
+					db.store.unlock(shards)
+				default:
+					shards := cmd.shards(args)
+					db.store.rlock(shards)
+					err = cmd.handler(c, args)
+					db.store.runlock(shards)
+				}
+				if err != nil {
+					failure.Store(&err)
+					return
+				}
+			}
+			ops.Add(n)
+		}()
+	}
+	wg.Wait()
+	if err := failure.Load(); err != nil {
+		return 0, *err
+	}
+	return float64(ops.Load()) / time.Since(start).Seconds(), nil
+}
+
+// benchPipeline measures SET and GET throughput over TCP against a server
+// run in process, with benchClients clients sending one command at a time
+// and then pipelines of growing depth. Each client waits for the replies
+// to a pipeline before sending the next, like Pipeline.Exec callers do.
+// Last, one client sends a pipeline larger than the socket buffers.
+func benchPipeline() int {
+	dir, err := os.MkdirTemp("", "lumina-bench-*")
+	if err != nil {
+		fmt.Println("Error creating scratch directory:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLuminaDB(filepath.Join(dir, "pipeline.log"))
+	if err != nil {
+		fmt.Println("Error creating database:", err)
+		return 1
+	}
+	defer db.Close()
+	db.logger.SetFsyncPolicy(fsyncNo)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Error starting server:", err)
+		return 1
+	}
+	defer l.Close()
+	go serve(l, db)
+
+	fmt.Printf("SET/GET throughput over TCP, %d clients, %v per run\n", benchClients, benchDuration)
+	fmt.Printf("%6s %14s %8s\n", "depth", "commands", "speedup")
+	var base float64
+	for _, depth := range []int{1, 4, 16, 64, 256} {
+		rate, err := benchDepth(l.Addr().String(), depth)
+		if err != nil {
+			fmt.Println("Error running benchmark:", err)
+			return 1
+		}
+		if base == 0 {
+			base = rate
+		}
+		fmt.Printf("%6d %10.0f/sec %7.2fx\n", depth, rate, rate/base)
+	}
+	fmt.Println("depth 1 is no pipelining; speedup is relative to it")
+
+	// One pipeline whose commands and replies each run to many megabytes,
+	// far more than the socket buffers hold.
+	rate, err := benchBigBatch(l.Addr().String())
+	if err != nil {
+		fmt.Println("Error running benchmark:", err)
+		return 1
+	}
+	fmt.Printf("one batch of %d SET/GET pairs of %dKB values: %.0f commands/sec\n",
+		bigBatch, bigValue>>10, rate)
+	return 0
+}
+
+const (
+	bigBatch = 4096
+	bigValue = 16 << 10
+)
+
+// benchBigBatch sends bigBatch SETs of bigValue bytes, each followed by a
+// GET of the same key, in a single pipeline, so commands and replies flow
+// at the same time. It returns the commands per second.
+func benchBigBatch(addr string) (float64, error) {
+	c, err := NewClient(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	value := strings.Repeat("v", bigValue)
+	p := c.Pipeline()
+	for i := range bigBatch {
+		key := fmt.Sprintf("big:%d", i)
+		p.Queue("SET", key, value)
+		p.Queue("GET", key)
+	}
+	start := time.Now()
+	replies, err := p.exec()
+	if err != nil {
+		return 0, err
+	}
+	for i := 1; i < len(replies); i += 2 {
+		if r := replies[i]; r.str != value {
+			return 0, fmt.Errorf("GET returned %d bytes, want %d", len(r.str), bigValue)
+		}
+	}
+	return float64(len(replies)) / time.Since(start).Seconds(), nil
+}
+
+// benchDepth runs pipelines of depth commands, half SET and half GET, for
+// benchDuration and returns the commands per second.
+func benchDepth(addr string, depth int) (float64, error) {
+	clients := make([]*Client, benchClients)
+	for i := range clients {
+		c, err := NewClient(addr)
+		if err != nil {
+			return 0, err
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	var ops atomic.Int64
+	var failure atomic.Pointer[error]
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(benchDuration)
+	start := time.Now()
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := c.Pipeline()
+			for n := 0; time.Now().Before(deadline); n++ {
+				for j := range depth {
+					key := fmt.Sprintf("key:%d:%d", i, (n*depth+j)%1000)
+					if j%2 == 0 {
+						p.Queue("SET", key, "value")
+					} else {
+						p.Queue("GET", key)
+					}
+				}
+				if _, err := p.Exec(); err != nil {
+					failure.Store(&err)
+					return
+				}
+				ops.Add(int64(depth))
+			}
+		}()
+	}
+	wg.Wait()
+	if err := failure.Load(); err != nil {
+		return 0, *err
+	}
+	return float64(ops.Load()) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// blockedClient is a connection waiting in BLPOP, BRPOP or BLMOVE for one
+// of its keys to receive data.
+//
+// Clients are served in the order they blocked. A command that pushes to a
+// list marks the key ready, and before the dispatcher releases the shards
+// serveBlocked pops an element for each waiting client in turn, so a
+// woken client always gets its element and nobody can overtake it. The
+// reply is handed to the waiting connection, which writes it.
+type blockedClient struct {
+	keys    []string
+	timeout time.Duration // 0 waits forever
+
+	// serve runs with every shard locked once key has data, and returns the
+	// function that writes the reply.
+	serve     func(key string) func(c *clientConn)
+	onTimeout func(c *clientConn)
+
+	reply chan func(c *clientConn)
+}
+
+// parseTimeout reads the timeout of a blocking command, in seconds.
+func parseTimeout(arg string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(secs) || secs > float64(math.MaxInt64/time.Second) {
+		return 0, respError("ERR timeout is not a float or out of range")
+	}
+	if secs < 0 {
+		return 0, respError("ERR timeout is negative")
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// lockForWrite locks the shards a write command needs. Serving the
+// clients blocked on a key takes more than the key's shard, as a BLMOVE
+// writes to its destination too, so a command on a key clients wait for
+// locks every shard instead. Nobody can start waiting on a key while its
+// shard is held, so once the shards are locked the check stays true until
+// the command is done.
+func (db *LuminaDB) lockForWrite(cmd *command, args []string) shardSet {
+	shards := cmd.shards(args)
+	db.store.lock(shards)
+	if shards != allShards && db.blockedKeys.Load() > 0 && db.hasWaiters(cmd.keys(args)) {
+		db.store.unlock(shards)
+		shards = allShards
+		db.store.lock(shards)
+	}
+	return shards
+}
+
+// hasWaiters reports whether clients are blocked on any of keys.
+func (db *LuminaDB) hasWaiters(keys []string) bool {
+	db.blockedMu.Lock()
+	defer db.blockedMu.Unlock()
+	for _, key := range keys {
+		if len(db.blocked[key]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// block queues c behind the clients already waiting on bc's keys. The
+// dispatcher sees c.blocked once the handler returns and waits for a
+// reply. Callers hold the shards of bc's keys for writing.
+func (db *LuminaDB) block(c *clientConn, bc *blockedClient) {
+	bc.reply = make(chan func(*clientConn), 1)
+	db.blockedMu.Lock()
+	defer db.blockedMu.Unlock()
+	for _, key := range bc.keys {
+		db.blocked[key] = append(db.blocked[key], bc)
+	}
+	db.blockedKeys.Store(int64(len(db.blocked)))
+	c.blocked = bc
+}
+
+// unblock takes bc off the queues of all its keys.
+func (db *LuminaDB) unblock(bc *blockedClient) {
+	db.blockedMu.Lock()
+	defer db.blockedMu.Unlock()
+	db.unblockLocked(bc)
+}
+
+func (db *LuminaDB) unblockLocked(bc *blockedClient) {
+	for _, key := range bc.keys {
+		queue := db.blocked[key]
+		for i, other := range queue {
+			if other == bc {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(db.blocked, key)
+		} else {
+			db.blocked[key] = queue
+		}
+	}
+	db.blockedKeys.Store(int64(len(db.blocked)))
+}
+
+// nextBlocked takes the client waiting longest on key off the queues, nil
+// if there is none.
+func (db *LuminaDB) nextBlocked(key string) *blockedClient {
+	db.blockedMu.Lock()
+	defer db.blockedMu.Unlock()
+	if len(db.blocked[key]) == 0 {
+		return nil
+	}
+	bc := db.blocked[key][0]
+	db.unblockLocked(bc)
+	return bc
+}
+
+// signalKey notes that key received data. Clients can only be waiting on
+// it if the caller holds every shard, see lockForWrite.
+func (db *LuminaDB) signalKey(key string) {
+	if db.blockedKeys.Load() > 0 && db.hasWaiters([]string{key}) {
+		db.readyKeys = append(db.readyKeys, key)
+	}
+}
+
+// serveBlocked hands elements of the ready keys to the clients waiting on
+// them, oldest first. A BLMOVE served here may make its destination ready
+// in turn, which is served in the same loop. Callers hold the shards of
+// the command they ran for writing; there are only ready keys when that
+// is every shard.
+func (db *LuminaDB) serveBlocked() {
+	if len(db.readyKeys) == 0 {
+		return // and leave readyKeys alone for commands running alongside
+	}
+	for len(db.readyKeys) > 0 {
+		key := db.readyKeys[0]
+		db.readyKeys = db.readyKeys[1:]
+
+		for {
+			if l, err := db.list(key); err != nil || l == nil {
+				break
+			}
+			bc := db.nextBlocked(key)
+			if bc == nil {
+				break
+			}
+			bc.reply <- bc.serve(key)
+			db.touchKey(key)
+			db.store.resize(key)
+		}
+	}
+	db.readyKeys = nil
+}
+
+// cancelBlock gives up waiting. If a reply was handed over in the meantime
+// it is returned, since its element has already been popped. Clients are
+// served with every shard held, so the shards of bc's keys keep that from
+// happening while this looks.
+func (db *LuminaDB) cancelBlock(bc *blockedClient) (func(*clientConn), bool) {
+	shards := shardsOf(bc.keys...)
+	db.store.lock(shards)
+	defer db.store.unlock(shards)
+	select {
+	case reply := <-bc.reply:
+		return reply, true
+	default:
+		db.unblock(bc)
+		return nil, false
+	}
+}
+
+// waitBlocked waits until c's blocking command is served, times out or
+// the client goes away, and writes the reply. Meanwhile the connection is
+// watched, so a client that disconnects leaves the queue rather than
+// swallowing an element nobody will read.
+func (c *clientConn) waitBlocked() error {
+	bc := c.blocked
+	c.blocked = nil
+	c.db.stats.blockedClients.Add(1)
+	defer c.db.stats.blockedClients.Add(-1)
+
+	// Replies to the commands pipelined before this one shouldn't wait for
+	// it. If the connection is gone, watching it below finds out.
+	c.w.Flush()
+
+	var timeout <-chan time.Time
+	if bc.timeout > 0 {
+		timer := time.NewTimer(bc.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	readable := make(chan error, 1)
+	go func() { readable <- c.parser.waitReadable() }()
+	watching := readable
+	defer func() {
+		// Stop the watcher before the connection is read again.
+		if watching != nil {
+			c.conn.SetReadDeadline(time.Now())
+			<-watching
+			c.conn.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	for {
+		select {
+		case reply := <-bc.reply:
+			return c.writeBlockedReply(reply)
+
+		case <-timeout:
+			if reply, ok := c.db.cancelBlock(bc); ok {
+				return c.writeBlockedReply(reply)
+			}
+			bc.onTimeout(c)
+			return nil
+
+		case err := <-readable:
+			watching, readable = nil, nil
+			if err == nil {
+				// The client pipelined more commands; they run once
+				// this one is answered.
+				continue
+			}
+			if _, ok := c.db.cancelBlock(bc); ok {
+				fmt.Printf("Client %d went away after being served by a blocking command\n", c.id)
+			}
+			return err
+
+		case <-c.db.quit:
+			c.db.cancelBlock(bc)
+			return errors.New("server shutting down")
+		}
+	}
+}
+
+// writeBlockedReply writes the reply of a served blocking command once the
+// pop it made is as durable as the fsync policy asks for.
+func (c *clientConn) writeBlockedReply(reply func(*clientConn)) error {
+	if err := c.db.logger.WaitDurable(); err != nil {
+		return fmt.Errorf("log fsync failed: %w", err)
+	}
+	reply(c)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitBlocked waits until n clients are blocked on key.
+func waitBlocked(t *testing.T, db *LuminaDB, key string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		db.blockedMu.Lock()
+		waiting := len(db.blocked[key])
+		db.blockedMu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients blocked on %s, want %d", waiting, key, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBLPOPTimeout(t *testing.T) {
+	db, addr := startServer(t)
+	c := dial(t, addr)
+
+	start := time.Now()
+	if got := c.do("BLPOP", "k", "0.1"); got != "*-1\r\n" {
+		t.Errorf("BLPOP on an empty list = %q, want a null array", got)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("BLPOP timed out after %v, want 100ms", d)
+	}
+	waitBlocked(t, db, "k", 0)
+
+	// With data there, it doesn't wait.
+	c.do("RPUSH", "k", "a")
+	if got := c.do("BLPOP", "k", "0.1"); got != "*2\r\n$1\r\nk\r\n$1\r\na\r\n" {
+		t.Errorf("BLPOP on a list = %q, want k and a", got)
+	}
+	if got := c.do("BLPOP", "k", "-1"); got != "-ERR timeout is negative\r\n" {
+		t.Errorf("BLPOP with a negative timeout = %q", got)
+	}
+}
+
+// Clients blocked on a key are served in the order they blocked, one
+// element each.
+func TestBlockedClientsServedInOrder(t *testing.T) {
+	db, addr := startServer(t)
+	var waiters []*testConn
+	for i := range 3 {
+		w := dial(t, addr)
+		w.send("BLPOP", "k", "0")
+		waitBlocked(t, db, "k", i+1)
+		waiters = append(waiters, w)
+	}
+
+	c := dial(t, addr)
+	if got := c.do("RPUSH", "k", "a"); got != ":1\r\n" {
+		t.Fatalf("RPUSH = %q", got)
+	}
+	if got := waiters[0].read(); got != "*2\r\n$1\r\nk\r\n$1\r\na\r\n" {
+		t.Errorf("first waiter got %q, want a", got)
+	}
+	waitBlocked(t, db, "k", 2)
+
+	c.do("RPUSH", "k", "b", "c", "d")
+	for i, want := range []string{"b", "c"} {
+		if got := waiters[i+1].read(); got != "*2\r\n$1\r\nk\r\n$1\r\n"+want+"\r\n" {
+			t.Errorf("waiter %d got %q, want %s", i+1, got, want)
+		}
+	}
+	if got := c.do("LRANGE", "k", "0", "-1"); got != "*1\r\n$1\r\nd\r\n" {
+		t.Errorf("left in the list: %q, want d", got)
+	}
+}
+
+// Any command that adds to a list wakes its waiters: an LMOVE into it, or
+// a push inside EXEC.
+func TestBlockedClientsWokenByMoveAndExec(t *testing.T) {
+	db, addr := startServer(t)
+	c := dial(t, addr)
+
+	w := dial(t, addr)
+	w.send("BLPOP", "dst", "0")
+	waitBlocked(t, db, "dst", 1)
+	c.do("RPUSH", "src", "x")
+	if got := c.do("LMOVE", "src", "dst", "LEFT", "RIGHT"); got != "$1\r\nx\r\n" {
+		t.Fatalf("LMOVE = %q", got)
+	}
+	if got := w.read(); got != "*2\r\n$3\r\ndst\r\n$1\r\nx\r\n" {
+		t.Errorf("waiter on dst got %q after LMOVE, want x", got)
+	}
+
+	w.send("BLMOVE", "k", "moved", "LEFT", "LEFT", "0")
+	waitBlocked(t, db, "k", 1)
+	c.do("MULTI")
+	c.do("SET", "other", "1")
+	c.do("RPUSH", "k", "y")
+	if got := c.do("EXEC"); got != "*2\r\n+OK\r\n:1\r\n" {
+		t.Fatalf("EXEC = %q", got)
+	}
+	if got := w.read(); got != "$1\r\ny\r\n" {
+		t.Errorf("BLMOVE got %q after a push in EXEC, want y", got)
+	}
+	if got := c.do("LRANGE", "moved", "0", "-1"); got != "*1\r\n$1\r\ny\r\n" {
+		t.Errorf("moved = %q, want y", got)
+	}
+}
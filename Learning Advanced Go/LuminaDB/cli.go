@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The command-line client, run with -client, works in one of four modes:
+//
+//	luminadb -client                  interactive, with line editing and history
+//	luminadb -client SET k "v w"      run one command and exit
+//	luminadb -client < cmds.txt       run the commands read, one per line
+//	luminadb -client -pipe < cmds.txt send them pipelined, report errors only
+//
+// Commands are split like in a shell, with the quoting and escapes of
+// inline commands. Replies are printed the way redis-cli does, or with
+// -raw bare for scripts: strings as they are, one element per line, and
+// errors on stderr. The exit status is 1 if a command failed.
+
+// cliOptions say what the client runs and how it prints replies.
+type cliOptions struct {
+	raw  bool     // print replies bare
+	pipe bool     // send the commands read pipelined
+	file string   // read commands from this file instead of stdin
+	args []string // a command to run once
+}
+
+// pipeBatch is how many commands -pipe sends before reading their replies.
+const pipeBatch = 1000
+
+// historyFile is where the interactive client keeps the commands typed,
+// in the home directory unless LUMINADB_HISTFILE names another file.
+const historyFile = ".luminadb_history"
+
+func runClient(opts ClientOptions, cli cliOptions) int {
+	switch {
+	case len(cli.args) > 0:
+		return runOneShot(opts, cli)
+	case cli.pipe, cli.file != "", !isTerminal(os.Stdin):
+		return runScript(opts, cli)
+	}
+	runInteractiveClient(opts, cli.raw)
+	return 0
+}
+
+func runOneShot(opts ClientOptions, cli cliOptions) int {
+	client, err := DialClient(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not connect to server:", err)
+		return 1
+	}
+	defer client.Close()
+
+	r, err := client.do(cli.args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	printReply(r, cli.args, cli.raw)
+	if subscribes(cli.args) && r.kind != '-' {
+		readMessages(client, cli.raw)
+	}
+	if r.kind == '-' {
+		return 1
+	}
+	return 0
+}
+
+// runScript runs the commands read from cli.file or stdin, one per line.
+// Blank lines and lines starting with # are skipped.
+func runScript(opts ClientOptions, cli cliOptions) int {
+	in := os.Stdin
+	if cli.file != "" && cli.file != "-" {
+		f, err := os.Open(cli.file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	client, err := DialClient(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not connect to server:", err)
+		return 1
+	}
+	defer client.Close()
+
+	if cli.pipe {
+		return pipeCommands(client, in)
+	}
+
+	failed := false
+	bad, err := scanCommands(in, func(_ int, args []string) bool {
+		r, err := client.do(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			failed = true
+			return false
+		}
+		printReply(r, args, cli.raw)
+		if subscribes(args) && r.kind != '-' {
+			readMessages(client, cli.raw)
+			return false
+		}
+		failed = failed || r.kind == '-'
+		return true
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading commands:", err)
+		return 1
+	}
+	if failed || bad > 0 {
+		return 1
+	}
+	return 0
+}
+
+// pipeCommands sends the commands read from in, in pipelined batches, like
+// redis-cli --pipe for mass insertion. Only error replies are printed,
+// then a count of errors and replies.
+func pipeCommands(client *Client, in io.Reader) int {
+	var errs, replies int
+	var lines []int // the input line of each queued command
+	p := client.Pipeline()
+	flush := func() bool {
+		got, err := p.exec()
+		for i, r := range got {
+			if r.kind == '-' {
+				fmt.Fprintf(os.Stderr, "line %d: %s\n", lines[i], r.str)
+				errs++
+			}
+		}
+		replies += len(got)
+		lines = lines[:0]
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return false
+		}
+		return true
+	}
+
+	ok := true
+	bad, err := scanCommands(in, func(lineNo int, args []string) bool {
+		p.Queue(args...)
+		lines = append(lines, lineNo)
+		if p.Len() == pipeBatch {
+			ok = flush()
+		}
+		return ok
+	})
+	if ok && p.Len() > 0 {
+		ok = flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading commands:", err)
+		return 1
+	}
+	if !ok {
+		return 1
+	}
+	errs += bad
+	fmt.Printf("errors: %d, replies: %d\n", errs, replies)
+	if errs > 0 {
+		return 1
+	}
+	return 0
+}
+
+// scanCommands splits the lines read from in into commands and calls fn
+// with each and its line number, until fn returns false. Blank lines and
+// lines starting with # are skipped; lines that don't split, say for an
+// unbalanced quote, are reported and counted.
+func scanCommands(in io.Reader, fn func(lineNo int, args []string) bool) (bad int, err error) {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, maxBulkLen)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %v\n", lineNo, err)
+			bad++
+			continue
+		}
+		if !fn(lineNo, args) {
+			break
+		}
+	}
+	return bad, sc.Err()
+}
+
+func runInteractiveClient(opts ClientOptions, raw bool) {
+	fmt.Println("╔═══════════════════════════════════════╗")
+	fmt.Println("║      LuminaDB Interactive Client      ║")
+	fmt.Println("╚═══════════════════════════════════════╝")
+	fmt.Println()
+
+	client, err := DialClient(opts)
+	if err != nil {
+		fmt.Printf("❌ Could not connect to server: %v\n", err)
+		fmt.Println("\nMake sure the server is running with: go run .")
+		return
+	}
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	fmt.Println("✓ Connected to", opts.Address)
+	fmt.Println("\nQuote values with spaces, and use ↑/↓ for earlier commands; EXIT quits")
+	fmt.Println(`Example: SET greeting "hello world"`)
+	fmt.Println("─────────────────────────────────────────")
+
+	ed := newLineEditor(historyPath())
+	for {
+		prompt := "luminadb> "
+		if client == nil {
+			prompt = "not connected> "
+		}
+		line, err := ed.readLine(prompt)
+		if err != nil {
+			break
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			fmt.Println("Invalid argument(s):", err)
+			continue
+		}
+		// Keep passwords out of the history file.
+		cmd := strings.ToUpper(args[0])
+		if cmd != "AUTH" && !(cmd == "HELLO" && containsFold(args, "AUTH")) {
+			ed.addHistory(line)
+		}
+		if cmd == "EXIT" || cmd == "QUIT" {
+			fmt.Println("Goodbye!")
+			break
+		}
+
+		// A lost connection is dialed again on the next command.
+		if client == nil {
+			if client, err = DialClient(opts); err != nil {
+				fmt.Println("Could not connect to server:", err)
+				continue
+			}
+		}
+		r, err := client.do(args)
+		if err != nil {
+			fmt.Println("Error:", err)
+			client.Close()
+			client = nil
+			continue
+		}
+		printReply(r, args, raw)
+		if subscribes(args) && r.kind != '-' {
+			readMessages(client, raw)
+			return
+		}
+	}
+}
+
+// subscribes reports whether args put the connection in subscribed mode,
+// where messages arrive without being asked for.
+func subscribes(args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	return cmd == "SUBSCRIBE" || cmd == "PSUBSCRIBE"
+}
+
+// readMessages prints the replies to the rest of a SUBSCRIBE and the
+// messages that follow, until the connection closes or Ctrl-C.
+func readMessages(client *Client, raw bool) {
+	if !raw {
+		fmt.Println("Reading messages... (press Ctrl-C to quit)")
+	}
+	for {
+		r, err := client.readReply()
+		if err != nil {
+			return
+		}
+		printReply(r, nil, raw)
+	}
+}
+
+// printReply prints a reply to args as the output mode says.
+func printReply(r reply, args []string, raw bool) {
+	switch {
+	case raw && r.kind == '-':
+		fmt.Fprintln(os.Stderr, r.str)
+	case raw:
+		fmt.Println(formatRaw(r))
+	case r.kind == '$' && len(args) > 0 && strings.EqualFold(args[0], "INFO"):
+		// INFO is text meant to be read, not a value to quote.
+		fmt.Print(r.str)
+	default:
+		fmt.Println(formatReply(r))
+	}
+}
+
+// formatReply formats a reply for people, like redis-cli: strings quoted,
+// types named, and the elements of an aggregate numbered one per line,
+// nested ones indented under their number.
+func formatReply(r reply) string {
+	switch r.kind {
+	case '+', '=':
+		return r.str
+	case '-':
+		return "(error) " + r.str
+	case ':':
+		return "(integer) " + r.str
+	case ',':
+		return "(double) " + r.str
+	case '(':
+		return "(big number) " + r.str
+	case '#':
+		if r.str == "t" {
+			return "(true)"
+		}
+		return "(false)"
+	case '_':
+		return "(nil)"
+	case '$':
+		return strconv.Quote(r.str)
+	case '%':
+		if len(r.items) == 0 {
+			return "(empty hash)"
+		}
+		return formatItems(r.items, true)
+	case '~':
+		if len(r.items) == 0 {
+			return "(empty set)"
+		}
+	}
+	if len(r.items) == 0 {
+		return "(empty array)"
+	}
+	return formatItems(r.items, false)
+}
+
+// formatItems lists the elements of an aggregate as "1) x", or the
+// entries of a map as "1# key => value", with the numbers right-aligned.
+func formatItems(items []reply, isMap bool) string {
+	step := 1
+	if isMap {
+		step = 2
+	}
+	width := len(strconv.Itoa(len(items) / step))
+	var b strings.Builder
+	for i := 0; i < len(items); i += step {
+		var prefix string
+		value := items[i]
+		if isMap {
+			prefix = fmt.Sprintf("%*d# %s => ", width, i/2+1, formatReply(items[i]))
+			value = items[i+1]
+		} else {
+			prefix = fmt.Sprintf("%*d) ", width, i+1)
+		}
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(prefix)
+		indent := "\n" + strings.Repeat(" ", utf8.RuneCountInString(prefix))
+		b.WriteString(strings.ReplaceAll(formatReply(value), "\n", indent))
+	}
+	return b.String()
+}
+
+// formatRaw formats a reply for scripts: scalars as they are, nil as an
+// empty line, and aggregates one element per line, map keys and values
+// alike.
+func formatRaw(r reply) string {
+	switch r.kind {
+	case '*', '~', '>', '%':
+		lines := make([]string, len(r.items))
+		for i, item := range r.items {
+			lines[i] = formatRaw(item)
+		}
+		return strings.Join(lines, "\n")
+	case '#':
+		if r.str == "t" {
+			return "true"
+		}
+		return "false"
+	}
+	return r.str
+}
+
+func containsFold(args []string, s string) bool {
+	for _, arg := range args {
+		if strings.EqualFold(arg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// historyPath returns the history file of the interactive client, or ""
+// to keep no history.
+func historyPath() string {
+	if path, ok := os.LookupEnv("LUMINADB_HISTFILE"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, historyFile)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
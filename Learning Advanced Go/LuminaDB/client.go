@@ -2,115 +2,282 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
+	"strconv"
 	"strings"
 )
 
 type Client struct {
 	conn   net.Conn
 	reader *bufio.Reader
+	buf    []byte // the command being sent
+}
+
+// ClientOptions say how to reach the server.
+type ClientOptions struct {
+	Network  string      // "tcp" (the default) or "unix"
+	Address  string      // host:port, or the socket path for "unix"
+	TLS      *tls.Config // connect over TLS if set
+	Password string      // sent with AUTH once connected, if set
 }
 
 func NewClient(address string) (*Client, error) {
-	conn, err := net.Dial("tcp", address)
+	return DialClient(ClientOptions{Address: address})
+}
+
+// DialClient connects to the server as opts say.
+func DialClient(opts ClientOptions) (*Client, error) {
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+	var conn net.Conn
+	var err error
+	if opts.TLS != nil {
+		conn, err = tls.Dial(network, opts.Address, opts.TLS)
+	} else {
+		conn, err = net.Dial(network, opts.Address)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
+	c := &Client{
 		conn:   conn,
 		reader: bufio.NewReader(conn),
-	}, nil
+	}
+	if opts.Password != "" {
+		r, err := c.do([]string{"AUTH", opts.Password})
+		if err == nil && r.kind == '-' {
+			err = errors.New(r.str)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
 }
 
+// SendCommand sends one command in a single write.
 func (c *Client) SendCommand(args []string) error {
-	// Build RESP array
-	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	c.buf = encodeCommand(c.buf[:0], args)
+	_, err := c.conn.Write(c.buf)
+	return err
+}
+
+// encodeCommand appends args encoded as a RESP array to b.
+func encodeCommand(b []byte, args []string) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, "\r\n"...)
 	for _, arg := range args {
-		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(arg), arg)
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// do sends a command and reads its reply.
+func (c *Client) do(args []string) (reply, error) {
+	if err := c.SendCommand(args); err != nil {
+		return reply{}, err
 	}
-	return nil
+	return c.readReply()
 }
 
 func (c *Client) ReadResponse() string {
-	line, err := c.reader.ReadString('\n')
+	r, err := c.readReply()
 	if err != nil {
 		return fmt.Sprintf("Error: %v", err)
 	}
+	return formatReply(r)
+}
 
-	line = strings.TrimSpace(line)
-
-	switch line[0] {
-	case '+':
-		return line[1:]
-	case '-':
-		return "(error) " + line[1:]
-	case ':':
-		return line[1:]
-	case '$':
-		if line == "$-1" {
-			return "(nil)"
-		}
-		value, _ := c.reader.ReadString('\n')
-		return strings.TrimSpace(value)
-	default:
-		return line
-	}
+// reply is one decoded reply. kind is its RESP type byte: '+', '-', ':',
+// '$', '*', '%', '_' and the other RESP3 types, with blob errors turned
+// into '-', null bulk strings and arrays into '_', and attributes dropped.
+// str holds a scalar's payload and items an aggregate's elements; for a
+// map its keys and values alternate.
+type reply struct {
+	kind  byte
+	str   string
+	items []reply
 }
 
-func (c *Client) Close() {
-	c.conn.Close()
+// readReply reads one reply whole, so the next one starts in step.
+func (c *Client) readReply() (reply, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return reply{}, err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return reply{}, errors.New("empty reply line")
+	}
+
+	kind, body := line[0], line[1:]
+	switch kind {
+	case '+', '-', ':', ',', '#', '(':
+		return reply{kind: kind, str: body}, nil
+	case '_':
+		return reply{kind: '_'}, nil
+	case '$', '=', '!':
+		n, err := replyLen(body, maxBulkLen)
+		if err != nil {
+			return reply{}, err
+		}
+		if n < 0 {
+			return reply{kind: '_'}, nil
+		}
+		// As in the server's parser, large values are buffered as they
+		// arrive so a bogus length can't allocate 512MB.
+		var buf []byte
+		if n <= maxLineSize {
+			buf = make([]byte, n+2)
+			if _, err := io.ReadFull(c.reader, buf); err != nil {
+				return reply{}, err
+			}
+		} else {
+			var b bytes.Buffer
+			if _, err := io.CopyN(&b, c.reader, int64(n+2)); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return reply{}, err
+			}
+			buf = b.Bytes()
+		}
+		s := string(buf[:n])
+		switch kind {
+		case '=':
+			// A verbatim string starts with its format, e.g. "txt:".
+			if len(s) >= 4 && s[3] == ':' {
+				s = s[4:]
+			}
+		case '!':
+			kind = '-'
+		}
+		return reply{kind: kind, str: s}, nil
+	case '*', '~', '>', '%', '|':
+		n, err := replyLen(body, maxReplyItems)
+		if err != nil {
+			return reply{}, err
+		}
+		if n < 0 {
+			return reply{kind: '_'}, nil
+		}
+		if kind == '%' || kind == '|' {
+			n *= 2
+		}
+		// Grow as elements arrive rather than trusting the announced count.
+		items := make([]reply, 0, min(n, 1024))
+		for range n {
+			r, err := c.readReply()
+			if err != nil {
+				return reply{}, err
+			}
+			items = append(items, r)
+		}
+		if kind == '|' {
+			return c.readReply() // the reply the attributes describe
+		}
+		return reply{kind: kind, items: items}, nil
+	}
+	return reply{}, fmt.Errorf("unexpected reply %q", line)
 }
 
-func runInteractiveClient() {
-	fmt.Println("╔═══════════════════════════════════════╗")
-	fmt.Println("║      LuminaDB Interactive Client      ║")
-	fmt.Println("╚═══════════════════════════════════════╝")
-	fmt.Println()
+// maxReplyItems bounds the length of an aggregate reply, as maxBulkLen does
+// a bulk string's, so a corrupt stream can't make the client allocate
+// without bound.
+const maxReplyItems = 1 << 24
 
-	client, err := NewClient("localhost:8080")
-	if err != nil {
-		fmt.Printf("❌ Could not connect to server: %v\n", err)
-		fmt.Println("\nMake sure the server is running with: go run .")
-		return
+// replyLen parses the length of a bulk string or aggregate; -1 means null.
+func replyLen(s string, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 || n > limit {
+		return 0, fmt.Errorf("bad reply length %q", s)
 	}
-	defer client.Close()
+	return n, nil
+}
 
-	fmt.Println("✓ Connected to localhost:8080")
-	fmt.Println("\nCommands: SET, GET, DEL, PING, EXISTS, DBSIZE, EXIT")
-	fmt.Println("Example: SET mykey myvalue")
-	fmt.Println("─────────────────────────────────────────")
+// Pipeline queues commands on a client and sends them together, so many
+// commands cost one round trip instead of one each. A pipeline is not a
+// transaction: other clients' commands may run in between.
+type Pipeline struct {
+	c      *Client
+	buf    []byte // the queued commands, encoded
+	queued int
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
+// Pipeline starts a pipeline on c. Nothing else may use c until Exec.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
 
-	for {
-		fmt.Print("luminadb> ")
+// Queue adds a command to the pipeline.
+func (p *Pipeline) Queue(args ...string) {
+	p.buf = encodeCommand(p.buf, args)
+	p.queued++
+}
 
-		if !scanner.Scan() {
-			break
-		}
+// Len returns the number of commands queued.
+func (p *Pipeline) Len() int {
+	return p.queued
+}
 
-		input := strings.TrimSpace(scanner.Text())
-		if input == "" {
-			continue
-		}
+// Exec sends the queued commands and returns their replies in order,
+// formatted like ReadResponse. The pipeline is empty afterwards and may
+// be reused.
+func (p *Pipeline) Exec() ([]string, error) {
+	replies, err := p.exec()
+	formatted := make([]string, len(replies))
+	for i, r := range replies {
+		formatted[i] = formatReply(r)
+	}
+	return formatted, err
+}
 
-		args := strings.Fields(input)
-		cmd := strings.ToUpper(args[0])
+// exec is Exec without the formatting. The commands are sent while their
+// replies are read: sending the whole batch first would stall on a batch
+// larger than the socket buffers, with the server waiting for its replies
+// to be read and the client waiting for its commands to be taken. After
+// an error the connection is closed, as it is out of step.
+func (p *Pipeline) exec() ([]reply, error) {
+	n, buf := p.queued, p.buf
+	p.queued, p.buf = 0, p.buf[:0]
+	sent := make(chan error, 1)
+	go func() {
+		_, err := p.c.conn.Write(buf)
+		sent <- err
+	}()
 
-		if cmd == "EXIT" || cmd == "QUIT" {
-			fmt.Println("Goodbye!")
+	replies := make([]reply, 0, n)
+	var err error
+	for range n {
+		var r reply
+		if r, err = p.c.readReply(); err != nil {
+			// The write may be stuck on a server that stopped reading.
+			p.c.conn.Close()
 			break
 		}
-
-		err := client.SendCommand(args)
-		if err != nil {
-			fmt.Printf("Error sending command: %v\n", err)
-			continue
-		}
-
-		response := client.ReadResponse()
-		fmt.Println(response)
+		replies = append(replies, r)
 	}
+	if werr := <-sent; err == nil && werr != nil {
+		p.c.conn.Close()
+		err = werr
+	}
+	return replies, err
+}
+
+func (c *Client) Close() {
+	c.conn.Close()
 }
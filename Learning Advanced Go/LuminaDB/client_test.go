@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readFrom returns a client that reads its replies from in.
+func readFrom(in string) *Client {
+	return &Client{reader: bufio.NewReader(strings.NewReader(in))}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		in   string
+		want reply
+	}{
+		{"+OK\r\n", reply{kind: '+', str: "OK"}},
+		{"$5\r\nhello\r\n", reply{kind: '$', str: "hello"}},
+		{"$-1\r\n", reply{kind: '_'}},
+		{"*-1\r\n", reply{kind: '_'}},
+		{"*0\r\n", reply{kind: '*', items: []reply{}}},
+		{"*2\r\n:1\r\n$1\r\na\r\n", reply{kind: '*', items: []reply{{kind: ':', str: "1"}, {kind: '$', str: "a"}}}},
+		{"%1\r\n+k\r\n:1\r\n", reply{kind: '%', items: []reply{{kind: '+', str: "k"}, {kind: ':', str: "1"}}}},
+		{"=8\r\ntxt:some\r\n", reply{kind: '=', str: "some"}},
+		{"!7\r\nERR bad\r\n", reply{kind: '-', str: "ERR bad"}},
+		{"|1\r\n+ttl\r\n:3\r\n+value\r\n", reply{kind: '+', str: "value"}},
+	}
+	for _, tt := range tests {
+		got, err := readFrom(tt.in).readReply()
+		if err != nil {
+			t.Errorf("readReply(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readReply(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// Lengths from the server are checked before anything is allocated for
+// them, and large bulks and aggregates grow as their contents arrive.
+func TestReadReplyLengths(t *testing.T) {
+	for _, in := range []string{
+		"$536870913\r\n",
+		"$-2\r\n",
+		"$x\r\n",
+		"*16777217\r\n",
+		"%16777217\r\n",
+		"*-2\r\n",
+		"~99999999999999999999\r\n",
+	} {
+		if _, err := readFrom(in).readReply(); err == nil || !strings.Contains(err.Error(), "bad reply length") {
+			t.Errorf("readReply(%q) = %v, want a bad length error", in, err)
+		}
+	}
+
+	for _, in := range []string{"*16777216\r\n:1\r\n", "$536870912\r\nabc"} {
+		if _, err := readFrom(in).readReply(); !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("readReply(%q) = %v, want EOF", in, err)
+		}
+	}
+}
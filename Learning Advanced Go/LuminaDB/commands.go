@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cmdFlags describe how a command behaves. The dispatcher uses them to pick
+// the lock a handler runs under, and COMMAND reports them to clients.
+type cmdFlags uint32
+
+const (
+	flagWrite    cmdFlags = 1 << iota // modifies the keyspace; runs with its keys' shards write-locked
+	flagReadonly                      // only reads the keyspace; runs with its keys' shards read-locked
+	flagAdmin                         // server administration
+	flagFast                          // O(1) or O(log N)
+	flagBlocking                      // may block the client, see blocking.go
+	flagNoMulti                       // can't be queued in a transaction, see multi.go
+	flagDenyOOM                       // may add data, so refused when maxmemory is reached, see eviction.go
+)
+
+var flagNames = []struct {
+	flag cmdFlags
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadonly, "readonly"},
+	{flagAdmin, "admin"},
+	{flagFast, "fast"},
+	{flagBlocking, "blocking"},
+	{flagNoMulti, "no-multi"},
+	{flagDenyOOM, "denyoom"},
+}
+
+// A commandFunc writes its reply to c, or returns an error without having
+// written anything; the dispatcher turns the error into the reply.
+type commandFunc func(c *clientConn, args []string) error
+
+type command struct {
+	name    string
+	handler commandFunc
+	arity   int // argument count including the name, -N means at least N
+	flags   cmdFlags
+	group   string // ACL category without the @, e.g. "string"
+
+	// Key positions as in Redis: the first and last argument index holding
+	// a key and the step between them. lastKey -1 is the last argument.
+	// firstKey 0 means the command takes no keys.
+	firstKey, lastKey, step int
+
+	stats callStats // see stats.go
+}
+
+var commandTable = make(map[string]*command)
+
+func registerCommands(cmds ...*command) {
+	for _, cmd := range cmds {
+		commandTable[cmd.name] = cmd
+	}
+}
+
+func init() {
+	registerCommands(
+		&command{name: "command", handler: commandCommand, arity: -1, group: "connection"},
+	)
+}
+
+// respError is sent to the client as it is; the text starts with an error
+// code such as ERR or WRONGTYPE. Any other error a handler returns is an
+// internal failure and gets an ERR prefix.
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+const (
+	errSyntax     respError = "ERR syntax error"
+	errNotInteger respError = "ERR value is not an integer or out of range"
+)
+
+func errWrongArgs(name string) error {
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+}
+
+// keys returns the key arguments of a call to cmd.
+func (cmd *command) keys(args []string) []string {
+	if cmd.firstKey == 0 || cmd.firstKey >= len(args) {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// shards returns the shards of the keys of a call to cmd, or every shard
+// for a command that takes no keys. It is keys without the allocation, as
+// every command calls it.
+func (cmd *command) shards(args []string) shardSet {
+	if cmd.firstKey == 0 {
+		return allShards
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var set shardSet
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.step {
+		set |= 1 << shardIndex(args[i])
+	}
+	if set == 0 {
+		return allShards
+	}
+	return set
+}
+
+func (cmd *command) checkArity(args []string) bool {
+	if cmd.arity >= 0 {
+		return len(args) == cmd.arity
+	}
+	return len(args) >= -cmd.arity
+}
+
+// execute runs one command and buffers its reply. The error it returns is
+// not for the client: the connection can't go on and must be closed.
+func (c *clientConn) execute(args []string) error {
+	cmd, ok := commandTable[strings.ToLower(args[0])]
+	if !ok {
+		var b strings.Builder
+		for _, arg := range args[1:] {
+			fmt.Fprintf(&b, "'%s' ", arg)
+		}
+		c.w.WriteError(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0], b.String()))
+		c.multiFailed = c.multi
+		return nil
+	}
+	if !cmd.checkArity(args) {
+		c.w.WriteError(errWrongArgs(cmd.name).Error())
+		c.multiFailed = c.multi
+		return nil
+	}
+	if c.user == nil && !noAuthCommands[cmd.name] {
+		c.w.WriteError(errNoAuth.Error())
+		c.multiFailed = c.multi
+		return nil
+	}
+	if c.user != nil {
+		if err := c.db.acl.check(c, cmd, args); err == errUserDeleted {
+			return err
+		} else if err != nil {
+			c.writeError(err)
+			c.multiFailed = c.multi
+			return nil
+		}
+	}
+	if cmd.flags&flagWrite != 0 && c.db.repl.readOnly.Load() && c.db.isReplica() {
+		c.w.WriteError(errReadOnlyReplica.Error())
+		c.multiFailed = c.multi
+		return nil
+	}
+	if c.push != nil && c.w.proto == 2 && !subscribedCommands[cmd.name] {
+		c.w.WriteError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context", cmd.name))
+		return nil
+	}
+	if cmd.flags&flagDenyOOM != 0 {
+		if err := c.db.freeMemory(); err != nil {
+			c.writeError(err)
+			c.multiFailed = c.multi
+			return nil
+		}
+	}
+	if c.multi && cmd.name != "exec" && cmd.name != "discard" && cmd.name != "multi" {
+		c.queue(cmd, args)
+		return nil
+	}
+	return c.call(cmd, args)
+}
+
+// call runs cmd with the shards of its keys locked the way its flags ask
+// for, see shards.go. Writes wait for the fsync policy only after the
+// shards are released, so other writers can go ahead and share the fsync.
+// Clients watching the keys of a write are told, and clients blocked on
+// keys the command pushed to are served, before the shards are released.
+func (c *clientConn) call(cmd *command, args []string) error {
+	db := c.db
+	var err error
+	start := time.Now()
+	switch {
+	case cmd.flags&flagWrite != 0:
+		shards := db.lockForWrite(cmd, args)
+		err = cmd.handler(c, args)
+		db.accountCommand(cmd, args)
+		if err == nil {
+			db.touchCommand(cmd, args)
+		}
+		db.serveBlocked()
+		db.store.unlock(shards)
+	case cmd.flags&flagReadonly != 0:
+		shards := cmd.shards(args)
+		db.store.rlock(shards)
+		err = cmd.handler(c, args)
+		db.store.runlock(shards)
+	default:
+		err = cmd.handler(c, args)
+	}
+	cmd.stats.record(time.Since(start), err)
+
+	if err != nil {
+		c.writeError(err)
+	}
+	if cmd.flags&flagWrite != 0 {
+		if err := db.logger.WaitDurable(); err != nil {
+			return fmt.Errorf("log fsync failed: %w", err)
+		}
+	}
+	if c.blocked != nil {
+		return c.waitBlocked()
+	}
+	return nil
+}
+
+func (c *clientConn) writeError(err error) {
+	if e, ok := err.(respError); ok {
+		c.w.WriteError(string(e))
+		return
+	}
+	fmt.Printf("Error running command: %v\n", err)
+	c.w.WriteError("ERR " + err.Error())
+}
+
+// COMMAND [COUNT | LIST | INFO name... | GETKEYS command args...]
+func commandCommand(c *clientConn, args []string) error {
+	if len(args) == 1 {
+		names := sortedCommandNames()
+		c.w.WriteArrayLen(len(names))
+		for _, name := range names {
+			c.writeCommandInfo(commandTable[name])
+		}
+		return nil
+	}
+
+	switch strings.ToUpper(args[1]) {
+	case "COUNT":
+		if len(args) != 2 {
+			return errWrongArgs("command|count")
+		}
+		c.w.WriteInteger(int64(len(commandTable)))
+	case "LIST":
+		if len(args) != 2 {
+			return errWrongArgs("command|list")
+		}
+		c.w.WriteBulks(sortedCommandNames())
+	case "INFO":
+		names := args[2:]
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+		c.w.WriteArrayLen(len(names))
+		for _, name := range names {
+			if cmd, ok := commandTable[strings.ToLower(name)]; ok {
+				c.writeCommandInfo(cmd)
+			} else {
+				c.w.WriteNullArray()
+			}
+		}
+	case "GETKEYS":
+		if len(args) < 3 {
+			return errWrongArgs("command|getkeys")
+		}
+		cmd, ok := commandTable[strings.ToLower(args[2])]
+		if !ok {
+			return respError("ERR Invalid command specified")
+		}
+		if !cmd.checkArity(args[2:]) {
+			return respError("ERR Invalid number of arguments specified for command")
+		}
+		keys := cmd.keys(args[2:])
+		if len(keys) == 0 {
+			return respError("ERR The command has no key arguments")
+		}
+		c.w.WriteBulks(keys)
+	default:
+		return respError(fmt.Sprintf("ERR unknown subcommand '%s'. Try COMMAND HELP.", args[1]))
+	}
+	return nil
+}
+
+// writeCommandInfo sends the Redis 6 style description of cmd: name, arity,
+// flags, first key, last key, key step and ACL categories.
+func (c *clientConn) writeCommandInfo(cmd *command) {
+	c.w.WriteArrayLen(7)
+	c.w.WriteBulk(cmd.name)
+	c.w.WriteInteger(int64(cmd.arity))
+
+	var flags []string
+	for _, f := range flagNames {
+		if cmd.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	c.w.WriteSetLen(len(flags))
+	for _, f := range flags {
+		c.w.WriteSimpleString(f)
+	}
+
+	c.w.WriteInteger(int64(cmd.firstKey))
+	c.w.WriteInteger(int64(cmd.lastKey))
+	c.w.WriteInteger(int64(cmd.step))
+
+	categories := cmd.categories()
+	c.w.WriteSetLen(len(categories))
+	for _, cat := range categories {
+		c.w.WriteSimpleString(cat)
+	}
+}
+
+// categories returns the ACL categories of cmd, derived from its group and
+// flags.
+func (cmd *command) categories() []string {
+	cats := []string{"@" + cmd.group}
+	if cmd.flags&flagWrite != 0 {
+		cats = append(cats, "@write")
+	}
+	if cmd.flags&flagReadonly != 0 {
+		cats = append(cats, "@read")
+	}
+	if cmd.flags&flagAdmin != 0 {
+		cats = append(cats, "@admin", "@dangerous")
+	}
+	if cmd.flags&flagBlocking != 0 {
+		cats = append(cats, "@blocking")
+	}
+	if cmd.flags&flagFast != 0 {
+		cats = append(cats, "@fast")
+	} else {
+		cats = append(cats, "@slow")
+	}
+	return cats
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
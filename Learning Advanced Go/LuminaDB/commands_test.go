@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Arguments quoted in error replies can't break the reply up: a line break
+// in one would end the error early and pass the rest off as another reply.
+func TestErrorRepliesStayOnOneLine(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+	for _, args := range [][]string{
+		{"NOSUCH\r\n+OK", "x\ny"},
+		{"COMMAND", "NOSUCH\r\n+OK"},
+		{"HELLO", "2", "NOSUCH\r\n+OK"},
+	} {
+		got := c.do(args...)
+		if !strings.HasPrefix(got, "-ERR ") || strings.ContainsAny(strings.TrimSuffix(got, "\r\n"), "\r\n") {
+			t.Errorf("%q = %q, want a one-line error", args, got)
+		}
+		if got := c.do("PING"); got != "+PONG\r\n" {
+			t.Fatalf("PING after %q = %q, want PONG", args, got)
+		}
+	}
+}
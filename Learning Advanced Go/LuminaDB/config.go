@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "config", handler: configCommand, arity: -2, flags: flagAdmin | flagNoMulti, group: "server"},
+	)
+}
+
+// Settings come from three places, each overriding the one before: the
+// defaults, the config file and the command line. The file has one
+// setting per line, the name followed by its value, and # comments:
+//
+//	port 6380
+//	save 900 1 300 10
+//	masterauth "a password with spaces"
+//
+// Every setting is also a flag of the same name, so -port 6380 does the
+// same. Those marked with an apply func may be changed with CONFIG SET
+// while the server runs; CONFIG REWRITE writes the current values back to
+// the file.
+
+// config holds the settings. Once the server runs, db.config.mu guards
+// the ones CONFIG SET may change.
+type config struct {
+	bind           string
+	port           int
+	dir            string
+	appendFilename string
+	dbFilename     string
+	aclFile        string
+
+	appendFsync       string
+	save              string
+	rewritePercentage int
+	rewriteMinSize    int64
+
+	pubsubLimit        int
+	replicaBufferLimit int
+	backlogSize        int
+
+	shutdownTimeout int
+
+	maxMemory        int64
+	maxMemoryPolicy  string
+	maxMemorySamples int
+
+	replicaOf       string
+	replicaReadOnly bool
+	masterUser      string
+	masterAuth      string
+	requirePass     string
+
+	tlsPort        int
+	tlsCertFile    string
+	tlsKeyFile     string
+	tlsCAFile      string
+	tlsAuthClients string
+	tlsReplication bool
+	unixSocket     string
+	unixSocketPerm string
+
+	metricsPort int
+	metricsBind string
+}
+
+func defaultConfig() *config {
+	return &config{
+		bind:               "localhost",
+		port:               defaultPort,
+		appendFilename:     "lumina.log",
+		dbFilename:         defaultSnapshotFile,
+		aclFile:            defaultACLFile,
+		appendFsync:        "everysec",
+		save:               "3600 1 300 100 60 10000",
+		rewritePercentage:  100,
+		rewriteMinSize:     64 << 20,
+		pubsubLimit:        defaultPubSubLimit,
+		replicaBufferLimit: defaultReplicaBufferLimit,
+		backlogSize:        defaultBacklogSize,
+		shutdownTimeout:    int(defaultShutdownTimeout / time.Second),
+		maxMemoryPolicy:    "noeviction",
+		maxMemorySamples:   defaultEvictionSamples,
+		replicaReadOnly:    true,
+		tlsAuthClients:     "no",
+		unixSocketPerm:     "700",
+		metricsBind:        "localhost",
+	}
+}
+
+// configParam is one setting. value reads and parses it in place; apply,
+// if set, hands a new value to the running server.
+type configParam struct {
+	name  string
+	usage string
+	value flag.Value
+	apply func(db *LuminaDB, cfg *config) error
+}
+
+// params lists the settings of cfg.
+func (cfg *config) params() []configParam {
+	return []configParam{
+		{"bind", "address to listen on for TCP and TLS", stringValue{&cfg.bind}, nil},
+		{"port", "port to listen on (0 disables plain TCP)", intValue{&cfg.port, 0, 65535}, nil},
+		{"dir", "directory for the log, snapshot and ACL files", stringValue{&cfg.dir}, nil},
+		{"appendfilename", "name of the log file", stringValue{&cfg.appendFilename}, nil},
+		{"dbfilename", "name of the snapshot file", stringValue{&cfg.dbFilename}, nil},
+		{"aclfile", "file the ACL users are kept in (empty keeps them in memory)", stringValue{&cfg.aclFile}, nil},
+
+		{"appendfsync", "when to fsync the log: always, everysec or no", checkedValue{&cfg.appendFsync, checkFsyncPolicy},
+			func(db *LuminaDB, cfg *config) error {
+				p, _ := parseFsyncPolicy(cfg.appendFsync)
+				db.logger.SetFsyncPolicy(p)
+				return nil
+			}},
+		{"save", "snapshot after <seconds> <changes> pairs (empty disables)", checkedValue{&cfg.save, checkSaveParams},
+			func(db *LuminaDB, cfg *config) error {
+				params, _ := parseSaveParams(cfg.save)
+				db.SetSaveParams(params)
+				return nil
+			}},
+		{"auto-rewrite-percentage", "rewrite the log once it grows by this percentage (0 disables)", intValue{&cfg.rewritePercentage, 0, 1 << 30},
+			applyAutoRewrite},
+		{"auto-rewrite-min-size", "minimum log size in bytes before an automatic rewrite", int64Value{&cfg.rewriteMinSize},
+			applyAutoRewrite},
+
+		{"pubsub-buffer-limit", "disconnect a subscriber once this many bytes wait to be sent to it (0 disables)", intValue{&cfg.pubsubLimit, 0, math.MaxInt},
+			func(db *LuminaDB, cfg *config) error {
+				db.pubsub.limit.Store(int64(cfg.pubsubLimit))
+				return nil
+			}},
+		{"replica-buffer-limit", "disconnect a replica once this many bytes wait to be sent to it (0 disables)", intValue{&cfg.replicaBufferLimit, 0, math.MaxInt},
+			func(db *LuminaDB, cfg *config) error {
+				db.repl.mu.Lock()
+				db.repl.bufferLimit = cfg.replicaBufferLimit
+				db.repl.mu.Unlock()
+				return nil
+			}},
+		{"repl-backlog-size", "bytes of the replication stream kept for partial resyncs", intValue{&cfg.backlogSize, 1, math.MaxInt},
+			func(db *LuminaDB, cfg *config) error {
+				db.repl.mu.Lock()
+				db.repl.backlogSize = cfg.backlogSize
+				db.repl.mu.Unlock()
+				return nil
+			}},
+
+		{"shutdown-timeout", "seconds a shutdown waits for connections to finish their commands", intValue{&cfg.shutdownTimeout, 0, 1 << 20},
+			func(db *LuminaDB, cfg *config) error {
+				db.shutdownTimeout.Store(int64(time.Duration(cfg.shutdownTimeout) * time.Second))
+				return nil
+			}},
+
+		{"maxmemory", "evict keys or refuse writes once the keyspace takes this many bytes, e.g. 100mb (0 disables)", memoryValue{&cfg.maxMemory},
+			func(db *LuminaDB, cfg *config) error {
+				db.maxMemory.Store(cfg.maxMemory)
+				return nil
+			}},
+		{"maxmemory-policy", "what goes once maxmemory is reached: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru or volatile-ttl",
+			checkedValue{&cfg.maxMemoryPolicy, checkEvictionPolicy},
+			func(db *LuminaDB, cfg *config) error {
+				p, _ := parseEvictionPolicy(cfg.maxMemoryPolicy)
+				db.evictionPolicy.Store(int64(p))
+				return nil
+			}},
+		{"maxmemory-samples", "keys looked at to pick each one to evict", intValue{&cfg.maxMemorySamples, 1, 64},
+			func(db *LuminaDB, cfg *config) error {
+				db.evictionSamples.Store(int64(cfg.maxMemorySamples))
+				return nil
+			}},
+
+		{"replicaof", "replicate the server at \"<host> <port>\"", checkedValue{&cfg.replicaOf, checkReplicaOf}, nil},
+		{"replica-read-only", "reject writes from clients while a replica", boolValue{&cfg.replicaReadOnly},
+			func(db *LuminaDB, cfg *config) error {
+				db.repl.readOnly.Store(cfg.replicaReadOnly)
+				return nil
+			}},
+		{"masteruser", "user a replica authenticates to its primary as (default user if empty)", stringValue{&cfg.masterUser}, applyMasterAuth},
+		{"masterauth", "password a replica authenticates to its primary with", stringValue{&cfg.masterAuth}, applyMasterAuth},
+		{"requirepass", "password of the default user (none if empty)", stringValue{&cfg.requirePass},
+			func(db *LuminaDB, cfg *config) error {
+				db.acl.setRequirePass(cfg.requirePass)
+				return nil
+			}},
+
+		{"tls-port", "port to listen on for TLS (0 disables)", intValue{&cfg.tlsPort, 0, 65535}, nil},
+		{"tls-cert-file", "TLS certificate; with -client or -tls-replication it is the client certificate", stringValue{&cfg.tlsCertFile}, nil},
+		{"tls-key-file", "private key of -tls-cert-file", stringValue{&cfg.tlsKeyFile}, nil},
+		{"tls-ca-cert-file", "CA certificates to verify peers with (system roots if empty)", stringValue{&cfg.tlsCAFile}, nil},
+		{"tls-auth-clients", "require TLS clients to present a certificate: no, optional or yes", stringValue{&cfg.tlsAuthClients}, nil},
+		{"tls-replication", "connect to the primary over TLS", boolValue{&cfg.tlsReplication}, nil},
+		{"unixsocket", "path of a Unix domain socket to listen on, or with -client to connect to", stringValue{&cfg.unixSocket}, nil},
+		{"unixsocketperm", "permissions of the Unix domain socket, in octal", checkedValue{&cfg.unixSocketPerm, checkSocketPerm}, nil},
+		{"metrics-port", "port to serve Prometheus metrics on over HTTP (0 disables)", intValue{&cfg.metricsPort, 0, 65535}, nil},
+		{"metrics-bind", "address to serve metrics on; anyone who can reach it can read them", stringValue{&cfg.metricsBind}, nil},
+	}
+}
+
+func applyAutoRewrite(db *LuminaDB, cfg *config) error {
+	db.SetAutoRewrite(cfg.rewritePercentage, cfg.rewriteMinSize)
+	return nil
+}
+
+func applyMasterAuth(db *LuminaDB, cfg *config) error {
+	db.repl.mu.Lock()
+	db.repl.masterUser, db.repl.masterAuth = cfg.masterUser, cfg.masterAuth
+	db.repl.mu.Unlock()
+	return nil
+}
+
+func checkFsyncPolicy(s string) error {
+	_, err := parseFsyncPolicy(s)
+	return err
+}
+
+func checkSaveParams(s string) error {
+	_, err := parseSaveParams(s)
+	return err
+}
+
+func checkReplicaOf(s string) error {
+	if s == "" {
+		return nil
+	}
+	_, _, err := parseReplicaOf(s)
+	return err
+}
+
+func checkEvictionPolicy(s string) error {
+	_, err := parseEvictionPolicy(s)
+	return err
+}
+
+func checkSocketPerm(s string) error {
+	_, err := parseSocketPerm(s)
+	return err
+}
+
+// The flag.Value types settings are parsed with.
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+// checkedValue is a string that must pass check.
+type checkedValue struct {
+	p     *string
+	check func(string) error
+}
+
+func (v checkedValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v checkedValue) Set(s string) error {
+	if err := v.check(s); err != nil {
+		return err
+	}
+	*v.p = s
+	return nil
+}
+
+type intValue struct {
+	p        *int
+	min, max int
+}
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < v.min || n > v.max {
+		return fmt.Errorf("argument must be an integer between %d and %d", v.min, v.max)
+	}
+	*v.p = n
+	return nil
+}
+
+type int64Value struct{ p *int64 }
+
+func (v int64Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*v.p, 10)
+}
+
+func (v int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return errors.New("argument must be a non-negative integer")
+	}
+	*v.p = n
+	return nil
+}
+
+// memoryValue is a number of bytes, which may be given with a unit as in
+// Redis: k, m and g are powers of 1000, kb, mb and gb powers of 1024.
+type memoryValue struct{ p *int64 }
+
+var memoryUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9},
+	{"b", 1},
+}
+
+func (v memoryValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*v.p, 10)
+}
+
+func (v memoryValue) Set(s string) error {
+	num, scale := strings.ToLower(s), int64(1)
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSuffix(num, u.suffix), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/scale {
+		return errors.New("argument must be a memory value, e.g. 1048576 or 100mb")
+	}
+	*v.p = n * scale
+	return nil
+}
+
+// boolValue takes yes/no like Redis as well as what strconv.ParseBool
+// does, and may stand alone on the command line.
+type boolValue struct{ p *bool }
+
+func (v boolValue) String() string {
+	if v.p != nil && *v.p {
+		return "yes"
+	}
+	return "no"
+}
+
+func (v boolValue) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "yes":
+		*v.p = true
+	case "no":
+		*v.p = false
+	default:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("argument must be 'yes' or 'no'")
+		}
+		*v.p = b
+	}
+	return nil
+}
+
+func (v boolValue) IsBoolFlag() bool { return true }
+
+// registerFlags makes every setting of cfg a command line flag.
+func (cfg *config) registerFlags(fs *flag.FlagSet) {
+	for _, p := range cfg.params() {
+		fs.Var(p.value, p.name, p.usage)
+	}
+}
+
+// loadFile reads the settings in path into cfg.
+func (cfg *config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	params := cfg.paramMap()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		name, value, ok, err := parseConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if !ok {
+			continue
+		}
+		p, found := params[name]
+		if !found {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+		if err := p.value.Set(value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", path, n, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (cfg *config) paramMap() map[string]configParam {
+	params := make(map[string]configParam)
+	for _, p := range cfg.params() {
+		params[p.name] = p
+	}
+	return params
+}
+
+// parseConfigLine splits a line of the config file into the setting's
+// name and value. Values may be quoted as in inline commands; several
+// words are joined with spaces. ok is false for blank and comment lines.
+func parseConfigLine(line string) (name, value string, ok bool, err error) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || trimmed[0] == '#' {
+		return "", "", false, nil
+	}
+	words, err := splitArgs(trimmed)
+	if err != nil {
+		return "", "", false, err
+	}
+	return strings.ToLower(words[0]), strings.Join(words[1:], " "), true, nil
+}
+
+// quoteConfigValue writes value so parseConfigLine reads it back the same.
+func quoteConfigValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\r\n\"'\\#") {
+		return value
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// serverConfig is the running server's view of its settings.
+type serverConfig struct {
+	mu   sync.Mutex
+	cfg  *config
+	file string // absolute path of the config file, "" without one
+}
+
+// get returns the settings matching pattern with their values.
+func (sc *serverConfig) get(pattern string) [][2]string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	var out [][2]string
+	for _, p := range sc.cfg.params() {
+		if globMatch(strings.ToLower(pattern), p.name) {
+			out = append(out, [2]string{p.name, p.value.String()})
+		}
+	}
+	return out
+}
+
+// set changes settings on the running server, all of them or, if any value
+// is rejected, none.
+func (sc *serverConfig) set(db *LuminaDB, pairs []string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	params := sc.cfg.paramMap()
+	old := *sc.cfg
+	seen := make(map[string]bool)
+	var applied []configParam
+	fail := func(name string, err error) error {
+		*sc.cfg = old
+		for _, p := range applied {
+			p.apply(db, sc.cfg)
+		}
+		return respError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err))
+	}
+
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(pairs[i])
+		p, ok := params[name]
+		switch {
+		case !ok:
+			return fail(pairs[i], errors.New("unsupported CONFIG parameter"))
+		case p.apply == nil:
+			return fail(pairs[i], errors.New("can't set immutable config"))
+		case seen[name]:
+			return fail(pairs[i], errors.New("duplicate parameter"))
+		}
+		seen[name] = true
+		if err := p.value.Set(pairs[i+1]); err != nil {
+			return fail(pairs[i], err)
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		p := params[strings.ToLower(pairs[i])]
+		applied = append(applied, p)
+		if err := p.apply(db, sc.cfg); err != nil {
+			return fail(pairs[i], err)
+		}
+	}
+	return nil
+}
+
+// rewrite writes the current settings to the config file. Lines of
+// settings keep their place and get the current value; comments and blank
+// lines stay as they are. Settings not in the file yet are added at the
+// end if they differ from the default.
+func (sc *serverConfig) rewrite() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.file == "" {
+		return respError("ERR The server is running without a config file")
+	}
+
+	data, err := os.ReadFile(sc.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	params := sc.cfg.paramMap()
+	written := make(map[string]bool)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		name, _, ok, err := parseConfigLine(line)
+		if _, known := params[name]; err != nil || !ok || !known {
+			lines = append(lines, line)
+			continue
+		}
+		if written[name] {
+			continue
+		}
+		written[name] = true
+		lines = append(lines, name+" "+quoteConfigValue(params[name].value.String()))
+	}
+
+	defaults := defaultConfig().paramMap()
+	added := false
+	for _, p := range sc.cfg.params() {
+		if written[p.name] || p.value.String() == defaults[p.name].value.String() {
+			continue
+		}
+		if !added {
+			lines = append(lines, "", "# Added by CONFIG REWRITE")
+			added = true
+		}
+		lines = append(lines, p.name+" "+quoteConfigValue(p.value.String()))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(sc.file), filepath.Base(sc.file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	tmp.Chmod(0644)
+	if fi, err := os.Stat(sc.file); err == nil {
+		tmp.Chmod(fi.Mode().Perm())
+	}
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), sc.file); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(sc.file))
+	return nil
+}
+
+// CONFIG GET pattern [pattern ...] | SET name value [name value ...] | REWRITE
+func configCommand(c *clientConn, args []string) error {
+	sc := &c.db.config
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "GET" && len(args) >= 3:
+		seen := make(map[string]bool)
+		var pairs [][2]string
+		for _, pattern := range args[2:] {
+			for _, kv := range sc.get(pattern) {
+				if !seen[kv[0]] {
+					seen[kv[0]] = true
+					pairs = append(pairs, kv)
+				}
+			}
+		}
+		c.w.WriteMapLen(len(pairs))
+		for _, kv := range pairs {
+			c.w.WriteBulk(kv[0])
+			c.w.WriteBulk(kv[1])
+		}
+	case sub == "SET" && len(args) >= 4 && len(args)%2 == 0:
+		if err := sc.set(c.db, args[2:]); err != nil {
+			return err
+		}
+		c.w.WriteSimpleString("OK")
+	case sub == "REWRITE" && len(args) == 2:
+		if err := sc.rewrite(); err != nil {
+			if _, ok := err.(respError); ok {
+				return err
+			}
+			return respError("ERR Rewriting config file: " + err.Error())
+		}
+		c.w.WriteSimpleString("OK")
+	case sub == "GET" || sub == "SET" || sub == "REWRITE":
+		return errWrongArgs("config|" + strings.ToLower(sub))
+	default:
+		return respError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[1]))
+	}
+	return nil
+}
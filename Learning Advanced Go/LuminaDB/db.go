@@ -2,65 +2,221 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// (Supporting structs RWData and LuminaDB omitted for brevity but remain the same)
-type RWData struct {
-	mu    sync.RWMutex
-	value map[string]string
-}
-
-func (d *RWData) Get(k string) string { d.mu.RLock(); defer d.mu.RUnlock(); return d.value[k] }
-func (d *RWData) Set(k, v string)     { d.mu.Lock(); defer d.mu.Unlock(); d.value[k] = v }
-
 type LuminaDB struct {
 	store  *RWData
 	logger *Logger
-}
 
-func (db *LuminaDB) Size() int {
-	db.store.mu.RLock()
-	defer db.store.mu.RUnlock()
+	// Keys found expired by readers, who only hold the key's shard for
+	// reading; the sweeper deletes them.
+	expireQueue chan string
 
-	return len(db.store.value)
-}
+	// Clients waiting in BLPOP and friends, by key in the order they
+	// blocked, guarded by blockedMu; blockedKeys is len(blocked). Keys
+	// pushed to since the last serveBlocked are only added while every
+	// shard is held, see lockForWrite.
+	blockedMu   sync.Mutex
+	blocked     map[string][]*blockedClient
+	blockedKeys atomic.Int64
+	readyKeys   []string
 
-func (db *LuminaDB) Exists(s string) bool {
-	db.store.mu.RLock()
-	defer db.store.mu.RUnlock()
+	scan [shardCount]scanCache // each shard's keys in SCAN order
 
-	_, exists := db.store.value[s]
-	return exists
-}
+	// Clients watching each key, see multi.go.
+	watchMu  sync.Mutex
+	watchers map[string]map[*clientConn]struct{}
 
-func (db *LuminaDB) FLUSHALL() {
-	db.store.mu.Lock()
-	defer db.store.mu.Unlock()
-	db.store.value = make(map[string]string)
+	pubsub pubsub
+	repl   *replication
+	acl    *acl
+	config serverConfig
+
+	quit chan struct{}  // closed by Close to stop background tasks
+	bg   sync.WaitGroup // background tasks still running
 
-	os.Truncate(db.logger.file.Name(), 0)
+	snapshotFile string
+	saveParams   atomic.Pointer[[]saveParam]
+	saving       atomic.Bool
+	lastSave     atomic.Int64 // unix seconds of the last successful save
+	saveFailed   atomic.Bool  // the last save failed
+	savedChanges atomic.Int64 // logger change count covered by the last save
+
+	rewritePercentage atomic.Int64 // log growth that triggers a rewrite, 0 for none
+	rewriteMinSize    atomic.Int64
+
+	// Shutdown, see shutdown.go.
+	clients          *clientSet
+	shutdownRequests chan shutdownRequest
+	shutdownTimeout  atomic.Int64 // nanoseconds
+
+	// Eviction, see eviction.go.
+	maxMemory       atomic.Int64 // bytes, 0 for no limit
+	evictionPolicy  atomic.Int64 // an evictionPolicy
+	evictionSamples atomic.Int64
+
+	stats serverStats // see stats.go
+}
+
+// SetOptions are the optional modifiers of the SET command.
+type SetOptions struct {
+	ExpireAt int64 // deadline in unix milliseconds, 0 means no expiry
+	NX       bool  // only set if the key does not exist
+	XX       bool  // only set if the key already exists
 }
+
 func NewLuminaDB(logFile string) (*LuminaDB, error) {
 	l, err := NewLogger(logFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return &LuminaDB{store: &RWData{value: make(map[string]string)}, logger: l}, nil
+	store := newRWData()
+	db := &LuminaDB{
+		store:        store,
+		logger:       l,
+		expireQueue:  make(chan string, 1024),
+		blocked:      make(map[string][]*blockedClient),
+		watchers:     make(map[string]map[*clientConn]struct{}),
+		quit:         make(chan struct{}),
+		snapshotFile: defaultSnapshotFile,
+	}
+	db.pubsub.channels = make(map[string]map[*clientConn]struct{})
+	db.pubsub.patterns = make(map[string]map[*clientConn]struct{})
+	db.pubsub.limit.Store(defaultPubSubLimit)
+	db.repl = newReplication()
+	db.acl = newACL()
+	db.config.cfg = defaultConfig()
+	l.feed = db.repl.feed
+	db.clients = newClientSet()
+	db.shutdownRequests = make(chan shutdownRequest)
+	db.shutdownTimeout.Store(int64(defaultShutdownTimeout))
+	db.evictionSamples.Store(defaultEvictionSamples)
+	db.lastSave.Store(time.Now().Unix())
+	db.stats.start = time.Now()
+	return db, nil
+}
+
+// The keyspace methods below do not lock. Commands run them through the
+// dispatcher (commands.go), which holds the shards of their keys for
+// reading or writing according to the command's flags, so a handler that
+// reads and then writes a key does so atomically.
+
+// Size returns the number of keys. Callers hold every shard.
+func (db *LuminaDB) Size() int {
+	keys, _ := db.store.counts()
+	return keys
+}
+
+// lookup returns the value of key, treating an expired key as missing, and
+// records the access for eviction. Callers hold the key's shard for
+// reading at least, so the expired key is handed to the sweeper instead of
+// being deleted here.
+func (db *LuminaDB) lookup(key string) (any, bool) {
+	return db.find(key, true)
+}
+
+// peek is lookup without recording the access, for commands like KEYS and
+// SCAN that would otherwise make every key look recently used.
+func (db *LuminaDB) peek(key string) (any, bool) {
+	return db.find(key, false)
+}
+
+func (db *LuminaDB) find(key string, touch bool) (any, bool) {
+	e := db.store.entry(key)
+	if e == nil {
+		return nil, false
+	}
+	now := nowMillis()
+	if db.store.expired(key, now) {
+		select {
+		case db.expireQueue <- key:
+		default: // the sweeper will sample it eventually
+		}
+		return nil, false
+	}
+	if touch {
+		e.touch(now)
+	}
+	return e.value, true
+}
+
+// lookupString is lookup for commands that only work on strings.
+func (db *LuminaDB) lookupString(key string) (string, bool, error) {
+	value, ok := db.lookup(key)
+	if !ok {
+		return "", false, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", false, errWrongType
+	}
+	return s, true, nil
+}
+
+// Type returns the type name of key, or "none" if it does not exist.
+func (db *LuminaDB) Type(key string) string {
+	value, ok := db.lookup(key)
+	if !ok {
+		return "none"
+	}
+	return typeNames[valueType(value)]
+}
+
+func (db *LuminaDB) Exists(s string) bool {
+	_, exists := db.lookup(s)
+	return exists
+}
+
+// FLUSHALL deletes every key. Callers hold every shard.
+func (db *LuminaDB) FLUSHALL() {
+	db.store.clear()
+	db.touchAll()
+
+	if err := db.logger.Truncate(); err != nil {
+		fmt.Printf("Error truncating log: %v\n", err)
+	}
+	if err := db.logger.LogFlushAll(); err != nil {
+		fmt.Printf("Error logging FLUSHALL: %v\n", err)
+	}
 }
 
 func (db *LuminaDB) Put(key, value string) error {
-	if err := db.logger.LogSet(key, value); err != nil {
-		return fmt.Errorf("Failed to log to disk: %w", err)
+	_, err := db.PutWithOptions(key, value, SetOptions{})
+	return err
+}
+
+// PutWithOptions implements SET with its EX/PX/NX/XX modifiers. It reports
+// whether the value was written; NX and XX can make it a no-op.
+func (db *LuminaDB) PutWithOptions(key, value string, opts SetOptions) (bool, error) {
+	_, exists := db.lookup(key)
+	if (opts.NX && exists) || (opts.XX && !exists) {
+		return false, nil
+	}
+
+	var err error
+	if opts.ExpireAt > 0 {
+		err = db.logger.LogSetExpire(key, value, opts.ExpireAt)
+	} else {
+		err = db.logger.LogSet(key, value)
 	}
+	if err != nil {
+		return false, fmt.Errorf("Failed to log to disk: %w", err)
+	}
+
 	db.store.Set(key, value)
-	return nil
+	if opts.ExpireAt > 0 {
+		db.store.SetExpire(key, opts.ExpireAt)
+	}
+	return true, nil
 }
 
-func (db *LuminaDB) Get(key string) (string, error) {
-	return db.store.Get(key), nil
+// Get returns the string at key and whether the key exists.
+func (db *LuminaDB) Get(key string) (string, bool, error) {
+	return db.lookupString(key)
 }
 
 // Delete removes from Disk then Memory
@@ -70,17 +226,82 @@ func (db *LuminaDB) Delete(key string) error {
 	}
 
 	db.store.Delete(key)
+	db.touchKey(key)
+	return nil
+}
+
+// Expire sets the deadline of key to at (unix milliseconds). A deadline in
+// the past deletes the key straight away. It reports false if the key
+// does not exist.
+func (db *LuminaDB) Expire(key string, at int64) (bool, error) {
+	if _, ok := db.lookup(key); !ok {
+		return false, nil
+	}
+
+	if at <= nowMillis() {
+		return true, db.Delete(key)
+	}
+
+	if err := db.logger.LogExpireAt(key, at); err != nil {
+		return false, fmt.Errorf("failed to log expire: %w", err)
+	}
+	db.store.SetExpire(key, at)
+	return true, nil
+}
+
+// Persist removes the deadline of key. It reports false if the key does
+// not exist or had no deadline.
+func (db *LuminaDB) Persist(key string) (bool, error) {
+	if _, ok := db.lookup(key); !ok {
+		return false, nil
+	}
+	if _, ok := db.store.deadline(key); !ok {
+		return false, nil
+	}
+	if err := db.logger.LogPersist(key); err != nil {
+		return false, fmt.Errorf("failed to log persist: %w", err)
+	}
+	db.store.Persist(key)
+	return true, nil
+}
+
+// PTTL returns the remaining time to live of key in milliseconds, -1 if
+// the key has no deadline and -2 if it does not exist.
+func (db *LuminaDB) PTTL(key string) int64 {
+	if _, ok := db.lookup(key); !ok {
+		return -2
+	}
+	at, ok := db.store.deadline(key)
+	if !ok {
+		return -1
+	}
+	return max(at-nowMillis(), 1)
+}
+
+// expireIfNeeded deletes key if its deadline has passed. The delete is
+// logged like any other so replaying the log gives the same result.
+// Callers hold the key's shard for writing.
+//
+// A replica leaves expired keys to the DEL its primary sends; lookup
+// already hides them.
+func (db *LuminaDB) expireIfNeeded(key string) error {
+	if !db.store.expired(key, nowMillis()) || db.isReplica() {
+		return nil
+	}
+	if err := db.logger.LogDelete(key); err != nil {
+		return fmt.Errorf("failed to log expiry: %w", err)
+	}
+	db.store.Delete(key)
+	db.stats.expiredKeys.Add(1)
 	return nil
 }
 
 func (db *LuminaDB) Close() error {
+	close(db.quit)
+	db.bg.Wait()
 	return db.logger.Close()
 }
 
-// func (l *Logger) LogSet(key, value string) error {
-// 	l.mu.Lock()
-// 	defer l.mu.Unlock()
-
-//		_, err := l.file.WriteString("SET " + key + " " + value + "\n")
-//		return err
-//	}
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"iter"
+	"math/rand/v2"
+)
+
+// With maxmemory set, LuminaDB works as a bounded cache: before a command
+// that may add data runs, keys are evicted until the keyspace fits again,
+// or under noeviction the command is refused with an OOM error.
+//
+// Memory is accounted per key, approximately: every entry knows roughly
+// how many bytes its key and value take, and each shard adds up its
+// entries. Large containers are sized from a sample of their elements, so
+// a write costs the same whatever the size of the value.
+//
+// Eviction is sampled like in Redis. Each round visits up to
+// maxmemory-samples shards in random order, skipping those without keys
+// the policy may evict, looks at maxmemory-samples keys of each (all of
+// them, or the ones with a deadline for the volatile policies) and evicts
+// the best candidate of all. Drawing from several shards keeps a shard
+// that happens to hold only poor candidates, such as far deadlines under
+// volatile-ttl, from deciding the round alone. An eviction is logged as a DEL, so replaying the log or
+// following the replication stream ends with the same keys; replicas
+// don't evict on their own and wait for those DELs instead.
+
+const (
+	defaultEvictionSamples = 5
+
+	entryOverhead     = 96 // map slot, entry and string headers of a key
+	containerOverhead = 48
+	sizeSamples       = 32 // containers with more elements are sized from this many
+
+	// Per element of a container, on top of its strings.
+	hashFieldOverhead  = 32
+	setMemberOverhead  = 16
+	listItemOverhead   = 16
+	zsetMemberOverhead = 80 // map slot, skiplist node and its levels
+
+	lfuInit      = 5  // counter of a new key, so it isn't the first to go
+	lfuLogFactor = 10 // the higher, the more accesses a counter increment takes
+	lfuDecayTime = 1  // minutes for the counter to drop by one while unused
+)
+
+const errOOM respError = "OOM command not allowed when used memory > 'maxmemory'."
+
+// evictionPolicy picks which keys go once maxmemory is reached, like
+// Redis' maxmemory-policy.
+type evictionPolicy int
+
+const (
+	noEviction    evictionPolicy = iota // refuse commands that add data
+	allKeysLRU                          // least recently used key
+	allKeysLFU                          // least frequently used key
+	allKeysRandom                       // any key
+	volatileLRU                         // least recently used key with a deadline
+	volatileTTL                         // key with the nearest deadline
+)
+
+var evictionPolicyNames = []string{"noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-ttl"}
+
+func (p evictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+func parseEvictionPolicy(s string) (evictionPolicy, error) {
+	for i, name := range evictionPolicyNames {
+		if s == name {
+			return evictionPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid maxmemory-policy %q, expected noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru or volatile-ttl", s)
+}
+
+// volatile reports whether the policy only evicts keys with a deadline.
+func (p evictionPolicy) volatile() bool {
+	return p == volatileLRU || p == volatileTTL
+}
+
+func newEntry(now int64) *entry {
+	e := &entry{}
+	e.access.Store(now)
+	e.freq.Store(lfuMinutes(now)<<8 | lfuInit)
+	return e
+}
+
+// touch records an access at now. Readers only hold the shard for reading,
+// hence the atomics; two readers racing may lose an increment, which LFU
+// can live with.
+//
+// freq holds a logarithmic counter in its low 8 bits and the minute it was
+// last updated above them, as in Redis: the counter drops by one for every
+// lfuDecayTime minutes the key went unused, then goes up by one with a
+// probability that shrinks as it grows.
+func (e *entry) touch(now int64) {
+	e.access.Store(now)
+	minutes := lfuMinutes(now)
+	counter := lfuCounter(e.freq.Load(), minutes)
+	if counter < 255 {
+		base := max(int(counter)-lfuInit, 0)
+		if base == 0 || rand.Float64() < 1/float64(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	e.freq.Store(minutes<<8 | counter)
+}
+
+// lfuMinutes returns now in minutes, wrapped to the 24 bits freq has room for.
+func lfuMinutes(now int64) uint32 {
+	return uint32(now/60000) & (1<<24 - 1)
+}
+
+// lfuCounter returns the counter in freq, decayed to the given minute.
+func lfuCounter(freq, minutes uint32) uint32 {
+	counter, last := freq&0xff, freq>>8
+	periods := ((minutes - last) & (1<<24 - 1)) / lfuDecayTime
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// entrySize estimates the bytes taken by key k holding v.
+func entrySize(k string, v any) int64 {
+	n := entryOverhead + len(k)
+	switch v := v.(type) {
+	case string:
+		n += len(v)
+	case map[string]string:
+		n += containerOverhead + sampledSize(len(v), func(yield func(int) bool) {
+			for f, val := range v {
+				if !yield(len(f) + len(val) + hashFieldOverhead) {
+					return
+				}
+			}
+		})
+	case map[string]struct{}:
+		n += containerOverhead + sampledSize(len(v), func(yield func(int) bool) {
+			for m := range v {
+				if !yield(len(m) + setMemberOverhead) {
+					return
+				}
+			}
+		})
+	case *list:
+		n += containerOverhead + 16*(len(v.buf)-v.n) // unused room in the ring
+		n += sampledSize(v.n, func(yield func(int) bool) {
+			step := max(v.n/sizeSamples, 1)
+			for i := 0; i < v.n; i += step {
+				if !yield(len(v.at(i)) + listItemOverhead) {
+					return
+				}
+			}
+		})
+	case *zset:
+		n += containerOverhead + sampledSize(v.Len(), func(yield func(int) bool) {
+			for m := range v.scores {
+				if !yield(len(m) + zsetMemberOverhead) {
+					return
+				}
+			}
+		})
+	}
+	return int64(n)
+}
+
+// sampledSize adds up the element sizes, stopping after sizeSamples of
+// them and scaling up to all n elements. Maps are walked in random order,
+// so for them the first few make a fair sample.
+func sampledSize(n int, sizes iter.Seq[int]) int {
+	sum, seen := 0, 0
+	for size := range sizes {
+		sum += size
+		if seen++; seen == sizeSamples {
+			break
+		}
+	}
+	if seen == 0 {
+		return 0
+	}
+	return sum * n / seen
+}
+
+// accountCommand resizes the keys of a write command once it has run.
+// Callers hold the shards of the keys for writing.
+func (db *LuminaDB) accountCommand(cmd *command, args []string) {
+	if cmd.firstKey == 0 {
+		return
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.step {
+		db.store.resize(args[i])
+	}
+}
+
+// freeMemory evicts keys until the keyspace fits in maxmemory. It returns
+// errOOM if it can't, because the policy is noeviction or no key is left
+// that the policy may evict. Callers hold no shard.
+func (db *LuminaDB) freeMemory() error {
+	limit := db.maxMemory.Load()
+	if limit == 0 || db.isReplica() {
+		return nil
+	}
+	policy := evictionPolicy(db.evictionPolicy.Load())
+	for db.store.used() > limit {
+		if policy == noEviction {
+			return errOOM
+		}
+		evicted, err := db.evictOne(policy)
+		if err != nil {
+			return err
+		}
+		if !evicted {
+			return errOOM
+		}
+	}
+	return nil
+}
+
+// evictOne evicts the best of a sample of keys drawn from the shards. It
+// reports false when no shard has a key the policy may evict.
+func (db *LuminaDB) evictOne(policy evictionPolicy) (bool, error) {
+	samples := int(db.evictionSamples.Load())
+	now := nowMillis()
+	var victim string
+	var best int64
+	found := false
+	consider := func(key string, score int64) {
+		if !found || score > best {
+			victim, best, found = key, score, true
+		}
+	}
+
+	start, visited := rand.IntN(shardCount), 0
+	for i := 0; i < shardCount && visited < samples; i++ {
+		s := &db.store.shards[(start+i)%shardCount]
+		eligible := s.keys.Load()
+		if policy.volatile() {
+			eligible = s.deadlines.Load()
+		}
+		if eligible == 0 {
+			continue
+		}
+		visited++
+		s.mu.RLock()
+		sampleShard(s, policy, samples, now, consider)
+		s.mu.RUnlock()
+	}
+	if !found {
+		return false, nil
+	}
+	return true, db.evict(victim, policy)
+}
+
+// sampleShard passes up to samples of the keys of s the policy may evict to
+// consider, scored so that the higher a key scores, the sooner the policy
+// wants it gone. Callers hold s for reading.
+func sampleShard(s *shard, policy evictionPolicy, samples int, now int64, consider func(key string, score int64)) {
+	sampled := 0
+	if policy.volatile() {
+		for key, at := range s.expires {
+			if policy == volatileTTL {
+				consider(key, -at) // the nearest deadline scores highest
+			} else {
+				consider(key, now-s.value[key].access.Load())
+			}
+			if sampled++; sampled == samples {
+				return
+			}
+		}
+		return
+	}
+	for key, e := range s.value {
+		switch policy {
+		case allKeysLRU:
+			consider(key, now-e.access.Load())
+		case allKeysLFU:
+			consider(key, 255-int64(lfuCounter(e.freq.Load(), lfuMinutes(now))))
+		default:
+			consider(key, 0)
+		}
+		if sampled++; sampled == samples {
+			return
+		}
+	}
+}
+
+// evict deletes key, chosen by evictOne, and logs it as a DEL. The shard
+// was let go in between, so a key that was deleted meanwhile, or under a
+// volatile policy lost its deadline, is left alone; the caller's next
+// round picks another.
+func (db *LuminaDB) evict(key string, policy evictionPolicy) error {
+	shards := shardsOf(key)
+	db.store.lock(shards)
+	defer db.store.unlock(shards)
+	if !db.store.has(key) {
+		return nil
+	}
+	if _, ok := db.store.deadline(key); policy.volatile() && !ok {
+		return nil
+	}
+
+	if err := db.logger.LogDelete(key); err != nil {
+		return fmt.Errorf("failed to log eviction: %w", err)
+	}
+	db.store.Delete(key)
+	db.touchKey(key)
+	db.stats.evictedKeys.Add(1)
+	return nil
+}
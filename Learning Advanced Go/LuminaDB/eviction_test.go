@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const evictionKeys = 100
+
+// fillForEviction starts a server under policy and fills it with
+// evictionKeys keys, k:0 to k:99; with volatile, the even ones get a
+// deadline, nearer for the lower i. score then sets up each entry so that,
+// of the keys the policy may evict, the lower i is the sooner it should
+// go. maxmemory-samples is at its highest, more than any shard holds, so
+// the order is exact.
+func fillForEviction(t *testing.T, policy string, volatile bool, score func(i int, e *entry)) (*LuminaDB, *testConn) {
+	t.Helper()
+	db, addr := startServer(t)
+	c := dial(t, addr)
+	c.do("CONFIG", "SET", "maxmemory-policy", policy)
+	c.do("CONFIG", "SET", "maxmemory-samples", "64")
+	value := strings.Repeat("v", 100)
+	for i := range evictionKeys {
+		args := []string{"SET", fmt.Sprint("k:", i), value}
+		if volatile && i%2 == 0 {
+			args = append(args, "PX", strconv.Itoa(1e9+i*1000))
+		}
+		c.do(args...)
+	}
+	if score != nil {
+		db.store.rlock(allShards)
+		for i := range evictionKeys {
+			score(i, db.store.entry(fmt.Sprint("k:", i)))
+		}
+		db.store.runlock(allShards)
+	}
+	return db, c
+}
+
+// squeeze sets maxmemory a tenth below what the keys use and runs a write,
+// which evicts to make room. It returns the reply to the write.
+func squeeze(t *testing.T, db *LuminaDB, c *testConn) (string, int64) {
+	t.Helper()
+	limit := db.store.used() * 9 / 10
+	if got := c.do("CONFIG", "SET", "maxmemory", strconv.FormatInt(limit, 10)); got != "+OK\r\n" {
+		t.Fatalf("CONFIG SET maxmemory = %q", got)
+	}
+	return c.do("SET", "new", "x"), limit
+}
+
+// remaining reports which of the keys are still there.
+func remaining(db *LuminaDB) []bool {
+	db.store.rlock(allShards)
+	defer db.store.runlock(allShards)
+	kept := make([]bool, evictionKeys)
+	for i := range kept {
+		kept[i] = db.store.has(fmt.Sprint("k:", i))
+	}
+	return kept
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	now := nowMillis()
+	tests := []struct {
+		policy   string
+		volatile bool // only the even keys have a deadline and may go
+		ordered  bool // keys go in order, lowest i first
+		score    func(i int, e *entry)
+	}{
+		{"allkeys-lru", false, true, func(i int, e *entry) { e.access.Store(now - int64(evictionKeys-i)*1000) }},
+		{"allkeys-lfu", false, true, func(i int, e *entry) { e.freq.Store(lfuMinutes(now)<<8 | uint32(i+1)) }},
+		{"allkeys-random", false, false, nil},
+		{"volatile-lru", true, true, func(i int, e *entry) { e.access.Store(now - int64(evictionKeys-i)*1000) }},
+		{"volatile-ttl", true, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			db, c := fillForEviction(t, tt.policy, tt.volatile, tt.score)
+			got, limit := squeeze(t, db, c)
+			if got != "+OK\r\n" {
+				t.Fatalf("SET past maxmemory = %q, want room made for it", got)
+			}
+			// Room is made before the write, which may then go over.
+			if used := db.store.used() - entrySize("new", "x"); used > limit {
+				t.Errorf("%d bytes used after evicting, over maxmemory %d", used, limit)
+			}
+
+			kept := remaining(db)
+			evicted, lastEvicted, firstKept := 0, -1, evictionKeys
+			for i, ok := range kept {
+				switch {
+				case tt.volatile && i%2 == 1:
+					if !ok {
+						t.Errorf("k:%d, which has no deadline, was evicted", i)
+					}
+				case ok:
+					firstKept = min(firstKept, i)
+				default:
+					evicted++
+					lastEvicted = i
+				}
+			}
+			if evicted == 0 {
+				t.Fatal("nothing was evicted")
+			}
+			if tt.ordered && lastEvicted > firstKept {
+				t.Errorf("k:%d was evicted before k:%d", lastEvicted, firstKept)
+			}
+			if got := c.do("INFO", "stats"); !strings.Contains(got, "evicted_keys:"+strconv.Itoa(evicted)+"\r\n") {
+				t.Errorf("INFO stats doesn't count %d evicted keys:\n%s", evicted, got)
+			}
+
+			// Evictions are logged as deletes, so a restart finds the
+			// same keys.
+			r := reopen(t, db)
+			if got := remaining(r); fmt.Sprint(got) != fmt.Sprint(kept) {
+				t.Errorf("after Recover the keys kept are\n%v\nwant\n%v", got, kept)
+			}
+		})
+	}
+}
+
+// Under noeviction writes that add data are refused once maxmemory is
+// reached, and so are they under a volatile policy with no key that has a
+// deadline. Reads and deletes still run.
+func TestEvictionOOM(t *testing.T) {
+	for _, policy := range []string{"noeviction", "volatile-lru", "volatile-ttl"} {
+		t.Run(policy, func(t *testing.T) {
+			db, c := fillForEviction(t, policy, false, nil)
+			if got, _ := squeeze(t, db, c); got != "-"+string(errOOM)+"\r\n" {
+				t.Errorf("SET past maxmemory = %q, want the OOM error", got)
+			}
+			for _, args := range [][]string{{"RPUSH", "l", "a"}, {"HSET", "h", "f", "v"}} {
+				if got := c.do(args...); got != "-"+string(errOOM)+"\r\n" {
+					t.Errorf("%q past maxmemory = %q, want the OOM error", args, got)
+				}
+			}
+			for i, ok := range remaining(db) {
+				if !ok {
+					t.Fatalf("k:%d was evicted", i)
+				}
+			}
+			if got := c.do("GET", "k:1"); !strings.HasPrefix(got, "$100\r\n") {
+				t.Errorf("GET past maxmemory = %q", got)
+			}
+			if got := c.do("DEL", "k:1"); got != ":1\r\n" {
+				t.Errorf("DEL past maxmemory = %q", got)
+			}
+		})
+	}
+}
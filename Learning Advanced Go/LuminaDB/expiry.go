@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	sweepInterval    = 100 * time.Millisecond
+	sweepSampleSize  = 20
+	sweepRepeatRatio = 4 // sample again while more than 1/4 of the sample was expired
+)
+
+// StartExpirySweeper runs the active expiry cycle in the background. Keys
+// that are never read again would otherwise sit in memory forever. It also
+// deletes the expired keys readers come across, since they only hold
+// their shard for reading.
+func (db *LuminaDB) StartExpirySweeper() {
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-db.quit:
+				return
+			case key := <-db.expireQueue:
+				shards := shardsOf(key)
+				db.store.lock(shards)
+				if err := db.expireIfNeeded(key); err != nil {
+					fmt.Printf("Error logging expired key: %v\n", err)
+				}
+				db.store.unlock(shards)
+			case <-ticker.C:
+				for i := range db.store.shards {
+					for db.sweepExpired(i) > sweepSampleSize/sweepRepeatRatio {
+						// most of the sample was expired, so there are likely more
+					}
+				}
+			}
+		}
+	}()
+}
+
+// sweepExpired samples keys with a deadline in shard i and deletes the
+// expired ones, returning how many it removed. Map iteration order is
+// random, so ranging over the first few entries is a cheap sample.
+func (db *LuminaDB) sweepExpired(i int) int {
+	s := &db.store.shards[i]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := nowMillis()
+	var expired []string
+	sampled := 0
+	for key, at := range s.expires {
+		if at <= now {
+			expired = append(expired, key)
+		}
+		sampled++
+		if sampled == sweepSampleSize {
+			break
+		}
+	}
+
+	for _, key := range expired {
+		if err := db.expireIfNeeded(key); err != nil {
+			fmt.Printf("Error logging expired key: %v\n", err)
+			return 0
+		}
+	}
+	return len(expired)
+}
+
+// deadlineAfter returns the deadline in unix milliseconds n units after
+// base, unit being 1000 for seconds and 1 for milliseconds. It reports
+// false if the deadline doesn't fit in an int64, which would otherwise wrap
+// around into the past and delete the key.
+func deadlineAfter(base, n, unit int64) (int64, bool) {
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return 0, false
+	}
+	n *= unit
+	if (n > 0 && base > math.MaxInt64-n) || (n < 0 && base < math.MinInt64-n) {
+		return 0, false
+	}
+	return base + n, true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestDeadlineAfter(t *testing.T) {
+	const now = 1_700_000_000_000
+	tests := []struct {
+		base, n, unit int64
+		want          int64
+		ok            bool
+	}{
+		{now, 10, 1000, now + 10_000, true},
+		{now, 10, 1, now + 10, true},
+		{now, -5, 1000, now - 5000, true},
+		{0, 1_700_000_000, 1000, now, true},
+		{now, math.MaxInt64, 1000, 0, false},
+		{now, math.MaxInt64 / 1000, 1000, 0, false}, // fits once multiplied, not once added
+		{now, math.MaxInt64, 1, 0, false},
+		{0, math.MaxInt64, 1000, 0, false},
+		{now, math.MinInt64, 1000, 0, false},
+		{now, math.MinInt64 / 1000, 1000, now + math.MinInt64/1000*1000, true},
+		{0, math.MaxInt64, 1, math.MaxInt64, true},
+	}
+	for _, tt := range tests {
+		got, ok := deadlineAfter(tt.base, tt.n, tt.unit)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("deadlineAfter(%d, %d, %d) = %d, %v; want %d, %v", tt.base, tt.n, tt.unit, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// A deadline too far away is refused, not wrapped into the past where it
+// would delete the key.
+func TestExpireOverflow(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+	huge := strconv.FormatInt(math.MaxInt64, 10)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EXPIRE", "k", huge}, "-ERR invalid expire time in 'expire' command\r\n"},
+		{[]string{"PEXPIRE", "k", huge}, "-ERR invalid expire time in 'pexpire' command\r\n"},
+		{[]string{"EXPIREAT", "k", huge}, "-ERR invalid expire time in 'expireat' command\r\n"},
+		{[]string{"EXPIRE", "k", strconv.FormatInt(math.MinInt64, 10)}, "-ERR invalid expire time in 'expire' command\r\n"},
+		{[]string{"SET", "k", "v", "EX", huge}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "k", "v", "PX", huge}, "-ERR invalid expire time in 'set' command\r\n"},
+	}
+	c.do("SET", "k", "v")
+	for _, tt := range tests {
+		if got := c.do(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+		if got := c.do("GET", "k"); got != "$1\r\nv\r\n" {
+			t.Fatalf("after %v: GET k = %q, want v", tt.args, got)
+		}
+		if got := c.do("TTL", "k"); got != ":-1\r\n" {
+			t.Errorf("after %v: TTL k = %q, want -1", tt.args, got)
+		}
+	}
+
+	// The largest deadline that fits is kept.
+	if got := c.do("EXPIRE", "k", strconv.FormatInt(math.MaxInt64/1000-nowMillis()/1000-1, 10)); got != ":1\r\n" {
+		t.Errorf("EXPIRE k <max> = %q, want 1", got)
+	}
+	if got := c.do("EXISTS", "k"); got != ":1\r\n" {
+		t.Errorf("EXISTS k = %q after the largest EXPIRE, want 1", got)
+	}
+}
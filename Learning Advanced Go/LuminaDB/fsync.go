@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// fsyncPolicy decides when the log is flushed to disk, trading durability
+// for write throughput like Redis' appendfsync.
+type fsyncPolicy int
+
+const (
+	fsyncAlways   fsyncPolicy = iota // before a write is acknowledged
+	fsyncEverySec                    // once a second in the background
+	fsyncNo                          // whenever the OS gets round to it
+)
+
+func (p fsyncPolicy) String() string {
+	switch p {
+	case fsyncAlways:
+		return "always"
+	case fsyncEverySec:
+		return "everysec"
+	default:
+		return "no"
+	}
+}
+
+func parseFsyncPolicy(s string) (fsyncPolicy, error) {
+	switch s {
+	case "always":
+		return fsyncAlways, nil
+	case "everysec":
+		return fsyncEverySec, nil
+	case "no":
+		return fsyncNo, nil
+	}
+	return 0, fmt.Errorf("invalid appendfsync %q, expected always, everysec or no", s)
+}
+
+// SetFsyncPolicy changes the policy of a running logger.
+func (l *Logger) SetFsyncPolicy(p fsyncPolicy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policy = p
+}
+
+// WaitDurable blocks until every frame written so far is on disk when the
+// policy is always. Writers call it after releasing their shards, so
+// while one fsync runs the next writers queue up behind it and share the
+// following one (group commit) instead of paying for a sync each.
+func (l *Logger) WaitDurable() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.policy != fsyncAlways {
+		return nil
+	}
+	return l.syncTo(l.written)
+}
+
+// syncTo fsyncs until at least target bytes are durable. Callers hold
+// l.mu, which is released while the fsync itself runs.
+func (l *Logger) syncTo(target int64) error {
+	for l.durable < target {
+		if l.syncing {
+			l.syncDone.Wait()
+			continue
+		}
+
+		l.syncing = true
+		upto := l.written
+		f := l.file
+		l.mu.Unlock()
+		err := f.Sync()
+		l.mu.Lock()
+		l.syncing = false
+		l.syncDone.Broadcast()
+
+		// A rewrite may have swapped and closed f meanwhile; it syncs the
+		// new file itself, so only fail if that did not cover us.
+		if err != nil && l.durable < upto {
+			return err
+		}
+		l.fsyncs++
+		if upto > l.durable {
+			l.durable = upto
+		}
+	}
+	return nil
+}
+
+// syncPending fsyncs whatever has been written since the last sync.
+func (l *Logger) syncPending() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncTo(l.written)
+}
+
+// StartLogSync flushes the log once a second under the everysec policy.
+func (db *LuminaDB) StartLogSync() {
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-db.quit:
+				return
+			case <-ticker.C:
+				db.logger.mu.Lock()
+				everysec := db.logger.policy == fsyncEverySec
+				db.logger.mu.Unlock()
+				if !everysec {
+					continue
+				}
+				if err := db.logger.syncPending(); err != nil {
+					fmt.Printf("Error syncing log: %v\n", err)
+				}
+			}
+		}
+	}()
+}
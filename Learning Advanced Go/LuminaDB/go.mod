@@ -0,0 +1,3 @@
+module LuminaDB
+
+go 1.25.0
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// HSet sets fields of the hash at k, creating it if needed; items alternate
+// field and value. Log replay uses it, so nothing is logged; callers hold
+// the shard of k for writing.
+func (d *RWData) HSet(k string, items []string) {
+	h, ok := d.get(k).(map[string]string)
+	if !ok {
+		h = make(map[string]string, len(items)/2)
+		d.put(k, h)
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		h[items[i]] = items[i+1]
+	}
+}
+
+// HDel removes fields of the hash at k, and k itself once it is empty.
+// Callers hold the shard of k for writing.
+func (d *RWData) HDel(k string, fields []string) {
+	h, ok := d.get(k).(map[string]string)
+	if !ok {
+		return
+	}
+	for _, f := range fields {
+		delete(h, f)
+	}
+	if len(h) == 0 {
+		d.Delete(k)
+	}
+}
+
+// hash returns the hash at key, or nil if the key does not exist.
+func (db *LuminaDB) hash(key string) (map[string]string, error) {
+	value, ok := db.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	h, ok := value.(map[string]string)
+	if !ok {
+		return nil, errWrongType
+	}
+	return h, nil
+}
+
+// hashForWrite is hash for commands that modify it. An expired key is
+// deleted first so the new hash does not inherit its deadline. Callers
+// hold the key's shard for writing.
+func (db *LuminaDB) hashForWrite(key string) (map[string]string, error) {
+	if err := db.expireIfNeeded(key); err != nil {
+		return nil, err
+	}
+	return db.hash(key)
+}
+
+// HSet sets the given fields (items alternate field and value) and returns
+// how many of them are new.
+func (db *LuminaDB) HSet(key string, items []string) (int, error) {
+	h, err := db.hashForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.logger.LogHSet(key, items); err != nil {
+		return 0, fmt.Errorf("failed to log hset: %w", err)
+	}
+
+	if h == nil {
+		h = make(map[string]string, len(items)/2)
+		db.store.put(key, h)
+	}
+	added := 0
+	for i := 0; i < len(items); i += 2 {
+		if _, ok := h[items[i]]; !ok {
+			added++
+		}
+		h[items[i]] = items[i+1]
+	}
+	return added, nil
+}
+
+// HDel removes fields and returns how many existed. Removing the last
+// field removes the key.
+func (db *LuminaDB) HDel(key string, fields []string) (int, error) {
+	h, err := db.hashForWrite(key)
+	if err != nil || h == nil {
+		return 0, err
+	}
+
+	var present []string
+	for _, f := range fields {
+		if _, ok := h[f]; ok {
+			present = append(present, f)
+		}
+	}
+	if len(present) == 0 {
+		return 0, nil
+	}
+	if err := db.logger.LogHDel(key, present); err != nil {
+		return 0, fmt.Errorf("failed to log hdel: %w", err)
+	}
+
+	for _, f := range present {
+		delete(h, f)
+	}
+	if len(h) == 0 {
+		db.store.Delete(key)
+	}
+	return len(present), nil
+}
+
+// HIncrBy adds delta to the integer in field, which counts as 0 if it is
+// missing. The result is logged as a plain HSET.
+func (db *LuminaDB) HIncrBy(key, field string, delta int64) (int64, error) {
+	h, err := db.hashForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if s, ok := h[field]; ok {
+		n, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, respError("ERR hash value is not an integer")
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, respError("ERR increment or decrement would overflow")
+	}
+	n += delta
+
+	if _, err := db.HSet(key, []string{field, strconv.FormatInt(n, 10)}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// HIncrByFloat adds delta to the number in field and returns the new value
+// as stored.
+func (db *LuminaDB) HIncrByFloat(key, field string, delta float64) (string, error) {
+	h, err := db.hashForWrite(key)
+	if err != nil {
+		return "", err
+	}
+	var f float64
+	if s, ok := h[field]; ok {
+		f, err = strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) {
+			return "", respError("ERR hash value is not a float")
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", respError("ERR increment would produce NaN or Infinity")
+	}
+
+	s := formatFloat(f)
+	if _, err := db.HSet(key, []string{field, s}); err != nil {
+		return "", err
+	}
+	return s, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "hset", handler: hsetCommand, arity: -4, flags: flagWrite | flagDenyOOM | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hget", handler: hgetCommand, arity: 3, flags: flagReadonly | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hmget", handler: hmgetCommand, arity: -3, flags: flagReadonly | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hdel", handler: hdelCommand, arity: -3, flags: flagWrite | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hexists", handler: hexistsCommand, arity: 3, flags: flagReadonly | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hlen", handler: hlenCommand, arity: 2, flags: flagReadonly | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hkeys", handler: hkeysCommand, arity: 2, flags: flagReadonly, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hvals", handler: hkeysCommand, arity: 2, flags: flagReadonly, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hgetall", handler: hgetallCommand, arity: 2, flags: flagReadonly, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hincrby", handler: hincrbyCommand, arity: 4, flags: flagWrite | flagDenyOOM | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hincrbyfloat", handler: hincrbyfloatCommand, arity: 4, flags: flagWrite | flagDenyOOM | flagFast, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "hscan", handler: hscanCommand, arity: -3, flags: flagReadonly, group: "hash", firstKey: 1, lastKey: 1, step: 1},
+	)
+}
+
+// HSET key field value [field value ...]
+func hsetCommand(c *clientConn, args []string) error {
+	if len(args)%2 != 0 {
+		return errWrongArgs("hset")
+	}
+	added, err := c.db.HSet(args[1], args[2:])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(added))
+	return nil
+}
+
+// HGET key field
+func hgetCommand(c *clientConn, args []string) error {
+	h, err := c.db.hash(args[1])
+	if err != nil {
+		return err
+	}
+	if v, ok := h[args[2]]; ok {
+		c.w.WriteBulk(v)
+	} else {
+		c.w.WriteNull()
+	}
+	return nil
+}
+
+// HMGET key field [field ...]
+func hmgetCommand(c *clientConn, args []string) error {
+	h, err := c.db.hash(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteArrayLen(len(args) - 2)
+	for _, field := range args[2:] {
+		if v, ok := h[field]; ok {
+			c.w.WriteBulk(v)
+		} else {
+			c.w.WriteNull()
+		}
+	}
+	return nil
+}
+
+// HDEL key field [field ...]
+func hdelCommand(c *clientConn, args []string) error {
+	n, err := c.db.HDel(args[1], args[2:])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// HEXISTS key field
+func hexistsCommand(c *clientConn, args []string) error {
+	h, err := c.db.hash(args[1])
+	if err != nil {
+		return err
+	}
+	_, ok := h[args[2]]
+	c.w.WriteInteger(boolInt(ok))
+	return nil
+}
+
+// HLEN key
+func hlenCommand(c *clientConn, args []string) error {
+	h, err := c.db.hash(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(len(h)))
+	return nil
+}
+
+// HKEYS key, HVALS key
+func hkeysCommand(c *clientConn, args []string) error {
+	h, err := c.db.hash(args[1])
+	if err != nil {
+		return err
+	}
+	keys := strings.ToUpper(args[0]) == "HKEYS"
+	c.w.WriteArrayLen(len(h))
+	for field, value := range h {
+		if keys {
+			c.w.WriteBulk(field)
+		} else {
+			c.w.WriteBulk(value)
+		}
+	}
+	return nil
+}
+
+// HGETALL key
+func hgetallCommand(c *clientConn, args []string) error {
+	h, err := c.db.hash(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteMapLen(len(h))
+	for field, value := range h {
+		c.w.WriteBulk(field)
+		c.w.WriteBulk(value)
+	}
+	return nil
+}
+
+// HINCRBY key field increment
+func hincrbyCommand(c *clientConn, args []string) error {
+	delta, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	n, err := c.db.HIncrBy(args[1], args[2], delta)
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(n)
+	return nil
+}
+
+// HINCRBYFLOAT key field increment
+func hincrbyfloatCommand(c *clientConn, args []string) error {
+	delta, err := strconv.ParseFloat(args[3], 64)
+	if err != nil {
+		return respError("ERR value is not a valid float")
+	}
+	s, err := c.db.HIncrByFloat(args[1], args[2], delta)
+	if err != nil {
+		return err
+	}
+	c.w.WriteBulk(s)
+	return nil
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+func hscanCommand(c *clientConn, args []string) error {
+	cursor, opts, err := parseScanArgs(args[2:], false)
+	if err != nil {
+		return err
+	}
+	h, err := c.db.hash(args[1])
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		c.writeScanReply(0, nil)
+		return nil
+	}
+	fields, next := c.db.scanMembers(args[1], func() []string {
+		fields := make([]string, 0, len(h))
+		for f := range h {
+			fields = append(fields, f)
+		}
+		return fields
+	}, cursor, opts)
+	items := make([]string, 0, 2*len(fields))
+	for _, f := range fields {
+		items = append(items, f, h[f])
+	}
+	c.writeScanReply(next, items)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "info", handler: infoCommand, arity: -1, group: "server"},
+	)
+}
+
+// infoSection writes one section of INFO as field:value lines.
+type infoSection struct {
+	name  string
+	write func(db *LuminaDB, b *strings.Builder)
+	extra bool // only sent when asked for by name or with "all"
+}
+
+var infoSections = []infoSection{
+	{"server", (*LuminaDB).writeServerInfo, false},
+	{"clients", (*LuminaDB).writeClientsInfo, false},
+	{"memory", (*LuminaDB).writeMemoryInfo, false},
+	{"persistence", (*LuminaDB).writePersistenceInfo, false},
+	{"stats", (*LuminaDB).writeStatsInfo, false},
+	{"replication", (*LuminaDB).writeReplicationInfo, false},
+	{"commandstats", (*LuminaDB).writeCommandStats, true},
+	{"keyspace", (*LuminaDB).writeKeyspaceInfo, false},
+}
+
+// INFO [section ...]
+//
+// Without a section, or with "default", every section but commandstats is
+// sent; "all" or "everything" sends them all.
+func infoCommand(c *clientConn, args []string) error {
+	want := make(map[string]bool)
+	for _, arg := range args[1:] {
+		want[strings.ToLower(arg)] = true
+	}
+	all := want["all"] || want["everything"]
+	if len(want) == 0 || want["default"] {
+		for _, s := range infoSections {
+			want[s.name] = want[s.name] || !s.extra
+		}
+	}
+
+	var b strings.Builder
+	for _, s := range infoSections {
+		if !all && !want[s.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(s.name[:1]), s.name[1:])
+		s.write(c.db, &b)
+	}
+	c.w.WriteVerbatim(b.String())
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "del", handler: delCommand, arity: -2, flags: flagWrite, group: "keyspace", firstKey: 1, lastKey: -1, step: 1},
+		&command{name: "exists", handler: existsCommand, arity: -2, flags: flagReadonly | flagFast, group: "keyspace", firstKey: 1, lastKey: -1, step: 1},
+		&command{name: "expire", handler: expireCommand, arity: 3, flags: flagWrite | flagFast, group: "keyspace", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "pexpire", handler: expireCommand, arity: 3, flags: flagWrite | flagFast, group: "keyspace", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "expireat", handler: expireCommand, arity: 3, flags: flagWrite | flagFast, group: "keyspace", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "ttl", handler: ttlCommand, arity: 2, flags: flagReadonly | flagFast, group: "keyspace", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "pttl", handler: ttlCommand, arity: 2, flags: flagReadonly | flagFast, group: "keyspace", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "persist", handler: persistCommand, arity: 2, flags: flagWrite | flagFast, group: "keyspace", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "type", handler: typeCommand, arity: 2, flags: flagReadonly | flagFast, group: "keyspace", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "keys", handler: keysCommand, arity: 2, flags: flagReadonly, group: "keyspace"},
+		&command{name: "scan", handler: scanCommand, arity: -2, flags: flagReadonly, group: "keyspace"},
+		&command{name: "dbsize", handler: dbsizeCommand, arity: 1, flags: flagReadonly | flagFast, group: "keyspace"},
+		&command{name: "flushall", handler: flushallCommand, arity: 1, flags: flagWrite, group: "keyspace"},
+	)
+}
+
+// DEL key [key ...]
+func delCommand(c *clientConn, args []string) error {
+	n, err := c.db.Del(args[1:])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// EXISTS key [key ...]
+//
+// A key named more than once is counted each time.
+func existsCommand(c *clientConn, args []string) error {
+	n := int64(0)
+	for _, key := range args[1:] {
+		n += boolInt(c.db.Exists(key))
+	}
+	c.w.WriteInteger(n)
+	return nil
+}
+
+// EXPIRE key seconds, PEXPIRE key milliseconds, EXPIREAT key unix-seconds
+func expireCommand(c *clientConn, args []string) error {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	var at int64
+	var valid bool
+	switch strings.ToUpper(args[0]) {
+	case "EXPIRE":
+		at, valid = deadlineAfter(nowMillis(), n, 1000)
+	case "PEXPIRE":
+		at, valid = deadlineAfter(nowMillis(), n, 1)
+	case "EXPIREAT":
+		at, valid = deadlineAfter(0, n, 1000)
+	}
+	if !valid {
+		return respError("ERR invalid expire time in '" + strings.ToLower(args[0]) + "' command")
+	}
+	ok, err := c.db.Expire(args[1], at)
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(boolInt(ok))
+	return nil
+}
+
+// TTL key, PTTL key
+func ttlCommand(c *clientConn, args []string) error {
+	ttl := c.db.PTTL(args[1])
+	if strings.ToUpper(args[0]) == "TTL" && ttl > 0 {
+		ttl = (ttl + 500) / 1000
+	}
+	c.w.WriteInteger(ttl)
+	return nil
+}
+
+// PERSIST key
+func persistCommand(c *clientConn, args []string) error {
+	ok, err := c.db.Persist(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(boolInt(ok))
+	return nil
+}
+
+// TYPE key
+func typeCommand(c *clientConn, args []string) error {
+	c.w.WriteSimpleString(c.db.Type(args[1]))
+	return nil
+}
+
+// KEYS pattern
+//
+// KEYS walks the whole keyspace with every shard read-locked; SCAN is the
+// way to list a large one, a few keys per call, so writers only ever wait
+// for a batch.
+func keysCommand(c *clientConn, args []string) error {
+	opts := scanOptions{match: args[1]}
+	var keys []string
+	for i := range c.db.store.shards {
+		for k := range c.db.store.shards[i].value {
+			if _, ok := c.db.peek(k); ok && opts.matches(k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	c.w.WriteBulks(keys)
+	return nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+//
+// COUNT is how many keys to look at, so a call may return fewer, or none
+// when MATCH or TYPE filter them out.
+func scanCommand(c *clientConn, args []string) error {
+	cursor, opts, err := parseScanArgs(args[1:], true)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	shard, pos := int(cursor>>scanPosBits), cursor&scanPosMax
+	for left := opts.count; left > 0 && shard < shardCount; {
+		batch, next := scanBatch(c.db.scanKeys(shard, pos == 0), pos, left)
+		left -= len(batch)
+		for _, e := range batch {
+			v, ok := c.db.peek(e.key)
+			if !ok || !opts.matches(e.key) || (opts.typ != "" && typeNames[valueType(v)] != opts.typ) {
+				continue
+			}
+			keys = append(keys, e.key)
+		}
+		if next != 0 {
+			pos = next
+			break
+		}
+		shard, pos = shard+1, 0
+	}
+	var next uint64
+	if shard < shardCount {
+		next = uint64(shard)<<scanPosBits | pos
+	}
+	c.writeScanReply(next, keys)
+	return nil
+}
+
+// DBSIZE
+func dbsizeCommand(c *clientConn, args []string) error {
+	c.w.WriteInteger(int64(c.db.Size()))
+	return nil
+}
+
+// FLUSHALL
+func flushallCommand(c *clientConn, args []string) error {
+	c.db.FLUSHALL()
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+func boolInt(ok bool) int64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
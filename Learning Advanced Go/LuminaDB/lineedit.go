@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// lineEditor reads the interactive client's commands with line editing
+// and history: the arrow keys and the usual Emacs keys move through the
+// line and through earlier commands, which are kept in a history file
+// between sessions.
+//
+// The terminal is switched to raw mode with stty while a line is read and
+// back afterwards, so Ctrl-C still works while a command runs. Where stty
+// is missing, lines are read as typed. Long lines that wrap are redrawn
+// badly, as the editor doesn't know the terminal's width.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      *bufio.Writer
+	history  []string // oldest first
+	histFile string
+}
+
+// historyMax is how many commands the history keeps.
+const historyMax = 1000
+
+var errInterrupted = errors.New("interrupted")
+
+func newLineEditor(histFile string) *lineEditor {
+	e := &lineEditor{
+		in:       bufio.NewReader(os.Stdin),
+		out:      bufio.NewWriter(os.Stdout),
+		histFile: histFile,
+	}
+	e.loadHistory()
+	return e
+}
+
+// loadHistory reads the history file, trimming it to historyMax lines.
+func (e *lineEditor) loadHistory() {
+	if e.histFile == "" {
+		return
+	}
+	data, err := os.ReadFile(e.histFile)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) > historyMax {
+		lines = lines[len(lines)-historyMax:]
+		os.WriteFile(e.histFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	e.history = lines
+}
+
+// addHistory records line, unless it repeats the one before, and appends
+// it to the history file.
+func (e *lineEditor) addHistory(line string) {
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > historyMax {
+		e.history = e.history[1:]
+	}
+	if e.histFile == "" {
+		return
+	}
+	f, err := os.OpenFile(e.histFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	f.WriteString(line + "\n")
+	f.Close()
+}
+
+// readLine shows prompt and reads a line. It returns io.EOF at the end of
+// the input or on Ctrl-D, and errInterrupted on Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if saved, err := stty("-g"); err == nil {
+		if _, err := stty("-icanon", "-echo", "-isig", "-ixon", "min", "1"); err == nil {
+			defer stty(saved)
+			return e.edit(prompt)
+		}
+	}
+	fmt.Print(prompt)
+	line, err := e.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// edit reads a line from a terminal in raw mode, echoing and redrawing it
+// as it is edited.
+func (e *lineEditor) edit(prompt string) (string, error) {
+	var buf []rune
+	pos := 0
+	hist := len(e.history) // the entry shown; len(history) for the new line
+	var typed []rune       // the new line, kept while browsing the history
+
+	refresh := func() {
+		e.out.WriteString("\r" + prompt + string(buf) + "\x1b[K")
+		if n := len(buf) - pos; n > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", n)
+		}
+		e.out.Flush()
+	}
+	show := func(i int) {
+		if i < 0 || i > len(e.history) {
+			return
+		}
+		if hist == len(e.history) {
+			typed = buf
+		}
+		hist = i
+		if i == len(e.history) {
+			buf = typed
+		} else {
+			buf = []rune(e.history[i])
+		}
+		pos = len(buf)
+	}
+	done := func(s string) {
+		e.out.WriteString(s)
+		e.out.Flush()
+	}
+
+	refresh()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			done("\r\n")
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			done("\r\n")
+			return string(buf), nil
+		case ctrl('C'):
+			done("^C\r\n")
+			return "", errInterrupted
+		case ctrl('D'):
+			if len(buf) == 0 {
+				done("\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = slices.Delete(buf, pos, pos+1)
+			}
+		case 0x7f, ctrl('H'):
+			if pos > 0 {
+				buf = slices.Delete(buf, pos-1, pos)
+				pos--
+			}
+		case ctrl('A'):
+			pos = 0
+		case ctrl('E'):
+			pos = len(buf)
+		case ctrl('B'):
+			pos = max(pos-1, 0)
+		case ctrl('F'):
+			pos = min(pos+1, len(buf))
+		case ctrl('K'):
+			buf = buf[:pos]
+		case ctrl('U'):
+			buf = slices.Clone(buf[pos:])
+			pos = 0
+		case ctrl('W'):
+			i := pos
+			for i > 0 && buf[i-1] == ' ' {
+				i--
+			}
+			for i > 0 && buf[i-1] != ' ' {
+				i--
+			}
+			buf = slices.Delete(buf, i, pos)
+			pos = i
+		case ctrl('L'):
+			e.out.WriteString("\x1b[H\x1b[2J")
+		case ctrl('P'):
+			show(hist - 1)
+		case ctrl('N'):
+			show(hist + 1)
+		case 0x1b:
+			switch e.escape() {
+			case 'A':
+				show(hist - 1)
+			case 'B':
+				show(hist + 1)
+			case 'C':
+				pos = min(pos+1, len(buf))
+			case 'D':
+				pos = max(pos-1, 0)
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '~': // Delete
+				if pos < len(buf) {
+					buf = slices.Delete(buf, pos, pos+1)
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = slices.Insert(buf, pos, r)
+				pos++
+			}
+		}
+		refresh()
+	}
+}
+
+// escape reads the rest of an escape sequence after ESC and returns the
+// key it stands for: 'A' to 'D' for the arrows, 'H' and 'F' for Home and
+// End, and '~' for Delete. Other sequences return 0.
+func (e *lineEditor) escape() byte {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+	b, err = e.in.ReadByte()
+	if err != nil {
+		return 0
+	}
+	if b < '0' || b > '9' {
+		return b
+	}
+	// ESC [ n ~, as sent by Delete (3), Home (1 or 7) and End (4 or 8).
+	n := b
+	for b >= '0' && b <= '9' {
+		if b, err = e.in.ReadByte(); err != nil {
+			return 0
+		}
+	}
+	if b != '~' {
+		return 0
+	}
+	switch n {
+	case '3':
+		return '~'
+	case '1', '7':
+		return 'H'
+	case '4', '8':
+		return 'F'
+	}
+	return 0
+}
+
+func ctrl(c rune) rune {
+	return c & 0x1f
+}
+
+// stty runs stty on the terminal on stdin and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// list is a double-ended queue of strings in a ring buffer, so pushes and
+// pops at either end are O(1) and indexing is O(1) too.
+type list struct {
+	buf  []string
+	head int // position of the first element in buf
+	n    int
+}
+
+func newList(items []string) *list {
+	l := &list{buf: make([]string, max(len(items), 4)), n: len(items)}
+	copy(l.buf, items)
+	return l
+}
+
+func (l *list) Len() int { return l.n }
+
+func (l *list) at(i int) string {
+	return l.buf[(l.head+i)%len(l.buf)]
+}
+
+// items returns elements start to stop inclusive, which must be in range.
+func (l *list) items(start, stop int) []string {
+	out := make([]string, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		out = append(out, l.at(i))
+	}
+	return out
+}
+
+func (l *list) all() []string {
+	return l.items(0, l.n-1)
+}
+
+// resize moves the elements into a buffer of size c, starting at 0.
+func (l *list) resize(c int) {
+	buf := make([]string, c)
+	for i := 0; i < l.n; i++ {
+		buf[i] = l.at(i)
+	}
+	l.buf, l.head = buf, 0
+}
+
+func (l *list) pushFront(s string) {
+	if l.n == len(l.buf) {
+		l.resize(2 * len(l.buf))
+	}
+	l.head = (l.head - 1 + len(l.buf)) % len(l.buf)
+	l.buf[l.head] = s
+	l.n++
+}
+
+func (l *list) pushBack(s string) {
+	if l.n == len(l.buf) {
+		l.resize(2 * len(l.buf))
+	}
+	l.buf[(l.head+l.n)%len(l.buf)] = s
+	l.n++
+}
+
+func (l *list) popFront() string {
+	s := l.buf[l.head]
+	l.buf[l.head] = ""
+	l.head = (l.head + 1) % len(l.buf)
+	l.n--
+	l.shrink()
+	return s
+}
+
+func (l *list) popBack() string {
+	i := (l.head + l.n - 1) % len(l.buf)
+	s := l.buf[i]
+	l.buf[i] = ""
+	l.n--
+	l.shrink()
+	return s
+}
+
+// shrink gives memory back once a queue that grew large has drained.
+func (l *list) shrink() {
+	if len(l.buf) > 64 && l.n < len(l.buf)/4 {
+		l.resize(len(l.buf) / 2)
+	}
+}
+
+func (l *list) push(left bool, elems []string) {
+	for _, e := range elems {
+		if left {
+			l.pushFront(e)
+		} else {
+			l.pushBack(e)
+		}
+	}
+}
+
+func (l *list) pop(left bool, count int) []string {
+	out := make([]string, 0, min(count, l.n))
+	for len(out) < count && l.n > 0 {
+		if left {
+			out = append(out, l.popFront())
+		} else {
+			out = append(out, l.popBack())
+		}
+	}
+	return out
+}
+
+// trim keeps elements start to stop, with Redis' index rules.
+func (l *list) trim(start, stop int) {
+	start, stop, ok := listRange(start, stop, l.n)
+	if !ok {
+		*l = *newList(nil)
+		return
+	}
+	*l = *newList(l.items(start, stop))
+}
+
+// remove deletes up to count occurrences of elem, from the tail if count is
+// negative and all of them if it is 0, and returns how many went.
+func (l *list) remove(count int, elem string) int {
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	keep := make([]bool, l.n)
+	removed := 0
+	for k := 0; k < l.n; k++ {
+		i := k
+		if count < 0 {
+			i = l.n - 1 - k
+		}
+		if (limit == 0 || removed < limit) && l.at(i) == elem {
+			removed++
+			continue
+		}
+		keep[i] = true
+	}
+	if removed == 0 {
+		return 0
+	}
+	items := make([]string, 0, l.n-removed)
+	for i := 0; i < l.n; i++ {
+		if keep[i] {
+			items = append(items, l.at(i))
+		}
+	}
+	*l = *newList(items)
+	return removed
+}
+
+func (l *list) contains(elem string) bool {
+	for i := 0; i < l.n; i++ {
+		if l.at(i) == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// listRange turns LRANGE style start and stop indexes, which may be
+// negative, into an inclusive range of a list of length n. ok is false
+// when the range is empty.
+func listRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start = max(start, 0)
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, min(stop, n-1), true
+}
+
+func sideName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// applyList replays one logged list action, so nothing is logged. Callers
+// hold the shard of k for writing.
+func (d *RWData) applyList(action byte, k string, args []string) error {
+	l, _ := d.get(k).(*list)
+	if l == nil {
+		if action != actionLPush && action != actionRPush {
+			return nil
+		}
+		l = newList(nil)
+		d.put(k, l)
+	}
+
+	switch action {
+	case actionLPush, actionRPush:
+		l.push(action == actionLPush, args)
+	case actionLPop, actionRPop:
+		count, err := frameInts(args, 1)
+		if err != nil {
+			return err
+		}
+		l.pop(action == actionLPop, count[0])
+	case actionLTrim:
+		r, err := frameInts(args, 2)
+		if err != nil {
+			return err
+		}
+		l.trim(r[0], r[1])
+	case actionLRem:
+		if len(args) != 2 {
+			return fmt.Errorf("LREM frame with %d items", len(args))
+		}
+		count, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		l.remove(count, args[1])
+	case actionLMove:
+		if len(args) != 3 {
+			return fmt.Errorf("LMOVE frame with %d items", len(args))
+		}
+		dst, _ := d.get(args[0]).(*list)
+		if dst == nil {
+			dst = newList(nil)
+			d.put(args[0], dst)
+		}
+		dst.push(args[2] == "LEFT", l.pop(args[1] == "LEFT", 1))
+	}
+
+	if l.Len() == 0 {
+		d.Delete(k)
+	}
+	return nil
+}
+
+func frameInts(args []string, n int) ([]int, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("expected %d numbers, got %d items", n, len(args))
+	}
+	out := make([]int, n)
+	for i, a := range args {
+		v, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// list returns the list at key, or nil if the key does not exist. Empty
+// lists are never stored.
+func (db *LuminaDB) list(key string) (*list, error) {
+	value, ok := db.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	l, ok := value.(*list)
+	if !ok {
+		return nil, errWrongType
+	}
+	return l, nil
+}
+
+// listForWrite is list for commands that modify it; see hashForWrite.
+func (db *LuminaDB) listForWrite(key string) (*list, error) {
+	if err := db.expireIfNeeded(key); err != nil {
+		return nil, err
+	}
+	return db.list(key)
+}
+
+// dropIfEmpty removes key once the list it holds is empty.
+func (db *LuminaDB) dropIfEmpty(key string, l *list) {
+	if l.Len() == 0 {
+		db.store.Delete(key)
+	}
+}
+
+// Push adds elems at the head (left) or tail of the list and returns its
+// new length. Clients blocked on key are served once the command is done.
+func (db *LuminaDB) Push(key string, left bool, elems []string) (int, error) {
+	l, err := db.listForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := db.logger.LogPush(key, left, elems); err != nil {
+		return 0, fmt.Errorf("failed to log push: %w", err)
+	}
+	if l == nil {
+		l = newList(nil)
+		db.store.put(key, l)
+	}
+	l.push(left, elems)
+	db.signalKey(key)
+	return l.Len(), nil
+}
+
+// Pop removes up to count elements from the head (left) or tail of the
+// list. It returns nil if the key does not exist.
+func (db *LuminaDB) Pop(key string, left bool, count int) ([]string, error) {
+	l, err := db.listForWrite(key)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	count = min(count, l.Len())
+	if count == 0 {
+		return []string{}, nil
+	}
+	if err := db.logger.LogPop(key, left, count); err != nil {
+		return nil, fmt.Errorf("failed to log pop: %w", err)
+	}
+	items := l.pop(left, count)
+	db.dropIfEmpty(key, l)
+	return items, nil
+}
+
+// LTrim keeps only elements start to stop of the list.
+func (db *LuminaDB) LTrim(key string, start, stop int) error {
+	l, err := db.listForWrite(key)
+	if err != nil || l == nil {
+		return err
+	}
+	if err := db.logger.LogLTrim(key, start, stop); err != nil {
+		return fmt.Errorf("failed to log ltrim: %w", err)
+	}
+	l.trim(start, stop)
+	db.dropIfEmpty(key, l)
+	return nil
+}
+
+// LRem removes occurrences of elem, see list.remove.
+func (db *LuminaDB) LRem(key string, count int, elem string) (int, error) {
+	l, err := db.listForWrite(key)
+	if err != nil || l == nil {
+		return 0, err
+	}
+	if !l.contains(elem) {
+		return 0, nil
+	}
+	if err := db.logger.LogLRem(key, count, elem); err != nil {
+		return 0, fmt.Errorf("failed to log lrem: %w", err)
+	}
+	removed := l.remove(count, elem)
+	db.dropIfEmpty(key, l)
+	return removed, nil
+}
+
+// LMove pops an element from one end of src and pushes it onto dst, which
+// may be the same list. It reports false if src does not exist. The move
+// is logged as one frame, so a crash can't lose the element in between.
+func (db *LuminaDB) LMove(src, dst string, fromLeft, toLeft bool) (string, bool, error) {
+	from, err := db.listForWrite(src)
+	if err != nil || from == nil {
+		return "", false, err
+	}
+	to, err := db.listForWrite(dst)
+	if err != nil {
+		return "", false, err
+	}
+	if err := db.logger.LogLMove(src, dst, fromLeft, toLeft); err != nil {
+		return "", false, fmt.Errorf("failed to log lmove: %w", err)
+	}
+
+	elem := from.pop(fromLeft, 1)[0]
+	if to == nil {
+		to = newList(nil)
+		db.store.put(dst, to)
+	}
+	to.push(toLeft, []string{elem})
+	db.dropIfEmpty(src, from)
+	db.signalKey(dst)
+	return elem, true, nil
+}
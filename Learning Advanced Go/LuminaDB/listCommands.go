@@ -0,0 +1,267 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "lpush", handler: pushCommand, arity: -3, flags: flagWrite | flagDenyOOM | flagFast, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "rpush", handler: pushCommand, arity: -3, flags: flagWrite | flagDenyOOM | flagFast, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "lpop", handler: popCommand, arity: -2, flags: flagWrite | flagFast, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "rpop", handler: popCommand, arity: -2, flags: flagWrite | flagFast, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "llen", handler: llenCommand, arity: 2, flags: flagReadonly | flagFast, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "lrange", handler: lrangeCommand, arity: 4, flags: flagReadonly, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "lindex", handler: lindexCommand, arity: 3, flags: flagReadonly, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "ltrim", handler: ltrimCommand, arity: 4, flags: flagWrite, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "lrem", handler: lremCommand, arity: 4, flags: flagWrite, group: "list", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "lmove", handler: lmoveCommand, arity: 5, flags: flagWrite | flagDenyOOM, group: "list", firstKey: 1, lastKey: 2, step: 1},
+		&command{name: "blpop", handler: bpopCommand, arity: -3, flags: flagWrite | flagBlocking, group: "list", firstKey: 1, lastKey: -2, step: 1},
+		&command{name: "brpop", handler: bpopCommand, arity: -3, flags: flagWrite | flagBlocking, group: "list", firstKey: 1, lastKey: -2, step: 1},
+		&command{name: "blmove", handler: blmoveCommand, arity: 6, flags: flagWrite | flagDenyOOM | flagBlocking, group: "list", firstKey: 1, lastKey: 2, step: 1},
+	)
+}
+
+// LPUSH key element [element ...], RPUSH key element [element ...]
+func pushCommand(c *clientConn, args []string) error {
+	n, err := c.db.Push(args[1], strings.ToUpper(args[0]) == "LPUSH", args[2:])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// LPOP key [count], RPOP key [count]
+func popCommand(c *clientConn, args []string) error {
+	if len(args) > 3 {
+		return errSyntax
+	}
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return respError("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	items, err := c.db.Pop(args[1], strings.ToUpper(args[0]) == "LPOP", count)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) == 3 && items == nil:
+		c.w.WriteNullArray()
+	case len(args) == 3:
+		c.w.WriteBulks(items)
+	case len(items) == 0:
+		c.w.WriteNull()
+	default:
+		c.w.WriteBulk(items[0])
+	}
+	return nil
+}
+
+// LLEN key
+func llenCommand(c *clientConn, args []string) error {
+	l, err := c.db.list(args[1])
+	if err != nil {
+		return err
+	}
+	n := 0
+	if l != nil {
+		n = l.Len()
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// LRANGE key start stop
+func lrangeCommand(c *clientConn, args []string) error {
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return errNotInteger
+	}
+	l, err := c.db.list(args[1])
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		c.w.WriteArrayLen(0)
+		return nil
+	}
+	start, stop, ok := listRange(start, stop, l.Len())
+	if !ok {
+		c.w.WriteArrayLen(0)
+		return nil
+	}
+	c.w.WriteBulks(l.items(start, stop))
+	return nil
+}
+
+// LINDEX key index
+func lindexCommand(c *clientConn, args []string) error {
+	i, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInteger
+	}
+	l, err := c.db.list(args[1])
+	if err != nil {
+		return err
+	}
+	if l != nil && i < 0 {
+		i += l.Len()
+	}
+	if l == nil || i < 0 || i >= l.Len() {
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteBulk(l.at(i))
+	return nil
+}
+
+// LTRIM key start stop
+func ltrimCommand(c *clientConn, args []string) error {
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return errNotInteger
+	}
+	if err := c.db.LTrim(args[1], start, stop); err != nil {
+		return err
+	}
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// LREM key count element
+func lremCommand(c *clientConn, args []string) error {
+	count, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInteger
+	}
+	n, err := c.db.LRem(args[1], count, args[3])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmoveCommand(c *clientConn, args []string) error {
+	fromLeft, toLeft, err := parseMoveSides(args[3], args[4])
+	if err != nil {
+		return err
+	}
+	elem, ok, err := c.db.LMove(args[1], args[2], fromLeft, toLeft)
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.w.WriteBulk(elem)
+	} else {
+		c.w.WriteNull()
+	}
+	return nil
+}
+
+func parseMoveSides(from, to string) (fromLeft, toLeft bool, err error) {
+	side := func(s string) (bool, error) {
+		switch strings.ToUpper(s) {
+		case "LEFT":
+			return true, nil
+		case "RIGHT":
+			return false, nil
+		}
+		return false, errSyntax
+	}
+	if fromLeft, err = side(from); err != nil {
+		return
+	}
+	toLeft, err = side(to)
+	return
+}
+
+// BLPOP key [key ...] timeout, BRPOP key [key ...] timeout
+func bpopCommand(c *clientConn, args []string) error {
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	left := strings.ToUpper(args[0]) == "BLPOP"
+	keys := args[1 : len(args)-1]
+
+	pop := func(key string) func(*clientConn) {
+		items, err := c.db.Pop(key, left, 1)
+		return func(c *clientConn) {
+			if err != nil {
+				c.writeError(err)
+				return
+			}
+			c.w.WriteBulks([]string{key, items[0]})
+		}
+	}
+
+	for _, key := range keys {
+		l, err := c.db.listForWrite(key)
+		if err != nil {
+			return err
+		}
+		if l != nil {
+			pop(key)(c)
+			return nil
+		}
+	}
+	c.db.block(c, &blockedClient{
+		keys:      keys,
+		timeout:   timeout,
+		serve:     pop,
+		onTimeout: func(c *clientConn) { c.w.WriteNullArray() },
+	})
+	return nil
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmoveCommand(c *clientConn, args []string) error {
+	fromLeft, toLeft, err := parseMoveSides(args[3], args[4])
+	if err != nil {
+		return err
+	}
+	timeout, err := parseTimeout(args[5])
+	if err != nil {
+		return err
+	}
+
+	move := func(key string) func(*clientConn) {
+		elem, _, err := c.db.LMove(key, args[2], fromLeft, toLeft)
+		c.db.touchKey(args[2])
+		c.db.store.resize(args[2])
+		return func(c *clientConn) {
+			if err != nil {
+				c.writeError(err)
+				return
+			}
+			c.w.WriteBulk(elem)
+		}
+	}
+
+	l, err := c.db.listForWrite(args[1])
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		move(args[1])(c)
+		return nil
+	}
+	c.db.block(c, &blockedClient{
+		keys:      []string{args[1]},
+		timeout:   timeout,
+		serve:     move,
+		onTimeout: func(c *clientConn) { c.w.WriteNull() },
+	})
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// The server listens on plain TCP, on TLS and on a Unix domain socket, in
+// any combination; clients get the same treatment whichever they came in
+// on.
+
+// tlsFiles are the certificate options, shared by the server, the client
+// and replicas dialing their primary.
+type tlsFiles struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	authClient string // "no", "optional" or "yes": whether clients must present a certificate
+}
+
+// certStore holds the certificate and CA pool in use. They are loaded again
+// on SIGHUP; connections made after that get the new ones, established
+// ones carry on.
+type certStore struct {
+	files tlsFiles
+	cert  atomic.Pointer[tls.Certificate]
+	pool  atomic.Pointer[x509.CertPool] // nil without a CA file
+}
+
+func newCertStore(files tlsFiles) (*certStore, error) {
+	switch files.authClient {
+	case "no", "optional", "yes":
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients %q, expected no, optional or yes", files.authClient)
+	}
+	if files.authClient != "no" && files.caFile == "" {
+		return nil, errors.New("tls-auth-clients needs a CA certificate file to check client certificates against")
+	}
+	s := &certStore{files: files}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the files again. On an error the ones loaded before stay
+// in use.
+func (s *certStore) reload() error {
+	var cert *tls.Certificate
+	if s.files.certFile != "" || s.files.keyFile != "" {
+		c, err := tls.LoadX509KeyPair(s.files.certFile, s.files.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if s.files.caFile != "" {
+		pem, err := os.ReadFile(s.files.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to load CA certificate: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", s.files.caFile)
+		}
+	}
+	s.cert.Store(cert)
+	s.pool.Store(pool)
+	return nil
+}
+
+// serverConfig returns the configuration of the TLS listener. It looks up
+// the current certificate for every handshake.
+func (s *certStore) serverConfig() (*tls.Config, error) {
+	if s.cert.Load() == nil {
+		return nil, errors.New("the TLS port needs a certificate and key file")
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert.Load()},
+				ClientCAs:    s.pool.Load(),
+			}
+			switch s.files.authClient {
+			case "yes":
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			case "optional":
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+// clientConfig returns the configuration for dialing serverName, with the
+// certificate as client certificate and the CA file, if any, in place of
+// the system roots.
+func (s *certStore) clientConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    s.pool.Load(),
+	}
+	if cert := s.cert.Load(); cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg
+}
+
+// listenUnix listens on a Unix domain socket at path with the given
+// permissions. A socket left behind by an earlier run is removed first.
+// The socket is created owner-only (see createSocket) and then given perm,
+// so it is never open to more than perm allows.
+func listenUnix(path string, perm fs.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := createSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func parseSocketPerm(s string) (fs.FileMode, error) {
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("invalid unixsocketperm %q, expected octal permissions such as 700", s)
+	}
+	return fs.FileMode(perm), nil
+}
+
+// serve accepts connections on l until it is closed.
+func serve(l net.Listener, db *LuminaDB) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+
+		go handleClient(conn, db)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// createSocket listens on a Unix domain socket at path. Without a umask,
+// the socket gets the permissions the system gives it until listenUnix
+// changes them.
+func createSocket(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket permissions are a Unix matter")
+	}
+	path := filepath.Join(t.TempDir(), "lumina.sock")
+	for _, perm := range []fs.FileMode{0700, 0660, 0777} {
+		// Each run replaces the socket the one before left.
+		l, err := listenUnix(path, perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != perm {
+			t.Errorf("socket mode = %v, want %v", got, perm)
+		}
+		if c, err := net.Dial("unix", path); err != nil {
+			t.Error(err)
+		} else {
+			c.Close()
+		}
+		l.Close()
+	}
+
+	// Anything but a socket is left alone.
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0600)
+	if l, err := listenUnix(file, 0700); err == nil {
+		l.Close()
+		t.Errorf("listenUnix replaced a regular file")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// createSocket listens on a Unix domain socket at path, created with the
+// process umask narrowed to the owner, since it would otherwise be open to
+// anyone the umask lets in until listenUnix changes its permissions. The
+// umask is process wide, so it is only ever narrowed: files other
+// goroutines create meanwhile get no more permissions than before.
+func createSocket(path string) (net.Listener, error) {
+	mask := syscall.Umask(0777)
+	syscall.Umask(mask | 0077)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var actionNames = map[byte]string{
+	actionSet:      "SET",
+	actionDel:      "DEL",
+	actionSetPX:    "SETPX",
+	actionExpireAt: "EXPIREAT",
+	actionPersist:  "PERSIST",
+	actionHSet:     "HSET",
+	actionHDel:     "HDEL",
+	actionRestore:  "RESTORE",
+	actionLPush:    "LPUSH",
+	actionRPush:    "RPUSH",
+	actionLPop:     "LPOP",
+	actionRPop:     "RPOP",
+	actionLTrim:    "LTRIM",
+	actionLRem:     "LREM",
+	actionLMove:    "LMOVE",
+	actionSAdd:     "SADD",
+	actionSRem:     "SREM",
+	actionZAdd:     "ZADD",
+	actionZRem:     "ZREM",
+	actionMulti:    "MULTI",
+	actionFlushAll: "FLUSHALL",
+}
+
+// CheckLog reads every frame of the log at path and prints a report. With
+// repair set, a bad frame and everything after it is cut off, keeping a
+// copy of the original as path+".bak". It returns the process exit code:
+// 0 if the log is (now) clean, 1 if it has a torn tail, 2 if it is corrupt.
+func CheckLog(path string, repair bool) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Error opening log: %v\n", err)
+		return 2
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Printf("Error opening log: %v\n", err)
+		return 2
+	}
+	id, version, start, err := readLogHeader(file)
+	if err != nil {
+		fmt.Printf("Error reading log header: %v\n", err)
+		return 2
+	}
+
+	counts := make(map[byte]int)
+	total := 0
+	good, err := readFrames(file, version, start, info.Size(), func(action byte, key, value string) error {
+		counts[action]++
+		total++
+		return nil
+	})
+
+	fmt.Printf("%s: version %d, id %016x, %d bytes\n", path, version, id, info.Size())
+	fmt.Printf("%d good frames", total)
+	for action := actionSet; action <= lastAction; action++ {
+		if counts[action] > 0 {
+			fmt.Printf(", %s %d", actionNames[action], counts[action])
+		}
+	}
+	fmt.Println()
+
+	if err == nil {
+		fmt.Println("Log is OK")
+		return 0
+	}
+
+	var fe *frameError
+	if !errors.As(err, &fe) {
+		fmt.Printf("Error reading log: %v\n", err)
+		return 2
+	}
+	dropped := info.Size() - good
+	fmt.Println(fe)
+	if fe.Torn {
+		fmt.Printf("The last %d bytes are an incomplete write; the server drops them on startup\n", dropped)
+	} else {
+		fmt.Printf("%d bytes from offset %d on cannot be trusted\n", dropped, good)
+	}
+
+	if !repair {
+		fmt.Println("Run with -repair-log to truncate the log at this point")
+		if fe.Torn {
+			return 1
+		}
+		return 2
+	}
+
+	if err := copyFile(path, path+".bak"); err != nil {
+		fmt.Printf("Error backing up log: %v\n", err)
+		return 2
+	}
+	if err := os.Truncate(path, good); err != nil {
+		fmt.Printf("Error truncating log: %v\n", err)
+		return 2
+	}
+	fmt.Printf("Truncated %s to %d bytes (%d dropped), original saved as %s.bak\n", path, good, dropped, path)
+	return 0
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -1,66 +1,240 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math/rand/v2"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Frame actions
+const (
+	actionSet      byte = 1
+	actionDel      byte = 2
+	actionSetPX    byte = 3 // value is an 8-byte deadline followed by the value
+	actionExpireAt byte = 4 // value is an 8-byte deadline
+	actionPersist  byte = 5
+	actionHSet     byte = 6 // value is encodeStrings(field, value, ...)
+	actionHDel     byte = 7 // value is encodeStrings(field, ...)
+	actionRestore  byte = 8 // value is a type code followed by encodeValue
+	actionLPush    byte = 9 // value is encodeStrings(element, ...)
+	actionRPush    byte = 10
+	actionLPop     byte = 11 // value is encodeStrings(count)
+	actionRPop     byte = 12
+	actionLTrim    byte = 13 // value is encodeStrings(start, stop)
+	actionLRem     byte = 14 // value is encodeStrings(count, element)
+	actionLMove    byte = 15 // key is the source, value encodeStrings(destination, LEFT|RIGHT, LEFT|RIGHT)
+	actionSAdd     byte = 16 // value is encodeStrings(member, ...)
+	actionSRem     byte = 17
+	actionZAdd     byte = 18 // value is encodeStrings(score, member, ...)
+	actionZRem     byte = 19 // value is encodeStrings(member, ...)
+	actionMulti    byte = 20 // value is the frames of a transaction without their CRCs
+	actionFlushAll byte = 21
+
+	lastAction = actionFlushAll
+)
+
+// Every log file starts with a header: the magic, a format version and a
+// random id. A new id is picked whenever the file is replaced (rewrite,
+// FLUSHALL), which is how a snapshot knows whether its offset still points
+// into the same log. Files written before the header existed have none and
+// are read as version 0.
+const (
+	logMagic      = "LUMINA"
+	logVersion    = 2
+	logHeaderSize = 16 // magic, uint16 version, uint64 id
+)
+
 type Logger struct {
-	file *os.File
-	mu   sync.Mutex
+	file     *os.File
+	filename string
+	mu       sync.Mutex
+
+	id      uint64 // 0 for a legacy file without header
+	version uint16
+	changes int64 // frames written since startup
+
+	size     int64 // bytes in the current log file
+	baseSize int64 // size right after the last rewrite (or at startup)
+
+	// While a rewrite runs, every frame is also copied here so it can be
+	// appended to the rewritten file before the swap.
+	rewriteBuf *bytes.Buffer
+
+	// While EXEC runs, frames are collected here instead of written, see
+	// beginTxn.
+	txn       *bytes.Buffer
+	txnFrames int
+
+	// feed gets every frame once it is in the file; it hands them to
+	// replicas, see replication.go. Called with l.mu held.
+	feed func([]byte)
+
+	// Durability, see fsync.go. written and durable count bytes since
+	// startup across file swaps, so they only ever grow.
+	policy   fsyncPolicy
+	written  int64
+	durable  int64
+	syncing  bool       // an fsync is running without l.mu held
+	syncDone *sync.Cond // signalled on l.mu when it finishes
+	fsyncs   int64
 }
 
 func (l *Logger) LogSet(key string, value string) error {
 	return l.LogSetBinary(key, value)
 }
 
-func (d *RWData) Delete(key string) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	delete(d.value, key)
-}
 func NewLogger(filename string) (*Logger, error) {
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &Logger{file: f, filename: filename, size: info.Size(), baseSize: info.Size(), policy: fsyncEverySec}
+	l.syncDone = sync.NewCond(&l.mu)
+	if info.Size() == 0 {
+		if err := l.writeHeader(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	l.id, l.version, _, err = readLogHeader(f)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
+	return l, nil
+}
 
-	return &Logger{file: f}, nil
+// writeHeader starts an empty log file under a fresh id. Callers hold l.mu
+// (or own l exclusively).
+func (l *Logger) writeHeader() error {
+	l.id = newLogID()
+	l.version = logVersion
+	n, err := l.file.Write(encodeLogHeader(l.id))
+	l.size += int64(n)
+	l.baseSize = l.size
+	return err
+}
+
+func newLogID() uint64 {
+	for {
+		if id := rand.Uint64(); id != 0 {
+			return id
+		}
+	}
 }
-func (l *Logger) LogSetBinary(key, value string) error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
 
-	// 1. Build the frame (Action 1 for SET)
-	timestamp := time.Now().Unix()
-	keyBytes := []byte(key)
-	valBytes := []byte(value)
+func encodeLogHeader(id uint64) []byte {
+	buf := make([]byte, logHeaderSize)
+	copy(buf, logMagic)
+	binary.BigEndian.PutUint16(buf[6:8], logVersion)
+	binary.BigEndian.PutUint64(buf[8:16], id)
+	return buf
+}
 
-	// Frame:
-	size := 1 + 8 + 4 + 4 + len(keyBytes) + len(valBytes)
-	buf := make([]byte, size)
+// readLogHeader returns the id and version of the log in f and the offset
+// of its first frame. A file without the magic is a legacy log.
+func readLogHeader(f io.ReaderAt) (id uint64, version uint16, start int64, err error) {
+	buf := make([]byte, logHeaderSize)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, 0, err
+	}
+	if n < len(logMagic) || string(buf[:len(logMagic)]) != logMagic {
+		return 0, 0, 0, nil
+	}
+	if n < logHeaderSize {
+		return 0, 0, 0, fmt.Errorf("log header truncated")
+	}
 
-	buf[0] = 1 // SET
-	binary.BigEndian.PutUint64(buf[1:9], uint64(timestamp))
-	binary.BigEndian.PutUint32(buf[9:13], uint32(len(keyBytes)))
-	binary.BigEndian.PutUint32(buf[13:17], uint32(len(valBytes)))
-	copy(buf[17:], keyBytes)
-	copy(buf[17+len(keyBytes):], valBytes)
+	version = binary.BigEndian.Uint16(buf[6:8])
+	if version > logVersion {
+		return 0, 0, 0, fmt.Errorf("log version %d is newer than supported %d", version, logVersion)
+	}
+	return binary.BigEndian.Uint64(buf[8:16]), version, logHeaderSize, nil
+}
 
-	// 2. Write the binary blob
-	_, err := l.file.Write(buf)
-	return err
+// position returns the id of the live log and the offset just past its last
+// frame.
+func (l *Logger) position() (uint64, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id, l.size
 }
-func (l *Logger) EncodeFrame(action byte, timestamp int64, key, value string) ([]byte, error) {
+
+// changeCount returns the number of frames written since startup.
+func (l *Logger) changeCount() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changes
+}
+
+// write appends raw frames to the log. Callers hold l.mu.
+func (l *Logger) write(buf []byte) error {
+	if l.txn != nil {
+		// The MULTI frame's CRC covers the frames inside it. Without
+		// their own they also can't pass for frames when hasValidFrame
+		// looks past a torn MULTI frame.
+		l.txn.Write(buf[:len(buf)-frameCRCSize])
+		l.txnFrames++
+		return nil
+	}
+	n, err := l.file.Write(buf)
+	l.size += int64(n)
+	l.written += int64(n)
+	if err != nil {
+		return err
+	}
+	l.changes++
+	if l.rewriteBuf != nil {
+		l.rewriteBuf.Write(buf)
+	}
+	if l.feed != nil {
+		l.feed(buf)
+	}
+	return nil
+}
+
+// appendFrames writes frames that are already encoded, as a replica does
+// with the ones it receives from its primary.
+func (l *Logger) appendFrames(buf []byte) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.write(buf)
+}
+func (l *Logger) LogSetBinary(key, value string) error {
+	return l.writeFrame(actionSet, key, value)
+}
+
+// Frame (version 2): action(1) timestamp(8) keyLen(4) valLen(4) key value
+// crc(4). The CRC32 covers everything before it, so a frame torn by a crash
+// or damaged on disk is caught on replay. Versions 0 and 1 had no CRC.
+const (
+	frameHeaderSize = 1 + 8 + 4 + 4
+	frameCRCSize    = 4
+)
+
+func (l *Logger) EncodeFrame(action byte, timestamp int64, key, value string) ([]byte, error) {
 	keyLen := uint32(len(key))
 	valueLen := uint32(len(value))
-	size := 1 + 8 + 4 + 4 + len(key) + len(value)
+	size := frameHeaderSize + len(key) + len(value) + frameCRCSize
 	data := make([]byte, size)
 
 	data[0] = action
@@ -69,81 +243,464 @@ func (l *Logger) EncodeFrame(action byte, timestamp int64, key, value string) ([
 	binary.BigEndian.PutUint32(data[13:17], valueLen)
 	copy(data[17:17+len(key)], []byte(key))
 	copy(data[17+len(key):], []byte(value))
+	binary.BigEndian.PutUint32(data[size-frameCRCSize:], crc32.ChecksumIEEE(data[:size-frameCRCSize]))
 	return data, nil
 }
 
-func (l *Logger) LogDelete(key string) error {
+// writeFrame encodes and appends a single frame.
+func (l *Logger) writeFrame(action byte, key, value string) error {
+	buf, err := l.EncodeFrame(action, time.Now().Unix(), key, value)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.write(buf)
+}
+
+// beginTxn starts collecting frames for a transaction; commitTxn writes
+// them. EXEC calls both with every shard held for writing, which keeps
+// every other writer out in between.
+func (l *Logger) beginTxn() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.txn, l.txnFrames = new(bytes.Buffer), 0
+}
 
-	// Build binary frame for DELETE (action = 2, value is empty)
-	timestamp := time.Now().Unix()
-	keyBytes := []byte(key)
+// commitTxn writes the frames collected since beginTxn as a single MULTI
+// frame, whose checksum covers them all.
+func (l *Logger) commitTxn() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	frames, n := l.txn.Bytes(), l.txnFrames
+	l.txn, l.txnFrames = nil, 0
+	if n == 0 {
+		return nil
+	}
+	buf, err := l.EncodeFrame(actionMulti, time.Now().Unix(), "", string(frames))
+	if err != nil {
+		return err
+	}
+	return l.write(buf)
+}
 
-	size := 1 + 8 + 4 + 4 + len(keyBytes) // No value for DEL
-	buf := make([]byte, size)
+// LogSetExpire logs a SET that carries a deadline (unix milliseconds), so a
+// key that expired while the server was down stays gone after Recover.
+func (l *Logger) LogSetExpire(key, value string, at int64) error {
+	return l.writeFrame(actionSetPX, key, string(encodeDeadline(at))+value)
+}
 
-	buf[0] = 2 // DEL
-	binary.BigEndian.PutUint64(buf[1:9], uint64(timestamp))
-	binary.BigEndian.PutUint32(buf[9:13], uint32(len(keyBytes)))
-	binary.BigEndian.PutUint32(buf[13:17], 0) // valLen = 0
-	copy(buf[17:], keyBytes)
+// LogExpireAt logs a new deadline (unix milliseconds) for an existing key.
+func (l *Logger) LogExpireAt(key string, at int64) error {
+	return l.writeFrame(actionExpireAt, key, string(encodeDeadline(at)))
+}
 
-	_, err := l.file.Write(buf)
-	return err
+// LogPersist logs the removal of a key's deadline.
+func (l *Logger) LogPersist(key string) error {
+	return l.writeFrame(actionPersist, key, "")
+}
+
+func (l *Logger) LogDelete(key string) error {
+	return l.writeFrame(actionDel, key, "")
+}
+
+// LogFlushAll starts the log afresh after FLUSHALL. Replay has nothing to
+// clear, but a replica following the log does.
+func (l *Logger) LogFlushAll() error {
+	return l.writeFrame(actionFlushAll, "", "")
+}
+
+// LogHSet logs fields set on a hash; items alternate field and value.
+func (l *Logger) LogHSet(key string, items []string) error {
+	return l.writeFrame(actionHSet, key, encodeStrings(items))
+}
+
+// LogHDel logs fields removed from a hash.
+func (l *Logger) LogHDel(key string, fields []string) error {
+	return l.writeFrame(actionHDel, key, encodeStrings(fields))
+}
+
+// LogPush logs elements pushed onto the head (left) or tail of a list.
+func (l *Logger) LogPush(key string, left bool, elems []string) error {
+	action := actionRPush
+	if left {
+		action = actionLPush
+	}
+	return l.writeFrame(action, key, encodeStrings(elems))
+}
+
+// LogPop logs count elements popped from the head (left) or tail of a list.
+func (l *Logger) LogPop(key string, left bool, count int) error {
+	action := actionRPop
+	if left {
+		action = actionLPop
+	}
+	return l.writeFrame(action, key, encodeStrings([]string{strconv.Itoa(count)}))
+}
+
+func (l *Logger) LogLTrim(key string, start, stop int) error {
+	return l.writeFrame(actionLTrim, key, encodeStrings([]string{strconv.Itoa(start), strconv.Itoa(stop)}))
+}
+
+func (l *Logger) LogLRem(key string, count int, elem string) error {
+	return l.writeFrame(actionLRem, key, encodeStrings([]string{strconv.Itoa(count), elem}))
+}
+
+func (l *Logger) LogLMove(src, dst string, fromLeft, toLeft bool) error {
+	return l.writeFrame(actionLMove, src, encodeStrings([]string{dst, sideName(fromLeft), sideName(toLeft)}))
+}
+
+// LogSAdd logs members added to a set.
+func (l *Logger) LogSAdd(key string, members []string) error {
+	return l.writeFrame(actionSAdd, key, encodeStrings(members))
+}
+
+// LogSRem logs members removed from a set, which SPOP does too.
+func (l *Logger) LogSRem(key string, members []string) error {
+	return l.writeFrame(actionSRem, key, encodeStrings(members))
+}
+
+// LogZAdd logs the final scores of sorted set members; items alternate
+// score and member.
+func (l *Logger) LogZAdd(key string, items []string) error {
+	return l.writeFrame(actionZAdd, key, encodeStrings(items))
 }
 
+// LogZRem logs members removed from a sorted set.
+func (l *Logger) LogZRem(key string, members []string) error {
+	return l.writeFrame(actionZRem, key, encodeStrings(members))
+}
+
+// restoreFrameValue is the value of a RESTORE frame, which replaces key
+// with v wholesale. Rewrites use it for everything that is not a string.
+func restoreFrameValue(v any) string {
+	return string([]byte{valueType(v)}) + encodeValue(v)
+}
+
+// Truncate empties the log. A rewrite in progress is abandoned, since the
+// snapshot it is writing no longer matches the data.
+func (l *Logger) Truncate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	l.size, l.baseSize = 0, 0
+	l.rewriteBuf = nil
+	if l.txn != nil {
+		// FLUSHALL inside a transaction: what it ran before is gone too.
+		l.txn.Reset()
+		l.txnFrames = 0
+	}
+	if err := l.writeHeader(); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.durable = l.written
+	return nil
+}
+
+// Close flushes the log to disk whatever the fsync policy, then closes it.
 func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
 	return l.file.Close()
 }
 
-// Recovery function to be implemented
+func encodeDeadline(at int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(at))
+	return buf
+}
+
+func decodeDeadline(value string) (int64, error) {
+	if len(value) < 8 {
+		return 0, fmt.Errorf("deadline too short")
+	}
+	return int64(binary.BigEndian.Uint64([]byte(value[:8]))), nil
+}
+
+// Recover loads the newest valid snapshot and replays the log frames
+// written after it. When no snapshot matches the current log, the whole log
+// is replayed. A torn final frame left by a crash is cut off; a damaged
+// frame anywhere else stops recovery so no data is silently dropped.
 func (db *LuminaDB) Recover() error {
-	file, err := os.Open("lumina.log")
+	file, err := os.Open(db.logger.filename)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
-
 	defer file.Close()
-	header := make([]byte, 17)
 
-	for {
-		_, err := io.ReadFull(file, header)
-		if err == io.EOF {
-			break
+	id, version, start, err := readLogHeader(file)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	db.store.lock(allShards)
+	defer db.store.unlock(allShards)
+
+	snap, err := db.loadSnapshot()
+	if err != nil {
+		fmt.Printf("Ignoring snapshot: %v\n", err)
+	}
+	if snap != nil && snap.logID == id && snap.logOffset >= start && snap.logOffset <= info.Size() {
+		db.store.load(snap.values, snap.expires)
+		start = snap.logOffset
+		fmt.Printf("Loaded snapshot with %d keys, replaying log from offset %d\n", len(snap.values), start)
+	} else if snap != nil {
+		fmt.Println("Snapshot does not match the current log, replaying the full log")
+	}
+
+	now := nowMillis()
+	good, err := readFrames(file, version, start, info.Size(), func(action byte, key, value string) error {
+		return db.applyFrame(action, key, value, now)
+	})
+
+	var fe *frameError
+	if errors.As(err, &fe) && fe.Torn {
+		fmt.Printf("Truncating torn frame at offset %d (%d bytes): %s\n", fe.Offset, info.Size()-good, fe.Reason)
+		return db.logger.truncateTo(good)
+	}
+	return err
+}
+
+// frameError describes a frame that could not be read back. Torn frames
+// are the last thing in the file, which is what an interrupted write looks
+// like; anything else is corruption.
+type frameError struct {
+	Offset int64
+	Reason string
+	Torn   bool
+}
+
+func (e *frameError) Error() string {
+	if e.Torn {
+		return fmt.Sprintf("torn frame at offset %d: %s", e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("corrupt frame at offset %d: %s", e.Offset, e.Reason)
+}
+
+// readFrames reads the frames of a log of the given version between
+// offsets start and end of f, and calls fn for each one. It returns the
+// offset just past the last good frame, and a *frameError if it stopped at
+// a bad one.
+func readFrames(f io.ReaderAt, version uint16, start, end int64, fn func(action byte, key, value string) error) (int64, error) {
+	crcSize := int64(0)
+	if version >= 2 {
+		crcSize = frameCRCSize
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, start, end-start))
+
+	header := make([]byte, frameHeaderSize)
+	offset := start
+	for offset < end {
+		if end-offset < frameHeaderSize {
+			return offset, &frameError{Offset: offset, Reason: "incomplete frame header", Torn: true}
 		}
-		if err != nil {
-			return fmt.Errorf("error reading header: %w", err)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return offset, fmt.Errorf("error reading header: %w", err)
 		}
 
 		action := header[0]
+		keyLen := int64(binary.BigEndian.Uint32(header[9:13]))
+		valLen := int64(binary.BigEndian.Uint32(header[13:17]))
+
+		frameLen := frameHeaderSize + keyLen + valLen + crcSize
+		if offset+frameLen > end {
+			// A damaged length looks just like a torn write, unless an
+			// intact frame turns up further on.
+			torn := crcSize == 0 || !hasValidFrame(f, offset+1, end)
+			return offset, &frameError{Offset: offset, Reason: fmt.Sprintf("frame of %d bytes runs past end of file", frameLen), Torn: torn}
+		}
+
+		payload := make([]byte, keyLen+valLen+crcSize)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, fmt.Errorf("error reading frame: %w", err)
+		}
+
+		if crcSize > 0 {
+			sum := binary.BigEndian.Uint32(payload[keyLen+valLen:])
+			crc := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, payload[:keyLen+valLen])
+			if crc != sum {
+				last := offset+frameLen == end
+				return offset, &frameError{Offset: offset, Reason: "checksum mismatch", Torn: last}
+			}
+		}
+		if action < actionSet || action > lastAction {
+			return offset, &frameError{Offset: offset, Reason: fmt.Sprintf("unknown action %d", action)}
+		}
+
+		if err := fn(action, string(payload[:keyLen]), string(payload[keyLen:keyLen+valLen])); err != nil {
+			return offset, err
+		}
+		offset += frameLen
+	}
+	return offset, nil
+}
+
+// hasValidFrame reports whether a version 2 frame with a matching checksum
+// starts anywhere in [from, end) of f. It only runs on the error path.
+func hasValidFrame(f io.ReaderAt, from, end int64) bool {
+	header := make([]byte, frameHeaderSize)
+	for offset := from; offset+frameHeaderSize+frameCRCSize <= end; offset++ {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			return false
+		}
+		if header[0] < actionSet || header[0] > lastAction {
+			continue
+		}
+		payloadLen := int64(binary.BigEndian.Uint32(header[9:13])) + int64(binary.BigEndian.Uint32(header[13:17]))
+		if offset+frameHeaderSize+payloadLen+frameCRCSize > end {
+			continue
+		}
 
-		keyLen := binary.BigEndian.Uint32(header[9:13])
-		valLen := binary.BigEndian.Uint32(header[13:17])
+		payload := make([]byte, payloadLen+frameCRCSize)
+		if _, err := f.ReadAt(payload, offset+frameHeaderSize); err != nil {
+			return false
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, payload[:payloadLen])
+		if crc == binary.BigEndian.Uint32(payload[payloadLen:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateTo cuts the log back to size, dropping a torn tail.
+func (l *Logger) truncateTo(size int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-		keyBytes := make([]byte, keyLen)
-		_, err = io.ReadFull(file, keyBytes)
+	if err := l.file.Truncate(size); err != nil {
+		return err
+	}
+	l.size = size
+	if l.baseSize > size {
+		l.baseSize = size
+	}
+	return nil
+}
+
+// applyFrame replays one logged action against the store. Deadlines are
+// compared against now so keys that expired while the server was down are
+// dropped. Callers hold every shard for writing, so a replica applies a
+// transaction all at once.
+func (db *LuminaDB) applyFrame(action byte, key, value string, now int64) error {
+	if action != actionMulti && action != actionFlushAll {
+		db.touchKey(key)
+		defer db.store.resize(key)
+	}
+	switch action {
+	case actionSet:
+		db.store.Set(key, value)
+	case actionDel:
+		db.store.Delete(key)
+	case actionSetPX:
+		at, err := decodeDeadline(value)
 		if err != nil {
-			return fmt.Errorf("error reading key: %w", err)
+			return fmt.Errorf("error reading deadline: %w", err)
 		}
-		valBytes := make([]byte, valLen)
-		_, err = io.ReadFull(file, valBytes)
+		if at <= now {
+			db.store.Delete(key)
+			return nil
+		}
+		db.store.Set(key, value[8:])
+		db.store.SetExpire(key, at)
+	case actionExpireAt:
+		at, err := decodeDeadline(value)
 		if err != nil {
-			return fmt.Errorf("error reading value: %w", err)
+			return fmt.Errorf("error reading deadline: %w", err)
 		}
-		key := string(keyBytes)
-		value := string(valBytes)
-
-		// Apply the action
-		switch action {
-		case 1: // SET
-			db.store.Set(key, value)
-		case 2: // DEL
+		if at <= now {
 			db.store.Delete(key)
+			return nil
+		}
+		db.store.SetExpire(key, at)
+	case actionPersist:
+		db.store.Persist(key)
+	case actionHSet:
+		items, err := decodeStrings(value)
+		if err == nil && len(items)%2 != 0 {
+			err = errors.New("odd number of items")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading hash fields: %w", err)
+		}
+		db.store.HSet(key, items)
+	case actionHDel:
+		fields, err := decodeStrings(value)
+		if err != nil {
+			return fmt.Errorf("error reading hash fields: %w", err)
+		}
+		db.store.HDel(key, fields)
+	case actionRestore:
+		if len(value) == 0 {
+			return fmt.Errorf("empty restore frame")
+		}
+		v, err := decodeValue(value[0], value[1:])
+		if err != nil {
+			return fmt.Errorf("error reading value: %w", err)
+		}
+		db.store.Set(key, v)
+	case actionLPush, actionRPush, actionLPop, actionRPop, actionLTrim, actionLRem, actionLMove:
+		args, err := decodeStrings(value)
+		if err != nil {
+			return fmt.Errorf("error reading list arguments: %w", err)
+		}
+		if action == actionLMove && len(args) > 0 {
+			db.touchKey(args[0])
+		}
+		if err := db.store.applyList(action, key, args); err != nil {
+			return fmt.Errorf("error replaying %s: %w", actionNames[action], err)
+		}
+		if action == actionLMove && len(args) > 0 {
+			db.store.resize(args[0])
+		}
+	case actionSAdd, actionSRem:
+		members, err := decodeStrings(value)
+		if err != nil {
+			return fmt.Errorf("error reading set members: %w", err)
+		}
+		db.store.applySet(action, key, members)
+	case actionZAdd, actionZRem:
+		args, err := decodeStrings(value)
+		if err != nil {
+			return fmt.Errorf("error reading sorted set members: %w", err)
+		}
+		if err := db.store.applyZSet(action, key, args); err != nil {
+			return fmt.Errorf("error replaying %s: %w", actionNames[action], err)
+		}
+	case actionMulti:
+		// Inside a MULTI frame, frames are laid out as in version 1 logs,
+		// without a CRC.
+		r := strings.NewReader(value)
+		_, err := readFrames(r, 1, 0, r.Size(), func(action byte, key, value string) error {
+			return db.applyFrame(action, key, value, now)
+		})
+		if err != nil {
+			// The outer checksum matched, so this is not a torn write.
+			return fmt.Errorf("error replaying transaction: %v", err)
 		}
+	case actionFlushAll:
+		db.store.clear()
+		db.touchAll()
 	}
 	return nil
 }
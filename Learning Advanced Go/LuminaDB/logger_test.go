@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLog writes a log with a SET frame for each of keys, each valued
+// "v:" and its key, and returns its path and where each frame starts.
+func writeLog(t *testing.T, keys ...string) (string, []int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.log")
+	l, err := NewLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for _, k := range keys {
+		_, size := l.position()
+		offsets = append(offsets, size)
+		if err := l.LogSetBinary(k, "v:"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path, offsets
+}
+
+// recoverLog opens a database on the log at path and recovers it.
+func recoverLog(t *testing.T, path string) (*LuminaDB, error) {
+	t.Helper()
+	db, err := NewLuminaDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.snapshotFile = filepath.Join(filepath.Dir(path), "test.snap")
+	t.Cleanup(func() { db.Close() })
+	return db, db.Recover()
+}
+
+// fileSize returns the size of the file at path.
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// The log holds frames for a, b and c. Damage at the end of the file is
+// what a crash mid-write leaves, and is cut off; damage with an intact
+// frame after it is corruption, and stops recovery with the file as it is.
+func TestRecoverDamagedLog(t *testing.T) {
+	// Frame layout: action(1) timestamp(8) keyLen(4) valLen(4) key value crc(4).
+	const valLenAt, valueAt = 13, 17 + 1
+	tests := []struct {
+		name   string
+		damage func(path string, frames []int64, size int64) error
+		torn   bool
+	}{
+		{"torn frame", func(path string, frames []int64, size int64) error {
+			return os.Truncate(path, size-3)
+		}, true},
+		{"torn frame header", func(path string, frames []int64, size int64) error {
+			return os.Truncate(path, frames[2]+5)
+		}, true},
+		{"checksum mismatch in the last frame", func(path string, frames []int64, size int64) error {
+			return flip(path, size-1)
+		}, true},
+		{"length past the end in the last frame", func(path string, frames []int64, size int64) error {
+			return putUint32(path, frames[2]+valLenAt, 1<<30)
+		}, true},
+		{"checksum mismatch before the last frame", func(path string, frames []int64, size int64) error {
+			return flip(path, frames[1]+valueAt)
+		}, false},
+		{"length past the end before the last frame", func(path string, frames []int64, size int64) error {
+			return putUint32(path, frames[1]+valLenAt, 1<<30)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, frames := writeLog(t, "a", "b", "c")
+			if err := tt.damage(path, frames, fileSize(t, path)); err != nil {
+				t.Fatal(err)
+			}
+			damaged := fileSize(t, path)
+
+			db, err := recoverLog(t, path)
+			if !tt.torn {
+				if err == nil {
+					t.Fatal("Recover succeeded on a corrupt log")
+				}
+				if size := fileSize(t, path); size != damaged {
+					t.Errorf("log is %d bytes after a failed Recover, want it left at %d", size, damaged)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := fileSize(t, path); size != frames[2] {
+				t.Errorf("log truncated to %d bytes, want %d, where c starts", size, frames[2])
+			}
+			want := map[string]string{"a": "v:a", "b": "v:b"}
+			checkRecovered(t, db, want)
+
+			// What is logged next follows on from the last good frame.
+			if err := db.logger.LogSetBinary("d", "v:d"); err != nil {
+				t.Fatal(err)
+			}
+			again, err := recoverLog(t, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want["d"] = "v:d"
+			checkRecovered(t, again, want)
+		})
+	}
+}
+
+// Logs from before the header (version 0) or the checksums (version 1)
+// are read as they are, a torn last frame included, and upgraded the way
+// main does at startup.
+func TestRecoverLegacyLog(t *testing.T) {
+	for _, version := range []uint16{0, 1} {
+		path := filepath.Join(t.TempDir(), "test.log")
+		var data []byte
+		if version > 0 {
+			data = encodeLogHeader(1)
+			binary.BigEndian.PutUint16(data[6:8], version)
+		}
+		var l Logger
+		for _, k := range []string{"a", "b", "c"} {
+			frame, _ := l.EncodeFrame(actionSet, 0, k, "v:"+k)
+			data = append(data, frame[:len(frame)-frameCRCSize]...)
+		}
+		good := len(data) - 5
+		if err := os.WriteFile(path, data[:good], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := recoverLog(t, path)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if db.logger.version != version {
+			t.Errorf("version %d log read as version %d", version, db.logger.version)
+		}
+		want := map[string]string{"a": "v:a", "b": "v:b"}
+		checkRecovered(t, db, want)
+
+		if err := db.RewriteLog(); err != nil {
+			t.Fatal(err)
+		}
+		if _, v, _, err := readLogHeaderFile(path); err != nil || v != logVersion {
+			t.Errorf("version %d log rewritten as version %d, %v; want %d", version, v, err, logVersion)
+		}
+		upgraded, err := recoverLog(t, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRecovered(t, upgraded, want)
+	}
+}
+
+// flip inverts the byte at offset in the file at path.
+func flip(path string, offset int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return err
+	}
+	b[0] ^= 0xFF
+	_, err = f.WriteAt(b, offset)
+	return err
+}
+
+// putUint32 overwrites four bytes at offset in the file at path with v.
+func putUint32(path string, offset int64, v uint32) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := binary.BigEndian.AppendUint32(nil, v)
+	_, err = f.WriteAt(b, offset)
+	return err
+}
@@ -0,0 +1,165 @@
+// Package luminaclient is a Go client for LuminaDB, and for other servers
+// speaking RESP2 or RESP3.
+//
+// A Client is safe for concurrent use: each call borrows a connection from
+// a pool and gives it back when the reply is in. Connections that fail are
+// dropped and replaced, so a restarted server is reconnected to on the
+// next call.
+//
+// The package lives in the LuminaDB module and is imported as
+// "LuminaDB/luminaclient":
+//
+//	c := luminaclient.New(luminaclient.Options{Addr: "localhost:8080"})
+//	defer c.Close()
+//	if err := c.Set(ctx, "greeting", "hello", time.Minute); err != nil { ... }
+//	v, err := c.Get(ctx, "greeting")
+//	if err == luminaclient.ErrNil { ... } // no such key
+package luminaclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrNil is returned by the typed helpers when the reply is null, for
+// example by Get for a key that does not exist.
+var ErrNil = errors.New("luminaclient: nil reply")
+
+// Options configure a Client. Zero fields get the defaults noted.
+type Options struct {
+	Network string      // "tcp" (default) or "unix"
+	Addr    string      // host:port or socket path, default "localhost:8080"
+	TLS     *tls.Config // connect over TLS if set
+
+	Username string // ACL user; the default user if empty
+	Password string // sent with AUTH, or HELLO when Protocol is 3
+	Protocol int    // 2 (default) or 3
+
+	PoolSize    int           // connections open at once, default 10
+	IdleTimeout time.Duration // close connections idle this long, default 5 minutes, -1 never
+	MaxRetries  int           // retries after a connection error, default 1, -1 none
+
+	DialTimeout  time.Duration // default 5 seconds
+	ReadTimeout  time.Duration // per reply, on top of the context's deadline; 0 for none
+	WriteTimeout time.Duration // per command; 0 for none
+}
+
+func (o *Options) setDefaults() {
+	if o.Network == "" {
+		o.Network = "tcp"
+	}
+	if o.Addr == "" {
+		o.Addr = "localhost:8080"
+	}
+	if o.Protocol == 0 {
+		o.Protocol = 2
+	}
+	if o.PoolSize <= 0 {
+		o.PoolSize = 10
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = 5 * time.Minute
+	}
+	switch {
+	case o.MaxRetries == 0:
+		o.MaxRetries = 1
+	case o.MaxRetries < 0:
+		o.MaxRetries = 0
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+}
+
+func (o *Options) username() string {
+	if o.Username == "" {
+		return "default"
+	}
+	return o.Username
+}
+
+// Client talks to one server through a pool of connections.
+type Client struct {
+	opts Options
+	pool *pool
+}
+
+// New returns a client for the server opts describe. It does not connect
+// until the first call.
+func New(opts Options) *Client {
+	opts.setDefaults()
+	c := &Client{opts: opts}
+	c.pool = newPool(&c.opts)
+	return c
+}
+
+// Close closes the connections. Calls still running finish first.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// Do sends a command and returns its reply, decoded into plain Go values:
+//
+//	simple string, bulk string, verbatim string  string
+//	integer                                      int64
+//	double                                       float64
+//	big number                                   *big.Int
+//	boolean                                      bool
+//	null, null bulk string, null array           nil
+//	array, set, push                             []any
+//	map                                          map[string]any
+//	error, blob error                            Error
+//
+// Map keys that aren't strings are formatted with fmt.Sprint; attributes
+// are dropped. An error reply at the top level is returned as the error,
+// while those inside an array, such as EXEC results, stay in it.
+//
+// Arguments may be strings, byte slices, integers, floats, bools and
+// fmt.Stringers.
+//
+// If the connection fails, Do retries on a new one up to MaxRetries times,
+// unless ctx is done; idle connections are dropped too, since a server
+// that closed one has likely closed them all. A command whose reply was lost may have run, so a
+// non-idempotent one like INCR can run twice; set MaxRetries to -1 if that
+// matters.
+func (c *Client) Do(ctx context.Context, args ...any) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("luminaclient: empty command")
+	}
+	var err error
+	for attempt := 0; attempt <= c.opts.MaxRetries; attempt++ {
+		var cn *conn
+		cn, err = c.pool.get(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+				return nil, err
+			}
+			continue // the dial failed; try again
+		}
+		var reply any
+		reply, err = cn.roundTrip(ctx, args, c.opts.ReadTimeout, c.opts.WriteTimeout)
+		var replyErr Error
+		c.pool.put(cn, err != nil && !errors.As(err, &replyErr))
+		if err == nil || !retryable(ctx, err) {
+			return reply, err
+		}
+		c.pool.closeIdle()
+	}
+	return nil, err
+}
+
+// retryable reports whether err broke the connection in a way a new one
+// may fix: the server closed it or reset it. Timeouts are not retried.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,454 @@
+package luminaclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Typed helpers for common commands. They convert the reply of Do and
+// return ErrNil where the server answers with null.
+
+// Ping checks that the server answers.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+// Get returns the string at key, or ErrNil if there is none.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return toString(c.Do(ctx, "GET", key))
+}
+
+// Set stores value at key. A ttl above zero makes the key expire after
+// it, rounded up to the next millisecond.
+func (c *Client) Set(ctx context.Context, key string, value any, ttl time.Duration) error {
+	args := []any{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", millis(ttl))
+	}
+	_, err := c.Do(ctx, args...)
+	return err
+}
+
+// SetNX stores value at key if the key does not exist, and reports whether
+// it did. ttl is as for Set.
+func (c *Client) SetNX(ctx context.Context, key string, value any, ttl time.Duration) (bool, error) {
+	args := []any{"SET", key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", millis(ttl))
+	}
+	reply, err := c.Do(ctx, args...)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// GetDel returns the string at key and deletes the key, or ErrNil.
+func (c *Client) GetDel(ctx context.Context, key string) (string, error) {
+	return toString(c.Do(ctx, "GETDEL", key))
+}
+
+// MGet returns the strings at keys, with nil for those that don't exist.
+func (c *Client) MGet(ctx context.Context, keys ...string) ([]any, error) {
+	reply, err := c.Do(ctx, append([]any{"MGET"}, stringArgs(keys)...)...)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		return nil, unexpected(reply)
+	}
+	return items, nil
+}
+
+// MSet stores pairs of keys and values.
+func (c *Client) MSet(ctx context.Context, pairs map[string]any) error {
+	args := make([]any, 0, 1+2*len(pairs))
+	args = append(args, "MSET")
+	for k, v := range pairs {
+		args = append(args, k, v)
+	}
+	_, err := c.Do(ctx, args...)
+	return err
+}
+
+// Incr adds one to the integer at key and returns the result.
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return toInt(c.Do(ctx, "INCR", key))
+}
+
+// IncrBy adds n to the integer at key and returns the result.
+func (c *Client) IncrBy(ctx context.Context, key string, n int64) (int64, error) {
+	return toInt(c.Do(ctx, "INCRBY", key, n))
+}
+
+// IncrByFloat adds f to the number at key and returns the result.
+func (c *Client) IncrByFloat(ctx context.Context, key string, f float64) (float64, error) {
+	return toFloat(c.Do(ctx, "INCRBYFLOAT", key, f))
+}
+
+// Decr subtracts one from the integer at key and returns the result.
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return toInt(c.Do(ctx, "DECR", key))
+}
+
+// Del deletes keys and returns how many existed.
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return toInt(c.Do(ctx, append([]any{"DEL"}, stringArgs(keys)...)...))
+}
+
+// Exists returns how many of keys exist.
+func (c *Client) Exists(ctx context.Context, keys ...string) (int64, error) {
+	return toInt(c.Do(ctx, append([]any{"EXISTS"}, stringArgs(keys)...)...))
+}
+
+// Expire makes key expire after ttl, rounded up to the next millisecond,
+// and reports whether the key exists.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return toBool(c.Do(ctx, "PEXPIRE", key, millis(ttl)))
+}
+
+// Persist removes the deadline of key and reports whether it had one.
+func (c *Client) Persist(ctx context.Context, key string) (bool, error) {
+	return toBool(c.Do(ctx, "PERSIST", key))
+}
+
+// TTL returns the time left before key expires: -1 if it has no deadline
+// and -2 if it does not exist, as the server reports them.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := toInt(c.Do(ctx, "PTTL", key))
+	if err != nil || ms < 0 {
+		return time.Duration(ms), err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Type returns the type of the value at key, "none" if there is none.
+func (c *Client) Type(ctx context.Context, key string) (string, error) {
+	return toString(c.Do(ctx, "TYPE", key))
+}
+
+// DBSize returns the number of keys.
+func (c *Client) DBSize(ctx context.Context) (int64, error) {
+	return toInt(c.Do(ctx, "DBSIZE"))
+}
+
+// HSet sets fields of the hash at key and returns how many were new.
+func (c *Client) HSet(ctx context.Context, key string, fields map[string]any) (int64, error) {
+	args := make([]any, 0, 2+2*len(fields))
+	args = append(args, "HSET", key)
+	for f, v := range fields {
+		args = append(args, f, v)
+	}
+	return toInt(c.Do(ctx, args...))
+}
+
+// HGet returns a field of the hash at key, or ErrNil.
+func (c *Client) HGet(ctx context.Context, key, field string) (string, error) {
+	return toString(c.Do(ctx, "HGET", key, field))
+}
+
+// HGetAll returns the hash at key, empty if there is none.
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return toStringMap(c.Do(ctx, "HGETALL", key))
+}
+
+// HDel removes fields of the hash at key and returns how many existed.
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int64, error) {
+	return toInt(c.Do(ctx, append([]any{"HDEL", key}, stringArgs(fields)...)...))
+}
+
+// HIncrBy adds n to a field of the hash at key and returns the result.
+func (c *Client) HIncrBy(ctx context.Context, key, field string, n int64) (int64, error) {
+	return toInt(c.Do(ctx, "HINCRBY", key, field, n))
+}
+
+// LPush prepends values to the list at key and returns its length.
+func (c *Client) LPush(ctx context.Context, key string, values ...any) (int64, error) {
+	return toInt(c.Do(ctx, append([]any{"LPUSH", key}, values...)...))
+}
+
+// RPush appends values to the list at key and returns its length.
+func (c *Client) RPush(ctx context.Context, key string, values ...any) (int64, error) {
+	return toInt(c.Do(ctx, append([]any{"RPUSH", key}, values...)...))
+}
+
+// LPop removes and returns the first element of the list at key, or ErrNil.
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return toString(c.Do(ctx, "LPOP", key))
+}
+
+// RPop removes and returns the last element of the list at key, or ErrNil.
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return toString(c.Do(ctx, "RPOP", key))
+}
+
+// BLPop waits up to timeout for an element to pop from the first non-empty
+// list of keys, and returns the key and the element; ErrNil if none came.
+// A timeout of zero waits for ever. ctx should allow for the timeout.
+func (c *Client) BLPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	args := append([]any{"BLPOP"}, stringArgs(keys)...)
+	items, err := toStrings(c.Do(ctx, append(args, timeout.Seconds())...))
+	if err != nil {
+		return "", "", err
+	}
+	if len(items) != 2 {
+		return "", "", ErrNil
+	}
+	return items[0], items[1], nil
+}
+
+// LRange returns elements start to stop of the list at key, both
+// inclusive; negative indexes count from the end.
+func (c *Client) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return toStrings(c.Do(ctx, "LRANGE", key, start, stop))
+}
+
+// LLen returns the length of the list at key.
+func (c *Client) LLen(ctx context.Context, key string) (int64, error) {
+	return toInt(c.Do(ctx, "LLEN", key))
+}
+
+// SAdd adds members to the set at key and returns how many were new.
+func (c *Client) SAdd(ctx context.Context, key string, members ...any) (int64, error) {
+	return toInt(c.Do(ctx, append([]any{"SADD", key}, members...)...))
+}
+
+// SRem removes members from the set at key and returns how many existed.
+func (c *Client) SRem(ctx context.Context, key string, members ...any) (int64, error) {
+	return toInt(c.Do(ctx, append([]any{"SREM", key}, members...)...))
+}
+
+// SMembers returns the members of the set at key.
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	return toStrings(c.Do(ctx, "SMEMBERS", key))
+}
+
+// SIsMember reports whether member is in the set at key.
+func (c *Client) SIsMember(ctx context.Context, key string, member any) (bool, error) {
+	return toBool(c.Do(ctx, "SISMEMBER", key, member))
+}
+
+// Z is a member of a sorted set and its score.
+type Z struct {
+	Member string
+	Score  float64
+}
+
+// ZAdd adds members to the sorted set at key, or updates their scores, and
+// returns how many were new.
+func (c *Client) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	args := make([]any, 0, 2+2*len(members))
+	args = append(args, "ZADD", key)
+	for _, m := range members {
+		args = append(args, m.Score, m.Member)
+	}
+	return toInt(c.Do(ctx, args...))
+}
+
+// ZScore returns the score of member in the sorted set at key, or ErrNil.
+func (c *Client) ZScore(ctx context.Context, key, member string) (float64, error) {
+	return toFloat(c.Do(ctx, "ZSCORE", key, member))
+}
+
+// ZRange returns members start to stop of the sorted set at key, by
+// ascending score.
+func (c *Client) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return toStrings(c.Do(ctx, "ZRANGE", key, start, stop))
+}
+
+// ZRangeWithScores is ZRange with the scores.
+func (c *Client) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	reply, err := c.Do(ctx, "ZRANGE", key, start, stop, "WITHSCORES")
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		return nil, unexpected(reply)
+	}
+	// RESP2 sends member, score, member, ...; RESP3 sends [member, score]
+	// pairs.
+	var zs []Z
+	for i := 0; i < len(items); i++ {
+		member, score := items[i], any(nil)
+		if pair, ok := member.([]any); ok && len(pair) == 2 {
+			member, score = pair[0], pair[1]
+		} else if i+1 < len(items) {
+			i++
+			score = items[i]
+		}
+		m, err := toString(member, nil)
+		if err != nil {
+			return nil, err
+		}
+		f, err := toFloat(score, nil)
+		if err != nil {
+			return nil, err
+		}
+		zs = append(zs, Z{m, f})
+	}
+	return zs, nil
+}
+
+// Publish sends message on channel and returns how many clients got it.
+func (c *Client) Publish(ctx context.Context, channel string, message any) (int64, error) {
+	return toInt(c.Do(ctx, "PUBLISH", channel, message))
+}
+
+// Reply conversions. Each takes the result of Do as it is.
+
+func toString(reply any, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch v := reply.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", ErrNil
+	}
+	return "", unexpected(reply)
+}
+
+func toInt(reply any, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, unexpected(reply)
+		}
+		return n, nil
+	case nil:
+		return 0, ErrNil
+	}
+	return 0, unexpected(reply)
+}
+
+func toFloat(reply any, err error) (float64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case string:
+		f, err := parseDouble(v)
+		if err != nil {
+			return 0, unexpected(reply)
+		}
+		return f, nil
+	case nil:
+		return 0, ErrNil
+	}
+	return 0, unexpected(reply)
+}
+
+func toBool(reply any, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	switch v := reply.(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case nil:
+		return false, ErrNil
+	}
+	return false, unexpected(reply)
+}
+
+// toStrings converts an array reply; null elements become "".
+func toStrings(reply any, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNil
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		return nil, unexpected(reply)
+	}
+	out := make([]string, len(items))
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		if out[i], err = toString(item, nil); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// toStringMap converts a map reply, or a flat array of keys and values as
+// RESP2 sends maps.
+func toStringMap(reply any, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case map[string]any:
+		out := make(map[string]string, len(v))
+		for k, item := range v {
+			if out[k], err = toString(item, nil); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case []any:
+		if len(v)%2 != 0 {
+			return nil, unexpected(reply)
+		}
+		out := make(map[string]string, len(v)/2)
+		for i := 0; i < len(v); i += 2 {
+			k, err := toString(v[i], nil)
+			if err != nil {
+				return nil, err
+			}
+			if out[k], err = toString(v[i+1], nil); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, unexpected(reply)
+}
+
+// millis returns d in whole milliseconds, rounding up, so that a positive
+// TTL under a millisecond doesn't become PX 0, which the server rejects.
+func millis(d time.Duration) int64 {
+	ms := d.Milliseconds()
+	if d > time.Duration(ms)*time.Millisecond {
+		ms++
+	}
+	return ms
+}
+
+func stringArgs(ss []string) []any {
+	args := make([]any, len(ss))
+	for i, s := range ss {
+		args[i] = s
+	}
+	return args
+}
+
+func unexpected(reply any) error {
+	return fmt.Errorf("luminaclient: unexpected reply %#v", reply)
+}
@@ -0,0 +1,143 @@
+package luminaclient
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMillis(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int64
+	}{
+		{0, 0},
+		{time.Nanosecond, 1},
+		{999 * time.Microsecond, 1},
+		{time.Millisecond, 1},
+		{time.Millisecond + time.Nanosecond, 2},
+		{1500 * time.Millisecond, 1500},
+		{time.Hour, 3_600_000},
+		{-time.Millisecond, -1},
+		{-500 * time.Microsecond, 0},
+		{1<<63 - 1, 9_223_372_036_855},
+	}
+	for _, tt := range tests {
+		if got := millis(tt.d); got != tt.want {
+			t.Errorf("millis(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+// TTLs go out in milliseconds, and one under a millisecond is not sent as
+// PX 0, which the server rejects.
+func TestTTLArguments(t *testing.T) {
+	s := newFakeServer(t, func(args []string) string {
+		if args[0] == "PEXPIRE" {
+			return ":1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	c := newClient(t, s, Options{})
+	ctx := context.Background()
+
+	calls := []struct {
+		call func() error
+		want []string
+	}{
+		{func() error { return c.Set(ctx, "k", "v", 0) }, []string{"SET", "k", "v"}},
+		{func() error { return c.Set(ctx, "k", "v", 500*time.Microsecond) }, []string{"SET", "k", "v", "PX", "1"}},
+		{func() error { return c.Set(ctx, "k", "v", 1500*time.Millisecond) }, []string{"SET", "k", "v", "PX", "1500"}},
+		{func() error { _, err := c.SetNX(ctx, "k", 7, time.Nanosecond); return err }, []string{"SET", "k", "7", "NX", "PX", "1"}},
+		{func() error { _, err := c.Expire(ctx, "k", 10*time.Microsecond); return err }, []string{"PEXPIRE", "k", "1"}},
+		{func() error { _, err := c.Expire(ctx, "k", time.Minute); return err }, []string{"PEXPIRE", "k", "60000"}},
+	}
+	for i, tt := range calls {
+		if err := tt.call(); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.received()[i]; !slices.Equal(got, tt.want) {
+			t.Errorf("sent %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// The typed helpers accept the replies of both RESP2 and RESP3.
+func TestTypedReplies(t *testing.T) {
+	var next atomic.Value // the reply to send
+	s := newFakeServer(t, func([]string) string { return next.Load().(string) })
+	c := newClient(t, s, Options{})
+	ctx := context.Background()
+
+	tests := []struct {
+		reply string
+		call  func() (any, error)
+		want  any
+	}{
+		{"$5\r\nhello\r\n", func() (any, error) { return c.Get(ctx, "k") }, "hello"},
+		{":42\r\n", func() (any, error) { return c.Get(ctx, "k") }, "42"},
+		{":7\r\n", func() (any, error) { return c.Incr(ctx, "k") }, int64(7)},
+		{"$2\r\n12\r\n", func() (any, error) { return c.DBSize(ctx) }, int64(12)},
+		{":1\r\n", func() (any, error) { return c.Expire(ctx, "k", time.Second) }, true},
+		{":0\r\n", func() (any, error) { return c.Persist(ctx, "k") }, false},
+		{"#t\r\n", func() (any, error) { return c.SIsMember(ctx, "k", "m") }, true},
+		{"$3\r\n2.5\r\n", func() (any, error) { return c.ZScore(ctx, "k", "m") }, 2.5},
+		{",2.5\r\n", func() (any, error) { return c.ZScore(ctx, "k", "m") }, 2.5},
+		{":1500\r\n", func() (any, error) { return c.TTL(ctx, "k") }, 1500 * time.Millisecond},
+		{":-2\r\n", func() (any, error) { return c.TTL(ctx, "k") }, time.Duration(-2)},
+		{"+OK\r\n", func() (any, error) { return c.SetNX(ctx, "k", "v", 0) }, true},
+		{"$-1\r\n", func() (any, error) { return c.SetNX(ctx, "k", "v", 0) }, false},
+		{"*3\r\n$1\r\na\r\n$-1\r\n:3\r\n", func() (any, error) { return c.LRange(ctx, "k", 0, -1) }, []string{"a", "", "3"}},
+		{"~2\r\n$1\r\na\r\n$1\r\nb\r\n", func() (any, error) { return c.SMembers(ctx, "k") }, []string{"a", "b"}},
+		{"*4\r\n$1\r\nf\r\n$1\r\n1\r\n$1\r\ng\r\n$1\r\n2\r\n", func() (any, error) { return c.HGetAll(ctx, "k") },
+			map[string]string{"f": "1", "g": "2"}},
+		{"%2\r\n$1\r\nf\r\n:1\r\n$1\r\ng\r\n$1\r\n2\r\n", func() (any, error) { return c.HGetAll(ctx, "k") },
+			map[string]string{"f": "1", "g": "2"}},
+		{"*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$3\r\n2.5\r\n", func() (any, error) { return c.ZRangeWithScores(ctx, "k", 0, -1) },
+			[]Z{{"a", 1}, {"b", 2.5}}},
+		{"*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2.5\r\n", func() (any, error) { return c.ZRangeWithScores(ctx, "k", 0, -1) },
+			[]Z{{"a", 1}, {"b", 2.5}}},
+		{"*2\r\n$4\r\nlist\r\n$1\r\nx\r\n", func() (any, error) {
+			k, v, err := c.BLPop(ctx, time.Second, "list")
+			return []string{k, v}, err
+		}, []string{"list", "x"}},
+	}
+	for _, tt := range tests {
+		next.Store(tt.reply)
+		got, err := tt.call()
+		if err != nil {
+			t.Errorf("reply %q: %v", tt.reply, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("reply %q gave %#v, want %#v", tt.reply, got, tt.want)
+		}
+	}
+
+	// Null replies are ErrNil; replies of the wrong type are errors too.
+	errorTests := []struct {
+		reply string
+		call  func() error
+	}{
+		{"$-1\r\n", func() error { _, err := c.Get(ctx, "k"); return err }},
+		{"_\r\n", func() error { _, err := c.HGet(ctx, "k", "f"); return err }},
+		{"$-1\r\n", func() error { _, err := c.ZScore(ctx, "k", "m"); return err }},
+		{"*-1\r\n", func() error { _, _, err := c.BLPop(ctx, time.Second, "k"); return err }},
+	}
+	for _, tt := range errorTests {
+		next.Store(tt.reply)
+		if err := tt.call(); !errors.Is(err, ErrNil) {
+			t.Errorf("reply %q gave %v, want ErrNil", tt.reply, err)
+		}
+	}
+	for _, reply := range []string{"*1\r\n+x\r\n", "#t\r\n"} {
+		next.Store(reply)
+		if _, err := c.Incr(ctx, "k"); err == nil || errors.Is(err, ErrNil) {
+			t.Errorf("Incr with reply %q gave %v, want an error", reply, err)
+		}
+	}
+}
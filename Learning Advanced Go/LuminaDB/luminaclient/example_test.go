@@ -0,0 +1,30 @@
+package luminaclient_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"LuminaDB/luminaclient"
+)
+
+func Example() {
+	ctx := context.Background()
+	c := luminaclient.New(luminaclient.Options{Addr: "localhost:8080"})
+	defer c.Close()
+
+	if err := c.Set(ctx, "greeting", "hello", time.Minute); err != nil {
+		fmt.Println(err)
+		return
+	}
+	v, err := c.Get(ctx, "greeting")
+	switch {
+	case errors.Is(err, luminaclient.ErrNil):
+		fmt.Println("no such key")
+	case err != nil:
+		fmt.Println(err)
+	default:
+		fmt.Println(v)
+	}
+}
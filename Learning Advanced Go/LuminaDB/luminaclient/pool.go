@@ -0,0 +1,215 @@
+package luminaclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by calls on a closed Client.
+var ErrClosed = errors.New("luminaclient: client is closed")
+
+// conn is one connection to the server, used by one call at a time.
+type conn struct {
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	usedAt time.Time
+}
+
+// pool hands out connections, at most Options.PoolSize of them at once.
+// Calls wait for a free slot; idle connections are kept for the next call,
+// and those idle for longer than Options.IdleTimeout are closed instead of
+// being reused.
+type pool struct {
+	opts  *Options
+	slots chan struct{} // one token per connection that may be in use
+
+	mu     sync.Mutex
+	idle   []*conn // most recently used last
+	closed bool
+}
+
+func newPool(opts *Options) *pool {
+	return &pool{opts: opts, slots: make(chan struct{}, opts.PoolSize)}
+}
+
+// get returns an idle connection, or dials a new one.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, ErrClosed
+	}
+	for len(p.idle) > 0 {
+		cn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.opts.IdleTimeout <= 0 || time.Since(cn.usedAt) < p.opts.IdleTimeout {
+			p.mu.Unlock()
+			return cn, nil
+		}
+		cn.nc.Close()
+	}
+	p.mu.Unlock()
+
+	cn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put gives cn back. A connection left in an unknown state by an error is
+// closed, and the next call dials a fresh one.
+func (p *pool) put(cn *conn, broken bool) {
+	p.mu.Lock()
+	if broken || p.closed {
+		cn.nc.Close()
+	} else {
+		cn.usedAt = time.Now()
+		p.idle = append(p.idle, cn)
+	}
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// closeIdle closes the idle connections. When the server went away, they
+// are as dead as the one that failed.
+func (p *pool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, cn := range p.idle {
+		cn.nc.Close()
+	}
+	p.idle = nil
+}
+
+// close closes the idle connections; the ones in use are closed as they
+// come back.
+func (p *pool) close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.closed = true
+	p.mu.Unlock()
+	p.closeIdle()
+	return nil
+}
+
+// dial connects and runs the handshake: HELLO for RESP3, otherwise AUTH if
+// a password is set.
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+	o := p.opts
+	ctx, cancel := context.WithTimeout(ctx, o.DialTimeout)
+	defer cancel()
+
+	var nc net.Conn
+	var err error
+	d := &net.Dialer{KeepAlive: 5 * time.Minute}
+	if o.TLS != nil {
+		nc, err = (&tls.Dialer{NetDialer: d, Config: o.TLS}).DialContext(ctx, o.Network, o.Addr)
+	} else {
+		nc, err = d.DialContext(ctx, o.Network, o.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{nc: nc, r: bufio.NewReaderSize(nc, 16<<10), w: bufio.NewWriter(nc)}
+
+	var hello []any
+	switch {
+	case o.Protocol == 3 && o.Password != "":
+		hello = []any{"HELLO", 3, "AUTH", o.username(), o.Password}
+	case o.Protocol == 3:
+		hello = []any{"HELLO", 3}
+	case o.Username != "":
+		hello = []any{"AUTH", o.Username, o.Password}
+	case o.Password != "":
+		hello = []any{"AUTH", o.Password}
+	}
+	if hello != nil {
+		if _, err := cn.roundTrip(ctx, hello, o.ReadTimeout, o.WriteTimeout); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// roundTrip sends cmd and reads its reply. An error reply is returned as
+// the error. The connection gives up when ctx is done, or when a timeout
+// passes if one is set.
+func (cn *conn) roundTrip(ctx context.Context, cmd []any, readTimeout, writeTimeout time.Duration) (any, error) {
+	cn.nc.SetWriteDeadline(deadline(ctx, writeTimeout))
+	cn.nc.SetReadDeadline(deadline(ctx, readTimeout))
+	stop := cn.watch(ctx)
+	defer stop()
+
+	if err := writeCommand(cn.w, cmd); err != nil {
+		return nil, err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	reply, err := readReply(cn.r)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// watch interrupts the connection's reads and writes once ctx is done,
+// right away if it already is, so callers set their own deadlines first.
+// The returned func stops watching.
+func (cn *conn) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		cn.nc.SetDeadline(time.Now())
+	})
+	return func() { stop() }
+}
+
+// deadline returns the earlier of ctx's deadline and timeout from now;
+// the zero time if there is neither.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d, ok := ctx.Deadline()
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); !ok || t.Before(d) {
+			return t
+		}
+	}
+	return d
+}
+
+// ctxErr reports an I/O error caused by ctx as ctx's error. The connection
+// deadline may pass a moment before ctx notices its own, hence the check
+// of the time.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var ne net.Error
+	if d, ok := ctx.Deadline(); ok && errors.As(err, &ne) && ne.Timeout() && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
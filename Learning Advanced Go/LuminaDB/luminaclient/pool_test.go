@@ -0,0 +1,328 @@
+package luminaclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolReusesConnections(t *testing.T) {
+	s := newFakeServer(t, pong)
+	c := newClient(t, s, Options{})
+	for range 10 {
+		if err := c.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("%d connections for 10 calls in a row, want 1", n)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	wait := make(chan struct{})
+	release := sync.OnceFunc(func() { close(wait) })
+	t.Cleanup(release)
+	var running atomic.Int32
+	s := newFakeServer(t, func(args []string) string {
+		if args[0] == "WAIT" {
+			running.Add(1)
+			<-wait
+		}
+		return "+OK\r\n"
+	})
+	c := newClient(t, s, Options{PoolSize: 2})
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for range 5 {
+		wg.Go(func() {
+			_, err := c.Do(ctx, "WAIT")
+			errs <- err
+		})
+	}
+	waitFor(t, func() bool { return running.Load() == 2 })
+	time.Sleep(50 * time.Millisecond) // time for a third call to get through
+	if n := running.Load(); n != 2 {
+		t.Fatalf("%d calls running at once, want PoolSize 2", n)
+	}
+
+	// A call waiting for a connection gives up when its context does.
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(short, "PING"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Do waiting for a connection = %v, want DeadlineExceeded", err)
+	}
+
+	release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	s := newFakeServer(t, pong)
+	c := newClient(t, s, Options{IdleTimeout: 20 * time.Millisecond})
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("%d connections, want 2: the idle one should have been replaced", n)
+	}
+}
+
+// hangServer never answers HANG, and answers anything else with PONG.
+func hangServer(t *testing.T) *fakeServer {
+	hang := make(chan struct{})
+	s := newFakeServer(t, func(args []string) string {
+		if args[0] == "HANG" {
+			<-hang
+			return ""
+		}
+		return "+PONG\r\n"
+	})
+	t.Cleanup(func() { close(hang) })
+	return s
+}
+
+// Cancelling the context interrupts a call blocked on the server, and the
+// connection it was using is not reused: the late reply would be taken
+// for the next command's.
+func TestContextCancelInterruptsCall(t *testing.T) {
+	s := hangServer(t)
+	c := newClient(t, s, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := c.Do(ctx, "HANG"); err != context.Canceled {
+		t.Fatalf("Do = %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("cancelled call took %v", d)
+	}
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("%d connections, want 2: the interrupted one should be dropped", n)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	s := hangServer(t)
+	c := newClient(t, s, Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(ctx, "HANG"); err != context.DeadlineExceeded {
+		t.Fatalf("Do = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestContextDoneBeforeCall(t *testing.T) {
+	s := newFakeServer(t, pong)
+	c := newClient(t, s, Options{})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Ping(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Ping = %v, want context.Canceled", err)
+	}
+}
+
+// A read timeout is not retried: the command may still be running.
+func TestReadTimeout(t *testing.T) {
+	s := hangServer(t)
+	c := newClient(t, s, Options{ReadTimeout: 50 * time.Millisecond})
+	_, err := c.Do(context.Background(), "HANG")
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Do = %v, want a timeout", err)
+	}
+	if n := len(s.received()); n != 1 {
+		t.Errorf("server got %d commands, want 1", n)
+	}
+}
+
+// When the server hangs up, the call is retried on a new connection, and
+// the idle connections, closed too, are not tried.
+func TestRetryAfterServerCloses(t *testing.T) {
+	s := newFakeServer(t, pong)
+	c := newClient(t, s, Options{})
+	ctx := context.Background()
+
+	// Open two connections and leave them idle.
+	var cns []*conn
+	for range 2 {
+		cn, err := c.pool.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cns = append(cns, cn)
+	}
+	for _, cn := range cns {
+		c.pool.put(cn, false)
+	}
+	waitFor(t, func() bool { return s.connections() == 2 })
+
+	s.closeConns()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping after the server closed the connections: %v", err)
+	}
+	if n := s.connections(); n != 3 {
+		t.Errorf("%d connections, want 3", n)
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	s := newFakeServer(t, pong)
+	c := newClient(t, s, Options{MaxRetries: -1})
+	ctx := context.Background()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.closeConns()
+	err := c.Ping(ctx)
+	if err == nil || !retryable(ctx, err) {
+		t.Fatalf("Ping = %v, want the connection error", err)
+	}
+	if n := len(s.received()); n != 1 {
+		t.Errorf("server got %d commands, want 1", n)
+	}
+}
+
+// An error reply leaves the connection in step, so it is kept.
+func TestErrorReplyKeepsConnection(t *testing.T) {
+	s := newFakeServer(t, func(args []string) string {
+		if args[0] == "FAIL" {
+			return "-ERR it failed\r\n"
+		}
+		return "+PONG\r\n"
+	})
+	c := newClient(t, s, Options{})
+	ctx := context.Background()
+
+	_, err := c.Do(ctx, "FAIL")
+	var e Error
+	if !errors.As(err, &e) || e.Prefix() != "ERR" || e.Error() != "ERR it failed" {
+		t.Fatalf("Do = %v, want Error(ERR it failed)", err)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+// A reply over the size limits is a protocol error, and the connection
+// it came on is dropped.
+func TestOversizedReplyDropsConnection(t *testing.T) {
+	s := newFakeServer(t, func(args []string) string {
+		if args[0] == "BIG" {
+			return "$536870913\r\n"
+		}
+		return "+PONG\r\n"
+	})
+	c := newClient(t, s, Options{})
+	ctx := context.Background()
+
+	var pe *ProtocolError
+	if _, err := c.Do(ctx, "BIG"); !errors.As(err, &pe) {
+		t.Fatalf("Do = %v, want a ProtocolError", err)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want []string
+	}{
+		{Options{Password: "pw"}, []string{"AUTH", "pw"}},
+		{Options{Username: "bob", Password: "pw"}, []string{"AUTH", "bob", "pw"}},
+		{Options{Protocol: 3}, []string{"HELLO", "3"}},
+		{Options{Protocol: 3, Password: "pw"}, []string{"HELLO", "3", "AUTH", "default", "pw"}},
+	}
+	for _, tt := range tests {
+		s := newFakeServer(t, func(args []string) string {
+			if args[0] == "HELLO" {
+				return "%1\r\n+server\r\n+lumina\r\n"
+			}
+			return "+OK\r\n"
+		})
+		c := newClient(t, s, tt.opts)
+		if err := c.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		got := s.received()
+		if len(got) != 2 || !slices.Equal(got[0], tt.want) {
+			t.Errorf("%+v: server got %q, want %q then PING", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestHandshakeFailure(t *testing.T) {
+	s := newFakeServer(t, func(args []string) string {
+		return "-WRONGPASS invalid username-password pair\r\n"
+	})
+	c := newClient(t, s, Options{Password: "wrong"})
+	var e Error
+	if err := c.Ping(context.Background()); !errors.As(err, &e) || e.Prefix() != "WRONGPASS" {
+		t.Fatalf("Ping = %v, want WRONGPASS", err)
+	}
+}
+
+func TestClosedClient(t *testing.T) {
+	s := newFakeServer(t, pong)
+	c := New(Options{Addr: s.addr()})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(context.Background()); err != ErrClosed {
+		t.Errorf("Ping after Close = %v, want ErrClosed", err)
+	}
+	if err := c.Close(); err != ErrClosed {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+}
+
+// waitFor polls cond for a few seconds, failing the test if it stays false.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,273 @@
+package luminaclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replies are decoded into the Go values listed at Client.Do.
+
+// Limits on what the server may send, so a corrupt stream can't make the
+// client allocate without bound.
+const (
+	maxBulkLen  = 512 << 20
+	maxArrayLen = 1 << 24
+)
+
+// Error is an error reply from the server, such as "WRONGTYPE Operation
+// against a key holding the wrong kind of value".
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Prefix returns the error code, the first word of the message.
+func (e Error) Prefix() string {
+	prefix, _, _ := strings.Cut(string(e), " ")
+	return prefix
+}
+
+// ProtocolError means the server sent something that is not RESP. The
+// connection can't be used afterwards.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string { return "luminaclient: protocol error: " + e.msg }
+
+func protocolErrorf(format string, args ...any) error {
+	return &ProtocolError{msg: fmt.Sprintf(format, args...)}
+}
+
+// readReply reads one reply.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, protocolErrorf("empty line")
+	}
+	body := string(line[1:])
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return Error(body), nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, protocolErrorf("bad integer %q", body)
+		}
+		return n, nil
+	case '$', '=', '!':
+		s, ok, err := readBulk(r, body)
+		if err != nil || !ok {
+			return nil, err
+		}
+		switch line[0] {
+		case '=':
+			// A verbatim string starts with its format, e.g. "txt:".
+			if len(s) >= 4 && s[3] == ':' {
+				s = s[4:]
+			}
+		case '!':
+			return Error(s), nil
+		}
+		return s, nil
+	case '*', '~', '>':
+		n, err := readLen(body, maxArrayLen)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, 0, min(n, 1024))
+		for range n {
+			v, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	case '%':
+		n, err := readLen(body, maxArrayLen)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		m := make(map[string]any, min(n, 1024))
+		for range n {
+			k, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			v, err := readReply(r)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			m[key] = v
+		}
+		return m, nil
+	case '|':
+		n, err := readLen(body, maxArrayLen)
+		if err != nil {
+			return nil, err
+		}
+		for range 2 * max(n, 0) {
+			if _, err := readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return readReply(r) // the reply the attributes describe
+	case '_':
+		return nil, nil
+	case ',':
+		return parseDouble(body)
+	case '#':
+		switch body {
+		case "t":
+			return true, nil
+		case "f":
+			return false, nil
+		}
+		return nil, protocolErrorf("bad boolean %q", body)
+	case '(':
+		n, ok := new(big.Int).SetString(body, 10)
+		if !ok {
+			return nil, protocolErrorf("bad big number %q", body)
+		}
+		return n, nil
+	}
+	return nil, protocolErrorf("unexpected reply type %q", line[0])
+}
+
+// readLine reads a line and strips its CRLF.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, protocolErrorf("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, protocolErrorf("line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readLen parses the length of a bulk string or aggregate; -1 means null.
+func readLen(s string, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 || n > limit {
+		return 0, protocolErrorf("bad length %q", s)
+	}
+	return n, nil
+}
+
+// readBulk reads the body of a bulk string whose length line was lenLine.
+// It reports false for the null bulk string.
+func readBulk(r *bufio.Reader, lenLine string) (string, bool, error) {
+	n, err := readLen(lenLine, maxBulkLen)
+	if err != nil || n < 0 {
+		return "", false, err
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", false, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", false, protocolErrorf("bulk string not terminated by CRLF")
+	}
+	return string(buf[:n]), true, nil
+}
+
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, protocolErrorf("bad double %q", s)
+	}
+	return f, nil
+}
+
+// writeCommand encodes a command as a RESP array of bulk strings.
+func writeCommand(w *bufio.Writer, args []any) error {
+	var num, scratch [64]byte
+	w.WriteByte('*')
+	w.Write(strconv.AppendInt(num[:0], int64(len(args)), 10))
+	w.WriteString("\r\n")
+	for _, arg := range args {
+		var b []byte
+		s, isString := arg.(string)
+		if !isString {
+			var err error
+			if b, err = appendArg(scratch[:0], arg); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('$')
+		w.Write(strconv.AppendInt(num[:0], int64(len(s)+len(b)), 10))
+		w.WriteString("\r\n")
+		w.WriteString(s)
+		w.Write(b)
+		w.WriteString("\r\n")
+	}
+	return nil
+}
+
+// appendArg appends the bytes sent for a command argument to b.
+func appendArg(b []byte, arg any) ([]byte, error) {
+	switch v := arg.(type) {
+	case string:
+		return append(b, v...), nil
+	case []byte:
+		return append(b, v...), nil
+	case int:
+		return strconv.AppendInt(b, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(b, v, 10), nil
+	case int32:
+		return strconv.AppendInt(b, int64(v), 10), nil
+	case uint:
+		return strconv.AppendUint(b, uint64(v), 10), nil
+	case uint64:
+		return strconv.AppendUint(b, v, 10), nil
+	case uint32:
+		return strconv.AppendUint(b, uint64(v), 10), nil
+	case float64:
+		return strconv.AppendFloat(b, v, 'f', -1, 64), nil
+	case float32:
+		return strconv.AppendFloat(b, float64(v), 'f', -1, 32), nil
+	case bool:
+		if v {
+			return append(b, '1'), nil
+		}
+		return append(b, '0'), nil
+	case time.Duration:
+		// Commands differ in the unit they take.
+		return nil, errors.New("luminaclient: pass a time.Duration as seconds or milliseconds")
+	case fmt.Stringer:
+		return append(b, v.String()...), nil
+	case nil:
+		return nil, errors.New("luminaclient: nil command argument")
+	}
+	return nil, fmt.Errorf("luminaclient: can't send argument of type %T", arg)
+}
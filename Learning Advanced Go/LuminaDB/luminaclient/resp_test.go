@@ -0,0 +1,137 @@
+package luminaclient
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	big, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"+OK\r\n", "OK"},
+		{"-ERR bad\r\n", Error("ERR bad")},
+		{":-42\r\n", int64(-42)},
+		{"$5\r\nhello\r\n", "hello"},
+		{"$0\r\n\r\n", ""},
+		{"$4\r\na\r\nb\r\n", "a\r\nb"},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*0\r\n", []any{}},
+		{"*3\r\n:1\r\n$1\r\na\r\n$-1\r\n", []any{int64(1), "a", nil}},
+		{"*2\r\n*1\r\n+x\r\n-ERR in EXEC\r\n", []any{[]any{"x"}, Error("ERR in EXEC")}},
+
+		// RESP3
+		{"_\r\n", nil},
+		{",1.5\r\n", 1.5},
+		{",-inf\r\n", math.Inf(-1)},
+		{"#t\r\n", true},
+		{"#f\r\n", false},
+		{"(123456789012345678901234567890\r\n", big},
+		{"=15\r\ntxt:hello world\r\n", "hello world"},
+		{"!9\r\nERR blob\n\r\n", Error("ERR blob\n")},
+		{"~2\r\n+a\r\n+b\r\n", []any{"a", "b"}},
+		{">2\r\n+message\r\n+hi\r\n", []any{"message", "hi"}},
+		{"%2\r\n+a\r\n:1\r\n:2\r\n+b\r\n", map[string]any{"a": int64(1), "2": "b"}},
+		{"%-1\r\n", nil},
+		{"|1\r\n+ttl\r\n:3\r\n+value\r\n", "value"},
+	}
+	for _, tt := range tests {
+		got, err := readReply(bufio.NewReader(strings.NewReader(tt.in)))
+		if err != nil {
+			t.Errorf("readReply(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readReply(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	got, err := readReply(bufio.NewReader(strings.NewReader(",nan\r\n")))
+	if f, ok := got.(float64); err != nil || !ok || !math.IsNaN(f) {
+		t.Errorf("readReply(,nan) = %v, %v; want NaN", got, err)
+	}
+}
+
+func TestReadReplyMalformed(t *testing.T) {
+	tests := []string{
+		"\r\n",
+		"+OK\n",
+		"?what\r\n",
+		":12x\r\n",
+		",one\r\n",
+		"#x\r\n",
+		"(12x\r\n",
+		"$abc\r\n",
+		"$-2\r\n",
+		"*-2\r\n",
+		"$3\r\nabcd\r\n",
+		"$536870913\r\n",
+		"$99999999999999999999\r\n",
+		"*16777217\r\n",
+		"%16777217\r\n",
+		"|16777217\r\n",
+		"*1\r\n$-7\r\n",
+		"+" + strings.Repeat("x", 64) + "\r\n", // longer than the reader's buffer
+	}
+	for _, in := range tests {
+		_, err := readReply(bufio.NewReaderSize(strings.NewReader(in), 16))
+		var pe *ProtocolError
+		if !errors.As(err, &pe) {
+			t.Errorf("readReply(%q) = %v, want a ProtocolError", in, err)
+		}
+	}
+}
+
+// A length within the limits is not trusted either: the reply is read as
+// it arrives, so a stream cut short ends with EOF instead of allocating
+// for the length announced.
+func TestReadReplyTruncated(t *testing.T) {
+	tests := []string{
+		"",
+		"+OK",
+		"$5\r\nhel",
+		"*16777216\r\n:1\r\n",
+		"%3\r\n+a\r\n",
+	}
+	for _, in := range tests {
+		_, err := readReply(bufio.NewReader(strings.NewReader(in)))
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("readReply(%q) = %v, want EOF", in, err)
+		}
+	}
+}
+
+type stringer struct{}
+
+func (stringer) String() string { return "str" }
+
+func TestWriteCommand(t *testing.T) {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	args := []any{"SET", []byte("k"), 12, int64(-3), uint32(7), 1.5, true, stringer{}, ""}
+	if err := writeCommand(w, args); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	want := "*9\r\n$3\r\nSET\r\n$1\r\nk\r\n$2\r\n12\r\n$2\r\n-3\r\n$1\r\n7\r\n" +
+		"$3\r\n1.5\r\n$1\r\n1\r\n$3\r\nstr\r\n$0\r\n\r\n"
+	if b.String() != want {
+		t.Errorf("writeCommand = %q, want %q", b.String(), want)
+	}
+
+	for _, arg := range []any{time.Second, nil, struct{}{}} {
+		if err := writeCommand(bufio.NewWriter(io.Discard), []any{"SET", arg}); err == nil {
+			t.Errorf("writeCommand accepted %#v", arg)
+		}
+	}
+}
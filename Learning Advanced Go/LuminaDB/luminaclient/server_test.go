@@ -0,0 +1,115 @@
+package luminaclient
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeServer is a RESP server for the tests. It passes each command to
+// reply and writes back what that returns, which is raw RESP; nothing if
+// it returns "".
+type fakeServer struct {
+	l     net.Listener
+	reply func(args []string) string
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+	commands [][]string
+}
+
+func newFakeServer(t *testing.T, reply func(args []string) string) *fakeServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l, reply: reply}
+	go s.serve()
+	t.Cleanup(func() {
+		l.Close()
+		s.closeConns()
+	})
+	return s
+}
+
+// pong answers every command with PONG.
+func pong([]string) string { return "+PONG\r\n" }
+
+func (s *fakeServer) addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		nc, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, nc)
+		s.accepted++
+		s.mu.Unlock()
+		go s.handle(nc)
+	}
+}
+
+func (s *fakeServer) handle(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	for {
+		cmd, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := cmd.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+		if out := s.reply(args); out != "" {
+			if _, err := io.WriteString(nc, out); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// closeConns hangs up on every client, as a restarting server would.
+func (s *fakeServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nc := range s.conns {
+		nc.Close()
+	}
+	s.conns = nil
+}
+
+// connections returns how many connections the server has accepted.
+func (s *fakeServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// received returns the commands the server has read, in order.
+func (s *fakeServer) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.commands...)
+}
+
+// newClient returns a client of s, closed when the test ends.
+func newClient(t *testing.T, s *fakeServer, opts Options) *Client {
+	t.Helper()
+	opts.Addr = s.addr()
+	c := New(opts)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
@@ -1,50 +1,248 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
 )
 
+const defaultPort = 8080
+
 func main() {
-	clientMode := flag.Bool("client", false, "run as client")
+	cfg := defaultConfig()
+	cfg.registerFlags(flag.CommandLine)
+	configFile := flag.String("config", "", "config file to read settings from; flags override it")
+	clientMode := flag.Bool("client", false, "run as client; arguments after the flags are a command to run once")
+	checkLog := flag.Bool("check-log", false, "verify the log file and exit")
+	repairLog := flag.Bool("repair-log", false, "truncate the log at the first bad frame and exit")
+	benchmark := flag.String("benchmark", "", "run a benchmark and exit (fsync, shards or pipeline)")
+	useTLS := flag.Bool("tls", false, "with -client, connect over TLS")
+	host := flag.String("host", "localhost", "with -client, the server to connect to")
+	flag.StringVar(host, "h", "localhost", "shorthand for -host")
+	flag.IntVar(&cfg.port, "p", cfg.port, "shorthand for -port")
+	password := flag.String("a", "", "with -client, the password to authenticate with")
+	raw := flag.Bool("raw", false, "with -client, print replies bare, for scripts")
+	pipe := flag.Bool("pipe", false, "with -client, send the commands read pipelined and report errors only")
+	cmdFile := flag.String("file", "", "with -client, read commands from this file instead of stdin")
 	flag.Parse()
 
+	// The file goes under the flags: read it, then set the flags given on
+	// the command line again.
+	var configPath string
+	if *configFile != "" {
+		var err error
+		if configPath, err = filepath.Abs(*configFile); err != nil {
+			fmt.Println("Error reading config file:", err)
+			os.Exit(1)
+		}
+		given := make(map[string]string)
+		flag.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+		if err := cfg.loadFile(configPath); err != nil {
+			fmt.Println("Error reading config file:", err)
+			os.Exit(1)
+		}
+		flag.Visit(func(f *flag.Flag) { f.Value.Set(given[f.Name]) })
+	}
+
+	if cfg.dir != "" {
+		if err := os.Chdir(cfg.dir); err != nil {
+			fmt.Println("Error changing directory:", err)
+			os.Exit(1)
+		}
+	}
+
+	files := tlsFiles{certFile: cfg.tlsCertFile, keyFile: cfg.tlsKeyFile, caFile: cfg.tlsCAFile, authClient: cfg.tlsAuthClients}
 	if *clientMode {
-		runInteractiveClient()
+		opts := ClientOptions{Address: net.JoinHostPort(*host, strconv.Itoa(cfg.port))}
+		if cfg.unixSocket != "" {
+			opts = ClientOptions{Network: "unix", Address: cfg.unixSocket}
+		}
+		if *useTLS {
+			files.authClient = "no"
+			certs, err := newCertStore(files)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			opts.TLS = certs.clientConfig(*host)
+		}
+		opts.Password = *password
+		os.Exit(runClient(opts, cliOptions{raw: *raw, pipe: *pipe, file: *cmdFile, args: flag.Args()}))
+	}
+	if *checkLog || *repairLog {
+		os.Exit(CheckLog(cfg.appendFilename, *repairLog))
+	}
+	if *benchmark != "" {
+		os.Exit(runBenchmark(*benchmark))
+	}
+
+	if cfg.port == 0 && cfg.tlsPort == 0 && cfg.unixSocket == "" {
+		fmt.Println("Nothing to listen on: port, tls-port and unixsocket are all disabled")
 		return
 	}
+	var certs *certStore
+	if cfg.tlsPort != 0 || cfg.tlsReplication {
+		var err error
+		if certs, err = newCertStore(files); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
 
 	// Create a new LuminaDB instance
-	db, err := NewLuminaDB("lumina.log")
+	db, err := NewLuminaDB(cfg.appendFilename)
 	if err != nil {
 		fmt.Println("Error creating database:", err)
 		return
 	}
 	defer db.Close()
+	db.snapshotFile = cfg.dbFilename
+	db.config.cfg, db.config.file = cfg, configPath
+
+	db.acl.file = cfg.aclFile
+	if err := db.acl.load(); err != nil {
+		fmt.Println("Error loading ACL file:", err)
+		db.Close()
+		os.Exit(1)
+	}
 
 	// Recover from log
 	if err := db.Recover(); err != nil {
 		fmt.Println("Error recovering database:", err)
+		fmt.Println("Inspect the log with -check-log, or drop everything from the bad frame on with -repair-log")
+		db.Close()
+		os.Exit(1)
 	}
-
-	// Start TCP server
-	listener, err := net.Listen("tcp", "localhost:8080")
-	if err != nil {
-		fmt.Println("Error starting server:", err)
-		return
+	if db.logger.version < logVersion {
+		fmt.Printf("Upgrading log from version %d to %d\n", db.logger.version, logVersion)
+		if err := db.RewriteLog(); err != nil {
+			fmt.Println("Error upgrading log:", err)
+			db.Close()
+			os.Exit(1)
+		}
 	}
-	defer listener.Close()
 
-	fmt.Println("LuminaDB server listening on localhost:8080")
+	// Hand the runtime settings to the server the way CONFIG SET does. An
+	// empty requirepass leaves the default user as the ACL file has it.
+	for _, p := range cfg.params() {
+		if p.apply != nil && (p.name != "requirepass" || cfg.requirePass != "") {
+			p.apply(db, cfg)
+		}
+	}
+	db.repl.port = cfg.port
+	if cfg.port == 0 {
+		db.repl.port = cfg.tlsPort
+	}
+	if cfg.tlsReplication {
+		db.repl.tls = certs
+	}
+	if cfg.replicaOf != "" {
+		host, masterPort, _ := parseReplicaOf(cfg.replicaOf)
+		db.ReplicaOf(host, masterPort)
+	}
+	db.StartLogSync()
+	db.StartExpirySweeper()
+	db.StartStatsSampler()
+	db.StartAutoRewrite(cfg.rewritePercentage, cfg.rewriteMinSize)
+	saveParams, _ := parseSaveParams(cfg.save)
+	db.StartSaveSchedule(saveParams)
 
-	for {
-		conn, err := listener.Accept()
+	// Start the listeners
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	listen := func(kind string, l net.Listener, err error) bool {
 		if err != nil {
-			fmt.Println("Error accepting connection:", err)
-			continue
+			fmt.Printf("Error starting %s server: %v\n", kind, err)
+			return false
+		}
+		listeners = append(listeners, l)
+		fmt.Printf("LuminaDB server listening on %s (%s)\n", l.Addr(), kind)
+		return true
+	}
+	if cfg.port != 0 {
+		l, err := net.Listen("tcp", net.JoinHostPort(cfg.bind, strconv.Itoa(cfg.port)))
+		if !listen("TCP", l, err) {
+			return
+		}
+	}
+	if cfg.tlsPort != 0 {
+		tlsConfig, err := certs.serverConfig()
+		var l net.Listener
+		if err == nil {
+			l, err = tls.Listen("tcp", net.JoinHostPort(cfg.bind, strconv.Itoa(cfg.tlsPort)), tlsConfig)
+		}
+		if !listen("TLS", l, err) {
+			return
 		}
+	}
+	if cfg.unixSocket != "" {
+		socketPerm, _ := parseSocketPerm(cfg.unixSocketPerm)
+		l, err := listenUnix(cfg.unixSocket, socketPerm)
+		if !listen("Unix socket", l, err) {
+			return
+		}
+	}
+	var metrics net.Listener
+	if cfg.metricsPort != 0 {
+		l, err := net.Listen("tcp", net.JoinHostPort(cfg.metricsBind, strconv.Itoa(cfg.metricsPort)))
+		if !listen("metrics", l, err) {
+			return
+		}
+		metrics = l
+	}
+
+	// SIGHUP loads the TLS certificates again, e.g. after they were renewed.
+	if certs != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := certs.reload(); err != nil {
+					fmt.Println("Error reloading TLS certificates, keeping the old ones:", err)
+					continue
+				}
+				fmt.Println("Reloaded TLS certificates")
+			}
+		}()
+	}
+
+	// Every listener is open before the first client is served: a port in
+	// use stops the server before it starts, and once clients are served,
+	// CONFIG SET may change cfg under db.config.mu.
+	for _, l := range listeners {
+		if l != metrics {
+			go serve(l, db)
+		}
+	}
+	if metrics != nil {
+		go serveMetrics(metrics, db)
+	}
 
-		go handleClient(conn, db)
+	// Run until SIGINT, SIGTERM or SHUTDOWN; a second signal gives up on a
+	// graceful shutdown.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	var req shutdownRequest
+	select {
+	case sig := <-stop:
+		fmt.Printf("Received %v, shutting down\n", sig)
+	case req = <-db.shutdownRequests:
+		fmt.Printf("SHUTDOWN requested by client %d\n", req.from.id)
 	}
+	go func() {
+		<-stop
+		fmt.Println("Received a second signal, exiting without saving")
+		os.Exit(1)
+	}()
+	os.Exit(db.Shutdown(listeners, req))
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer runs a server in process on a free port and returns it with
+// its address. Its log, snapshot and ACL file are in a directory of their
+// own. It stops when the test ends.
+func startServer(t *testing.T) (*LuminaDB, string) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := NewLuminaDB(filepath.Join(dir, "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.snapshotFile = filepath.Join(dir, "test.snap")
+	db.acl.file = filepath.Join(dir, "users.acl")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleClient(conn, db)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		db.Close()
+	})
+	return db, l.Addr().String()
+}
+
+// reopen loads a second database from db's log and snapshot, as a restart
+// would. It is closed when the test ends.
+func reopen(t *testing.T, db *LuminaDB) *LuminaDB {
+	t.Helper()
+	r, err := NewLuminaDB(db.logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.snapshotFile = db.snapshotFile
+	t.Cleanup(func() { r.Close() })
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// testConn talks RESP to the server and hands back the replies as the raw
+// bytes sent, so tests check exactly what a client would read.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial connects to addr. Its reads and writes fail after a few seconds, so
+// a server that hangs fails the test instead of stalling it.
+func dial(t *testing.T, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply, failing the test on an I/O
+// error.
+func (c *testConn) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// send writes a command.
+func (c *testConn) send(args ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write(encode(args)); err != nil {
+		c.t.Fatalf("sending %q: %v", args, err)
+	}
+}
+
+// encode returns args as a RESP array of bulk strings, the way clients
+// send commands.
+func encode(args []string) []byte {
+	var b []byte
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, "\r\n"...)
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
+
+// read returns the next reply whole.
+func (c *testConn) read() string {
+	c.t.Helper()
+	var b strings.Builder
+	if err := readRaw(c.r, &b); err != nil {
+		c.t.Fatalf("reading a reply: %v (read %q)", err, b.String())
+	}
+	return b.String()
+}
+
+func readRaw(r *bufio.Reader, b *strings.Builder) error {
+	line, err := r.ReadString('\n')
+	b.WriteString(line)
+	if err != nil {
+		return err
+	}
+	n, _ := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	switch line[0] {
+	case '$', '=', '!':
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		b.Write(buf)
+	case '*', '~', '>', '%', '|':
+		if line[0] == '%' || line[0] == '|' {
+			n *= 2
+		}
+		for range n {
+			if err := readRaw(r, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
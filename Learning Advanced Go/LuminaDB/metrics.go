@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// With metrics-port set, the counters of INFO are also served over HTTP
+// at /metrics in the Prometheus text format. The endpoint has no
+// authentication, so it listens on metrics-bind, localhost unless set
+// otherwise, rather than bind: exposing it is a choice of its own, to be
+// made with a firewall or proxy in front.
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// family starts a metric with its help text and type.
+func (m metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP lumina_%s %s\n# TYPE lumina_%s %s\n", name, help, name, kind)
+}
+
+func (m metricsWriter) sample(name string, value float64) {
+	fmt.Fprintf(m.w, "lumina_%s %g\n", name, value)
+}
+
+func (m metricsWriter) gauge(name, help string, value float64) {
+	m.family(name, "gauge", help)
+	m.sample(name, value)
+}
+
+func (m metricsWriter) counter(name, help string, value float64) {
+	m.family(name, "counter", help)
+	m.sample(name, value)
+}
+
+// perCommand writes one sample per called command.
+func (m metricsWriter) perCommand(name, kind, help string, cmds []*command, value func(*command) float64) {
+	m.family(name, kind, help)
+	for _, cmd := range cmds {
+		fmt.Fprintf(m.w, "lumina_%s{cmd=%q} %g\n", name, cmd.name, value(cmd))
+	}
+}
+
+func (db *LuminaDB) writeMetrics(m metricsWriter) {
+	m.gauge("uptime_seconds", "Seconds since the server started.", time.Since(db.stats.start).Seconds())
+
+	m.gauge("connected_clients", "Open client connections.", float64(db.clients.count()))
+	m.gauge("blocked_clients", "Clients waiting in a blocking command.", float64(db.stats.blockedClients.Load()))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	m.gauge("memory_used_bytes", "Bytes of allocated heap objects.", float64(mem.HeapAlloc))
+	m.gauge("memory_sys_bytes", "Bytes of memory obtained from the OS.", float64(mem.Sys))
+	m.counter("gc_cycles_total", "Completed garbage collection cycles.", float64(mem.NumGC))
+	m.gauge("memory_dataset_bytes", "Approximate bytes held by the keyspace, what maxmemory is compared with.", float64(db.store.used()))
+	m.gauge("memory_max_bytes", "The maxmemory limit, 0 if there is none.", float64(db.maxMemory.Load()))
+
+	log := db.logger.stats()
+	m.gauge("changes_since_last_save", "Writes not yet covered by a snapshot.", float64(db.logger.changeCount()-db.savedChanges.Load()))
+	m.gauge("last_save_timestamp_seconds", "Unix time of the last successful snapshot.", float64(db.lastSave.Load()))
+	m.gauge("last_save_failed", "1 if the last snapshot failed.", float64(boolInt(db.saveFailed.Load())))
+	m.gauge("save_in_progress", "1 while a snapshot is being written.", float64(boolInt(db.saving.Load())))
+	m.gauge("log_size_bytes", "Size of the log file.", float64(log.size))
+	m.gauge("log_rewrite_in_progress", "1 while the log is being rewritten.", float64(boolInt(log.rewriting)))
+	m.counter("log_fsyncs_total", "fsyncs of the log file.", float64(log.fsyncs))
+
+	m.counter("connections_received_total", "Connections accepted.", float64(db.stats.connections.Load()))
+	m.counter("connections_rejected_total", "Connections turned away during shutdown.", float64(db.stats.rejectedConnections.Load()))
+	m.counter("commands_processed_total", "Commands run.", float64(totalCommands()))
+	m.gauge("instantaneous_ops_per_second", "Commands per second over the last couple of seconds.", float64(db.stats.opsPerSec.Load()))
+	m.counter("expired_keys_total", "Keys deleted because their deadline passed.", float64(db.stats.expiredKeys.Load()))
+	m.counter("evicted_keys_total", "Keys evicted to stay under maxmemory.", float64(db.stats.evictedKeys.Load()))
+
+	cmds := calledCommands()
+	m.perCommand("command_calls_total", "counter", "Calls per command.", cmds,
+		func(cmd *command) float64 { return float64(cmd.stats.calls.Load()) })
+	m.perCommand("command_failed_calls_total", "counter", "Calls per command answered with an error.", cmds,
+		func(cmd *command) float64 { return float64(cmd.stats.failed.Load()) })
+	m.perCommand("command_duration_seconds_total", "counter", "Time spent running each command.", cmds,
+		func(cmd *command) float64 { return time.Duration(cmd.stats.nanos.Load()).Seconds() })
+
+	keys, expires := db.store.counts()
+	m.gauge("keys", "Keys in the keyspace.", float64(keys))
+	m.gauge("keys_with_expiry", "Keys with a deadline.", float64(expires))
+
+	role := 0
+	if db.isReplica() {
+		role = 1
+	}
+	db.repl.mu.Lock()
+	offset, replicas := db.repl.offset, len(db.repl.replicas)
+	db.repl.mu.Unlock()
+	m.gauge("replica", "1 on a replica, 0 on a primary.", float64(role))
+	m.gauge("replication_offset", "Replication stream offset.", float64(offset))
+	m.gauge("connected_replicas", "Replicas connected to this server.", float64(replicas))
+}
+
+// serveMetrics answers /metrics on l until it is closed.
+func serveMetrics(l net.Listener, db *LuminaDB) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m := metricsWriter{bufio.NewWriter(w)}
+		db.writeMetrics(m)
+		m.w.Flush()
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	srv.Serve(l)
+}
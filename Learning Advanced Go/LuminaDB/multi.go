@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "multi", handler: multiCommand, arity: 1, flags: flagFast | flagNoMulti, group: "transaction"},
+		&command{name: "exec", handler: execCommand, arity: 1, group: "transaction"},
+		&command{name: "discard", handler: discardCommand, arity: 1, flags: flagFast, group: "transaction"},
+		&command{name: "watch", handler: watchCommand, arity: -2, flags: flagFast | flagNoMulti, group: "transaction", firstKey: 1, lastKey: -1, step: 1},
+		&command{name: "unwatch", handler: unwatchCommand, arity: 1, flags: flagFast, group: "transaction"},
+	)
+}
+
+// Between MULTI and EXEC commands are checked and queued instead of run.
+// EXEC runs them all with every shard locked, so no other client sees the
+// keyspace halfway through, and the logger collects their frames into one
+// transaction frame, so Recover replays all of them or none.
+//
+// WATCH makes EXEC fail if a watched key changes before it runs. Any write
+// command that succeeds on a key counts as a change, even one that left the
+// value as it was, as do expiry, FLUSHALL and serving a blocked client.
+
+// queue adds a command to c's transaction, or rejects it, which makes EXEC
+// abort.
+func (c *clientConn) queue(cmd *command, args []string) {
+	if cmd.flags&flagNoMulti != 0 {
+		c.multiFailed = true
+		c.w.WriteError("ERR Command not allowed inside a transaction")
+		return
+	}
+	c.queued = append(c.queued, args)
+	c.w.WriteSimpleString("QUEUED")
+}
+
+func (c *clientConn) discard() {
+	c.multi, c.queued, c.multiFailed = false, nil, false
+}
+
+// MULTI
+func multiCommand(c *clientConn, args []string) error {
+	if c.multi {
+		return respError("ERR MULTI calls can not be nested")
+	}
+	c.multi = true
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// DISCARD
+func discardCommand(c *clientConn, args []string) error {
+	if !c.multi {
+		return respError("ERR DISCARD without MULTI")
+	}
+	c.discard()
+	c.unwatch()
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// EXEC
+//
+// The reply is an array of the queued commands' replies, or a null array if
+// a watched key changed and nothing ran.
+func execCommand(c *clientConn, args []string) error {
+	if !c.multi {
+		return respError("ERR EXEC without MULTI")
+	}
+	queued, failed := c.queued, c.multiFailed
+	c.discard()
+	defer c.unwatch()
+	if failed {
+		return respError("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if err := c.db.checkQueued(queued); err != nil {
+		return respError("EXECABORT Transaction discarded because of: " + err.Error())
+	}
+	return c.execQueued(queued)
+}
+
+// checkQueued runs the checks of execute that depend on the server's state
+// rather than the command again, as it may have changed since the commands
+// were queued: the server may have become a read only replica, or used up
+// its memory.
+func (db *LuminaDB) checkQueued(queued [][]string) error {
+	var flags cmdFlags
+	for _, args := range queued {
+		flags |= commandTable[strings.ToLower(args[0])].flags
+	}
+	if flags&flagWrite != 0 && db.repl.readOnly.Load() && db.isReplica() {
+		return errReadOnlyReplica
+	}
+	if flags&flagDenyOOM != 0 {
+		return db.freeMemory()
+	}
+	return nil
+}
+
+// execQueued runs a transaction. A blocking command that would wait gets
+// its timeout reply at once, as the shards can't be given up half way.
+func (c *clientConn) execQueued(queued [][]string) error {
+	db := c.db
+	db.store.lock(allShards)
+	if c.watchChanged() {
+		db.store.unlock(allShards)
+		c.w.WriteNullArray()
+		return nil
+	}
+
+	db.logger.beginTxn()
+	wrote := false
+	c.w.WriteArrayLen(len(queued))
+	for _, args := range queued {
+		cmd := commandTable[strings.ToLower(args[0])]
+		start := time.Now()
+		err := cmd.handler(c, args)
+		cmd.stats.record(time.Since(start), err)
+		if cmd.flags&flagWrite != 0 {
+			db.accountCommand(cmd, args)
+		}
+		if err != nil {
+			c.writeError(err)
+		} else if cmd.flags&flagWrite != 0 {
+			db.touchCommand(cmd, args)
+		}
+		if bc := c.blocked; bc != nil {
+			c.blocked = nil
+			db.unblock(bc)
+			bc.onTimeout(c)
+		}
+		wrote = wrote || cmd.flags&flagWrite != 0
+	}
+	db.serveBlocked()
+	// The keyspace already has the changes; if they can't be logged the
+	// connection is dropped so the client doesn't take them as saved.
+	err := db.logger.commitTxn()
+	db.store.unlock(allShards)
+	if err != nil {
+		return fmt.Errorf("failed to log transaction: %w", err)
+	}
+
+	if wrote {
+		if err := db.logger.WaitDurable(); err != nil {
+			return fmt.Errorf("log fsync failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// WATCH key [key ...]
+func watchCommand(c *clientConn, args []string) error {
+	c.db.watch(c, args[1:])
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// UNWATCH
+func unwatchCommand(c *clientConn, args []string) error {
+	c.unwatch()
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// watch adds keys to the ones c watches. A key's deadline is noted too, as
+// reaching it changes the key without anyone writing to it.
+func (db *LuminaDB) watch(c *clientConn, keys []string) {
+	shards := shardsOf(keys...)
+	db.store.rlock(shards)
+	defer db.store.runlock(shards)
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+
+	if c.watching == nil {
+		c.watching = make(map[string]int64)
+	}
+	for _, key := range keys {
+		if _, ok := c.watching[key]; ok {
+			continue
+		}
+		var at int64
+		if _, ok := db.peek(key); ok {
+			at, _ = db.store.deadline(key)
+		}
+		c.watching[key] = at
+		if db.watchers[key] == nil {
+			db.watchers[key] = make(map[*clientConn]struct{})
+		}
+		db.watchers[key][c] = struct{}{}
+	}
+}
+
+// unwatch forgets all keys c watches.
+func (c *clientConn) unwatch() {
+	db := c.db
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+
+	for key := range c.watching {
+		delete(db.watchers[key], c)
+		if len(db.watchers[key]) == 0 {
+			delete(db.watchers, key)
+		}
+	}
+	c.watching, c.watchDirty = nil, false
+}
+
+// watchChanged reports whether a key c watches changed since WATCH.
+// Callers hold every shard for writing.
+func (c *clientConn) watchChanged() bool {
+	c.db.watchMu.Lock()
+	defer c.db.watchMu.Unlock()
+
+	if c.watchDirty {
+		return true
+	}
+	now := nowMillis()
+	for _, at := range c.watching {
+		if at != 0 && at <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// touchKey marks the clients watching key. Callers hold the key's shard
+// for writing.
+func (db *LuminaDB) touchKey(key string) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for c := range db.watchers[key] {
+		c.watchDirty = true
+	}
+}
+
+// touchCommand marks the clients watching the keys of a write command.
+// Callers hold the shards of the keys for writing.
+func (db *LuminaDB) touchCommand(cmd *command, args []string) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if len(db.watchers) == 0 {
+		return
+	}
+	for _, key := range cmd.keys(args) {
+		for c := range db.watchers[key] {
+			c.watchDirty = true
+		}
+	}
+}
+
+// touchAll marks every client watching a key, for FLUSHALL. Callers hold
+// every shard for writing.
+func (db *LuminaDB) touchAll() {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for _, clients := range db.watchers {
+		for c := range clients {
+			c.watchDirty = true
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMultiExec(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "a", "1"}, "+QUEUED\r\n"},
+		{[]string{"INCR", "a"}, "+QUEUED\r\n"},
+		{[]string{"SET", "b", "x"}, "+QUEUED\r\n"},
+		{[]string{"INCR", "b"}, "+QUEUED\r\n"},
+		{[]string{"GET", "a"}, "+QUEUED\r\n"},
+		// A command failing at EXEC doesn't stop the others.
+		{[]string{"EXEC"}, "*5\r\n+OK\r\n:2\r\n+OK\r\n-ERR value is not an integer or out of range\r\n$1\r\n2\r\n"},
+		{[]string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+		{[]string{"DISCARD"}, "-ERR DISCARD without MULTI\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"MULTI"}, "-ERR MULTI calls can not be nested\r\n"},
+		{[]string{"SET", "a", "3"}, "+QUEUED\r\n"},
+		{[]string{"DISCARD"}, "+OK\r\n"},
+		{[]string{"GET", "a"}, "$1\r\n2\r\n"},
+	}
+	for _, step := range steps {
+		if got := c.do(step.args...); got != step.want {
+			t.Errorf("%v = %q, want %q", step.args, got, step.want)
+		}
+	}
+}
+
+// A command rejected while queueing aborts the whole transaction.
+func TestMultiAbort(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	c.do("MULTI")
+	c.do("SET", "a", "1")
+	if got := c.do("NOSUCHCOMMAND"); got[0] != '-' {
+		t.Errorf("unknown command in MULTI = %q, want an error", got)
+	}
+	if got := c.do("GET"); got[0] != '-' {
+		t.Errorf("GET with no key in MULTI = %q, want an error", got)
+	}
+	if got := c.do("WATCH", "a"); got != "-ERR Command not allowed inside a transaction\r\n" {
+		t.Errorf("WATCH in MULTI = %q", got)
+	}
+	if got := c.do("EXEC"); got != "-EXECABORT Transaction discarded because of previous errors.\r\n" {
+		t.Errorf("EXEC = %q, want EXECABORT", got)
+	}
+	if got := c.do("EXISTS", "a"); got != ":0\r\n" {
+		t.Errorf("EXISTS a = %q after the aborted EXEC, want 0", got)
+	}
+}
+
+// The checks that depend on the server's state run again at EXEC, as the
+// state may have changed since the commands were queued.
+func TestExecRechecksServerState(t *testing.T) {
+	_, addr := startServer(t)
+	c, admin := dial(t, addr), dial(t, addr)
+	c.do("SET", "big", strings.Repeat("x", 1000))
+
+	c.do("MULTI")
+	c.do("SET", "a", "1")
+	admin.do("CONFIG", "SET", "maxmemory-policy", "noeviction")
+	admin.do("CONFIG", "SET", "maxmemory", "100")
+	if got := c.do("EXEC"); !strings.HasPrefix(got, "-EXECABORT Transaction discarded because of: OOM ") {
+		t.Errorf("EXEC past maxmemory = %q, want EXECABORT with the OOM error", got)
+	}
+	admin.do("CONFIG", "SET", "maxmemory", "0")
+
+	// Closed at once, so the replica never reaches its primary.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	c.do("MULTI")
+	c.do("SET", "a", "1")
+	c.do("GET", "a")
+	admin.do("REPLICAOF", host, port)
+	t.Cleanup(func() { admin.do("REPLICAOF", "NO", "ONE") })
+	if got := c.do("EXEC"); got != "-EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.\r\n" {
+		t.Errorf("EXEC on a replica = %q, want EXECABORT with READONLY", got)
+	}
+	if got := c.do("EXISTS", "a"); got != ":0\r\n" {
+		t.Errorf("EXISTS a = %q after the aborted EXECs, want 0", got)
+	}
+
+	// A transaction that only reads still runs.
+	c.do("MULTI")
+	c.do("GET", "a")
+	if got := c.do("EXEC"); got != "*1\r\n$-1\r\n" {
+		t.Errorf("read only EXEC on a replica = %q, want it to run", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	_, addr := startServer(t)
+	c, other := dial(t, addr), dial(t, addr)
+
+	// Untouched, the watched key lets EXEC through.
+	c.do("WATCH", "k")
+	c.do("MULTI")
+	c.do("SET", "k", "mine")
+	if got := c.do("EXEC"); got != "*1\r\n+OK\r\n" {
+		t.Errorf("EXEC = %q, want the SET's reply", got)
+	}
+
+	// Written by someone else, it makes EXEC fail, and nothing runs.
+	c.do("WATCH", "k")
+	other.do("SET", "k", "theirs")
+	c.do("MULTI")
+	c.do("SET", "k", "mine again")
+	if got := c.do("EXEC"); got != "*-1\r\n" {
+		t.Errorf("EXEC after a watched key changed = %q, want a null array", got)
+	}
+	if got := c.do("GET", "k"); got != "$6\r\ntheirs\r\n" {
+		t.Errorf("GET k = %q, want theirs", got)
+	}
+
+	// EXEC forgets the watched keys; so does UNWATCH.
+	other.do("SET", "k", "again")
+	c.do("MULTI")
+	c.do("SET", "k", "mine")
+	if got := c.do("EXEC"); got != "*1\r\n+OK\r\n" {
+		t.Errorf("EXEC after the previous one = %q, want it to run", got)
+	}
+	c.do("WATCH", "k")
+	c.do("UNWATCH")
+	other.do("SET", "k", "again")
+	c.do("MULTI")
+	c.do("SET", "k", "mine")
+	if got := c.do("EXEC"); got != "*1\r\n+OK\r\n" {
+		t.Errorf("EXEC after UNWATCH = %q, want it to run", got)
+	}
+}
+
+// INFO reads the key counts without taking the keyspace lock, which EXEC
+// already holds while it runs the queued commands.
+func TestMultiInfoExec(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+	c.do("SET", "a", "1")
+	c.do("SET", "b", "2", "EX", "100")
+
+	c.do("MULTI")
+	c.do("INFO", "keyspace")
+	c.do("DBSIZE")
+	got := c.do("EXEC")
+	if !strings.HasPrefix(got, "*2\r\n") || !strings.HasSuffix(got, ":2\r\n") {
+		t.Fatalf("EXEC = %q, want INFO's reply and DBSIZE 2", got)
+	}
+	if !strings.Contains(got, "db0:keys=2,expires=1") {
+		t.Errorf("INFO keyspace in EXEC = %q, want db0:keys=2,expires=1", got)
+	}
+
+	// The lock was given back: another client gets on.
+	if got := dial(t, addr).do("GET", "a"); got != "$1\r\n1\r\n" {
+		t.Errorf("GET a = %q, want 1", got)
+	}
+}
+
+func TestKeyCountsFollowChanges(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+	steps := []struct {
+		args          []string
+		keys, expires string
+	}{
+		{[]string{"SET", "a", "1"}, "1", "0"},
+		{[]string{"SET", "b", "1", "PX", "100000"}, "2", "1"},
+		{[]string{"EXPIRE", "b", "200"}, "2", "1"},
+		{[]string{"SET", "b", "2"}, "2", "0"},
+		{[]string{"EXPIRE", "a", "100"}, "2", "1"},
+		{[]string{"PERSIST", "a"}, "2", "0"},
+		{[]string{"EXPIRE", "a", "100"}, "2", "1"},
+		{[]string{"DEL", "a"}, "1", "0"},
+		{[]string{"FLUSHALL"}, "0", "0"},
+	}
+	for _, step := range steps {
+		c.do(step.args...)
+		info := c.do("INFO", "keyspace")
+		want := "db0:keys=" + step.keys + ",expires=" + step.expires
+		if step.keys == "0" {
+			want = "# Keyspace\r\n\r\n"
+		}
+		if !strings.Contains(info, want) {
+			t.Errorf("after %v: INFO keyspace = %q, want %q", step.args, info, want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A pipeline whose commands and replies each outgrow the socket buffers
+// completes: the client reads replies while it still sends, and the
+// server sends replies while it still reads.
+func TestPipelineLargerThanSocketBuffers(t *testing.T) {
+	_, addr := startServer(t)
+	c, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	const n = 1000
+	value := strings.Repeat("v", 16<<10)
+	p := c.Pipeline()
+	for i := range n {
+		key := fmt.Sprint("key:", i)
+		p.Queue("SET", key, value)
+		p.Queue("GET", key)
+	}
+	replies, err := p.exec()
+	if err != nil {
+		t.Fatalf("exec: %v after %d replies", err, len(replies))
+	}
+	if len(replies) != 2*n {
+		t.Fatalf("got %d replies, want %d", len(replies), 2*n)
+	}
+	for i := 1; i < len(replies); i += 2 {
+		if r := replies[i]; r.str != value {
+			t.Fatalf("GET key:%d returned %d bytes, want %d", i/2, len(r.str), len(value))
+		}
+	}
+
+	// The connection is still in step.
+	if r, err := c.do([]string{"PING"}); err != nil || r.str != "PONG" {
+		t.Errorf("PING = %+v, %v; want PONG", r, err)
+	}
+}
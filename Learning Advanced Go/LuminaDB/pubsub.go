@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "subscribe", handler: subscribeCommand, arity: -2, flags: flagNoMulti, group: "pubsub"},
+		&command{name: "psubscribe", handler: subscribeCommand, arity: -2, flags: flagNoMulti, group: "pubsub"},
+		&command{name: "unsubscribe", handler: unsubscribeCommand, arity: -1, flags: flagNoMulti, group: "pubsub"},
+		&command{name: "punsubscribe", handler: unsubscribeCommand, arity: -1, flags: flagNoMulti, group: "pubsub"},
+		&command{name: "publish", handler: publishCommand, arity: 3, flags: flagFast, group: "pubsub"},
+		&command{name: "pubsub", handler: pubsubCommand, arity: -2, group: "pubsub"},
+	)
+}
+
+// defaultPubSubLimit is how many bytes may wait to be sent to a subscriber
+// before it is disconnected.
+const defaultPubSubLimit = 32 << 20
+
+// pubsub holds the subscriptions of all clients. It has a lock of its own,
+// since publishing doesn't touch the keyspace.
+type pubsub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*clientConn]struct{}
+	patterns map[string]map[*clientConn]struct{}
+
+	limit atomic.Int64 // output buffer limit of a subscriber in bytes, 0 for none
+}
+
+// A subscribed connection is in push mode: everything it is sent goes
+// through an outbox, which a goroutine of its own writes out. Publishers
+// only ever append to outboxes, so a subscriber that doesn't read can't
+// hold them up; once more than the limit piles up it is disconnected.
+//
+// Under RESP2 a subscribed client may only run the commands below, as it
+// couldn't tell their replies from messages.
+var subscribedCommands = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+}
+
+var (
+	errOutputLimit  = errors.New("output buffer limit reached")
+	errOutboxClosed = errors.New("outbox closed")
+)
+
+type outbox struct {
+	conn  net.Conn
+	limit int
+	resp3 atomic.Bool // the client speaks RESP3; publishers read it
+
+	mu      sync.Mutex
+	wake    *sync.Cond
+	pending []byte
+	size    int   // bytes queued or being written
+	closing bool  // send what is pending, then stop
+	err     error // why sending stopped
+	done    chan struct{}
+}
+
+// newOutbox returns an outbox for conn; it queues writes until run starts
+// sending them.
+func newOutbox(conn net.Conn, limit int) *outbox {
+	o := &outbox{conn: conn, limit: limit, done: make(chan struct{})}
+	o.wake = sync.NewCond(&o.mu)
+	return o
+}
+
+// Write queues p. Going over the limit closes the connection.
+func (o *outbox) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch {
+	case o.err != nil:
+		return 0, o.err
+	case o.closing:
+		return 0, errOutboxClosed
+	case o.limit > 0 && o.size+len(p) > o.limit:
+		o.err = errOutputLimit
+		o.conn.Close()
+		o.wake.Signal()
+		return 0, o.err
+	}
+	o.pending = append(o.pending, p...)
+	o.size += len(p)
+	o.wake.Signal()
+	return len(p), nil
+}
+
+func (o *outbox) run() {
+	defer close(o.done)
+	var buf []byte
+	for {
+		o.mu.Lock()
+		for len(o.pending) == 0 && !o.closing && o.err == nil {
+			o.wake.Wait()
+		}
+		if o.err != nil || len(o.pending) == 0 {
+			o.mu.Unlock()
+			return
+		}
+		buf, o.pending = o.pending, buf[:0]
+		o.mu.Unlock()
+
+		_, err := o.conn.Write(buf)
+
+		o.mu.Lock()
+		o.size -= len(buf)
+		if err != nil && o.err == nil {
+			o.err = err
+		}
+		o.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close stops the outbox once everything queued is sent, and with wait set
+// waits for that. run must have been started.
+func (o *outbox) close(wait bool) error {
+	o.mu.Lock()
+	o.closing = true
+	o.wake.Signal()
+	o.mu.Unlock()
+	if !wait {
+		return nil
+	}
+	<-o.done
+	return o.err
+}
+
+// startPush switches c to push mode; the subscribe commands call it before
+// their first confirmation.
+func (c *clientConn) startPush() error {
+	if c.push != nil {
+		return nil
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	c.push = newOutbox(c.conn, int(c.db.pubsub.limit.Load()))
+	c.push.resp3.Store(c.w.proto == 3)
+	go c.push.run()
+	c.w = &RespWriter{w: bufio.NewWriter(c.push), proto: c.w.proto}
+	return nil
+}
+
+// stopPush leaves push mode once c has no subscriptions left, after
+// everything queued has been sent.
+func (c *clientConn) stopPush() error {
+	err := c.w.Flush()
+	if cerr := c.push.close(true); err == nil {
+		err = cerr
+	}
+	c.w = &RespWriter{w: bufio.NewWriterSize(c.conn, replyBufferSize), proto: c.w.proto}
+	c.push = nil
+	return err
+}
+
+// leavePubSub drops c's subscriptions when the connection ends.
+func (c *clientConn) leavePubSub() {
+	if c.subscriptions() > 0 {
+		ps := &c.db.pubsub
+		ps.mu.Lock()
+		for ch := range c.channels {
+			ps.remove(ps.channels, ch, c)
+		}
+		for pat := range c.patterns {
+			ps.remove(ps.patterns, pat, c)
+		}
+		ps.mu.Unlock()
+	}
+	if c.push != nil {
+		c.push.close(false)
+	}
+}
+
+// subscriptions counts c's channels and patterns. Only c's own goroutine
+// changes them, so it may read them without the lock.
+func (c *clientConn) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (ps *pubsub) remove(m map[string]map[*clientConn]struct{}, name string, c *clientConn) {
+	delete(m[name], c)
+	if len(m[name]) == 0 {
+		delete(m, name)
+	}
+}
+
+// SUBSCRIBE channel [channel ...], PSUBSCRIBE pattern [pattern ...]
+func subscribeCommand(c *clientConn, args []string) error {
+	if err := c.startPush(); err != nil {
+		return err
+	}
+	ps := &c.db.pubsub
+	kind, subs, mine := "subscribe", ps.channels, &c.channels
+	if strings.ToUpper(args[0]) == "PSUBSCRIBE" {
+		kind, subs, mine = "psubscribe", ps.patterns, &c.patterns
+	}
+
+	// The confirmations reach the outbox before the lock is released, so
+	// no message can overtake them.
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if *mine == nil {
+		*mine = make(map[string]struct{})
+	}
+	for _, name := range args[1:] {
+		(*mine)[name] = struct{}{}
+		if subs[name] == nil {
+			subs[name] = make(map[*clientConn]struct{})
+		}
+		subs[name][c] = struct{}{}
+		c.w.WritePushLen(3)
+		c.w.WriteBulk(kind)
+		c.w.WriteBulk(name)
+		c.w.WriteInteger(int64(c.subscriptions()))
+	}
+	return c.w.Flush()
+}
+
+// UNSUBSCRIBE [channel ...], PUNSUBSCRIBE [pattern ...]
+//
+// Without arguments all channels, or all patterns, are dropped.
+func unsubscribeCommand(c *clientConn, args []string) error {
+	ps := &c.db.pubsub
+	kind, subs, mine := "unsubscribe", ps.channels, c.channels
+	if strings.ToUpper(args[0]) == "PUNSUBSCRIBE" {
+		kind, subs, mine = "punsubscribe", ps.patterns, c.patterns
+	}
+	names := args[1:]
+	if len(names) == 0 {
+		for name := range mine {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(names) == 0 {
+		c.w.WritePushLen(3)
+		c.w.WriteBulk(kind)
+		c.w.WriteNull()
+		c.w.WriteInteger(int64(c.subscriptions()))
+		return nil
+	}
+	for _, name := range names {
+		if _, ok := mine[name]; ok {
+			delete(mine, name)
+			ps.remove(subs, name, c)
+		}
+		c.w.WritePushLen(3)
+		c.w.WriteBulk(kind)
+		c.w.WriteBulk(name)
+		c.w.WriteInteger(int64(c.subscriptions()))
+	}
+	return nil
+}
+
+// PUBLISH channel message
+func publishCommand(c *clientConn, args []string) error {
+	c.w.WriteInteger(int64(c.db.pubsub.publish(args[1], args[2])))
+	return nil
+}
+
+// publish sends message to the subscribers of channel and of the patterns
+// matching it, and returns how many deliveries that made.
+func (ps *pubsub) publish(channel, message string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	n := 0
+	msg := pushMessage{items: []string{"message", channel, message}}
+	for c := range ps.channels[channel] {
+		ps.deliver(c, &msg)
+		n++
+	}
+	for pattern, clients := range ps.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		pmsg := pushMessage{items: []string{"pmessage", pattern, channel, message}}
+		for c := range clients {
+			ps.deliver(c, &pmsg)
+			n++
+		}
+	}
+	return n
+}
+
+func (ps *pubsub) deliver(c *clientConn, msg *pushMessage) {
+	o := c.push
+	if _, err := o.Write(msg.encode(o.resp3.Load())); err == errOutputLimit {
+		fmt.Printf("Disconnecting client %d: more than %d bytes of messages waiting\n", c.id, ps.limit.Load())
+	}
+}
+
+// pushMessage is a message encoded once per protocol, however many
+// subscribers it goes to.
+type pushMessage struct {
+	items []string
+	enc   [2][]byte // RESP2, RESP3
+}
+
+func (m *pushMessage) encode(resp3 bool) []byte {
+	i, proto := 0, 2
+	if resp3 {
+		i, proto = 1, 3
+	}
+	if m.enc[i] == nil {
+		var buf bytes.Buffer
+		w := &RespWriter{w: bufio.NewWriter(&buf), proto: proto}
+		w.WritePushLen(len(m.items))
+		for _, item := range m.items {
+			w.WriteBulk(item)
+		}
+		w.Flush()
+		m.enc[i] = buf.Bytes()
+	}
+	return m.enc[i]
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func pubsubCommand(c *clientConn, args []string) error {
+	ps := &c.db.pubsub
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "CHANNELS" && len(args) <= 3:
+		var names []string
+		for name := range ps.channels {
+			if len(args) == 2 || globMatch(args[2], name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		c.w.WriteBulks(names)
+	case sub == "NUMSUB":
+		c.w.WriteMapLen(len(args) - 2)
+		for _, name := range args[2:] {
+			c.w.WriteBulk(name)
+			c.w.WriteInteger(int64(len(ps.channels[name])))
+		}
+	case sub == "NUMPAT" && len(args) == 2:
+		c.w.WriteInteger(int64(len(ps.patterns)))
+	case sub == "CHANNELS" || sub == "NUMPAT":
+		return errWrongArgs("pubsub|" + strings.ToLower(sub))
+	default:
+		return respError(fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[1]))
+	}
+	return nil
+}
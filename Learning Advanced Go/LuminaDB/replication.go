@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "replicaof", handler: replicaofCommand, arity: 3, flags: flagAdmin | flagNoMulti, group: "server"},
+		&command{name: "slaveof", handler: replicaofCommand, arity: 3, flags: flagAdmin | flagNoMulti, group: "server"},
+		&command{name: "replconf", handler: replconfCommand, arity: -3, flags: flagAdmin | flagNoMulti, group: "server"},
+		&command{name: "psync", handler: psyncCommand, arity: 3, flags: flagAdmin | flagNoMulti, group: "server"},
+	)
+}
+
+// A replica connects to its primary like any client and sends PSYNC with
+// the replication id and offset it has got to. The offset counts bytes of
+// the replication stream, which is the frames the primary's Logger writes.
+// If the id matches and the backlog, the latest part of the stream, still
+// reaches back to the offset, the primary carries on from there. Otherwise
+// it sends a snapshot and the stream from where the snapshot was taken.
+//
+// A replica writes the frames it receives to its own log unchanged and
+// streams them on, so replicas of a replica see the same ids and offsets.
+
+const (
+	defaultBacklogSize        = 1 << 20
+	defaultReplicaBufferLimit = 256 << 20
+
+	replAckInterval      = time.Second
+	replRetryInterval    = time.Second
+	replHandshakeTimeout = 10 * time.Second
+	maxReplFramePayload  = 2*maxBulkLen + 64
+)
+
+var (
+	errReadOnlyReplica   = respError("READONLY You can't write against a read only replica.")
+	errReplicaConnection = respError("ERR Command is not valid when client is a replica.")
+)
+
+type replication struct {
+	mu      sync.Mutex
+	replid  string
+	replid2 string // the id before the last promotion, which replicas of the old primary still use
+	offset  int64  // bytes of the stream so far
+	offset2 int64  // replid2 holds up to this offset; -1 without replid2
+
+	backlog      []byte
+	backlogStart int64 // stream offset of backlog[0]
+	replicas     map[*replicaLink]struct{}
+
+	// Settings; CONFIG SET changes these under mu.
+	backlogSize int
+	bufferLimit int    // bytes that may wait to be sent to a replica
+	masterUser  string // credentials for the primary; no AUTH without masterAuth
+	masterAuth  string
+
+	// Settings fixed before the server starts.
+	port int        // this server's port, which its primary shows in INFO
+	tls  *certStore // dial the primary over TLS if set
+
+	readOnly atomic.Bool // reject writes from clients while a replica
+
+	master   atomic.Pointer[masterLink] // set while this server is a replica
+	switchMu sync.Mutex                 // serializes REPLICAOF
+}
+
+func newReplication() *replication {
+	r := &replication{
+		replid:      newReplID(),
+		offset2:     -1,
+		replicas:    make(map[*replicaLink]struct{}),
+		backlogSize: defaultBacklogSize,
+		bufferLimit: defaultReplicaBufferLimit,
+		port:        defaultPort,
+	}
+	r.readOnly.Store(true)
+	return r
+}
+
+func newReplID() string {
+	return fmt.Sprintf("%016x%016x%08x", rand.Uint64(), rand.Uint64(), rand.Uint32())
+}
+
+func (db *LuminaDB) isReplica() bool {
+	return db.repl.master.Load() != nil
+}
+
+// position returns the replication id and stream offset.
+func (r *replication) position() (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.replid, r.offset
+}
+
+// feed is called by the Logger with every frame it writes. On a replica
+// those are writes of its own clients, which the stream doesn't carry.
+func (r *replication) feed(buf []byte) {
+	if r.master.Load() != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forward(buf)
+}
+
+// forward appends frames to the stream. Callers hold r.mu.
+func (r *replication) forward(buf []byte) {
+	r.offset += int64(len(buf))
+	r.backlog = append(r.backlog, buf...)
+	if len(r.backlog) > 2*r.backlogSize {
+		drop := len(r.backlog) - r.backlogSize
+		r.backlog = append(r.backlog[:0], r.backlog[drop:]...)
+		r.backlogStart += int64(drop)
+	}
+	for link := range r.replicas {
+		if _, err := link.out.Write(buf); err == errOutputLimit {
+			fmt.Printf("Disconnecting replica %s: more than %d bytes waiting\n", link, r.bufferLimit)
+		}
+	}
+}
+
+// canContinue reports whether a replica at offset of stream replid can be
+// served from the backlog. Callers hold r.mu.
+func (r *replication) canContinue(replid string, offset int64) bool {
+	if replid != r.replid && (replid != r.replid2 || offset > r.offset2) {
+		return false
+	}
+	return offset >= r.backlogStart && offset <= r.offset
+}
+
+// reset starts the stream afresh at the primary's position after a full
+// sync. Replicas of this server can't follow across it and have to sync
+// again.
+func (r *replication) reset(replid string, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replid, r.offset = replid, offset
+	r.replid2, r.offset2 = "", -1
+	r.backlog, r.backlogStart = r.backlog[:0], offset
+	for link := range r.replicas {
+		link.c.conn.Close()
+	}
+}
+
+// replicaLink is the primary's end of a replica connection.
+type replicaLink struct {
+	c      *clientConn
+	out    *outbox
+	addr   string
+	port   int // the replica's own port, from REPLCONF
+	online atomic.Bool
+
+	ackOffset atomic.Int64
+	ackTime   atomic.Int64 // unix ms of the last ACK
+}
+
+func (link *replicaLink) String() string {
+	return net.JoinHostPort(link.addr, strconv.Itoa(link.port))
+}
+
+// PSYNC replicationid offset
+//
+// Sent by a replica; from the reply on the connection carries the stream.
+func psyncCommand(c *clientConn, args []string) error {
+	if c.replica != nil {
+		return errReplicaConnection
+	}
+	offset, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	db, r := c.db, c.db.repl
+	link := &replicaLink{c: c, port: c.replPort}
+	link.addr, _, _ = net.SplitHostPort(c.conn.RemoteAddr().String())
+	link.ackOffset.Store(-1)
+	link.ackTime.Store(nowMillis())
+
+	// With the store locked nothing is written, so the snapshot or backlog
+	// ends exactly where the frames queued in link.out begin.
+	var snap *snapshotData
+	var backlog []byte
+	db.store.rlock(allShards)
+	r.mu.Lock()
+	link.out = newOutbox(c.conn, r.bufferLimit)
+	partial := r.canContinue(args[1], offset)
+	if partial {
+		backlog = append([]byte(nil), r.backlog[offset-r.backlogStart:]...)
+	} else {
+		snap = &snapshotData{created: nowMillis()}
+		snap.values, snap.expires = db.store.snapshot()
+		offset = r.offset
+	}
+	replid := r.replid
+	r.replicas[link] = struct{}{}
+	r.mu.Unlock()
+	db.store.runlock(allShards)
+	c.replica = link
+
+	if partial {
+		fmt.Printf("Replica %s continues from offset %d\n", link, offset)
+		c.w.WriteSimpleString("CONTINUE " + replid)
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(backlog); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := encodeSnapshot(&buf, snap); err != nil {
+			return err
+		}
+		fmt.Printf("Full resync of replica %s: %d keys, %d bytes at offset %d\n", link, len(snap.values), buf.Len(), offset)
+		c.w.WriteSimpleString(fmt.Sprintf("FULLRESYNC %s %d", replid, offset))
+		c.w.WriteBulk(buf.String())
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// Everything sent from here on goes behind the stream.
+	c.w = &RespWriter{w: bufio.NewWriter(link.out), proto: c.w.proto}
+	go link.out.run()
+	link.online.Store(true)
+	return nil
+}
+
+// leaveReplication forgets a replica whose connection ended.
+func (c *clientConn) leaveReplication() {
+	link := c.replica
+	if link == nil {
+		return
+	}
+	r := c.db.repl
+	r.mu.Lock()
+	delete(r.replicas, link)
+	r.mu.Unlock()
+	link.out.close(false)
+	fmt.Printf("Replica %s disconnected\n", link)
+}
+
+// REPLCONF LISTENING-PORT port | ACK offset | CAPA capability
+func replconfCommand(c *clientConn, args []string) error {
+	switch strings.ToUpper(args[1]) {
+	case "LISTENING-PORT":
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errNotInteger
+		}
+		c.replPort = port
+	case "ACK":
+		// Replicas don't read replies, so ACK gets none.
+		if offset, err := strconv.ParseInt(args[2], 10, 64); err == nil && c.replica != nil {
+			c.replica.ackOffset.Store(offset)
+			c.replica.ackTime.Store(nowMillis())
+		}
+		return nil
+	case "CAPA":
+	default:
+		return errSyntax
+	}
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// REPLICAOF host port, REPLICAOF NO ONE
+func replicaofCommand(c *clientConn, args []string) error {
+	if c.replica != nil {
+		return errReplicaConnection
+	}
+	if strings.EqualFold(args[1], "NO") && strings.EqualFold(args[2], "ONE") {
+		c.db.Promote()
+		c.w.WriteSimpleString("OK")
+		return nil
+	}
+	port, err := strconv.Atoi(args[2])
+	if err != nil || port <= 0 || port > 65535 {
+		return respError("ERR Invalid master port")
+	}
+	if m := c.db.repl.master.Load(); m != nil && m.host == args[1] && m.port == port {
+		c.w.WriteSimpleString("OK Already connected to specified master")
+		return nil
+	}
+	c.db.ReplicaOf(args[1], port)
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// parseReplicaOf parses the "<host> <port>" of the -replicaof flag.
+func parseReplicaOf(s string) (string, int, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 2 {
+		if port, err := strconv.Atoi(fields[1]); err == nil && port > 0 && port <= 65535 {
+			return fields[0], port, nil
+		}
+	}
+	return "", 0, fmt.Errorf("invalid replicaof %q, expected \"<host> <port>\"", s)
+}
+
+// ReplicaOf makes the server a replica of host:port, leaving its current
+// primary if it has one.
+func (db *LuminaDB) ReplicaOf(host string, port int) {
+	r := db.repl
+	r.switchMu.Lock()
+	defer r.switchMu.Unlock()
+
+	// The old link stays in place until it has stopped, so clients can't
+	// write in between.
+	if old := r.master.Load(); old != nil {
+		old.close()
+	}
+	m := &masterLink{host: host, port: port, stop: make(chan struct{}), done: make(chan struct{})}
+	m.downSince.Store(nowMillis())
+	r.master.Store(m)
+	fmt.Printf("Replicating %s\n", m.addr())
+	db.bg.Add(1)
+	go m.run(db)
+}
+
+// Promote turns a replica into a primary. It keeps its data and offset and
+// starts a new replication id; replicas that followed the same primary can
+// still continue from the old one.
+func (db *LuminaDB) Promote() {
+	r := db.repl
+	r.switchMu.Lock()
+	defer r.switchMu.Unlock()
+
+	m := r.master.Load()
+	if m == nil {
+		return
+	}
+	m.close()
+
+	r.mu.Lock()
+	r.master.Store(nil)
+	r.replid2, r.offset2 = r.replid, r.offset
+	r.replid = newReplID()
+	r.mu.Unlock()
+	fmt.Println("Promoted to primary")
+}
+
+// masterLink is a replica's connection to its primary. It reconnects until
+// it is closed.
+type masterLink struct {
+	host string
+	port int
+	stop chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	conn    net.Conn
+	stopped bool
+
+	up        atomic.Bool
+	syncing   atomic.Bool
+	lastIO    atomic.Int64 // unix ms
+	downSince atomic.Int64 // unix ms
+}
+
+func (m *masterLink) addr() string {
+	return net.JoinHostPort(m.host, strconv.Itoa(m.port))
+}
+
+// close stops the link and waits for it to finish.
+func (m *masterLink) close() {
+	close(m.stop)
+	<-m.done
+}
+
+// setConn records the live connection so stopping can close it. It
+// reports false if the link is already stopping.
+func (m *masterLink) setConn(conn net.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return false
+	}
+	m.conn = conn
+	return true
+}
+
+func (m *masterLink) run(db *LuminaDB) {
+	defer db.bg.Done()
+	defer close(m.done)
+
+	// Closing the connection is what interrupts a sync in progress.
+	go func() {
+		select {
+		case <-m.stop:
+		case <-db.quit:
+		}
+		m.mu.Lock()
+		m.stopped = true
+		if m.conn != nil {
+			m.conn.Close()
+		}
+		m.mu.Unlock()
+	}()
+
+	var lastErr string
+	for {
+		err := m.sync(db)
+		if m.up.Swap(false) {
+			lastErr = ""
+			m.downSince.Store(nowMillis())
+		}
+		m.syncing.Store(false)
+
+		select {
+		case <-m.stop:
+			return
+		case <-db.quit:
+			return
+		default:
+		}
+		// A primary that stays down is only reported once.
+		if err.Error() != lastErr {
+			fmt.Printf("Connection to primary %s lost: %v\n", m.addr(), err)
+			lastErr = err.Error()
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-db.quit:
+			return
+		case <-time.After(replRetryInterval):
+		}
+	}
+}
+
+// sync connects to the primary, catches up with it and applies the stream
+// until the connection fails.
+func (m *masterLink) sync(db *LuminaDB) error {
+	dialer := &net.Dialer{Timeout: replHandshakeTimeout}
+	var conn net.Conn
+	var err error
+	if certs := db.repl.tls; certs != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr(), certs.clientConfig(m.host))
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr())
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !m.setConn(conn) {
+		return errors.New("replication stopped")
+	}
+
+	p := NewRespParser(conn)
+	w := NewRespWriter(conn)
+	request := func(args ...string) (string, error) {
+		w.WriteBulks(args)
+		if err := w.Flush(); err != nil {
+			return "", err
+		}
+		line, err := p.readLine(maxLineSize)
+		if err != nil {
+			return "", err
+		}
+		if len(line) == 0 || line[0] != '+' {
+			return "", fmt.Errorf("%s: %s", args[0], printable(line))
+		}
+		return string(line[1:]), nil
+	}
+
+	conn.SetDeadline(time.Now().Add(replHandshakeTimeout))
+	if _, err := request("PING"); err != nil {
+		return err
+	}
+	if auth := db.repl.authArgs(); auth != nil {
+		if _, err := request(auth...); err != nil {
+			return err
+		}
+	}
+	if _, err := request("REPLCONF", "listening-port", strconv.Itoa(db.repl.port)); err != nil {
+		return err
+	}
+	replid, offset := db.repl.position()
+	reply, err := request("PSYNC", replid, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch fields := strings.Fields(reply); {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad PSYNC reply %q", reply)
+		}
+		m.syncing.Store(true)
+		if err := db.loadFromMaster(p, fields[1], offset); err != nil {
+			return fmt.Errorf("full resync failed: %w", err)
+		}
+		m.syncing.Store(false)
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		if len(fields) == 2 && fields[1] != replid {
+			// The primary was promoted since; its stream goes on under
+			// a new id.
+			db.repl.mu.Lock()
+			db.repl.replid2, db.repl.offset2 = db.repl.replid, db.repl.offset
+			db.repl.replid = fields[1]
+			db.repl.mu.Unlock()
+		}
+		fmt.Printf("Continuing replication from %s at offset %d\n", m.addr(), offset)
+	default:
+		return fmt.Errorf("bad PSYNC reply %q", reply)
+	}
+
+	m.up.Store(true)
+	m.lastIO.Store(nowMillis())
+	stopAcks := make(chan struct{})
+	defer close(stopAcks)
+	go m.sendAcks(db, w, stopAcks)
+	return db.applyStream(m, p.reader)
+}
+
+// authArgs returns the AUTH command for the primary, nil without a
+// password.
+func (r *replication) authArgs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.masterAuth == "":
+		return nil
+	case r.masterUser == "":
+		return []string{"AUTH", r.masterAuth}
+	default:
+		return []string{"AUTH", r.masterUser, r.masterAuth}
+	}
+}
+
+// sendAcks tells the primary how far the replica has got, which is what
+// the primary shows as its lag.
+func (m *masterLink) sendAcks(db *LuminaDB, w *RespWriter, stop chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		_, offset := db.repl.position()
+		w.WriteBulks([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)})
+		if err := w.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadFromMaster replaces the data set with the snapshot of a full resync
+// and rewrites the local log to match.
+func (db *LuminaDB) loadFromMaster(p *RespParser, replid string, offset int64) error {
+	line, err := p.readLine(maxLineSize)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(string(bytes.TrimPrefix(line, []byte("$"))), 10, 64)
+	if err != nil || len(line) == 0 || line[0] != '$' || size < 0 {
+		return fmt.Errorf("expected snapshot, got %q", printable(line))
+	}
+	body := io.LimitReader(p.reader, size)
+	snap, err := decodeSnapshot(bufio.NewReader(body), size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	if _, err := p.reader.Discard(2); err != nil {
+		return err
+	}
+
+	db.store.lock(allShards)
+	db.store.load(snap.values, snap.expires)
+	db.touchAll()
+	db.repl.reset(replid, offset)
+	db.store.unlock(allShards)
+	fmt.Printf("Full resync: loaded %d keys at offset %d\n", len(snap.values), offset)
+
+	return db.RewriteLog()
+}
+
+// applyStream reads frames from the primary and applies them until the
+// connection fails.
+func (db *LuminaDB) applyStream(m *masterLink, r *bufio.Reader) error {
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		payload := int64(binary.BigEndian.Uint32(header[9:13])) + int64(binary.BigEndian.Uint32(header[13:17]))
+		if payload > maxReplFramePayload {
+			return fmt.Errorf("frame of %d bytes from primary", payload)
+		}
+		frame := make([]byte, frameHeaderSize+payload+frameCRCSize)
+		copy(frame, header)
+		if _, err := io.ReadFull(r, frame[frameHeaderSize:]); err != nil {
+			return err
+		}
+		m.lastIO.Store(nowMillis())
+		if err := db.applyReplicated(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// applyReplicated logs and applies one frame from the primary and passes
+// it on to this server's own replicas.
+func (db *LuminaDB) applyReplicated(frame []byte) error {
+	var action byte
+	var key, value string
+	_, err := readFrames(bytes.NewReader(frame), logVersion, 0, int64(len(frame)), func(a byte, k, v string) error {
+		action, key, value = a, k, v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.store.lock(allShards)
+	defer db.store.unlock(allShards)
+	if err := db.logger.appendFrames(frame); err != nil {
+		return fmt.Errorf("failed to log to disk: %w", err)
+	}
+	if err := db.applyFrame(action, key, value, nowMillis()); err != nil {
+		// The data set may be half way through the frame; only a full
+		// resync can be trusted now.
+		db.repl.reset(newReplID(), 0)
+		return err
+	}
+	db.repl.mu.Lock()
+	db.repl.forward(frame)
+	db.repl.mu.Unlock()
+	return nil
+}
+
+// writeReplicationInfo adds the replication section to INFO.
+func (db *LuminaDB) writeReplicationInfo(b *strings.Builder) {
+	r := db.repl
+	now := nowMillis()
+	if m := r.master.Load(); m != nil {
+		fmt.Fprintf(b, "role:slave\r\n")
+		fmt.Fprintf(b, "master_host:%s\r\nmaster_port:%d\r\n", m.host, m.port)
+		if m.up.Load() {
+			fmt.Fprintf(b, "master_link_status:up\r\n")
+		} else {
+			fmt.Fprintf(b, "master_link_status:down\r\n")
+		}
+		lastIO := int64(-1)
+		if at := m.lastIO.Load(); at != 0 {
+			lastIO = (now - at) / 1000
+		}
+		fmt.Fprintf(b, "master_last_io_seconds_ago:%d\r\n", lastIO)
+		fmt.Fprintf(b, "master_sync_in_progress:%d\r\n", boolInt(m.syncing.Load()))
+		_, offset := r.position()
+		fmt.Fprintf(b, "slave_repl_offset:%d\r\n", offset)
+		fmt.Fprintf(b, "slave_read_only:%d\r\n", boolInt(r.readOnly.Load()))
+		if !m.up.Load() {
+			fmt.Fprintf(b, "master_link_down_since_seconds:%d\r\n", (now-m.downSince.Load())/1000)
+		}
+	} else {
+		fmt.Fprintf(b, "role:master\r\n")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	links := make([]*replicaLink, 0, len(r.replicas))
+	for link := range r.replicas {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].String() < links[j].String() })
+	fmt.Fprintf(b, "connected_slaves:%d\r\n", len(links))
+	for i, link := range links {
+		state := "wait_bgsave"
+		if link.online.Load() {
+			state = "online"
+		}
+		fmt.Fprintf(b, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, link.addr, link.port, state, max(link.ackOffset.Load(), 0), (now-link.ackTime.Load())/1000)
+	}
+	replid2 := r.replid2
+	if replid2 == "" {
+		replid2 = strings.Repeat("0", 40)
+	}
+	fmt.Fprintf(b, "master_replid:%s\r\nmaster_replid2:%s\r\n", r.replid, replid2)
+	fmt.Fprintf(b, "master_repl_offset:%d\r\nsecond_repl_offset:%d\r\n", r.offset, r.offset2)
+	fmt.Fprintf(b, "repl_backlog_active:1\r\nrepl_backlog_size:%d\r\n", r.backlogSize)
+	fmt.Fprintf(b, "repl_backlog_first_byte_offset:%d\r\nrepl_backlog_histlen:%d\r\n", r.backlogStart, len(r.backlog))
+}
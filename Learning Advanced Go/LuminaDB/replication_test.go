@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startReplica runs a second server and makes it a replica of the one at
+// primary.
+func startReplica(t *testing.T, primary string) (*LuminaDB, *testConn) {
+	t.Helper()
+	db, addr := startServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+	db.repl.port, _ = strconv.Atoi(port)
+	c := dial(t, addr)
+	host, port, _ := net.SplitHostPort(primary)
+	if got := c.do("REPLICAOF", host, port); got != "+OK\r\n" {
+		t.Fatalf("REPLICAOF = %q", got)
+	}
+	return db, c
+}
+
+// eventually retries cmd on c until it replies want.
+func eventually(t *testing.T, c *testConn, want string, cmd ...string) {
+	t.Helper()
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if got = c.do(cmd...); got == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%q = %q, want %q", cmd, got, want)
+}
+
+// infoField returns a field of INFO replication, "" if it isn't there.
+func infoField(c *testConn, name string) string {
+	for _, line := range strings.Split(c.do("INFO", "replication"), "\r\n") {
+		if v, ok := strings.CutPrefix(line, name+":"); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func TestReplication(t *testing.T) {
+	_, addr := startServer(t)
+	p := dial(t, addr)
+	p.do("SET", "a", "1", "EX", "100")
+	p.do("RPUSH", "l", "x", "y")
+	p.do("HSET", "h", "f", "v")
+
+	// The replica starts with a full sync...
+	_, r := startReplica(t, addr)
+	eventually(t, r, "$1\r\n1\r\n", "GET", "a")
+	if got := r.do("LRANGE", "l", "0", "-1"); got != "*2\r\n$1\r\nx\r\n$1\r\ny\r\n" {
+		t.Errorf("LRANGE l on the replica = %q", got)
+	}
+	if got := r.do("HGET", "h", "f"); got != "$1\r\nv\r\n" {
+		t.Errorf("HGET h f on the replica = %q", got)
+	}
+	if got := r.do("TTL", "a"); got == ":-1\r\n" || got == ":-2\r\n" {
+		t.Errorf("TTL a on the replica = %q, want the deadline kept", got)
+	}
+
+	// ...and then follows the primary's writes.
+	p.do("SET", "b", "2")
+	p.do("INCR", "a")
+	p.do("DEL", "h")
+	eventually(t, r, "$1\r\n2\r\n", "GET", "a")
+	if got := r.do("GET", "b"); got != "$1\r\n2\r\n" {
+		t.Errorf("GET b on the replica = %q", got)
+	}
+	if got := r.do("EXISTS", "h"); got != ":0\r\n" {
+		t.Errorf("EXISTS h on the replica = %q, want it deleted", got)
+	}
+
+	// Its clients can read but not write.
+	if got := r.do("SET", "c", "3"); got != "-READONLY You can't write against a read only replica.\r\n" {
+		t.Errorf("SET on the replica = %q, want READONLY", got)
+	}
+	if got := r.do("DEL", "a"); !strings.HasPrefix(got, "-READONLY ") {
+		t.Errorf("DEL on the replica = %q, want READONLY", got)
+	}
+
+	// Once the replica has acknowledged the stream, both ends show it has
+	// no lag.
+	want := infoField(p, "master_repl_offset")
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		slave := infoField(p, "slave0")
+		if strings.Contains(slave, ",state=online,offset="+want+",") {
+			if lag := slave[strings.LastIndex(slave, "=")+1:]; lag != "0" && lag != "1" {
+				t.Errorf("slave0 on the primary = %q, want a lag of a second at most", slave)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slave0 on the primary = %q, want online at offset %s", slave, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := infoField(p, "connected_slaves"); got != "1" {
+		t.Errorf("connected_slaves on the primary = %q, want 1", got)
+	}
+	fields := map[string]string{
+		"role":               "slave",
+		"master_link_status": "up",
+		"slave_repl_offset":  want,
+		"slave_read_only":    "1",
+	}
+	for name, want := range fields {
+		if got := infoField(r, name); got != want {
+			t.Errorf("%s on the replica = %q, want %q", name, got, want)
+		}
+	}
+	if got := infoField(r, "master_last_io_seconds_ago"); got != "0" && got != "1" {
+		t.Errorf("master_last_io_seconds_ago on the replica = %q", got)
+	}
+}
+
+// After a short disconnection the replica carries on from its offset
+// instead of syncing afresh, which would drop what it holds.
+func TestReplicationPartialResync(t *testing.T) {
+	_, addr := startServer(t)
+	p := dial(t, addr)
+	p.do("SET", "a", "1")
+	db, r := startReplica(t, addr)
+	eventually(t, r, "$1\r\n1\r\n", "GET", "a")
+
+	// A key of the replica's own, which a full sync would drop.
+	r.do("CONFIG", "SET", "replica-read-only", "no")
+	if got := r.do("SET", "local", "x"); got != "+OK\r\n" {
+		t.Fatalf("SET on a writable replica = %q", got)
+	}
+
+	m := db.repl.master.Load()
+	m.mu.Lock()
+	m.conn.Close()
+	m.mu.Unlock()
+	p.do("SET", "a", "2")
+	p.do("SET", "b", "3")
+
+	eventually(t, r, "$1\r\n3\r\n", "GET", "b")
+	if got := r.do("GET", "a"); got != "$1\r\n2\r\n" {
+		t.Errorf("GET a on the replica = %q, want 2", got)
+	}
+	if got := r.do("GET", "local"); got != "$1\r\nx\r\n" {
+		t.Errorf("GET local on the replica = %q, want it kept by a partial resync", got)
+	}
+	if got, want := infoField(r, "slave_repl_offset"), infoField(p, "master_repl_offset"); got != want {
+		t.Errorf("slave_repl_offset = %s, want the primary's %s", got, want)
+	}
+}
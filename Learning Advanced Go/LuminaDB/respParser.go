@@ -2,53 +2,275 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 )
 
+// Limits on what a client may send, matching Redis' defaults.
+const (
+	maxInlineSize    = 64 * 1024   // longest inline command line
+	maxMultibulkLen  = 1024 * 1024 // most arguments in one command
+	maxBulkLen       = 512 << 20   // largest single argument
+	maxLineSize      = 64 * 1024   // longest "*<n>" or "$<n>" header line
+	parserBufferSize = 16 * 1024
+)
+
+// ProtocolError is returned for input that is not valid RESP. The
+// connection cannot be resynchronised afterwards, so the server reports
+// it and hangs up.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func protocolErrorf(format string, args ...any) error {
+	return &ProtocolError{msg: fmt.Sprintf(format, args...)}
+}
+
 type RespParser struct {
 	reader *bufio.Reader
 }
 
 func NewRespParser(rd io.Reader) *RespParser {
-	return &RespParser{reader: bufio.NewReader(rd)}
+	return &RespParser{reader: bufio.NewReaderSize(rd, parserBufferSize)}
 }
 
+// Parse reads one command. Clients normally send a RESP array of bulk
+// strings, but a plain line of space separated words (an inline command,
+// as typed into telnet or nc) is accepted too. An empty command yields an
+// empty slice.
 func (p *RespParser) Parse() ([]string, error) {
-	line, err := p.reader.ReadString('\n')
+	b, err := p.reader.Peek(1)
 	if err != nil {
 		return nil, err
 	}
-
-	if line[0] != '*' {
-		return nil, fmt.Errorf("expect '*' at start of array")
+	if b[0] != '*' {
+		return p.parseInline()
 	}
 
-	count, _ := strconv.Atoi(line[1 : len(line)-2])
-	args := make([]string, count)
+	line, err := p.readLine(maxLineSize)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count > maxMultibulkLen {
+		return nil, protocolErrorf("invalid multibulk length")
+	}
+	if count <= 0 {
+		return []string{}, nil
+	}
 
+	// Grow as arguments arrive rather than trusting the announced count.
+	args := make([]string, 0, min(count, 1024))
 	for i := 0; i < count; i++ {
-		args[i], err = p.readBulkString()
+		arg, err := p.readBulkString()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
 		if err != nil {
 			return nil, err
 		}
+		args = append(args, arg)
 	}
 
 	return args, nil
 }
 
+// Buffered returns the number of bytes read from the connection but not
+// parsed yet: more than zero while the client is pipelining.
+func (p *RespParser) Buffered() int {
+	return p.reader.Buffered()
+}
+
+// waitReadable blocks until more input arrives or the connection fails,
+// without consuming anything.
+func (p *RespParser) waitReadable() error {
+	_, err := p.reader.Peek(1)
+	return err
+}
+
 func (p *RespParser) readBulkString() (string, error) {
-	line, _ := p.reader.ReadString('\n') // Read the "$3\r\n"
-	if line[0] != '$' {
-		return "", fmt.Errorf("expected '$' for bulk string")
+	line, err := p.readLine(maxLineSize) // Read the "$3\r\n"
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", protocolErrorf("expected '$', got '%s'", printable(line))
 	}
 
-	size, _ := strconv.Atoi(line[1 : len(line)-2])
+	size, err := strconv.Atoi(string(line[1:]))
+	if err != nil || size < 0 || size > maxBulkLen {
+		return "", protocolErrorf("invalid bulk length")
+	}
 
-	// Read exactly 'size' bytes + the 2 bytes for \r\n
-	data := make([]byte, size+2)
-	io.ReadFull(p.reader, data)
+	// Read exactly 'size' bytes + the 2 bytes for \r\n. Large values are
+	// buffered as they arrive so a bogus length can't allocate 512MB.
+	var data []byte
+	if size <= maxLineSize {
+		data = make([]byte, size+2)
+		if _, err := io.ReadFull(p.reader, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	} else {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, p.reader, int64(size+2)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		data = buf.Bytes()
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return "", protocolErrorf("bulk string not terminated by CRLF")
+	}
 
 	return string(data[:size]), nil
 }
+
+func (p *RespParser) parseInline() ([]string, error) {
+	line, err := p.readLine(maxInlineSize)
+	if err != nil {
+		return nil, err
+	}
+	args, err := splitArgs(string(line))
+	if err != nil {
+		return nil, protocolErrorf("%v", err)
+	}
+	return args, nil
+}
+
+// readLine returns the next line without its terminator. Lines normally end
+// in CRLF, but a bare LF is accepted so inline commands work from nc.
+func (p *RespParser) readLine(limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := p.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return nil, protocolErrorf("too big request")
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// splitArgs splits an inline command the way a shell would: words are
+// separated by blanks, "double quotes" understand \n, \r, \t, \", \\ and
+// \xHH escapes, and 'single quotes' only \'.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isBlank(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg bytes.Buffer
+		inDouble, inSingle := false, false
+	word:
+		for ; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					v, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg.WriteByte(byte(v))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					case 'b':
+						arg.WriteByte('\b')
+					case 'a':
+						arg.WriteByte('\a')
+					default:
+						arg.WriteByte(line[i])
+					}
+				case c == '"':
+					if i+1 < len(line) && !isBlank(line[i+1]) {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+					inDouble = false
+				default:
+					arg.WriteByte(c)
+				}
+			case inSingle:
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					arg.WriteByte('\'')
+					i++
+				case c == '\'':
+					if i+1 < len(line) && !isBlank(line[i+1]) {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+					inSingle = false
+				default:
+					arg.WriteByte(c)
+				}
+			case isBlank(c):
+				break word
+			case c == '"':
+				inDouble = true
+			case c == '\'':
+				inSingle = true
+			default:
+				arg.WriteByte(c)
+			}
+		}
+		if inDouble || inSingle {
+			return nil, errors.New("unbalanced quotes in request")
+		}
+		args = append(args, arg.String())
+	}
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// printable shortens and quotes raw input for error messages.
+func printable(b []byte) string {
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	q := strconv.Quote(string(b))
+	return q[1 : len(q)-1]
+}
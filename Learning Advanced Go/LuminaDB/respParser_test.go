@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+// FuzzParse feeds arbitrary bytes to the parser. Whatever comes in, Parse
+// must not panic, must fail with a ProtocolError or a read error rather
+// than anything else, and must consume input on every call. Each command
+// it returns must parse back the same once encoded again.
+//
+// The seed corpus in testdata/fuzz/FuzzParse holds the awkward cases:
+// blank lines, negative and overflowing lengths, truncated bulks and
+// unbalanced quotes in inline commands.
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"))
+	f.Add([]byte("SET key \"a value\"\r\nGET key\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := NewRespParser(bytes.NewReader(data))
+		// Every command takes at least a byte, so this many calls are
+		// enough to reach the end.
+		for range len(data) + 1 {
+			args, err := p.Parse()
+			if err != nil {
+				var pe *ProtocolError
+				if !errors.As(err, &pe) && err != io.EOF && err != io.ErrUnexpectedEOF {
+					t.Fatalf("Parse: unexpected error %v", err)
+				}
+				return
+			}
+			again, err := NewRespParser(bytes.NewReader(encode(args))).Parse()
+			if err != nil {
+				t.Fatalf("reparsing %q: %v", args, err)
+			}
+			if !slices.Equal(again, args) {
+				t.Fatalf("reparsed %q as %q", args, again)
+			}
+		}
+		t.Fatalf("Parse still returning commands after %d calls on %d bytes", len(data)+1, len(data))
+	})
+}
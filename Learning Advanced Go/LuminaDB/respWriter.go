@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RespWriter encodes replies. Until a client switches to RESP3 with HELLO,
+// the RESP3-only types are sent as their RESP2 equivalents: maps become
+// flat arrays, sets become arrays, doubles become bulk strings and null is
+// the null bulk string.
+type RespWriter struct {
+	w     *bufio.Writer
+	proto int
+}
+
+// A connection's replies wait in a buffer of replyBufferSize bytes. While a
+// client pipelines they go out once the batch read so far has run, or as
+// soon as replyFlushSize bytes are waiting, so a long batch streams its
+// replies instead of holding them back.
+const (
+	replyBufferSize = 64 << 10
+	replyFlushSize  = 16 << 10
+)
+
+func NewRespWriter(w io.Writer) *RespWriter {
+	return &RespWriter{w: bufio.NewWriterSize(w, replyBufferSize), proto: 2}
+}
+
+// Flush sends everything written so far.
+func (r *RespWriter) Flush() error {
+	return r.w.Flush()
+}
+
+// Buffered returns the number of bytes written but not sent yet.
+func (r *RespWriter) Buffered() int {
+	return r.w.Buffered()
+}
+
+func (r *RespWriter) writeLine(prefix byte, s string) {
+	r.w.WriteByte(prefix)
+	r.w.WriteString(s)
+	r.w.WriteString("\r\n")
+}
+
+func (r *RespWriter) WriteSimpleString(s string) {
+	r.writeLine('+', s)
+}
+
+// errorNewlines turns line breaks into spaces. Error messages quote
+// client arguments, which could otherwise end the line early and pass
+// what follows for replies of their own; Redis does the same.
+var errorNewlines = strings.NewReplacer("\r", " ", "\n", " ")
+
+// WriteError sends an error reply. msg should start with an error code
+// such as ERR or WRONGTYPE.
+func (r *RespWriter) WriteError(msg string) {
+	r.writeLine('-', errorNewlines.Replace(msg))
+}
+
+func (r *RespWriter) WriteInteger(n int64) {
+	r.writeLine(':', strconv.FormatInt(n, 10))
+}
+
+func (r *RespWriter) WriteBulk(s string) {
+	r.writeLine('$', strconv.Itoa(len(s)))
+	r.w.WriteString(s)
+	r.w.WriteString("\r\n")
+}
+
+func (r *RespWriter) WriteNull() {
+	if r.proto == 3 {
+		r.w.WriteString("_\r\n")
+		return
+	}
+	r.w.WriteString("$-1\r\n")
+}
+
+// WriteNullArray is the "no result" reply of commands that normally return
+// an array, such as BLPOP on timeout.
+func (r *RespWriter) WriteNullArray() {
+	if r.proto == 3 {
+		r.w.WriteString("_\r\n")
+		return
+	}
+	r.w.WriteString("*-1\r\n")
+}
+
+func (r *RespWriter) WriteArrayLen(n int) {
+	r.writeLine('*', strconv.Itoa(n))
+}
+
+// WriteMapLen starts a map of n key/value pairs.
+func (r *RespWriter) WriteMapLen(n int) {
+	if r.proto == 3 {
+		r.writeLine('%', strconv.Itoa(n))
+		return
+	}
+	r.writeLine('*', strconv.Itoa(2*n))
+}
+
+func (r *RespWriter) WriteSetLen(n int) {
+	if r.proto == 3 {
+		r.writeLine('~', strconv.Itoa(n))
+		return
+	}
+	r.writeLine('*', strconv.Itoa(n))
+}
+
+// WritePushLen starts an out-of-band message such as a pub/sub delivery.
+func (r *RespWriter) WritePushLen(n int) {
+	if r.proto == 3 {
+		r.writeLine('>', strconv.Itoa(n))
+		return
+	}
+	r.writeLine('*', strconv.Itoa(n))
+}
+
+func (r *RespWriter) WriteDouble(f float64) {
+	s := formatFloat(f)
+	if r.proto == 3 {
+		r.writeLine(',', s)
+		return
+	}
+	r.WriteBulk(s)
+}
+
+func (r *RespWriter) WriteBool(b bool) {
+	if r.proto == 3 {
+		if b {
+			r.w.WriteString("#t\r\n")
+		} else {
+			r.w.WriteString("#f\r\n")
+		}
+		return
+	}
+	if b {
+		r.WriteInteger(1)
+	} else {
+		r.WriteInteger(0)
+	}
+}
+
+// WriteVerbatim sends free-form text such as INFO output. RESP3 marks it
+// as verbatim text so clients can print it as is.
+func (r *RespWriter) WriteVerbatim(s string) {
+	if r.proto == 3 {
+		r.writeLine('=', strconv.Itoa(len(s)+4))
+		r.w.WriteString("txt:")
+		r.w.WriteString(s)
+		r.w.WriteString("\r\n")
+		return
+	}
+	r.WriteBulk(s)
+}
+
+// WriteBulks sends an array of bulk strings.
+func (r *RespWriter) WriteBulks(items []string) {
+	r.WriteArrayLen(len(items))
+	for _, item := range items {
+		r.WriteBulk(item)
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Frames that pile up during a rewrite are copied into the new file in
+// chunks without holding the logger lock; only the last chunk smaller
+// than this is written while writers wait.
+const rewriteDrainThreshold = 64 * 1024
+
+var (
+	errRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+	errRewriteAborted    = errors.New("rewrite aborted: log was truncated")
+)
+
+// BGRewriteLog compacts the log in the background. It snapshots the store,
+// writes one SET frame per live key into a temporary file, then appends the
+// frames logged in the meantime and atomically renames it over the log.
+func (db *LuminaDB) BGRewriteLog() error {
+	buf, values, expires, err := db.beginRewrite()
+	if err != nil {
+		return err
+	}
+
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		start := time.Now()
+		if err := db.rewriteLog(buf, values, expires); err != nil {
+			fmt.Printf("Log rewrite failed: %v\n", err)
+			return
+		}
+		fmt.Printf("Log rewrite finished in %v\n", time.Since(start))
+	}()
+	return nil
+}
+
+// RewriteLog compacts the log in the foreground. It is used at startup to
+// bring a log written in an older format up to the current version.
+func (db *LuminaDB) RewriteLog() error {
+	buf, values, expires, err := db.beginRewrite()
+	if err != nil {
+		return err
+	}
+	return db.rewriteLog(buf, values, expires)
+}
+
+func (db *LuminaDB) beginRewrite() (*bytes.Buffer, map[string]any, map[string]int64, error) {
+	db.store.lock(allShards)
+	defer db.store.unlock(allShards)
+
+	buf, err := db.logger.startRewrite()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Every write logged from here on lands in buf, so nothing can fall
+	// between the copy and the frames appended at the end.
+	values, expires := db.store.snapshot()
+	return buf, values, expires, nil
+}
+
+func (db *LuminaDB) rewriteLog(buf *bytes.Buffer, values map[string]any, expires map[string]int64) error {
+	l := db.logger
+	tmp, err := os.CreateTemp(filepath.Dir(l.filename), filepath.Base(l.filename)+".rewrite-*")
+	if err != nil {
+		l.cancelRewrite(buf)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Chmod(0644)
+
+	id := newLogID()
+	w := bufio.NewWriter(tmp)
+	w.Write(encodeLogHeader(id))
+	timestamp := time.Now().Unix()
+	now := nowMillis()
+	for key, v := range values {
+		at, hasDeadline := expires[key]
+		if hasDeadline && at <= now {
+			continue
+		}
+		var frame []byte
+		switch value, isString := v.(string); {
+		case isString && hasDeadline:
+			frame, _ = l.EncodeFrame(actionSetPX, timestamp, key, string(encodeDeadline(at))+value)
+		case isString:
+			frame, _ = l.EncodeFrame(actionSet, timestamp, key, value)
+		default:
+			// Other types are restored whole, then given their deadline.
+			frame, _ = l.EncodeFrame(actionRestore, timestamp, key, restoreFrameValue(v))
+			if hasDeadline {
+				expire, _ := l.EncodeFrame(actionExpireAt, timestamp, key, string(encodeDeadline(at)))
+				frame = append(frame, expire...)
+			}
+		}
+		if _, err := w.Write(frame); err != nil {
+			tmp.Close()
+			l.cancelRewrite(buf)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		l.cancelRewrite(buf)
+		return err
+	}
+
+	return l.finishRewrite(buf, tmp, id)
+}
+
+// startRewrite begins buffering a copy of every new frame.
+func (l *Logger) startRewrite() (*bytes.Buffer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rewriteBuf != nil {
+		return nil, errRewriteInProgress
+	}
+	l.rewriteBuf = new(bytes.Buffer)
+	return l.rewriteBuf, nil
+}
+
+func (l *Logger) cancelRewrite(buf *bytes.Buffer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rewriteBuf == buf {
+		l.rewriteBuf = nil
+	}
+}
+
+// finishRewrite appends the frames buffered during the rewrite to tmp and
+// swaps it in as the live log under its new id. tmp is closed on return.
+func (l *Logger) finishRewrite(buf *bytes.Buffer, tmp *os.File, id uint64) error {
+	defer tmp.Close()
+
+	for {
+		l.mu.Lock()
+		if l.rewriteBuf != buf {
+			l.mu.Unlock()
+			return errRewriteAborted
+		}
+		if buf.Len() < rewriteDrainThreshold {
+			break // keep the lock for the final swap
+		}
+		chunk := append([]byte(nil), buf.Bytes()...)
+		buf.Reset()
+		l.mu.Unlock()
+
+		if _, err := tmp.Write(chunk); err != nil {
+			l.cancelRewrite(buf)
+			return err
+		}
+	}
+	defer l.mu.Unlock()
+	l.rewriteBuf = nil
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	// Open the new file before renaming it so a failure leaves the old
+	// log in place and still open.
+	f, err := os.OpenFile(tmp.Name(), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.filename); err != nil {
+		f.Close()
+		return err
+	}
+	syncDir(filepath.Dir(l.filename))
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file.Close()
+	l.file = f
+	l.id, l.version = id, logVersion
+	l.size, l.baseSize = info.Size(), info.Size()
+	l.durable = l.written // tmp was synced with every frame in it
+	return nil
+}
+
+// needsRewrite reports whether the log has grown past minSize and by more
+// than percentage since the last rewrite.
+func (l *Logger) needsRewrite(percentage int, minSize int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rewriteBuf != nil || l.size < minSize {
+		return false
+	}
+	if l.baseSize == 0 {
+		return true
+	}
+	growth := (l.size - l.baseSize) * 100 / l.baseSize
+	return growth >= int64(percentage)
+}
+
+// StartAutoRewrite checks the log size once a second and starts a rewrite
+// when it crosses the thresholds. A percentage of 0 disables it.
+// SetAutoRewrite changes the thresholds later.
+func (db *LuminaDB) StartAutoRewrite(percentage int, minSize int64) {
+	db.SetAutoRewrite(percentage, minSize)
+
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-db.quit:
+				return
+			case <-ticker.C:
+				percentage, minSize := db.rewritePercentage.Load(), db.rewriteMinSize.Load()
+				if percentage <= 0 || !db.logger.needsRewrite(int(percentage), minSize) {
+					continue
+				}
+				if err := db.BGRewriteLog(); err == nil {
+					fmt.Println("Starting automatic log rewrite")
+				}
+			}
+		}
+	}()
+}
+
+// SetAutoRewrite changes the automatic rewrite thresholds.
+func (db *LuminaDB) SetAutoRewrite(percentage int, minSize int64) {
+	db.rewritePercentage.Store(int64(percentage))
+	db.rewriteMinSize.Store(minSize)
+}
+
+// syncDir flushes a directory entry so a rename survives a crash.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
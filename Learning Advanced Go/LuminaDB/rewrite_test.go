@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes made while a rewrite runs land in the log that replaces the old
+// one, transactions among them, including one still being collected when
+// the new log is swapped in.
+func TestRewriteKeepsWritesMadeMeanwhile(t *testing.T) {
+	db, addr := startServer(t)
+	c := dial(t, addr)
+	c.do("SET", "before", "1")
+	c.do("SET", "deleted", "1")
+	c.do("SET", "counter", "1")
+	oldID, _ := db.logger.position()
+
+	buf, values, expires, err := db.beginRewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.do("SET", "during", "1")
+	c.do("DEL", "deleted")
+	c.do("MULTI")
+	c.do("INCR", "counter")
+	c.do("SET", "in-exec", "1")
+	if got := c.do("EXEC"); got != "*2\r\n:2\r\n+OK\r\n" {
+		t.Fatalf("EXEC = %q", got)
+	}
+
+	// A transaction left open over the swap, as EXEC would if it ran
+	// then, is written to the new log when it commits.
+	db.logger.beginTxn()
+	db.logger.LogSetBinary("across:a", "1")
+	db.logger.LogSetBinary("across:b", "2")
+	if err := db.rewriteLog(buf, values, expires); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.logger.commitTxn(); err != nil {
+		t.Fatal(err)
+	}
+	c.do("SET", "after", "1")
+
+	if id, _ := db.logger.position(); id == oldID {
+		t.Fatal("the log was not replaced")
+	}
+	checkRecovered(t, reopen(t, db), map[string]string{
+		"before":   "1",
+		"during":   "1",
+		"counter":  "2",
+		"in-exec":  "1",
+		"across:a": "1",
+		"across:b": "2",
+		"after":    "1",
+	})
+}
+
+// More than rewriteDrainThreshold piles up during the rewrite, so
+// finishRewrite copies it in chunks while a client goes on writing.
+func TestRewriteDrainsWhileWriting(t *testing.T) {
+	db, addr := startServer(t)
+	buf, values, expires, err := db.beginRewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := strings.Repeat("v", 1<<10)
+	c := dial(t, addr)
+	stop := make(chan struct{})
+	written := make(chan int)
+	go func() {
+		i := 0
+		defer func() { written <- i }()
+		for ; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Not c.do: it would fail the test from this goroutine.
+			if _, err := c.conn.Write(encode([]string{"SET", fmt.Sprint("k:", i), value})); err != nil {
+				return
+			}
+			var b strings.Builder
+			if err := readRaw(c.r, &b); err != nil || b.String() != "+OK\r\n" {
+				return
+			}
+		}
+	}()
+	for {
+		if _, size := db.logger.position(); size > 2*rewriteDrainThreshold {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err = db.rewriteLog(buf, values, expires)
+	close(stop)
+	n := <-written
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string, n)
+	for i := range n {
+		want[fmt.Sprint("k:", i)] = value
+	}
+	checkRecovered(t, reopen(t, db), want)
+}
+
+// checkRecovered checks that r holds the string keys in want and nothing
+// else.
+func checkRecovered(t *testing.T, r *LuminaDB, want map[string]string) {
+	t.Helper()
+	for k, v := range want {
+		if got, ok, _ := r.Get(k); !ok || got != v {
+			t.Errorf("recovered %s = %.20q, %v; want %.20q", k, got, ok, v)
+		}
+	}
+	if n, _ := r.store.counts(); n != len(want) {
+		t.Errorf("recovered %d keys, want %d", n, len(want))
+	}
+}
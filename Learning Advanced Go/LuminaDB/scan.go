@@ -0,0 +1,263 @@
+package main
+
+import (
+	"hash/maphash"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SCAN returns keys a shard at a time, and within a shard in the order of
+// their hash. The cursor is the shard in its top bits and the hash to carry
+// on from below them. A key's shard and hash never change while the server
+// runs, so a key that exists for the whole iteration is returned exactly
+// once however the keyspace changes in between. The same goes for HSCAN,
+// SSCAN and ZSCAN over the fields or members of one value.
+//
+// Go maps can't be iterated from a position, so each shard's keys are
+// copied into a slice sorted by hash. A SCAN entering a shard rebuilds the
+// shard's slice if keys were added or removed since it was built; calls
+// further into the shard search it. Since the copy is never older than the
+// iteration's arrival in the shard, it holds every key present from then
+// on. A value's fields or members are sorted the same way, and the order
+// is kept on its entry until the value is written to.
+
+var scanSeed = maphash.MakeSeed()
+
+// The cursor of SCAN is shard<<scanPosBits | hash.
+const (
+	scanPosBits = 64 - 6 // shardCount is 1<<6
+	scanPosMax  = 1<<scanPosBits - 1
+)
+
+type scanEntry struct {
+	hash uint64
+	key  string
+}
+
+// scanCache is one shard's keys in SCAN order.
+type scanCache struct {
+	mu      sync.Mutex
+	entries []scanEntry
+	gen     uint64 // the shard's gen when entries was built
+	built   bool
+}
+
+// scanHash hashes s to a position below scanPosMax, leaving the top bits
+// of the cursor for the shard.
+func scanHash(s string) uint64 {
+	return maphash.String(scanSeed, s) >> (64 - scanPosBits)
+}
+
+// scanOrder returns keys sorted by hash.
+func scanOrder(keys []string) []scanEntry {
+	entries := make([]scanEntry, len(keys))
+	for i, k := range keys {
+		entries[i] = scanEntry{scanHash(k), k}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+	return entries
+}
+
+// scanBatch returns count entries of sorted from cursor on, plus any that
+// share the last one's hash so a cursor never splits them, and the cursor
+// to continue from, 0 once the end is reached.
+func scanBatch(sorted []scanEntry, cursor uint64, count int) ([]scanEntry, uint64) {
+	i := sort.Search(len(sorted), func(i int) bool { return sorted[i].hash >= cursor })
+	end := min(i+count, len(sorted))
+	for end < len(sorted) && end > i && sorted[end].hash == sorted[end-1].hash {
+		end++
+	}
+	if end == len(sorted) || sorted[end-1].hash == scanPosMax {
+		return sorted[i:end], 0
+	}
+	return sorted[i:end], sorted[end-1].hash + 1
+}
+
+// scanKeys returns the keys of shard i in SCAN order, rebuilding them when
+// an iteration enters the shard after keys were added or removed. Callers
+// hold shard i for reading at least.
+func (db *LuminaDB) scanKeys(i int, restart bool) []scanEntry {
+	sc := &db.scan[i]
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	s := &db.store.shards[i]
+	if !sc.built || (restart && s.gen != sc.gen) {
+		keys := make([]string, 0, len(s.value))
+		for k := range s.value {
+			keys = append(keys, k)
+		}
+		sc.entries, sc.gen, sc.built = scanOrder(keys), s.gen, true
+	}
+	return sc.entries
+}
+
+// scanMembers returns the next batch of the fields or members of the value
+// at key that match. members lists them; it is only called when the value
+// changed since its last scan. Callers hold the shard of key.
+func (db *LuminaDB) scanMembers(key string, members func() []string, cursor uint64, opts scanOptions) ([]string, uint64) {
+	e := db.store.entry(key)
+	sorted := e.members.Load()
+	if sorted == nil {
+		order := scanOrder(members())
+		sorted = &order
+		e.members.Store(sorted)
+	}
+	batch, next := scanBatch(*sorted, cursor, opts.count)
+	out := make([]string, 0, len(batch))
+	for _, e := range batch {
+		if opts.matches(e.key) {
+			out = append(out, e.key)
+		}
+	}
+	return out, next
+}
+
+// scanOptions are the arguments after the cursor.
+type scanOptions struct {
+	match string // glob pattern, "" for all
+	count int
+	typ   string // SCAN only: type name to keep, "" for all
+}
+
+func parseScanArgs(args []string, allowType bool) (uint64, scanOptions, error) {
+	opts := scanOptions{count: 10}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, opts, respError("ERR invalid cursor")
+	}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, opts, errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			opts.match = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return 0, opts, errNotInteger
+			}
+			if n < 1 {
+				return 0, opts, errSyntax
+			}
+			opts.count = n
+		case "TYPE":
+			if !allowType {
+				return 0, opts, errSyntax
+			}
+			opts.typ = strings.ToLower(args[i+1])
+		default:
+			return 0, opts, errSyntax
+		}
+	}
+	return cursor, opts, nil
+}
+
+func (o scanOptions) matches(s string) bool {
+	return o.match == "" || o.match == "*" || globMatch(o.match, s)
+}
+
+// writeScanReply sends the [cursor, items] pair SCAN and friends reply with.
+func (c *clientConn) writeScanReply(next uint64, items []string) {
+	c.w.WriteArrayLen(2)
+	c.w.WriteBulk(strconv.FormatUint(next, 10))
+	c.w.WriteBulks(items)
+}
+
+// globMatch reports whether s matches a Redis style glob pattern: * and ?
+// wildcards, [abc], [^abc] and [a-z] classes, and \ to quote the next
+// character.
+func globMatch(pattern, s string) bool {
+	// On a mismatch, backtrack to the last * and let it eat one more
+	// character of s.
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				starP, starI = p, i
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if end, ok := matchClass(pattern, p, s[i]); ok {
+					p = end
+					i++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) {
+					if pattern[p+1] == s[i] {
+						p += 2
+						i++
+						continue
+					}
+					break
+				}
+				fallthrough
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the [...] class starting at pattern[p] and
+// returns the index just past the class.
+func matchClass(pattern string, p int, c byte) (int, bool) {
+	p++
+	not := p < len(pattern) && pattern[p] == '^'
+	if not {
+		p++
+	}
+	match := false
+	for ; p < len(pattern) && pattern[p] != ']'; p++ {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			if pattern[p] == c {
+				match = true
+			}
+		case p+2 < len(pattern) && pattern[p+1] == '-' && pattern[p+2] != ']':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				match = true
+			}
+			p += 2
+		case pattern[p] == c:
+			match = true
+		}
+	}
+	if p < len(pattern) {
+		p++ // the closing ]
+	}
+	return p, match != not
+}
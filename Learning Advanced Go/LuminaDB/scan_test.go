@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient connects a Client to addr, closed when the test ends.
+func newTestClient(t *testing.T, addr string) *Client {
+	t.Helper()
+	c, err := NewClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// scanAll runs a whole iteration of cmd, SCAN or one of HSCAN, SSCAN and
+// ZSCAN with its key as the first of args, and counts how often each item
+// came back. step is how many items of a reply go with one member: 2 for
+// HSCAN and ZSCAN, whose values and scores are skipped.
+func scanAll(t *testing.T, c *Client, cmd string, args []string, step int) map[string]int {
+	t.Helper()
+	seen := make(map[string]int)
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 100000 {
+			t.Fatalf("%s did not finish", cmd)
+		}
+		r, err := c.do(append(append([]string{cmd}, args...), cursor, "COUNT", "5"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.kind != '*' || len(r.items) != 2 {
+			t.Fatalf("%s %s: reply %+v", cmd, cursor, r)
+		}
+		for i := 0; i < len(r.items[1].items); i += step {
+			seen[r.items[1].items[i].str]++
+		}
+		if cursor = r.items[0].str; cursor == "0" {
+			return seen
+		}
+	}
+}
+
+func TestScanSmallKeyspace(t *testing.T) {
+	_, addr := startServer(t)
+	c := newTestClient(t, addr)
+	for i := range 10 {
+		c.do([]string{"SET", fmt.Sprint("key:", i), "v"})
+	}
+	r, err := c.do([]string{"SCAN", "0", "COUNT", "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.items[0].str != "0" || len(r.items[1].items) != 10 {
+		t.Errorf("SCAN 0 COUNT 100 = cursor %s and %d keys, want 0 and 10", r.items[0].str, len(r.items[1].items))
+	}
+}
+
+// churn keeps running write on a client of its own until the test ends.
+func churn(t *testing.T, addr string, write func(i int) []string) {
+	c := newTestClient(t, addr)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		close(stop)
+		wg.Wait()
+	})
+	wg.Go(func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := c.do(write(i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// A key present for the whole iteration is returned exactly once, however
+// many keys come and go meanwhile.
+func TestScanUnderConcurrentWrites(t *testing.T) {
+	_, addr := startServer(t)
+	c := newTestClient(t, addr)
+	const n = 1000
+	for i := range n {
+		c.do([]string{"SET", fmt.Sprint("stable:", i), "v"})
+	}
+	churn(t, addr, func(i int) []string {
+		if i%2 == 0 {
+			return []string{"SET", fmt.Sprint("tmp:", i/2%500), "v"}
+		}
+		return []string{"DEL", fmt.Sprint("tmp:", i/2%500+250)}
+	})
+
+	for range 3 {
+		seen := scanAll(t, c, "SCAN", []string{}, 1)
+		for i := range n {
+			if k := fmt.Sprint("stable:", i); seen[k] != 1 {
+				t.Fatalf("SCAN returned %s %d times, want once", k, seen[k])
+			}
+		}
+	}
+}
+
+func TestHScanUnderConcurrentWrites(t *testing.T) {
+	_, addr := startServer(t)
+	c := newTestClient(t, addr)
+	const n = 1000
+	for i := range n {
+		c.do([]string{"HSET", "h", fmt.Sprint("stable:", i), "v"})
+	}
+	churn(t, addr, func(i int) []string {
+		if i%2 == 0 {
+			return []string{"HSET", "h", fmt.Sprint("tmp:", i/2%500), "v"}
+		}
+		return []string{"HDEL", "h", fmt.Sprint("tmp:", i/2%500+250)}
+	})
+
+	for range 3 {
+		seen := scanAll(t, c, "HSCAN", []string{"h"}, 2)
+		for i := range n {
+			if f := fmt.Sprint("stable:", i); seen[f] != 1 {
+				t.Fatalf("HSCAN returned %s %d times, want once", f, seen[f])
+			}
+		}
+	}
+}
+
+// The orders SCAN and HSCAN keep between calls follow the writes made
+// since: a new iteration sees them.
+func TestScanSeesWrites(t *testing.T) {
+	_, addr := startServer(t)
+	c := newTestClient(t, addr)
+	for _, step := range []struct {
+		write        []string
+		keys, fields int
+	}{
+		{[]string{"HSET", "h", "a", "1"}, 1, 1},
+		{[]string{"HSET", "h", "b", "2"}, 1, 2},
+		{[]string{"SET", "k", "v"}, 2, 2},
+		{[]string{"HDEL", "h", "a"}, 2, 1},
+		{[]string{"DEL", "k"}, 1, 1},
+	} {
+		if _, err := c.do(step.write); err != nil {
+			t.Fatal(err)
+		}
+		if keys := scanAll(t, c, "SCAN", []string{}, 1); len(keys) != step.keys {
+			t.Errorf("after %q SCAN returned %v, want %d keys", step.write, keys, step.keys)
+		}
+		if fields := scanAll(t, c, "HSCAN", []string{"h"}, 2); len(fields) != step.fields {
+			t.Errorf("after %q HSCAN returned %v, want %d fields", step.write, fields, step.fields)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "ping", handler: pingCommand, arity: -1, flags: flagFast, group: "connection"},
+		&command{name: "hello", handler: helloCommand, arity: -1, flags: flagFast, group: "connection"},
+		&command{name: "save", handler: saveCommand, arity: 1, flags: flagAdmin | flagNoMulti, group: "server"},
+		&command{name: "bgsave", handler: bgsaveCommand, arity: 1, flags: flagAdmin | flagNoMulti, group: "server"},
+		&command{name: "bgrewriteaof", handler: bgrewriteaofCommand, arity: 1, flags: flagAdmin | flagNoMulti, group: "server"},
+		&command{name: "lastsave", handler: lastsaveCommand, arity: 1, flags: flagFast, group: "server"},
+	)
+}
+
+// PING [message]
+//
+// A subscribed RESP2 client gets an array, which it can tell from the
+// messages around it.
+func pingCommand(c *clientConn, args []string) error {
+	if c.push != nil && c.w.proto == 2 && len(args) <= 2 {
+		c.w.WriteArrayLen(2)
+		c.w.WriteBulk("pong")
+		c.w.WriteBulk(strings.Join(args[1:], ""))
+		return nil
+	}
+	switch len(args) {
+	case 1:
+		c.w.WriteSimpleString("PONG")
+	case 2:
+		c.w.WriteBulk(args[1])
+	default:
+		return errWrongArgs("ping")
+	}
+	return nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(c *clientConn, args []string) error {
+	proto := c.w.proto
+	if len(args) >= 2 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			return respError("ERR Protocol version is not an integer or out of range")
+		}
+		if v != 2 && v != 3 {
+			return respError("NOPROTO unsupported protocol version")
+		}
+		proto = v
+	}
+
+	var name *string
+	auth := 0 // index of the AUTH option
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return respError("ERR syntax error in HELLO option 'auth'")
+			}
+			auth = i
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return respError("ERR syntax error in HELLO option 'setname'")
+			}
+			name = &args[i+1]
+			i++
+		default:
+			return respError("ERR syntax error in HELLO option '" + args[i] + "'")
+		}
+	}
+	switch {
+	case auth > 0:
+		u, err := c.db.acl.authenticate(args[auth+1], args[auth+2])
+		if err != nil {
+			return err
+		}
+		c.user = u
+	case c.user == nil:
+		return respError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	if name != nil {
+		c.name = *name
+	}
+
+	c.w.proto = proto
+	if c.push != nil {
+		c.push.resp3.Store(proto == 3)
+	}
+	c.w.WriteMapLen(7)
+	c.w.WriteBulk("server")
+	c.w.WriteBulk("lumina")
+	c.w.WriteBulk("version")
+	c.w.WriteBulk(serverVersion)
+	c.w.WriteBulk("proto")
+	c.w.WriteInteger(int64(proto))
+	c.w.WriteBulk("id")
+	c.w.WriteInteger(c.id)
+	c.w.WriteBulk("mode")
+	c.w.WriteBulk("standalone")
+	c.w.WriteBulk("role")
+	c.w.WriteBulk("master")
+	c.w.WriteBulk("modules")
+	c.w.WriteArrayLen(0)
+	return nil
+}
+
+// SAVE
+func saveCommand(c *clientConn, args []string) error {
+	if err := c.db.Save(); err != nil {
+		return respError("ERR " + err.Error())
+	}
+	c.w.WriteSimpleString("OK")
+	return nil
+}
+
+// BGSAVE
+func bgsaveCommand(c *clientConn, args []string) error {
+	if err := c.db.BGSave(); err != nil {
+		return respError("ERR " + err.Error())
+	}
+	c.w.WriteSimpleString("Background saving started")
+	return nil
+}
+
+// BGREWRITEAOF
+func bgrewriteaofCommand(c *clientConn, args []string) error {
+	if err := c.db.BGRewriteLog(); err != nil {
+		return respError("ERR " + err.Error())
+	}
+	c.w.WriteSimpleString("Background append only file rewriting started")
+	return nil
+}
+
+// LASTSAVE
+func lastsaveCommand(c *clientConn, args []string) error {
+	c.w.WriteInteger(c.db.LastSave())
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+)
+
+// A set is stored as a map[string]struct{}.
+
+// applySet replays one logged set action, so nothing is logged. Callers
+// hold the shard of k for writing.
+func (d *RWData) applySet(action byte, k string, members []string) {
+	s, ok := d.get(k).(map[string]struct{})
+	if !ok {
+		if action != actionSAdd {
+			return
+		}
+		s = make(map[string]struct{}, len(members))
+		d.put(k, s)
+	}
+	for _, m := range members {
+		if action == actionSAdd {
+			s[m] = struct{}{}
+		} else {
+			delete(s, m)
+		}
+	}
+	if len(s) == 0 {
+		d.Delete(k)
+	}
+}
+
+// set returns the set at key, or nil if the key does not exist.
+func (db *LuminaDB) set(key string) (map[string]struct{}, error) {
+	value, ok := db.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	s, ok := value.(map[string]struct{})
+	if !ok {
+		return nil, errWrongType
+	}
+	return s, nil
+}
+
+// setForWrite is set for commands that modify it; see hashForWrite.
+func (db *LuminaDB) setForWrite(key string) (map[string]struct{}, error) {
+	if err := db.expireIfNeeded(key); err != nil {
+		return nil, err
+	}
+	return db.set(key)
+}
+
+// SAdd adds members and returns how many were new.
+func (db *LuminaDB) SAdd(key string, members []string) (int, error) {
+	s, err := db.setForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	added := filterMembers(s, members, false)
+	if len(added) == 0 {
+		return 0, nil
+	}
+	if err := db.logger.LogSAdd(key, added); err != nil {
+		return 0, fmt.Errorf("failed to log sadd: %w", err)
+	}
+
+	if s == nil {
+		s = make(map[string]struct{}, len(added))
+		db.store.put(key, s)
+	}
+	for _, m := range added {
+		s[m] = struct{}{}
+	}
+	return len(added), nil
+}
+
+// SRem removes members and returns how many existed. Removing the last
+// member removes the key.
+func (db *LuminaDB) SRem(key string, members []string) (int, error) {
+	s, err := db.setForWrite(key)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	present := filterMembers(s, members, true)
+	if len(present) == 0 {
+		return 0, nil
+	}
+	return len(present), db.removeMembers(key, s, present)
+}
+
+// SPop removes and returns up to count random members.
+func (db *LuminaDB) SPop(key string, count int) ([]string, error) {
+	s, err := db.setForWrite(key)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	popped := randomMembers(s, count)
+	if len(popped) == 0 {
+		return popped, nil
+	}
+	// Logged as the SREM of what was picked, so the replay is exact.
+	return popped, db.removeMembers(key, s, popped)
+}
+
+func (db *LuminaDB) removeMembers(key string, s map[string]struct{}, members []string) error {
+	if err := db.logger.LogSRem(key, members); err != nil {
+		return fmt.Errorf("failed to log srem: %w", err)
+	}
+	for _, m := range members {
+		delete(s, m)
+	}
+	if len(s) == 0 {
+		db.store.Delete(key)
+	}
+	return nil
+}
+
+// randomMembers picks up to count distinct members of s uniformly.
+func randomMembers(s map[string]struct{}, count int) []string {
+	members := make([]string, 0, len(s))
+	for m := range s {
+		members = append(members, m)
+	}
+	count = min(count, len(members))
+	for i := 0; i < count; i++ {
+		j := i + rand.IntN(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:count]
+}
+
+// setOp computes SINTER, SUNION or SDIFF of the sets at keys. Missing keys
+// count as empty sets.
+func (db *LuminaDB) setOp(op string, keys []string) (map[string]struct{}, error) {
+	sets := make([]map[string]struct{}, len(keys))
+	for i, key := range keys {
+		s, err := db.set(key)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = s
+	}
+
+	result := make(map[string]struct{})
+	switch op {
+	case "SINTER":
+		for m := range sets[0] {
+			in := true
+			for _, s := range sets[1:] {
+				if _, ok := s[m]; !ok {
+					in = false
+					break
+				}
+			}
+			if in {
+				result[m] = struct{}{}
+			}
+		}
+	case "SUNION":
+		for _, s := range sets {
+			for m := range s {
+				result[m] = struct{}{}
+			}
+		}
+	case "SDIFF":
+		for m := range sets[0] {
+			result[m] = struct{}{}
+		}
+		for _, s := range sets[1:] {
+			for m := range s {
+				delete(result, m)
+			}
+		}
+	}
+	return result, nil
+}
+
+// filterMembers returns the distinct members that are (present) or are not
+// in s.
+func filterMembers(s map[string]struct{}, members []string, present bool) []string {
+	var out []string
+	seen := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		if _, ok := seen[m]; ok {
+			continue
+		}
+		seen[m] = struct{}{}
+		if _, ok := s[m]; ok == present {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "sadd", handler: saddCommand, arity: -3, flags: flagWrite | flagDenyOOM | flagFast, group: "set", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "srem", handler: sremCommand, arity: -3, flags: flagWrite | flagFast, group: "set", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "smembers", handler: smembersCommand, arity: 2, flags: flagReadonly, group: "set", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "sismember", handler: sismemberCommand, arity: 3, flags: flagReadonly | flagFast, group: "set", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "scard", handler: scardCommand, arity: 2, flags: flagReadonly | flagFast, group: "set", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "sinter", handler: setOpCommand, arity: -2, flags: flagReadonly, group: "set", firstKey: 1, lastKey: -1, step: 1},
+		&command{name: "sunion", handler: setOpCommand, arity: -2, flags: flagReadonly, group: "set", firstKey: 1, lastKey: -1, step: 1},
+		&command{name: "sdiff", handler: setOpCommand, arity: -2, flags: flagReadonly, group: "set", firstKey: 1, lastKey: -1, step: 1},
+		&command{name: "srandmember", handler: srandmemberCommand, arity: -2, flags: flagReadonly, group: "set", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "spop", handler: spopCommand, arity: -2, flags: flagWrite | flagFast, group: "set", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "sscan", handler: sscanCommand, arity: -3, flags: flagReadonly, group: "set", firstKey: 1, lastKey: 1, step: 1},
+	)
+}
+
+// SADD key member [member ...]
+func saddCommand(c *clientConn, args []string) error {
+	n, err := c.db.SAdd(args[1], args[2:])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// SREM key member [member ...]
+func sremCommand(c *clientConn, args []string) error {
+	n, err := c.db.SRem(args[1], args[2:])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// SMEMBERS key
+func smembersCommand(c *clientConn, args []string) error {
+	s, err := c.db.set(args[1])
+	if err != nil {
+		return err
+	}
+	c.writeSet(s)
+	return nil
+}
+
+// SISMEMBER key member
+func sismemberCommand(c *clientConn, args []string) error {
+	s, err := c.db.set(args[1])
+	if err != nil {
+		return err
+	}
+	_, ok := s[args[2]]
+	c.w.WriteInteger(boolInt(ok))
+	return nil
+}
+
+// SCARD key
+func scardCommand(c *clientConn, args []string) error {
+	s, err := c.db.set(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(len(s)))
+	return nil
+}
+
+// SINTER key [key ...], SUNION key [key ...], SDIFF key [key ...]
+func setOpCommand(c *clientConn, args []string) error {
+	s, err := c.db.setOp(strings.ToUpper(args[0]), args[1:])
+	if err != nil {
+		return err
+	}
+	c.writeSet(s)
+	return nil
+}
+
+// SRANDMEMBER key [count]
+//
+// A positive count returns distinct members, a negative one may repeat
+// them.
+func srandmemberCommand(c *clientConn, args []string) error {
+	if len(args) > 3 {
+		return errSyntax
+	}
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errNotInteger
+		}
+		count = n
+	}
+	s, err := c.db.set(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 2 && len(s) == 0:
+		c.w.WriteNull()
+	case len(args) == 2:
+		c.w.WriteBulk(randomMembers(s, 1)[0])
+	case count >= 0:
+		c.w.WriteBulks(randomMembers(s, count))
+	default:
+		all := randomMembers(s, len(s))
+		picks := make([]string, 0, min(-count, 1024))
+		for i := 0; i < -count && len(all) > 0; i++ {
+			picks = append(picks, all[rand.IntN(len(all))])
+		}
+		c.w.WriteBulks(picks)
+	}
+	return nil
+}
+
+// SPOP key [count]
+func spopCommand(c *clientConn, args []string) error {
+	if len(args) > 3 {
+		return errSyntax
+	}
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return respError("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+	popped, err := c.db.SPop(args[1], count)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(args) == 3:
+		c.w.WriteBulks(popped)
+	case len(popped) == 0:
+		c.w.WriteNull()
+	default:
+		c.w.WriteBulk(popped[0])
+	}
+	return nil
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func sscanCommand(c *clientConn, args []string) error {
+	cursor, opts, err := parseScanArgs(args[2:], false)
+	if err != nil {
+		return err
+	}
+	s, err := c.db.set(args[1])
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		c.writeScanReply(0, nil)
+		return nil
+	}
+	members, next := c.db.scanMembers(args[1], func() []string {
+		members := make([]string, 0, len(s))
+		for m := range s {
+			members = append(members, m)
+		}
+		return members
+	}, cursor, opts)
+	c.writeScanReply(next, members)
+	return nil
+}
+
+func (c *clientConn) writeSet(s map[string]struct{}) {
+	c.w.WriteSetLen(len(s))
+	for m := range s {
+		c.w.WriteBulk(m)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// The keyspace is split by key hash into shardCount shards, each with its
+// own lock, so commands on keys in different shards run side by side.
+//
+// The dispatcher locks the shards of a command's keys before running it
+// (see call in commands.go), always in ascending shard order so two
+// multi-key commands can't deadlock. Commands without key arguments, such
+// as KEYS or FLUSHALL, lock every shard; so do EXEC, log replay, snapshots
+// and rewrites, which need the whole keyspace to stand still. The logger
+// has a lock of its own, so frames of commands on different shards
+// interleave in the log; they touch different keys, so replaying them in
+// either order gives the same result.
+
+const shardCount = 64 // a power of two, and the width of shardSet
+
+// shardSet is a set of shard indexes, one bit each.
+type shardSet uint64
+
+const allShards = ^shardSet(0)
+
+type shard struct {
+	mu      sync.RWMutex
+	value   map[string]*entry
+	expires map[string]int64 // key -> deadline in unix milliseconds
+	used    atomic.Int64     // approximate bytes held by the keys, see eviction.go
+
+	// The sizes of value and expires, kept apart so INFO and the metrics
+	// can read them without the lock, which EXEC may already hold.
+	keys      atomic.Int64
+	deadlines atomic.Int64
+
+	gen uint64 // bumped whenever a key is added or removed, see scan.go
+
+	_ [56]byte // pad to two cache lines so neighbouring locks don't contend
+}
+
+// entry is a key's value, one of the types in values.go, along with what
+// eviction needs to know about it.
+type entry struct {
+	value  any
+	size   int64         // approximate bytes, as of the last resize
+	access atomic.Int64  // unix milliseconds of the last lookup, for LRU
+	freq   atomic.Uint32 // LFU counter and when it last changed, see touch
+
+	// The fields or members of a hash, set or sorted set in HSCAN order,
+	// built by the first scan after a write and dropped by resize.
+	members atomic.Pointer[[]scanEntry]
+}
+
+// RWData is the keyspace. Unless noted otherwise its methods expect the
+// caller to hold the lock of the shard of every key they are given.
+type RWData struct {
+	shards [shardCount]shard
+}
+
+func newRWData() *RWData {
+	d := &RWData{}
+	d.clear()
+	return d
+}
+
+// shardIndex hashes key with FNV-1a.
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h & (shardCount - 1))
+}
+
+func (d *RWData) shardFor(key string) *shard {
+	return &d.shards[shardIndex(key)]
+}
+
+// shardsOf returns the shards of keys.
+func shardsOf(keys ...string) shardSet {
+	var set shardSet
+	for _, k := range keys {
+		set |= 1 << shardIndex(k)
+	}
+	return set
+}
+
+// lock write-locks the shards in set in ascending order.
+func (d *RWData) lock(set shardSet) {
+	for s := set; s != 0; s &= s - 1 {
+		d.shards[bits.TrailingZeros64(uint64(s))].mu.Lock()
+	}
+}
+
+func (d *RWData) unlock(set shardSet) {
+	for s := set; s != 0; s &= s - 1 {
+		d.shards[bits.TrailingZeros64(uint64(s))].mu.Unlock()
+	}
+}
+
+// rlock read-locks the shards in set in ascending order.
+func (d *RWData) rlock(set shardSet) {
+	for s := set; s != 0; s &= s - 1 {
+		d.shards[bits.TrailingZeros64(uint64(s))].mu.RLock()
+	}
+}
+
+func (d *RWData) runlock(set shardSet) {
+	for s := set; s != 0; s &= s - 1 {
+		d.shards[bits.TrailingZeros64(uint64(s))].mu.RUnlock()
+	}
+}
+
+// get returns the value of k, nil if it does not exist, whether or not its
+// deadline has passed.
+func (d *RWData) get(k string) any {
+	if e := d.shardFor(k).value[k]; e != nil {
+		return e.value
+	}
+	return nil
+}
+
+// entry returns the entry of k, nil if it does not exist.
+func (d *RWData) entry(k string) *entry {
+	return d.shardFor(k).value[k]
+}
+
+func (d *RWData) has(k string) bool {
+	_, ok := d.shardFor(k).value[k]
+	return ok
+}
+
+// put stores v at k, keeping the deadline of k if it has one.
+func (d *RWData) put(k string, v any) {
+	s := d.shardFor(k)
+	e := s.value[k]
+	if e == nil {
+		e = newEntry(nowMillis())
+		s.value[k] = e
+		s.keys.Add(1)
+		s.gen++
+	}
+	e.value = v
+	d.resize(k)
+}
+
+// resize accounts for the size of k again, and drops the scan order of its
+// members. Commands change lists, hashes and the like in place, so the
+// dispatcher calls it for the keys of every write once the handler is done.
+func (d *RWData) resize(k string) {
+	s := d.shardFor(k)
+	if e := s.value[k]; e != nil {
+		e.members.Store(nil)
+		size := entrySize(k, e.value)
+		s.used.Add(size - e.size)
+		e.size = size
+	}
+}
+
+// used returns the approximate bytes held by the keyspace. It reads the
+// shards' counters without locking them, so it can be called anywhere.
+func (d *RWData) used() int64 {
+	var n int64
+	for i := range d.shards {
+		n += d.shards[i].used.Load()
+	}
+	return n
+}
+
+// counts returns the number of keys and of keys with a deadline, adding up
+// the shards' counters. Like used, it needs no lock; without the shards
+// held, the two numbers may be a moment apart.
+func (d *RWData) counts() (keys, expires int) {
+	for i := range d.shards {
+		keys += int(d.shards[i].keys.Load())
+		expires += int(d.shards[i].deadlines.Load())
+	}
+	return keys, expires
+}
+
+// deadline returns the deadline of k, if it has one.
+func (d *RWData) deadline(k string) (int64, bool) {
+	at, ok := d.shardFor(k).expires[k]
+	return at, ok
+}
+
+// Set, SetExpire, Persist and Delete are what log replay applies.
+func (d *RWData) Set(k string, v any) {
+	d.put(k, v)
+	d.Persist(k)
+}
+
+// SetExpire attaches a deadline to an existing key.
+func (d *RWData) SetExpire(k string, at int64) {
+	s := d.shardFor(k)
+	if _, ok := s.value[k]; ok {
+		if _, had := s.expires[k]; !had {
+			s.deadlines.Add(1)
+		}
+		s.expires[k] = at
+	}
+}
+
+// Persist drops the deadline of a key, if any.
+func (d *RWData) Persist(k string) {
+	s := d.shardFor(k)
+	if _, ok := s.expires[k]; ok {
+		delete(s.expires, k)
+		s.deadlines.Add(-1)
+	}
+}
+
+func (d *RWData) Delete(k string) {
+	s := d.shardFor(k)
+	if e := s.value[k]; e != nil {
+		s.used.Add(-e.size)
+		delete(s.value, k)
+		s.keys.Add(-1)
+		s.gen++
+	}
+	d.Persist(k)
+}
+
+// expired reports whether k has a deadline at or before now.
+func (d *RWData) expired(k string, now int64) bool {
+	at, ok := d.shardFor(k).expires[k]
+	return ok && at <= now
+}
+
+// The methods below work on the whole keyspace; callers hold every shard.
+
+// clear empties the keyspace.
+func (d *RWData) clear() {
+	for i := range d.shards {
+		d.shards[i].value = make(map[string]*entry)
+		d.shards[i].expires = make(map[string]int64)
+		d.shards[i].used.Store(0)
+		d.shards[i].keys.Store(0)
+		d.shards[i].deadlines.Store(0)
+		d.shards[i].gen++
+	}
+}
+
+// load replaces the keyspace with values and expires.
+func (d *RWData) load(values map[string]any, expires map[string]int64) {
+	d.clear()
+	for k, v := range values {
+		d.put(k, v)
+	}
+	for k, at := range expires {
+		d.SetExpire(k, at)
+	}
+}
+
+// snapshot copies the keyspace. Copying the maps is cheap next to encoding
+// them, so the locks are only held for the copy. Values other than strings
+// are copied too, since commands change them in place.
+func (d *RWData) snapshot() (map[string]any, map[string]int64) {
+	keys, withDeadline := d.counts()
+	values := make(map[string]any, keys)
+	expires := make(map[string]int64, withDeadline)
+	for i := range d.shards {
+		for k, e := range d.shards[i].value {
+			values[k] = cloneValue(e.value)
+		}
+		for k, at := range d.shards[i].expires {
+			expires[k] = at
+		}
+	}
+	return values, expires
+}
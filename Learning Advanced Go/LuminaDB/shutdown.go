@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "shutdown", handler: shutdownCommand, arity: -1, flags: flagAdmin | flagNoMulti, group: "server"},
+	)
+}
+
+// Shutting down stops the listeners, lets every connection finish the
+// command it is running and closes it, then fsyncs and closes the log.
+// Idle connections are woken by a read deadline in the past; the ones still
+// busy when the timeout runs out are cut off. A final snapshot is taken if
+// asked for, or by default if a save schedule is set.
+
+const defaultShutdownTimeout = 10 * time.Second
+
+type saveMode int
+
+const (
+	saveDefault saveMode = iota // save if a save schedule is set
+	saveForce
+	saveSkip
+)
+
+// shutdownRequest asks main to shut the server down. from is the client
+// that sent SHUTDOWN, which waits on done for the outcome, nil for a signal.
+type shutdownRequest struct {
+	save saveMode
+	from *clientConn
+	done chan error
+}
+
+// clientSet tracks the open connections so shutdown can wait for them.
+type clientSet struct {
+	mu      sync.Mutex
+	conns   map[*clientConn]struct{}
+	left    *sync.Cond // signalled on mu whenever a connection is removed
+	closing atomic.Bool
+}
+
+func newClientSet() *clientSet {
+	s := &clientSet{conns: make(map[*clientConn]struct{})}
+	s.left = sync.NewCond(&s.mu)
+	return s
+}
+
+// add registers c; it reports false once shutdown has begun.
+func (s *clientSet) add(c *clientConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *clientSet) remove(c *clientConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.left.Broadcast()
+}
+
+// drain wakes every connection but except and waits until they are gone
+// or the deadline passes. It reports whether they all left in time.
+func (s *clientSet) drain(except *clientConn, deadline time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closing.Store(true)
+	for c := range s.conns {
+		if c != except {
+			c.conn.SetReadDeadline(time.Now())
+		}
+	}
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		s.mu.Lock()
+		s.left.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	for s.busy(except) > 0 && time.Now().Before(deadline) {
+		s.left.Wait()
+	}
+	return s.busy(except) == 0
+}
+
+// closeAll cuts off the connections still open but except.
+func (s *clientSet) closeAll(except *clientConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c != except {
+			c.conn.Close()
+		}
+	}
+}
+
+// busy counts the connections other than except. Callers hold s.mu.
+func (s *clientSet) busy(except *clientConn) int {
+	n := len(s.conns)
+	if _, ok := s.conns[except]; ok {
+		n--
+	}
+	return n
+}
+
+// SHUTDOWN [NOSAVE | SAVE]
+//
+// There is no reply when the shutdown succeeds: the connection closes as
+// the server exits.
+func shutdownCommand(c *clientConn, args []string) error {
+	req := shutdownRequest{from: c, done: make(chan error, 1)}
+	switch {
+	case len(args) == 1:
+	case len(args) == 2 && strings.EqualFold(args[1], "SAVE"):
+		req.save = saveForce
+	case len(args) == 2 && strings.EqualFold(args[1], "NOSAVE"):
+		req.save = saveSkip
+	default:
+		return errSyntax
+	}
+
+	c.db.shutdownRequests <- req
+	if err := <-req.done; err != nil {
+		return respError("ERR Errors trying to SHUTDOWN: " + err.Error())
+	}
+	return nil
+}
+
+// Shutdown takes the server down as described at the top of the file and
+// returns the exit status: 0 if everything was saved, 1 otherwise.
+func (db *LuminaDB) Shutdown(listeners []net.Listener, req shutdownRequest) int {
+	start := time.Now()
+	go func() {
+		for r := range db.shutdownRequests {
+			r.done <- errors.New("the server is already shutting down")
+		}
+	}()
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	timeout := time.Duration(db.shutdownTimeout.Load())
+	if !db.clients.drain(req.from, start.Add(timeout)) {
+		fmt.Printf("Connections still busy after %v, closing them\n", timeout)
+		db.clients.closeAll(req.from)
+	}
+
+	save := req.save == saveForce
+	if req.save == saveDefault {
+		save = len(*db.saveParams.Load()) > 0
+	}
+	var failed error
+	if save {
+		fmt.Println("Saving the final snapshot")
+		if err := db.Save(); err != nil {
+			fmt.Println("Error saving the final snapshot:", err)
+			failed = fmt.Errorf("final snapshot failed: %w", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		fmt.Println("Error closing the log:", err)
+		failed = fmt.Errorf("closing the log failed: %w", err)
+	}
+
+	if failed != nil {
+		// The client that asked gets to hear why before the server exits.
+		if req.done != nil {
+			req.done <- failed
+			db.clients.drain(nil, time.Now().Add(time.Second))
+		}
+		fmt.Printf("LuminaDB stopped with errors after %v\n", time.Since(start).Round(time.Millisecond))
+		return 1
+	}
+	fmt.Printf("LuminaDB stopped after %v\n", time.Since(start).Round(time.Millisecond))
+	return 0
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot file layout:
+//
+//	magic "LUMINASN", uint16 version, int64 created (unix ms),
+//	uint64 log id, int64 log offset,
+//	entries: type(1) expireAt(8) keyLen(4) valLen(4) key value,
+//	  with the type codes and value encoding of values.go,
+//	end marker 0xFF, uint32 CRC32 of everything before it.
+//
+// The log id and offset say which log file the snapshot was taken against
+// and how far into it; Recover replays only the frames after that offset.
+const (
+	snapshotMagic   = "LUMINASN"
+	snapshotVersion = 1
+
+	snapEOF byte = 0xFF
+
+	defaultSnapshotFile = "lumina.snap"
+)
+
+var errSaveInProgress = errors.New("Background save already in progress")
+
+type snapshotData struct {
+	created   int64
+	logID     uint64
+	logOffset int64
+	values    map[string]any
+	expires   map[string]int64
+}
+
+// saveParam triggers a background save once at least changes writes
+// happened and seconds have passed since the last save.
+type saveParam struct {
+	seconds int64
+	changes int64
+}
+
+// captureSnapshot copies the keyspace together with the log position it
+// corresponds to. Callers hold every shard for reading at least, which
+// keeps writers out between the two.
+func (db *LuminaDB) captureSnapshot() *snapshotData {
+	snap := &snapshotData{created: nowMillis()}
+	snap.logID, snap.logOffset = db.logger.position()
+	snap.values, snap.expires = db.store.snapshot()
+	return snap
+}
+
+// Save writes a snapshot in the foreground. Like BGSave it copies the
+// keyspace with writers held off and writes the copy once they are let go,
+// so they wait for the copy but not for the disk.
+func (db *LuminaDB) Save() error {
+	if !db.saving.CompareAndSwap(false, true) {
+		return errSaveInProgress
+	}
+	defer db.saving.Store(false)
+
+	db.store.rlock(allShards)
+	changes := db.logger.changeCount()
+	snap := db.captureSnapshot()
+	db.store.runlock(allShards)
+
+	err := writeSnapshot(db.snapshotFile, snap)
+
+	db.saveFailed.Store(err != nil)
+	if err != nil {
+		return err
+	}
+	db.lastSave.Store(time.Now().Unix())
+	db.savedChanges.Store(changes)
+	return nil
+}
+
+// BGSave copies the keyspace and writes the snapshot in the background.
+func (db *LuminaDB) BGSave() error {
+	if !db.saving.CompareAndSwap(false, true) {
+		return errSaveInProgress
+	}
+
+	db.store.rlock(allShards)
+	changes := db.logger.changeCount()
+	snap := db.captureSnapshot()
+	db.store.runlock(allShards)
+
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		defer db.saving.Store(false)
+
+		start := time.Now()
+		err := writeSnapshot(db.snapshotFile, snap)
+		db.saveFailed.Store(err != nil)
+		if err != nil {
+			fmt.Printf("Background save failed: %v\n", err)
+			return
+		}
+		db.lastSave.Store(time.Now().Unix())
+		db.savedChanges.Store(changes)
+		fmt.Printf("Background save of %d keys finished in %v\n", len(snap.values), time.Since(start))
+	}()
+	return nil
+}
+
+// LastSave returns the unix time of the last successful snapshot.
+func (db *LuminaDB) LastSave() int64 {
+	return db.lastSave.Load()
+}
+
+// StartSaveSchedule starts a background save whenever one of params is
+// satisfied. SetSaveParams changes them later; none disables saving.
+func (db *LuminaDB) StartSaveSchedule(params []saveParam) {
+	db.SetSaveParams(params)
+
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-db.quit:
+				return
+			case <-ticker.C:
+				changes := db.logger.changeCount() - db.savedChanges.Load()
+				elapsed := time.Now().Unix() - db.lastSave.Load()
+				for _, p := range *db.saveParams.Load() {
+					if changes >= p.changes && elapsed >= p.seconds {
+						if err := db.BGSave(); err == nil {
+							fmt.Printf("%d changes in %d seconds, saving\n", changes, elapsed)
+						}
+						break
+					}
+				}
+			}
+		}
+	}()
+}
+
+// SetSaveParams replaces the save schedule.
+func (db *LuminaDB) SetSaveParams(params []saveParam) {
+	db.saveParams.Store(&params)
+}
+
+// parseSaveParams parses a schedule like "3600 1 300 100" into pairs of
+// seconds and changes. An empty string disables scheduled saves.
+func parseSaveParams(s string) ([]saveParam, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save schedule needs pairs of <seconds> <changes>")
+	}
+
+	var params []saveParam
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid seconds %q in save schedule", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, fmt.Errorf("invalid changes %q in save schedule", fields[i+1])
+		}
+		params = append(params, saveParam{seconds: seconds, changes: changes})
+	}
+	return params, nil
+}
+
+// writeSnapshot writes snap to a temporary file and renames it into place.
+// The previous snapshot is kept as path+".prev" in case the new one turns
+// out to be unreadable.
+func writeSnapshot(path string, snap *snapshotData) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	tmp.Chmod(0644)
+
+	if err := encodeSnapshot(tmp, snap); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".prev"); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// encodeSnapshot writes snap in the snapshot file format to out; a full
+// sync sends replicas the same bytes.
+func encodeSnapshot(out io.Writer, snap *snapshotData) error {
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(out, crc))
+
+	header := make([]byte, 8+2+8+8+8)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[8:10], snapshotVersion)
+	binary.BigEndian.PutUint64(header[10:18], uint64(snap.created))
+	binary.BigEndian.PutUint64(header[18:26], snap.logID)
+	binary.BigEndian.PutUint64(header[26:34], uint64(snap.logOffset))
+	w.Write(header)
+
+	entry := make([]byte, 1+8+4+4)
+	for key, v := range snap.values {
+		at := snap.expires[key]
+		if at != 0 && at <= snap.created {
+			continue
+		}
+		value := encodeValue(v)
+		entry[0] = valueType(v)
+		binary.BigEndian.PutUint64(entry[1:9], uint64(at))
+		binary.BigEndian.PutUint32(entry[9:13], uint32(len(key)))
+		binary.BigEndian.PutUint32(entry[13:17], uint32(len(value)))
+		w.Write(entry)
+		w.WriteString(key)
+		w.WriteString(value)
+	}
+	w.WriteByte(snapEOF)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc.Sum32())
+	_, err := out.Write(sum)
+	return err
+}
+
+// loadSnapshot returns the newest snapshot that passes its checksum, or nil
+// if there is none.
+func (db *LuminaDB) loadSnapshot() (*snapshotData, error) {
+	var errs []error
+	for _, path := range []string{db.snapshotFile, db.snapshotFile + ".prev"} {
+		snap, err := readSnapshot(path)
+		if err == nil {
+			return snap, nil
+		}
+		if !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func readSnapshot(path string) (*snapshotData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(bufio.NewReader(f), info.Size())
+}
+
+// decodeSnapshot reads a snapshot of size bytes written by encodeSnapshot,
+// dropping keys whose deadline has passed. An entry longer than what is
+// left of size is rejected before anything is allocated for it, so a
+// damaged length can't ask for gigabytes.
+func decodeSnapshot(in io.Reader, size int64) (*snapshotData, error) {
+	crc := crc32.NewIEEE()
+	r := io.TeeReader(in, crc)
+
+	header := make([]byte, 8+2+8+8+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading header: %w", err)
+	}
+	if string(header[:8]) != snapshotMagic {
+		return nil, fmt.Errorf("not a snapshot file")
+	}
+	if v := binary.BigEndian.Uint16(header[8:10]); v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	snap := &snapshotData{
+		created:   int64(binary.BigEndian.Uint64(header[10:18])),
+		logID:     binary.BigEndian.Uint64(header[18:26]),
+		logOffset: int64(binary.BigEndian.Uint64(header[26:34])),
+		values:    make(map[string]any),
+		expires:   make(map[string]int64),
+	}
+
+	now := nowMillis()
+	entry := make([]byte, 1+8+4+4)
+	left := size - int64(len(header))
+	for {
+		if _, err := io.ReadFull(r, entry[:1]); err != nil {
+			return nil, fmt.Errorf("error reading entry: %w", err)
+		}
+		if entry[0] == snapEOF {
+			break
+		}
+		if _, err := io.ReadFull(r, entry[1:]); err != nil {
+			return nil, fmt.Errorf("error reading entry: %w", err)
+		}
+		at := int64(binary.BigEndian.Uint64(entry[1:9]))
+		keyLen := binary.BigEndian.Uint32(entry[9:13])
+		valLen := binary.BigEndian.Uint32(entry[13:17])
+		left -= int64(len(entry))
+		if n := int64(keyLen) + int64(valLen); n > left {
+			return nil, fmt.Errorf("entry of %d bytes runs past the end of the snapshot", n)
+		}
+		left -= int64(keyLen) + int64(valLen)
+
+		data := make([]byte, int64(keyLen)+int64(valLen))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("error reading entry: %w", err)
+		}
+		if at != 0 && at <= now {
+			continue
+		}
+		key := string(data[:keyLen])
+		value, err := decodeValue(entry[0], string(data[keyLen:]))
+		if err != nil {
+			return nil, fmt.Errorf("entry %q: %w", key, err)
+		}
+		snap.values[key] = value
+		if at != 0 {
+			snap.expires[key] = at
+		}
+	}
+
+	want := crc.Sum32()
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return nil, fmt.Errorf("error reading checksum: %w", err)
+	}
+	if binary.BigEndian.Uint32(sum) != want {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return snap, nil
+}
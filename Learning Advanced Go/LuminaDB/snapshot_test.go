@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Recover loads the snapshot and replays only the log after it: a frame
+// before the snapshot's offset is not read again, damaged or not.
+func TestSnapshotAndLogTail(t *testing.T) {
+	db, addr := startServer(t)
+	c := dial(t, addr)
+	c.do("SET", "a", "1")
+	c.do("SET", "b", "2")
+	c.do("RPUSH", "list", "x", "y")
+	if got := c.do("SAVE"); got != "+OK\r\n" {
+		t.Fatalf("SAVE = %q", got)
+	}
+	c.do("SET", "c", "3")
+	c.do("DEL", "a")
+	c.do("INCR", "b")
+
+	// Damage the first frame, which the snapshot covers.
+	_, _, start, err := readLogHeaderFile(db.logger.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flip(db.logger.filename, start+frameHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+
+	r := reopen(t, db)
+	for k, want := range map[string]string{"b": "3", "c": "3"} {
+		if got, _, _ := r.Get(k); got != want {
+			t.Errorf("recovered %s = %q, want %q", k, got, want)
+		}
+	}
+	if _, ok, _ := r.Get("a"); ok {
+		t.Error("recovered a, which was deleted after the snapshot")
+	}
+	if l, ok := r.store.get("list").(*list); !ok || l.Len() != 2 {
+		t.Errorf("recovered list = %#v, want 2 elements", r.store.get("list"))
+	}
+}
+
+// A snapshot that fails its checksum gives way to the previous one, and
+// the log is replayed from where that one was taken.
+func TestSnapshotPrevFallback(t *testing.T) {
+	db, addr := startServer(t)
+	c := dial(t, addr)
+	c.do("SET", "a", "1")
+	c.do("SAVE")
+	c.do("SET", "b", "2")
+	c.do("SAVE")
+	c.do("SET", "c", "3")
+
+	if _, err := os.Stat(db.snapshotFile + ".prev"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(db.snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flip(db.snapshotFile, info.Size()/2); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := db.loadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.values) != 1 || snap.values["a"] != "1" {
+		t.Errorf("loaded snapshot holds %v, want the first one", snap.values)
+	}
+	checkRecovered(t, reopen(t, db), map[string]string{"a": "1", "b": "2", "c": "3"})
+}
+
+// A damaged entry length is caught before it is allocated for.
+func TestDecodeSnapshotBadLength(t *testing.T) {
+	snap := &snapshotData{
+		created: nowMillis(),
+		values:  map[string]any{"key": "value"},
+		expires: map[string]int64{},
+	}
+	var b bytes.Buffer
+	if err := encodeSnapshot(&b, snap); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	if _, err := decodeSnapshot(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("decoding an intact snapshot: %v", err)
+	}
+
+	// The value length of the only entry, after the 34-byte header and
+	// the entry's type, deadline and key length.
+	binary.BigEndian.PutUint32(data[34+1+8+4:], 0xFFFFFFF0)
+	_, err := decodeSnapshot(bytes.NewReader(data), int64(len(data)))
+	if err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Fatalf("decodeSnapshot = %v, want an entry running past the end", err)
+	}
+}
+
+// readLogHeaderFile reads the header of the log at path.
+func readLogHeaderFile(path string) (uint64, uint16, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	return readLogHeader(f)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The counters behind INFO and the metrics endpoint are atomics bumped
+// where things happen: a command costs a clock read and a few adds, and
+// nothing is locked or added up until somebody asks.
+
+const (
+	opsSampleInterval = 100 * time.Millisecond
+	opsSamples        = 16 // instantaneous_ops_per_sec averages this many intervals
+)
+
+type serverStats struct {
+	start               time.Time
+	connections         atomic.Int64 // accepted since startup
+	rejectedConnections atomic.Int64 // turned away while shutting down
+	blockedClients      atomic.Int64 // waiting in a blocking command
+	expiredKeys         atomic.Int64
+	evictedKeys         atomic.Int64 // removed to stay under maxmemory
+	opsPerSec           atomic.Int64
+}
+
+// callStats count the calls of one command.
+type callStats struct {
+	calls  atomic.Int64
+	failed atomic.Int64 // answered with an error
+	nanos  atomic.Int64 // time spent running the command
+}
+
+func (s *callStats) record(d time.Duration, err error) {
+	s.calls.Add(1)
+	s.nanos.Add(int64(d))
+	if err != nil {
+		s.failed.Add(1)
+	}
+}
+
+// totalCommands returns the number of commands run since startup.
+func totalCommands() int64 {
+	var n int64
+	for _, cmd := range commandTable {
+		n += cmd.stats.calls.Load()
+	}
+	return n
+}
+
+// StartStatsSampler keeps instantaneous_ops_per_sec up to date.
+func (db *LuminaDB) StartStatsSampler() {
+	db.bg.Add(1)
+	go func() {
+		defer db.bg.Done()
+		ticker := time.NewTicker(opsSampleInterval)
+		defer ticker.Stop()
+
+		var samples [opsSamples]int64
+		i, last := 0, totalCommands()
+		for {
+			select {
+			case <-db.quit:
+				return
+			case <-ticker.C:
+				n := totalCommands()
+				samples[i%opsSamples] = n - last
+				i, last = i+1, n
+
+				var sum int64
+				for _, s := range samples {
+					sum += s
+				}
+				db.stats.opsPerSec.Store(sum * int64(time.Second/opsSampleInterval) / opsSamples)
+			}
+		}
+	}()
+}
+
+// logStats describe the log file.
+type logStats struct {
+	size      int64
+	baseSize  int64
+	fsyncs    int64
+	policy    fsyncPolicy
+	rewriting bool
+}
+
+func (l *Logger) stats() logStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return logStats{l.size, l.baseSize, l.fsyncs, l.policy, l.rewriteBuf != nil}
+}
+
+// count returns the number of open connections.
+func (s *clientSet) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (p *pubsub) counts() (channels, patterns int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.channels), len(p.patterns)
+}
+
+func (db *LuminaDB) writeServerInfo(b *strings.Builder) {
+	db.config.mu.Lock()
+	port, tlsPort, file := db.config.cfg.port, db.config.cfg.tlsPort, db.config.file
+	db.config.mu.Unlock()
+	exe, _ := os.Executable()
+	uptime := int64(time.Since(db.stats.start).Seconds())
+
+	fmt.Fprintf(b, "lumina_version:%s\r\n", serverVersion)
+	fmt.Fprintf(b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(b, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "tcp_port:%d\r\ntls_port:%d\r\n", port, tlsPort)
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\nuptime_in_days:%d\r\n", uptime, uptime/86400)
+	fmt.Fprintf(b, "executable:%s\r\nconfig_file:%s\r\n", exe, file)
+}
+
+func (db *LuminaDB) writeClientsInfo(b *strings.Builder) {
+	fmt.Fprintf(b, "connected_clients:%d\r\n", db.clients.count())
+	fmt.Fprintf(b, "blocked_clients:%d\r\n", db.stats.blockedClients.Load())
+}
+
+func (db *LuminaDB) writeMemoryInfo(b *strings.Builder) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(b, "used_memory:%d\r\nused_memory_human:%s\r\n", m.HeapAlloc, humanBytes(m.HeapAlloc))
+	fmt.Fprintf(b, "used_memory_sys:%d\r\nused_memory_sys_human:%s\r\n", m.Sys, humanBytes(m.Sys))
+	dataset, limit := db.store.used(), db.maxMemory.Load()
+	fmt.Fprintf(b, "used_memory_dataset:%d\r\nused_memory_dataset_human:%s\r\n", dataset, humanBytes(uint64(dataset)))
+	fmt.Fprintf(b, "maxmemory:%d\r\nmaxmemory_human:%s\r\n", limit, humanBytes(uint64(limit)))
+	fmt.Fprintf(b, "maxmemory_policy:%s\r\n", evictionPolicy(db.evictionPolicy.Load()))
+	fmt.Fprintf(b, "heap_objects:%d\r\n", m.HeapObjects)
+	fmt.Fprintf(b, "gc_cycles:%d\r\n", m.NumGC)
+	fmt.Fprintf(b, "mem_allocator:go\r\n")
+}
+
+func (db *LuminaDB) writePersistenceInfo(b *strings.Builder) {
+	status := "ok"
+	if db.saveFailed.Load() {
+		status = "err"
+	}
+	log := db.logger.stats()
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", db.logger.changeCount()-db.savedChanges.Load())
+	fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", boolInt(db.saving.Load()))
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", db.lastSave.Load())
+	fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", status)
+	fmt.Fprintf(b, "aof_enabled:1\r\n")
+	fmt.Fprintf(b, "aof_rewrite_in_progress:%d\r\n", boolInt(log.rewriting))
+	fmt.Fprintf(b, "aof_current_size:%d\r\naof_base_size:%d\r\n", log.size, log.baseSize)
+	fmt.Fprintf(b, "aof_fsync:%s\r\naof_fsyncs:%d\r\n", log.policy, log.fsyncs)
+}
+
+func (db *LuminaDB) writeStatsInfo(b *strings.Builder) {
+	channels, patterns := db.pubsub.counts()
+	fmt.Fprintf(b, "total_connections_received:%d\r\n", db.stats.connections.Load())
+	fmt.Fprintf(b, "rejected_connections:%d\r\n", db.stats.rejectedConnections.Load())
+	fmt.Fprintf(b, "total_commands_processed:%d\r\n", totalCommands())
+	fmt.Fprintf(b, "instantaneous_ops_per_sec:%d\r\n", db.stats.opsPerSec.Load())
+	fmt.Fprintf(b, "expired_keys:%d\r\n", db.stats.expiredKeys.Load())
+	fmt.Fprintf(b, "evicted_keys:%d\r\n", db.stats.evictedKeys.Load())
+	fmt.Fprintf(b, "pubsub_channels:%d\r\npubsub_patterns:%d\r\n", channels, patterns)
+}
+
+// writeCommandStats lists the commands called at least once.
+func (db *LuminaDB) writeCommandStats(b *strings.Builder) {
+	for _, cmd := range calledCommands() {
+		calls, usec := cmd.stats.calls.Load(), cmd.stats.nanos.Load()/1000
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,failed_calls=%d\r\n",
+			cmd.name, calls, usec, float64(usec)/float64(calls), cmd.stats.failed.Load())
+	}
+}
+
+func (db *LuminaDB) writeKeyspaceInfo(b *strings.Builder) {
+	if keys, expires := db.store.counts(); keys > 0 {
+		fmt.Fprintf(b, "db0:keys=%d,expires=%d\r\n", keys, expires)
+	}
+}
+
+// calledCommands returns the commands called since startup by name.
+func calledCommands() []*command {
+	var cmds []*command
+	for _, cmd := range commandTable {
+		if cmd.stats.calls.Load() > 0 {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+	return cmds
+}
+
+func humanBytes(n uint64) string {
+	const units = "KMGTP"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.2f%c", f, units[i])
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// maxStringSize is the largest value SETRANGE and APPEND may build, the
+// same as the largest bulk string a client may send.
+const maxStringSize = maxBulkLen
+
+// stringForWrite is lookupString for commands that modify the value; an
+// expired key is deleted first. Callers hold the key's shard for writing.
+func (db *LuminaDB) stringForWrite(key string) (string, bool, error) {
+	if err := db.expireIfNeeded(key); err != nil {
+		return "", false, err
+	}
+	return db.lookupString(key)
+}
+
+// update replaces the string at key but, unlike SET, keeps its deadline.
+// The value and deadline go into one frame so they are replayed together.
+func (db *LuminaDB) update(key, value string) error {
+	var err error
+	if at, ok := db.store.deadline(key); ok {
+		err = db.logger.LogSetExpire(key, value, at)
+	} else {
+		err = db.logger.LogSet(key, value)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to log to disk: %w", err)
+	}
+	db.store.put(key, value)
+	return nil
+}
+
+// IncrBy adds delta to the integer at key, which counts as 0 if missing.
+func (db *LuminaDB) IncrBy(key string, delta int64) (int64, error) {
+	s, ok, err := db.stringForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if ok {
+		n, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, errNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, respError("ERR increment or decrement would overflow")
+	}
+	n += delta
+	return n, db.update(key, strconv.FormatInt(n, 10))
+}
+
+// IncrByFloat adds delta to the number at key and returns the new value
+// as stored.
+func (db *LuminaDB) IncrByFloat(key string, delta float64) (string, error) {
+	s, ok, err := db.stringForWrite(key)
+	if err != nil {
+		return "", err
+	}
+	var f float64
+	if ok {
+		f, err = strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) {
+			return "", respError("ERR value is not a valid float")
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", respError("ERR increment would produce NaN or Infinity")
+	}
+	s = formatFloat(f)
+	return s, db.update(key, s)
+}
+
+// Append adds value to the end of the string at key and returns its new
+// length.
+func (db *LuminaDB) Append(key, value string) (int, error) {
+	s, _, err := db.stringForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(s)+len(value) > maxStringSize {
+		return 0, respError("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	s += value
+	return len(s), db.update(key, s)
+}
+
+// SetRange overwrites the string at key from offset on, padding it with
+// zero bytes if it is shorter, and returns its new length.
+func (db *LuminaDB) SetRange(key string, offset int, value string) (int, error) {
+	s, ok, err := db.stringForWrite(key)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		// Nothing to write; don't create the key either.
+		return len(s), nil
+	}
+	if offset+len(value) > maxStringSize {
+		return 0, respError("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+
+	buf := []byte(s)
+	if need := offset + len(value); need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+	copy(buf[offset:], value)
+	if !ok {
+		_, err := db.PutWithOptions(key, string(buf), SetOptions{})
+		return len(buf), err
+	}
+	return len(buf), db.update(key, string(buf))
+}
+
+// GetSet sets key to value like SET and returns the old string.
+func (db *LuminaDB) GetSet(key, value string) (string, bool, error) {
+	old, ok, err := db.stringForWrite(key)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := db.PutWithOptions(key, value, SetOptions{}); err != nil {
+		return "", false, err
+	}
+	return old, ok, nil
+}
+
+// GetDel deletes key and returns the string it held.
+func (db *LuminaDB) GetDel(key string) (string, bool, error) {
+	s, ok, err := db.stringForWrite(key)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return s, true, db.Delete(key)
+}
+
+// MSet sets several keys at once; pairs alternate key and value. With nx
+// set nothing is written if any of the keys exists, and the result says
+// whether the keys were set.
+func (db *LuminaDB) MSet(pairs []string, nx bool) (bool, error) {
+	if nx {
+		for i := 0; i < len(pairs); i += 2 {
+			if db.Exists(pairs[i]) {
+				return false, nil
+			}
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		if _, err := db.PutWithOptions(pairs[i], pairs[i+1], SetOptions{}); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Del deletes keys and returns how many of them existed.
+func (db *LuminaDB) Del(keys []string) (int, error) {
+	n := 0
+	for _, key := range keys {
+		if err := db.expireIfNeeded(key); err != nil {
+			return n, err
+		}
+		if !db.store.has(key) {
+			continue
+		}
+		if err := db.Delete(key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// stringRange returns the GETRANGE substring of s; start and end are
+// inclusive and may count from the end.
+func stringRange(s string, start, end int) string {
+	n := len(s)
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	start, end = max(start, 0), max(end, 0)
+	end = min(end, n-1)
+	if n == 0 || start > end {
+		return ""
+	}
+	return s[start : end+1]
+}
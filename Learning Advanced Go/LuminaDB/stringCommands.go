@@ -0,0 +1,255 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "get", handler: getCommand, arity: 2, flags: flagReadonly | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "set", handler: setCommand, arity: -3, flags: flagWrite | flagDenyOOM, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "setnx", handler: setnxCommand, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "getset", handler: getsetCommand, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "getdel", handler: getdelCommand, arity: 2, flags: flagWrite | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "mset", handler: msetCommand, arity: -3, flags: flagWrite | flagDenyOOM, group: "string", firstKey: 1, lastKey: -1, step: 2},
+		&command{name: "msetnx", handler: msetCommand, arity: -3, flags: flagWrite | flagDenyOOM, group: "string", firstKey: 1, lastKey: -1, step: 2},
+		&command{name: "mget", handler: mgetCommand, arity: -2, flags: flagReadonly | flagFast, group: "string", firstKey: 1, lastKey: -1, step: 1},
+		&command{name: "incr", handler: incrCommand, arity: 2, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "decr", handler: incrCommand, arity: 2, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "incrby", handler: incrCommand, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "decrby", handler: incrCommand, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "incrbyfloat", handler: incrbyfloatCommand, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "append", handler: appendCommand, arity: 3, flags: flagWrite | flagDenyOOM | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "strlen", handler: strlenCommand, arity: 2, flags: flagReadonly | flagFast, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "getrange", handler: getrangeCommand, arity: 4, flags: flagReadonly, group: "string", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "setrange", handler: setrangeCommand, arity: 4, flags: flagWrite | flagDenyOOM, group: "string", firstKey: 1, lastKey: 1, step: 1},
+	)
+}
+
+// GET key
+func getCommand(c *clientConn, args []string) error {
+	val, ok, err := c.db.Get(args[1])
+	if err != nil {
+		return err
+	}
+	c.writeOptionalBulk(val, ok)
+	return nil
+}
+
+// SET key value [NX | XX] [EX seconds | PX milliseconds]
+func setCommand(c *clientConn, args []string) error {
+	opts, err := parseSetOptions(args[3:])
+	if err != nil {
+		return err
+	}
+	written, err := c.db.PutWithOptions(args[1], args[2], opts)
+	if err != nil {
+		return err
+	}
+	if written {
+		c.w.WriteSimpleString("OK")
+	} else {
+		c.w.WriteNull()
+	}
+	return nil
+}
+
+// SETNX key value
+func setnxCommand(c *clientConn, args []string) error {
+	written, err := c.db.PutWithOptions(args[1], args[2], SetOptions{NX: true})
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(boolInt(written))
+	return nil
+}
+
+// GETSET key value
+func getsetCommand(c *clientConn, args []string) error {
+	old, ok, err := c.db.GetSet(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	c.writeOptionalBulk(old, ok)
+	return nil
+}
+
+// GETDEL key
+func getdelCommand(c *clientConn, args []string) error {
+	val, ok, err := c.db.GetDel(args[1])
+	if err != nil {
+		return err
+	}
+	c.writeOptionalBulk(val, ok)
+	return nil
+}
+
+// MSET key value [key value ...], MSETNX key value [key value ...]
+func msetCommand(c *clientConn, args []string) error {
+	if len(args)%2 != 1 {
+		return errWrongArgs(strings.ToLower(args[0]))
+	}
+	nx := strings.ToUpper(args[0]) == "MSETNX"
+	written, err := c.db.MSet(args[1:], nx)
+	if err != nil {
+		return err
+	}
+	if nx {
+		c.w.WriteInteger(boolInt(written))
+	} else {
+		c.w.WriteSimpleString("OK")
+	}
+	return nil
+}
+
+// MGET key [key ...]
+//
+// Keys that are missing or hold another type read as null.
+func mgetCommand(c *clientConn, args []string) error {
+	c.w.WriteArrayLen(len(args) - 1)
+	for _, key := range args[1:] {
+		val, ok, _ := c.db.Get(key)
+		c.writeOptionalBulk(val, ok)
+	}
+	return nil
+}
+
+// INCR key, DECR key, INCRBY key increment, DECRBY key decrement
+func incrCommand(c *clientConn, args []string) error {
+	delta := int64(1)
+	if len(args) == 3 {
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		delta = n
+	}
+	if strings.HasPrefix(strings.ToUpper(args[0]), "DECR") {
+		if delta == math.MinInt64 {
+			return respError("ERR decrement would overflow")
+		}
+		delta = -delta
+	}
+	n, err := c.db.IncrBy(args[1], delta)
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(n)
+	return nil
+}
+
+// INCRBYFLOAT key increment
+func incrbyfloatCommand(c *clientConn, args []string) error {
+	delta, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || math.IsNaN(delta) {
+		return respError("ERR value is not a valid float")
+	}
+	s, err := c.db.IncrByFloat(args[1], delta)
+	if err != nil {
+		return err
+	}
+	c.w.WriteBulk(s)
+	return nil
+}
+
+// APPEND key value
+func appendCommand(c *clientConn, args []string) error {
+	n, err := c.db.Append(args[1], args[2])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// STRLEN key
+func strlenCommand(c *clientConn, args []string) error {
+	val, _, err := c.db.Get(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(len(val)))
+	return nil
+}
+
+// GETRANGE key start end
+func getrangeCommand(c *clientConn, args []string) error {
+	start, err1 := strconv.Atoi(args[2])
+	end, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return errNotInteger
+	}
+	val, _, err := c.db.Get(args[1])
+	if err != nil {
+		return err
+	}
+	c.w.WriteBulk(stringRange(val, start, end))
+	return nil
+}
+
+// SETRANGE key offset value
+func setrangeCommand(c *clientConn, args []string) error {
+	offset, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errNotInteger
+	}
+	if offset < 0 {
+		return respError("ERR offset is out of range")
+	}
+	n, err := c.db.SetRange(args[1], offset, args[3])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+func (c *clientConn) writeOptionalBulk(s string, ok bool) {
+	if ok {
+		c.w.WriteBulk(s)
+	} else {
+		c.w.WriteNull()
+	}
+}
+
+// parseSetOptions reads the EX/PX/NX/XX modifiers that follow SET key value.
+func parseSetOptions(args []string) (SetOptions, error) {
+	var opts SetOptions
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "EX", "PX":
+			if i+1 >= len(args) || opts.ExpireAt != 0 {
+				return opts, errSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return opts, errNotInteger
+			}
+			if n <= 0 {
+				return opts, respError("ERR invalid expire time in 'set' command")
+			}
+			unit := int64(1)
+			if strings.ToUpper(args[i]) == "EX" {
+				unit = 1000
+			}
+			at, ok := deadlineAfter(nowMillis(), n, unit)
+			if !ok {
+				return opts, respError("ERR invalid expire time in 'set' command")
+			}
+			opts.ExpireAt = at
+			i++
+		default:
+			return opts, errSyntax
+		}
+	}
+	if opts.NX && opts.XX {
+		return opts, errSyntax
+	}
+	return opts, nil
+}
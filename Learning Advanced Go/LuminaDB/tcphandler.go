@@ -1,21 +1,93 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strings"
+	"sync/atomic"
 )
 
+const serverVersion = "0.6.0"
+
+// nextClientID numbers connections for HELLO and, later, CLIENT commands.
+var nextClientID atomic.Int64
+
+// clientConn is the server side of one client connection.
+type clientConn struct {
+	conn   net.Conn
+	parser *RespParser
+	db     *LuminaDB
+	w      *RespWriter
+	id     int64
+	name   string
+	user   *aclUser // nil until the client authenticates, see acl.go
+
+	blocked *blockedClient // set by a blocking command that found no data
+
+	// Transaction state, see multi.go. watchDirty is guarded by
+	// db.watchMu.
+	multi       bool
+	queued      [][]string
+	multiFailed bool             // a command could not be queued; EXEC aborts
+	watching    map[string]int64 // watched keys and their deadline at WATCH
+	watchDirty  bool             // a watched key changed
+
+	// Pub/sub state, see pubsub.go. push is set while the client is
+	// subscribed; channels and patterns are guarded by db.pubsub.mu.
+	push     *outbox
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// Replication state, see replication.go. replica is set once the
+	// client is a replica taking the stream.
+	replPort int
+	replica  *replicaLink
+}
+
 func handleClient(conn net.Conn, db *LuminaDB) {
 	defer conn.Close()
 
 	parser := NewRespParser(conn)
+	c := &clientConn{
+		conn:   conn,
+		parser: parser,
+		db:     db,
+		w:      NewRespWriter(conn),
+		id:     nextClientID.Add(1),
+		user:   db.acl.login(),
+	}
+	db.stats.connections.Add(1)
+	if !db.clients.add(c) {
+		db.stats.rejectedConnections.Add(1)
+		return
+	}
+	defer db.clients.remove(c)
+	defer c.unwatch()
+	defer c.leavePubSub()
+	defer c.leaveReplication()
 
 	for {
+		// While the client pipelines, replies collect in c.w; they go out
+		// in one write once every command read so far has run and the
+		// parser is about to wait for more, or once replyFlushSize bytes
+		// of them are waiting.
+		if parser.Buffered() == 0 || c.w.Buffered() >= replyFlushSize {
+			if err := c.w.Flush(); err != nil {
+				if err != errOutputLimit {
+					fmt.Printf("Error writing to client: %v\n", err)
+				}
+				return
+			}
+		}
+
 		args, err := parser.Parse()
 		if err != nil {
-			if err != io.EOF {
+			var perr *ProtocolError
+			if errors.As(err, &perr) {
+				c.w.WriteError("ERR " + perr.Error())
+				c.w.Flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) && !db.clients.closing.Load() {
 				fmt.Printf("Client error: %v\n", err)
 			}
 			return
@@ -25,95 +97,25 @@ func handleClient(conn net.Conn, db *LuminaDB) {
 			continue
 		}
 
-		command := strings.ToUpper(args[0])
-
-		switch command {
-		case "SET":
-			if len(args) == 3 {
-				err := db.Put(args[1], args[2])
-				if err != nil {
-					fmt.Printf("Error setting the key: %v\n", err)
-					return
-				}
-				_, err = conn.Write([]byte("+OK\r\n"))
-				if err != nil {
-					fmt.Printf("Error writing to client: %v\n", err)
-					return
-				}
-			} else {
-				conn.Write([]byte("-ERR wrong number of arguments for 'SET'\r\n"))
-			}
-		case "GET":
-			if len(args) == 2 {
-				val, err := db.Get(args[1])
-				if err != nil {
-					fmt.Printf("Error getting the key: %v\n", err)
-					return
-				}
-				if val == "" {
-					conn.Write([]byte("$-1\r\n"))
-				} else {
-					response := fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
-					_, err = conn.Write([]byte(response))
-					if err != nil {
-						fmt.Printf("Error writing to client: %v\n", err)
-						return
-					}
-				}
-			} else {
-				conn.Write([]byte("-ERR wrong number of arguments for 'GET'\r\n"))
-			}
-		case "DEL":
-			if len(args) == 2 {
-				err := db.Delete(args[1])
-				if err != nil {
-					fmt.Printf("Error deleting the key: %v\n", err)
-					return
-				}
-				_, err = conn.Write([]byte(":1\r\n"))
-				if err != nil {
-					fmt.Printf("Error writing to client: %v\n", err)
-					return
-				}
-			} else {
-				conn.Write([]byte("-ERR wrong number of arguments for 'DEL'\r\n"))
+		if err := c.execute(args); err != nil {
+			if err != io.EOF && !db.clients.closing.Load() {
+				fmt.Printf("Closing client %d: %v\n", c.id, err)
 			}
-		case "PING":
-			_, err = conn.Write([]byte("+PONG\r\n"))
-			if err != nil {
+			return
+		}
+
+		// Back from push mode once the last subscription is gone.
+		if c.push != nil && c.subscriptions() == 0 {
+			if err := c.stopPush(); err != nil {
 				fmt.Printf("Error writing to client: %v\n", err)
 				return
 			}
-		case "EXISTS":
-			if len(args) == 2 {
-				if db.Exists(args[1]) {
-					_, err = conn.Write([]byte(":1\r\n"))
-					if err != nil {
-						fmt.Printf("Error writing to client: %v\n", err)
-						return
-					}
-				} else {
-					conn.Write([]byte(":0\r\n"))
-				}
-			} else {
-				conn.Write([]byte("-ERR wrong number of arguments for 'EXISTS'\r\n"))
-			}
-		case "DBSIZE":
-			if len(args) == 1 {
-				size := db.Size()
-				response := fmt.Sprintf(":%d\r\n", size)
-				conn.Write([]byte(response))
-			}
-		case "FLUSHALL":
-			if len(args) == 1 {
-				db.FLUSHALL()
-				conn.Write([]byte("+OK\r\n"))
-			} else {
-				conn.Write([]byte("-ERR wrong number of arguments for 'FLUSHALL'\r\n"))
-			}
-		default:
-			conn.Write([]byte("-ERR unknown command\r\n"))
 		}
 
+		// The server is shutting down; the command got its reply.
+		if db.clients.closing.Load() {
+			c.w.Flush()
+			return
+		}
 	}
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"strconv"
+)
+
+// Every key holds one of these types. In the keyspace a string is a plain
+// Go string, a hash a map[string]string, a list a *list, a set a
+// map[string]struct{} and a sorted set a *zset. The codes are written to
+// snapshots and RESTORE frames, so existing ones must not change.
+const (
+	typeString byte = 0
+	typeHash   byte = 1
+	typeList   byte = 2
+	typeSet    byte = 3
+	typeZSet   byte = 4
+)
+
+var typeNames = map[byte]string{
+	typeString: "string",
+	typeHash:   "hash",
+	typeList:   "list",
+	typeSet:    "set",
+	typeZSet:   "zset",
+}
+
+const errWrongType respError = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+func valueType(v any) byte {
+	switch v.(type) {
+	case map[string]string:
+		return typeHash
+	case *list:
+		return typeList
+	case map[string]struct{}:
+		return typeSet
+	case *zset:
+		return typeZSet
+	default:
+		return typeString
+	}
+}
+
+// cloneValue copies the containers that commands modify in place, so a
+// snapshot taken under the lock stays valid after it is released.
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case map[string]string:
+		return maps.Clone(v)
+	case *list:
+		return newList(v.all())
+	case map[string]struct{}:
+		return maps.Clone(v)
+	case *zset:
+		z := newZSet()
+		for m, score := range v.scores {
+			z.set(m, score)
+		}
+		return z
+	default:
+		return v
+	}
+}
+
+// encodeValue serialises v for a snapshot or RESTORE frame. Strings are
+// stored as they are, anything else as a list of length-prefixed strings.
+func encodeValue(v any) string {
+	switch v := v.(type) {
+	case map[string]string:
+		items := make([]string, 0, 2*len(v))
+		for field, value := range v {
+			items = append(items, field, value)
+		}
+		return encodeStrings(items)
+	case *list:
+		return encodeStrings(v.all())
+	case map[string]struct{}:
+		members := make([]string, 0, len(v))
+		for m := range v {
+			members = append(members, m)
+		}
+		return encodeStrings(members)
+	case *zset:
+		return encodeStrings(v.items())
+	case string:
+		return v
+	}
+	panic(fmt.Sprintf("encodeValue: unexpected type %T", v))
+}
+
+func decodeValue(t byte, data string) (any, error) {
+	switch t {
+	case typeString:
+		return data, nil
+	case typeHash:
+		items, err := decodeStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, fmt.Errorf("hash with odd number of items")
+		}
+		h := make(map[string]string, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			h[items[i]] = items[i+1]
+		}
+		return h, nil
+	case typeList:
+		items, err := decodeStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		return newList(items), nil
+	case typeSet:
+		members, err := decodeStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		s := make(map[string]struct{}, len(members))
+		for _, m := range members {
+			s[m] = struct{}{}
+		}
+		return s, nil
+	case typeZSet:
+		items, err := decodeStrings(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(items)%2 != 0 {
+			return nil, fmt.Errorf("sorted set with odd number of items")
+		}
+		z := newZSet()
+		for i := 0; i < len(items); i += 2 {
+			score, err := strconv.ParseFloat(items[i], 64)
+			if err != nil {
+				return nil, err
+			}
+			z.set(items[i+1], score)
+		}
+		return z, nil
+	}
+	return nil, fmt.Errorf("unknown value type %d", t)
+}
+
+// encodeStrings packs items as uint32 length + bytes each. Frames that carry
+// several fields (HSET, HDEL, RESTORE) use it for their value.
+func encodeStrings(items []string) string {
+	size := 0
+	for _, s := range items {
+		size += 4 + len(s)
+	}
+	buf := make([]byte, 0, size)
+	for _, s := range items {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+		buf = append(buf, s...)
+	}
+	return string(buf)
+}
+
+func decodeStrings(data string) ([]string, error) {
+	var items []string
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated length")
+		}
+		n := binary.BigEndian.Uint32([]byte(data[:4]))
+		data = data[4:]
+		if uint64(n) > uint64(len(data)) {
+			return nil, fmt.Errorf("item of %d bytes runs past the end", n)
+		}
+		items = append(items, data[:n])
+		data = data[n:]
+	}
+	return items, nil
+}
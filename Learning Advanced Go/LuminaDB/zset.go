@@ -0,0 +1,553 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// Sorted sets are kept twice: a map from member to score for O(1) ZSCORE,
+// and a skiplist ordered by (score, member) for ranks and ranges. The
+// skiplist is the one Redis uses: every forward link records how many
+// nodes it skips, so the rank of a node falls out of the search.
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int // nodes between this one and forward, counting forward
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)}, level: 1}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports whether n sorts before (score, member).
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+func (n *skiplistNode) is(score float64, member string) bool {
+	return n.score == score && n.member == member
+}
+
+func (sl *skiplist) insert(score float64, member string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+}
+
+func (sl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || !x.is(score, member) {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// rank returns the 1-based rank of (score, member), or 0 if it is absent.
+func (sl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for next := x.level[i].forward; next != nil && (next.before(score, member) || next.is(score, member)); next = x.level[i].forward {
+			rank += x.level[i].span
+			x = next
+		}
+		if x != sl.header && x.is(score, member) {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node with the given 1-based rank.
+func (sl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// scoreRange is the min and max of ZRANGEBYSCORE and ZCOUNT; "(" makes an
+// end exclusive.
+type scoreRange struct {
+	min, max     float64
+	minEx, maxEx bool
+}
+
+func (r scoreRange) aboveMin(score float64) bool {
+	if r.minEx {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r scoreRange) belowMax(score float64) bool {
+	if r.maxEx {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+func (r scoreRange) empty() bool {
+	return r.min > r.max || (r.min == r.max && (r.minEx || r.maxEx))
+}
+
+// firstInRange returns the lowest node with a score in r.
+func (sl *skiplist) firstInRange(r scoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.belowMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the highest node with a score in r.
+func (sl *skiplist) lastInRange(r scoreRange) *skiplistNode {
+	if r.empty() {
+		return nil
+	}
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if x == sl.header || !r.aboveMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+type zset struct {
+	scores map[string]float64
+	sl     *skiplist
+}
+
+func newZSet() *zset {
+	return &zset{scores: make(map[string]float64), sl: newSkiplist()}
+}
+
+func (z *zset) Len() int { return len(z.scores) }
+
+// set gives member a score and reports whether it is new.
+func (z *zset) set(member string, score float64) bool {
+	old, ok := z.scores[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.sl.delete(old, member)
+	}
+	z.sl.insert(score, member)
+	z.scores[member] = score
+	return !ok
+}
+
+func (z *zset) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	z.sl.delete(score, member)
+	delete(z.scores, member)
+	return true
+}
+
+// rank returns the 0-based rank of member, counting from the highest score
+// if reverse is set.
+func (z *zset) rank(member string, reverse bool) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.sl.rank(score, member)
+	if reverse {
+		return z.Len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// byIndex returns the members ranked start to stop, which follow LRANGE's
+// rules for negative and out of range indexes.
+func (z *zset) byIndex(start, stop int, reverse bool) []*skiplistNode {
+	start, stop, ok := listRange(start, stop, z.Len())
+	if !ok {
+		return nil
+	}
+	var x *skiplistNode
+	if reverse {
+		x = z.sl.byRank(z.Len() - start)
+	} else {
+		x = z.sl.byRank(start + 1)
+	}
+	nodes := make([]*skiplistNode, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		nodes = append(nodes, x)
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return nodes
+}
+
+// byScore returns the members with a score in r, skipping offset of them
+// and returning at most count (all if count is negative).
+func (z *zset) byScore(r scoreRange, reverse bool, offset, count int) []*skiplistNode {
+	var x *skiplistNode
+	if reverse {
+		x = z.sl.lastInRange(r)
+	} else {
+		x = z.sl.firstInRange(r)
+	}
+	var nodes []*skiplistNode
+	for x != nil && count != 0 {
+		if (reverse && !r.aboveMin(x.score)) || (!reverse && !r.belowMax(x.score)) {
+			break
+		}
+		if offset > 0 {
+			offset--
+		} else {
+			nodes = append(nodes, x)
+			count--
+		}
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return nodes
+}
+
+// count returns how many members have a score in r, from the ranks of the
+// first and last of them.
+func (z *zset) count(r scoreRange) int {
+	first := z.sl.firstInRange(r)
+	if first == nil {
+		return 0
+	}
+	last := z.sl.lastInRange(r)
+	return z.sl.rank(last.score, last.member) - z.sl.rank(first.score, first.member) + 1
+}
+
+// items returns the members in order as alternating score and member, the
+// layout of ZADD frames.
+func (z *zset) items() []string {
+	items := make([]string, 0, 2*z.Len())
+	for x := z.sl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		items = append(items, formatScore(x.score), x.member)
+	}
+	return items
+}
+
+// formatScore writes a score so that parsing it gives the same float back.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseScore reads a score; NaN is not a valid one.
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, respError("ERR value is not a valid float")
+	}
+	return f, nil
+}
+
+// parseScoreRange reads the min and max of ZRANGEBYSCORE and ZCOUNT.
+func parseScoreRange(min, max string) (scoreRange, error) {
+	var r scoreRange
+	var err error
+	bound := func(s string) (float64, bool, error) {
+		ex := strings.HasPrefix(s, "(")
+		if ex {
+			s = s[1:]
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) {
+			return 0, false, respError("ERR min or max is not a float")
+		}
+		return f, ex, nil
+	}
+	if r.min, r.minEx, err = bound(min); err != nil {
+		return r, err
+	}
+	r.max, r.maxEx, err = bound(max)
+	return r, err
+}
+
+// applyZSet replays one logged sorted set action, so nothing is logged.
+// Callers hold the shard of k for writing.
+func (d *RWData) applyZSet(action byte, k string, args []string) error {
+	z, ok := d.get(k).(*zset)
+	if !ok {
+		if action != actionZAdd {
+			return nil
+		}
+		z = newZSet()
+		d.put(k, z)
+	}
+	switch action {
+	case actionZAdd:
+		if len(args)%2 != 0 {
+			return fmt.Errorf("ZADD frame with %d items", len(args))
+		}
+		for i := 0; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return err
+			}
+			z.set(args[i+1], score)
+		}
+	case actionZRem:
+		for _, m := range args {
+			z.remove(m)
+		}
+	}
+	if z.Len() == 0 {
+		d.Delete(k)
+	}
+	return nil
+}
+
+// zset returns the sorted set at key, or nil if the key does not exist.
+func (db *LuminaDB) zset(key string) (*zset, error) {
+	value, ok := db.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	z, ok := value.(*zset)
+	if !ok {
+		return nil, errWrongType
+	}
+	return z, nil
+}
+
+// zsetForWrite is zset for commands that modify it; see hashForWrite.
+func (db *LuminaDB) zsetForWrite(key string) (*zset, error) {
+	if err := db.expireIfNeeded(key); err != nil {
+		return nil, err
+	}
+	return db.zset(key)
+}
+
+// ZAddOptions are the modifiers of ZADD.
+type ZAddOptions struct {
+	NX, XX bool // only add new members / only update existing ones
+	GT, LT bool // only update when the new score is greater / less
+	CH     bool // count changed members, not just added ones
+	Incr   bool // add the score to the current one, like ZINCRBY
+}
+
+// ZAdd sets the scores of members (items alternate score and member) and
+// returns the count ZADD replies with. With Incr it also returns the new
+// score of the single member, and ok is false if the options vetoed it.
+func (db *LuminaDB) ZAdd(key string, items []string, opts ZAddOptions) (n int, score float64, ok bool, err error) {
+	scores := make([]float64, len(items)/2)
+	for i := range scores {
+		if scores[i], err = parseScore(items[2*i]); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	z, err := db.zsetForWrite(key)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	// Work out the final scores first, so only real changes are logged.
+	var changes []string
+	final := make(map[string]float64)
+	added, changed := 0, 0
+	for i, newScore := range scores {
+		member := items[2*i+1]
+		current, exists := final[member]
+		if !exists && z != nil {
+			current, exists = z.scores[member]
+		}
+		if (opts.NX && exists) || (opts.XX && !exists) {
+			continue
+		}
+		if opts.Incr {
+			newScore += current
+			if math.IsNaN(newScore) {
+				return 0, 0, false, respError("ERR resulting score is not a number (NaN)")
+			}
+		}
+		if exists && ((opts.GT && newScore <= current) || (opts.LT && newScore >= current)) {
+			continue
+		}
+		score, ok = newScore, true
+		if exists && newScore == current {
+			continue
+		}
+		if _, seen := final[member]; !exists && !seen {
+			added++
+		} else {
+			changed++
+		}
+		final[member] = newScore
+		changes = append(changes, formatScore(newScore), member)
+	}
+
+	if len(changes) > 0 {
+		if err := db.logger.LogZAdd(key, changes); err != nil {
+			return 0, 0, false, fmt.Errorf("failed to log zadd: %w", err)
+		}
+		if z == nil {
+			z = newZSet()
+			db.store.put(key, z)
+		}
+		for i := 0; i < len(changes); i += 2 {
+			z.set(changes[i+1], final[changes[i+1]])
+		}
+	}
+
+	n = added
+	if opts.CH {
+		n += changed
+	}
+	return n, score, ok, nil
+}
+
+// ZRem removes members and returns how many existed. Removing the last
+// member removes the key.
+func (db *LuminaDB) ZRem(key string, members []string) (int, error) {
+	z, err := db.zsetForWrite(key)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	var present []string
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		if _, ok := z.scores[m]; ok && !seen[m] {
+			present = append(present, m)
+			seen[m] = true
+		}
+	}
+	if len(present) == 0 {
+		return 0, nil
+	}
+	if err := db.logger.LogZRem(key, present); err != nil {
+		return 0, fmt.Errorf("failed to log zrem: %w", err)
+	}
+	for _, m := range present {
+		z.remove(m)
+	}
+	if z.Len() == 0 {
+		db.store.Delete(key)
+	}
+	return len(present), nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommands(
+		&command{name: "zadd", handler: zaddCommand, arity: -4, flags: flagWrite | flagDenyOOM | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zincrby", handler: zincrbyCommand, arity: 4, flags: flagWrite | flagDenyOOM | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zrem", handler: zremCommand, arity: -3, flags: flagWrite | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zscore", handler: zscoreCommand, arity: 3, flags: flagReadonly | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zcard", handler: zcardCommand, arity: 2, flags: flagReadonly | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zrank", handler: zrankCommand, arity: 3, flags: flagReadonly | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zrevrank", handler: zrankCommand, arity: 3, flags: flagReadonly | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zcount", handler: zcountCommand, arity: 4, flags: flagReadonly | flagFast, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zrange", handler: zrangeCommand, arity: -4, flags: flagReadonly, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zrevrange", handler: zrangeCommand, arity: -4, flags: flagReadonly, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zrangebyscore", handler: zrangeCommand, arity: -4, flags: flagReadonly, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+		&command{name: "zscan", handler: zscanCommand, arity: -3, flags: flagReadonly, group: "sortedset", firstKey: 1, lastKey: 1, step: 1},
+	)
+}
+
+// ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]
+func zaddCommand(c *clientConn, args []string) error {
+	var opts ZAddOptions
+	i := 2
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GT":
+			opts.GT = true
+		case "LT":
+			opts.LT = true
+		case "CH":
+			opts.CH = true
+		case "INCR":
+			opts.Incr = true
+		default:
+			break options
+		}
+	}
+	items := args[i:]
+	switch {
+	case len(items) == 0 || len(items)%2 != 0:
+		return errSyntax
+	case opts.NX && opts.XX:
+		return respError("ERR XX and NX options at the same time are not compatible")
+	case (opts.GT && opts.LT) || (opts.NX && (opts.GT || opts.LT)):
+		return respError("ERR GT, LT, and/or NX options at the same time are not compatible")
+	case opts.Incr && len(items) > 2:
+		return respError("ERR INCR option supports a single increment-element pair")
+	}
+
+	n, score, ok, err := c.db.ZAdd(args[1], items, opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.Incr && ok:
+		c.w.WriteDouble(score)
+	case opts.Incr:
+		c.w.WriteNull()
+	default:
+		c.w.WriteInteger(int64(n))
+	}
+	return nil
+}
+
+// ZINCRBY key increment member
+func zincrbyCommand(c *clientConn, args []string) error {
+	_, score, _, err := c.db.ZAdd(args[1], args[2:], ZAddOptions{Incr: true})
+	if err != nil {
+		return err
+	}
+	c.w.WriteDouble(score)
+	return nil
+}
+
+// ZREM key member [member ...]
+func zremCommand(c *clientConn, args []string) error {
+	n, err := c.db.ZRem(args[1], args[2:])
+	if err != nil {
+		return err
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// ZSCORE key member
+func zscoreCommand(c *clientConn, args []string) error {
+	z, err := c.db.zset(args[1])
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		c.w.WriteNull()
+		return nil
+	}
+	score, ok := z.scores[args[2]]
+	if !ok {
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteDouble(score)
+	return nil
+}
+
+// ZCARD key
+func zcardCommand(c *clientConn, args []string) error {
+	z, err := c.db.zset(args[1])
+	if err != nil {
+		return err
+	}
+	n := 0
+	if z != nil {
+		n = z.Len()
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// ZRANK key member, ZREVRANK key member
+func zrankCommand(c *clientConn, args []string) error {
+	z, err := c.db.zset(args[1])
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		c.w.WriteNull()
+		return nil
+	}
+	rank, ok := z.rank(args[2], strings.ToUpper(args[0]) == "ZREVRANK")
+	if !ok {
+		c.w.WriteNull()
+		return nil
+	}
+	c.w.WriteInteger(int64(rank))
+	return nil
+}
+
+// ZCOUNT key min max
+func zcountCommand(c *clientConn, args []string) error {
+	r, err := parseScoreRange(args[2], args[3])
+	if err != nil {
+		return err
+	}
+	z, err := c.db.zset(args[1])
+	if err != nil {
+		return err
+	}
+	n := 0
+	if z != nil {
+		n = z.count(r)
+	}
+	c.w.WriteInteger(int64(n))
+	return nil
+}
+
+// ZRANGE key start stop [BYSCORE] [REV] [LIMIT offset count] [WITHSCORES]
+// ZREVRANGE key start stop [WITHSCORES]
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func zrangeCommand(c *clientConn, args []string) error {
+	name := strings.ToUpper(args[0])
+	byScore, rev := name == "ZRANGEBYSCORE", name == "ZREVRANGE"
+	withScores, limited := false, false
+	offset, count := 0, -1
+	for i := 4; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "WITHSCORES":
+			withScores = true
+		case opt == "LIMIT" && name != "ZREVRANGE" && i+2 < len(args):
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1])
+			count, err2 = strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return errNotInteger
+			}
+			limited = true
+			i += 2
+		case opt == "BYSCORE" && name == "ZRANGE":
+			byScore = true
+		case opt == "REV" && name == "ZRANGE":
+			rev = true
+		default:
+			return errSyntax
+		}
+	}
+	if limited && !byScore {
+		return respError("ERR syntax error, LIMIT is only supported in combination with BYSCORE")
+	}
+
+	var nodes []*skiplistNode
+	if byScore {
+		min, max := args[2], args[3]
+		if rev {
+			min, max = max, min
+		}
+		r, err := parseScoreRange(min, max)
+		if err != nil {
+			return err
+		}
+		z, err := c.db.zset(args[1])
+		if err != nil {
+			return err
+		}
+		if z != nil && offset >= 0 {
+			nodes = z.byScore(r, rev, offset, count)
+		}
+	} else {
+		start, err1 := strconv.Atoi(args[2])
+		stop, err2 := strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil {
+			return errNotInteger
+		}
+		z, err := c.db.zset(args[1])
+		if err != nil {
+			return err
+		}
+		if z != nil {
+			nodes = z.byIndex(start, stop, rev)
+		}
+	}
+	c.writeScoredMembers(nodes, withScores)
+	return nil
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count]
+//
+// Scores come back as bulk strings between the members, as in Redis.
+func zscanCommand(c *clientConn, args []string) error {
+	cursor, opts, err := parseScanArgs(args[2:], false)
+	if err != nil {
+		return err
+	}
+	z, err := c.db.zset(args[1])
+	if err != nil {
+		return err
+	}
+	if z == nil {
+		c.writeScanReply(0, nil)
+		return nil
+	}
+	members, next := c.db.scanMembers(args[1], func() []string {
+		members := make([]string, 0, z.Len())
+		for m := range z.scores {
+			members = append(members, m)
+		}
+		return members
+	}, cursor, opts)
+	items := make([]string, 0, 2*len(members))
+	for _, m := range members {
+		items = append(items, m, formatScore(z.scores[m]))
+	}
+	c.writeScanReply(next, items)
+	return nil
+}
+
+// writeScoredMembers replies with the members of nodes and, if withScores
+// is set, their scores: interleaved under RESP2, as [member, score] pairs
+// under RESP3.
+func (c *clientConn) writeScoredMembers(nodes []*skiplistNode, withScores bool) {
+	n := len(nodes)
+	if withScores && c.w.proto != 3 {
+		n *= 2
+	}
+	c.w.WriteArrayLen(n)
+	for _, x := range nodes {
+		if withScores && c.w.proto == 3 {
+			c.w.WriteArrayLen(2)
+		}
+		c.w.WriteBulk(x.member)
+		if withScores {
+			c.w.WriteDouble(x.score)
+		}
+	}
+}